@@ -2,19 +2,24 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/aleh/docode-waf/internal/api"
 	"github.com/aleh/docode-waf/internal/config"
 	"github.com/aleh/docode-waf/internal/constants"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/metrics"
 	"github.com/aleh/docode-waf/internal/middleware"
 	"github.com/aleh/docode-waf/internal/proxy"
 	"github.com/aleh/docode-waf/internal/services"
+	"github.com/aleh/docode-waf/internal/tracing"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
@@ -22,9 +27,15 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// fatal logs err and exits, like log.Fatalf
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func loadEnvironment() {
 	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using environment variables or config.yaml")
+		slog.Info("No .env file found, using environment variables or config.yaml")
 	}
 }
 
@@ -35,9 +46,11 @@ func initRedis(cfg *config.Config) *redis.Client {
 		DB:       cfg.Redis.DB,
 	})
 
+	// Redis being down is not fatal: limits fall back to per-node counters
+	// and the client reconnects on its own once Redis is back
 	ctx := context.Background()
 	if err := redisClient.Ping(ctx).Err(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		slog.Warn("Failed to connect to Redis, starting in degraded mode", "error", err)
 	}
 
 	return redisClient
@@ -46,7 +59,7 @@ func initRedis(cfg *config.Config) *redis.Client {
 func initDatabase(cfg *config.Config) *sqlx.DB {
 	db, err := sqlx.Connect(cfg.Database.Driver, cfg.GetDSN())
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("Failed to connect to database", err)
 	}
 	return db
 }
@@ -59,7 +72,7 @@ func initServices(db *sqlx.DB) (*services.VHostService, *services.CertificateSer
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
 		jwtSecret = "change-this-secret-in-production"
-		log.Println("Warning: Using default JWT secret. Set JWT_SECRET environment variable in production!")
+		slog.Warn("Using default JWT secret. Set JWT_SECRET environment variable in production!")
 	}
 	authService := services.NewAuthService(db, jwtSecret)
 
@@ -67,54 +80,83 @@ func initServices(db *sqlx.DB) (*services.VHostService, *services.CertificateSer
 }
 
 func setupVHostsAndCerts(vhostService *services.VHostService, certService *services.CertificateService, nginxConfigService *services.NginxConfigService) {
-	log.Println("Loading virtual hosts from database...")
+	slog.Info("Loading virtual hosts from database")
 	vhosts, err := vhostService.ListVHosts()
 	if err != nil {
-		log.Printf("Warning: Failed to load virtual hosts: %v", err)
+		slog.Warn("Failed to load virtual hosts", "error", err)
 		return
 	}
 
-	log.Printf("Loaded %d enabled virtual hosts", len(vhosts))
+	slog.Info("Loaded enabled virtual hosts", "count", len(vhosts))
 
 	// Export SSL certificates for vhosts
-	log.Println("Exporting SSL certificates...")
+	slog.Info("Exporting SSL certificates")
 	for _, vhost := range vhosts {
 		if vhost.SSLEnabled && vhost.SSLCertificateID != "" {
 			cert, err := certService.GetCertificate(vhost.SSLCertificateID)
 			if err == nil {
 				if err := certService.SaveCertificateFiles(vhost.SSLCertificateID, []byte(cert.CertContent), []byte(cert.KeyContent)); err != nil {
-					log.Printf("Warning: Failed to export certificate %s: %v", vhost.SSLCertificateID, err)
+					slog.Warn("Failed to export certificate", "certificate_id", vhost.SSLCertificateID, "error", err)
 				} else {
-					log.Printf("Exported certificate for domain: %s", vhost.Domain)
+					slog.Info("Exported certificate", "domain", vhost.Domain)
 				}
 			}
 		}
 	}
 
 	// Generate nginx configs for all vhosts
-	log.Println("Generating nginx configurations...")
+	slog.Info("Generating nginx configurations")
 	if err := nginxConfigService.RegenerateAllVHostConfigs(vhosts); err != nil {
-		log.Printf("Warning: Failed to generate nginx configs: %v", err)
+		slog.Warn("Failed to generate nginx configs", "error", err)
 	} else {
-		log.Printf("Generated nginx configurations for %d vhosts", len(vhosts))
+		slog.Info("Generated nginx configurations", "vhosts", len(vhosts))
 	}
 }
 
-func setupWAFServer(cfg *config.Config, redisClient *redis.Client, db *sqlx.DB, reverseProxyHandler http.Handler) *http.Server {
+// vhostReloader reloads the state keyed by vhost domain after vhosts change:
+// the proxy's routing table and the IP blocker's per-vhost groups
+type vhostReloader struct {
+	proxy   *proxy.ReverseProxy
+	ipIndex *services.IPGroupIndex
+}
+
+func (r *vhostReloader) ReloadVHosts() error {
+	r.ipIndex.Invalidate()
+	return r.proxy.ReloadVHosts()
+}
+
+func setupWAFServer(cfg *config.Config, redisClient *redis.Client, db *sqlx.DB, jail *services.JailService,
+	connLimiter *middleware.ConnectionLimiter, attackMode *services.AttackModeService, limiter *services.FallbackLimiter,
+	ipIndex *services.IPGroupIndex, geoIPService *services.GeoIPService, trafficLog *services.TrafficLogger, events *services.EventForwarder,
+	captures *services.CaptureService, decisions *services.DecisionStream, reverseProxyHandler *proxy.ReverseProxy) *http.Server {
 	gin.SetMode(gin.ReleaseMode)
 	wafRouter := gin.New()
+	if err := middleware.TrustClientIP(wafRouter, cfg.WAF.TrustedProxies); err != nil {
+		fatal("Invalid waf.trusted_proxies", err)
+	}
 	wafRouter.Use(gin.Recovery())
+	wafRouter.Use(middleware.ClientIPMiddleware(cfg.WAF.TrustedProxies))
+	wafRouter.Use(middleware.RequestIDMiddleware(cfg.WAF.RequestID))
+	if tracing.Enabled() {
+		wafRouter.Use(tracing.ServerMiddleware())
+	}
+	if cfg.Metrics.Enabled {
+		wafRouter.Use(middleware.MetricsMiddleware(reverseProxyHandler.HasVHost))
+	}
 
-	// Initialize GeoIP service
-	geoIPService := services.NewGeoIPService()
-
-	// Apply WAF middleware
-	wafRouter.Use(middleware.RateLimiterMiddleware(redisClient, db))
-	wafRouter.Use(middleware.HTTPFloodProtectionMiddleware(redisClient, cfg.WAF.HTTPFlood.MaxRequestsPerMinute, time.Minute))
-	wafRouter.Use(middleware.IPBlockerMiddleware(db))
-	wafRouter.Use(middleware.RegionFilter(db, geoIPService))
-	wafRouter.Use(middleware.BotDetectorMiddleware(db))
-	wafRouter.Use(middleware.LoggingMiddleware(db))
+	// Apply WAF middleware; each gets its own span when tracing is enabled.
+	// Logging comes before the blocking middleware so it sees what they reject.
+	wafRouter.Use(middleware.SecurityEventMiddleware(events))
+	wafRouter.Use(middleware.LoggingMiddleware(trafficLog, jail, decisions))
+	wafRouter.Use(middleware.CaptureMiddleware(captures))
+	wafRouter.Use(tracing.Step("waf.jail", middleware.JailMiddleware(jail))...)
+	wafRouter.Use(tracing.Step("waf.connection_limit", connLimiter.Middleware())...)
+	wafRouter.Use(tracing.Step("waf.attack_mode", middleware.AttackModeMiddleware(attackMode))...)
+	wafRouter.Use(tracing.Step("waf.rate_limit", middleware.RateLimiterMiddleware(limiter, db, jail, attackMode, geoIPService))...)
+	wafRouter.Use(tracing.Step("waf.http_flood", middleware.HTTPFloodProtectionMiddleware(limiter, jail, cfg.WAF.HTTPFlood.MaxRequestsPerMinute, time.Minute))...)
+	wafRouter.Use(tracing.Step("waf.ip_blocker", middleware.IPBlockerMiddleware(db, ipIndex, geoIPService))...)
+	wafRouter.Use(tracing.Step("waf.region_filter", middleware.RegionFilter(db, geoIPService))...)
+	wafRouter.Use(tracing.Step("waf.bot_detector", middleware.BotDetectorMiddleware(db, redisClient, limiter))...)
 
 	// Proxy all requests to the reverse proxy
 	wafRouter.NoRoute(gin.WrapH(reverseProxyHandler))
@@ -125,12 +167,22 @@ func setupWAFServer(cfg *config.Config, redisClient *redis.Client, db *sqlx.DB,
 		Handler:      wafRouter,
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
+		ConnContext:  middleware.ConnContext,
+	}
+	connLimiter.ConfigureServer(wafServer)
+	wafServer.ConnState = middleware.HeaderCaptureConnState(wafServer.ConnState)
+
+	listener, err := net.Listen("tcp", wafServer.Addr)
+	if err != nil {
+		fatal("WAF server error", err)
 	}
 
 	go func() {
-		log.Printf("Starting WAF server on %s", wafServer.Addr)
-		if err := wafServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("WAF server error: %v", err)
+		slog.Info("Starting WAF server", "addr", wafServer.Addr)
+		// Enforce per-IP connection limits and capture raw header order and
+		// casing for the bot detector
+		if err := wafServer.Serve(middleware.NewHeaderCaptureListener(connLimiter.Listener(listener))); err != nil && err != http.ErrServerClosed {
+			fatal("WAF server error", err)
 		}
 	}()
 
@@ -140,7 +192,12 @@ func setupWAFServer(cfg *config.Config, redisClient *redis.Client, db *sqlx.DB,
 func setupAPIRoutes(apiV1 *gin.RouterGroup, authService *services.AuthService, authHandler *api.AuthHandler,
 	dashboardHandler *api.DashboardHandler, vhostHandler *api.VHostHandler,
 	ipGroupHandler *api.IPGroupHandler, certHandler *api.CertificateHandler, settingsHandler *api.SettingsHandler,
-	blockingHandler *api.BlockingRuleHandler, rateLimitHandler *api.RateLimitHandler, logsHandler *api.LogsHandler, cfg *config.Config) {
+	blockingHandler *api.BlockingRuleHandler, rateLimitHandler *api.RateLimitHandler, logsHandler *api.LogsHandler,
+	banHandler *api.BanHandler, attackModeHandler *api.AttackModeHandler, clusterHandler *api.ClusterHandler,
+	exportHandler *api.ExportHandler, alertHandler *api.AlertHandler, captureHandler *api.CaptureHandler, loggingHandler *api.LoggingHandler,
+	analyticsHandler *api.AnalyticsHandler, reportHandler *api.ReportHandler,
+	connLimiter *middleware.ConnectionLimiter, trafficLog *services.TrafficLogger, nginxIngest *services.NginxIngestService,
+	events *services.EventForwarder, cfg *config.Config) {
 
 	// Public Auth routes (no authentication required)
 	auth := apiV1.Group("/auth")
@@ -175,6 +232,11 @@ func setupAPIRoutes(apiV1 *gin.RouterGroup, authService *services.AuthService, a
 		protected.GET("/dashboard/recent-attacks", dashboardHandler.GetRecentAttacks)
 		protected.GET("/dashboard/attacks-by-country", dashboardHandler.GetAttacksByCountry)
 
+		// Per-vhost traffic analytics
+		protected.GET("/analytics/vhosts/:domain/top/:dimension", analyticsHandler.GetTop)
+		protected.GET("/analytics/vhosts/:domain/latency", analyticsHandler.GetLatency)
+		protected.GET("/analytics/vhosts/:domain/bandwidth", analyticsHandler.GetBandwidth)
+
 		// Virtual Hosts
 		protected.GET("/vhosts", vhostHandler.ListVHosts)
 		protected.GET(constants.RouteVHostID, vhostHandler.GetVHost)
@@ -197,6 +259,13 @@ func setupAPIRoutes(apiV1 *gin.RouterGroup, authService *services.AuthService, a
 		protected.POST("/ip-groups/:id/addresses", ipGroupHandler.AddIPAddress)
 		protected.PUT("/ip-groups/:id/addresses/:addressId", ipGroupHandler.UpdateIPAddress)
 		protected.DELETE("/ip-groups/:id/addresses/:addressId", ipGroupHandler.DeleteIPAddress)
+		protected.POST("/ip-groups/:id/import", ipGroupHandler.ImportIPAddresses)
+		protected.GET("/ip-groups/:id/export", ipGroupHandler.ExportIPAddresses)
+		protected.GET("/ip-groups/:id/feeds", ipGroupHandler.ListFeeds)
+		protected.POST("/ip-groups/:id/feeds", ipGroupHandler.CreateFeed)
+		protected.PUT("/ip-groups/:id/feeds/:feedId", ipGroupHandler.UpdateFeed)
+		protected.DELETE("/ip-groups/:id/feeds/:feedId", ipGroupHandler.DeleteFeed)
+		protected.POST("/ip-groups/:id/feeds/:feedId/sync", ipGroupHandler.SyncFeed)
 
 		// SSL Certificates
 		protected.GET("/certificates", certHandler.GetCertificates)
@@ -223,12 +292,96 @@ func setupAPIRoutes(apiV1 *gin.RouterGroup, authService *services.AuthService, a
 		protected.DELETE(constants.RouteRateLimitRuleID, rateLimitHandler.DeleteRateLimitRule)
 		protected.PATCH(constants.RouteRateLimitRuleID+"/toggle", rateLimitHandler.ToggleRateLimitRule)
 
+		// Temporary Bans (jail)
+		protected.GET("/bans", banHandler.ListBans)
+		protected.POST("/bans", banHandler.CreateBan)
+		protected.GET(constants.RouteBanIP, banHandler.GetBan)
+		protected.PUT(constants.RouteBanIP+"/extend", banHandler.ExtendBan)
+		protected.DELETE(constants.RouteBanIP, banHandler.LiftBan)
+
+		// Adaptive "under attack" mode
+		protected.GET("/attack-mode", attackModeHandler.ListAttackModes)
+		protected.GET("/attack-mode/events", attackModeHandler.ListAttackModeEvents)
+		protected.GET("/attack-mode/vhosts/:domain", attackModeHandler.GetAttackMode)
+		protected.PUT("/attack-mode/vhosts/:domain", attackModeHandler.SetAttackMode)
+
+		// Cluster
+		protected.GET("/cluster/nodes", clusterHandler.ListNodes)
+		protected.POST("/cluster/invalidate-caches", clusterHandler.InvalidateCaches)
+
+		// Connection-level DoS protection counters
+		protected.GET("/waf/connection-stats", func(c *gin.Context) {
+			c.JSON(http.StatusOK, connLimiter.Stats())
+		})
+
+		// Traffic log pipeline counters (queue depth, drops, failed batches)
+		protected.GET("/waf/traffic-log-stats", func(c *gin.Context) {
+			c.JSON(http.StatusOK, trafficLog.Stats())
+		})
+
+		// nginx access log ingest counters (ingested, skipped as seen by the WAF)
+		protected.GET("/waf/nginx-ingest-stats", func(c *gin.Context) {
+			c.JSON(http.StatusOK, nginxIngest.Stats())
+		})
+
+		// SIEM sink counters (buffered, sent, dropped, retries)
+		protected.GET("/waf/siem-stats", func(c *gin.Context) {
+			c.JSON(http.StatusOK, events.Stats())
+		})
+
 		// Logs & Monitoring
 		protected.GET("/logs/vhosts", logsHandler.GetVHostsForLogs)
 		protected.GET("/logs/nginx/access", logsHandler.GetNginxAccessLogs)
 		protected.GET("/logs/nginx/error", logsHandler.GetNginxErrorLogs)
 		protected.GET("/logs/nginx/stream", logsHandler.StreamNginxLogs)
 		protected.GET("/logs/waf", logsHandler.GetWAFLogs)
+		protected.GET("/logs/waf/stream", logsHandler.StreamWAFDecisions)
+		protected.GET("/logs/search", logsHandler.SearchLogs)
+		protected.GET("/logs/requests/:id", logsHandler.GetRequest)
+
+		// Forensic request captures
+		protected.GET("/captures", captureHandler.ListCaptures)
+		protected.GET("/captures/stats", captureHandler.GetCaptureStats)
+		protected.GET("/captures/:id", captureHandler.GetCapture)
+		protected.POST("/captures/:id/replay", captureHandler.ReplayCapture)
+
+		// Log export (streamed or queued as a background job)
+		protected.GET("/logs/export", exportHandler.StreamExport)
+		protected.GET("/logs/exports", exportHandler.ListExportJobs)
+		protected.POST("/logs/exports", exportHandler.CreateExportJob)
+		protected.GET("/logs/exports/:id", exportHandler.GetExportJob)
+		protected.GET("/logs/exports/:id/download", exportHandler.DownloadExport)
+		protected.DELETE("/logs/exports/:id", exportHandler.DeleteExportJob)
+
+		// Alerting
+		protected.GET("/alerts", alertHandler.ListAlerts)
+		protected.GET("/alerts/rules", alertHandler.ListRules)
+		protected.POST("/alerts/rules", alertHandler.CreateRule)
+		protected.GET("/alerts/rules/:id", alertHandler.GetRule)
+		protected.PUT("/alerts/rules/:id", alertHandler.UpdateRule)
+		protected.PATCH("/alerts/rules/:id/toggle", alertHandler.ToggleRule)
+		protected.DELETE("/alerts/rules/:id", alertHandler.DeleteRule)
+		protected.GET("/alerts/channels", alertHandler.ListChannels)
+		protected.POST("/alerts/channels", alertHandler.CreateChannel)
+		protected.PUT("/alerts/channels/:id", alertHandler.UpdateChannel)
+		protected.DELETE("/alerts/channels/:id", alertHandler.DeleteChannel)
+		protected.POST("/alerts/channels/:id/test", alertHandler.TestChannel)
+		protected.GET("/alerts/silences", alertHandler.ListSilences)
+		protected.POST("/alerts/silences", alertHandler.CreateSilence)
+		protected.DELETE("/alerts/silences/:id", alertHandler.DeleteSilence)
+
+		// Scheduled and on-demand reports
+		protected.GET("/reports/schedules", reportHandler.ListSchedules)
+		protected.POST("/reports/schedules", reportHandler.CreateSchedule)
+		protected.GET("/reports/schedules/:id", reportHandler.GetSchedule)
+		protected.PUT("/reports/schedules/:id", reportHandler.UpdateSchedule)
+		protected.DELETE("/reports/schedules/:id", reportHandler.DeleteSchedule)
+		protected.POST("/reports/schedules/:id/send", reportHandler.SendSchedule)
+		protected.GET("/reports/download", reportHandler.DownloadReport)
+
+		// Log levels of this node, changeable without a restart
+		protected.GET("/logging/levels", loggingHandler.GetLevels)
+		protected.PUT("/logging/levels", loggingHandler.SetLevel)
 
 		// Settings (POST only, GET is public)
 		protected.POST("/settings/app", settingsHandler.SaveAppSettings)
@@ -236,24 +389,41 @@ func setupAPIRoutes(apiV1 *gin.RouterGroup, authService *services.AuthService, a
 }
 
 func setupAdminServer(cfg *config.Config, db *sqlx.DB, nginxConfigService *services.NginxConfigService,
-	vhostService *services.VHostService, certService *services.CertificateService, authService *services.AuthService, reverseProxyHandler *proxy.ReverseProxy) *http.Server {
+	vhostService *services.VHostService, certService *services.CertificateService, authService *services.AuthService,
+	jail *services.JailService, connLimiter *middleware.ConnectionLimiter, attackMode *services.AttackModeService,
+	redisClient *redis.Client, limiter *services.FallbackLimiter, feeds *services.FeedService, ipIndex *services.IPGroupIndex,
+	cluster *services.ClusterService, trafficLog *services.TrafficLogger, nginxIngest *services.NginxIngestService, exports *services.LogExportService,
+	events *services.EventForwarder, alerts *services.AlertService, reports *services.ReportService, captures *services.CaptureService,
+	decisions *services.DecisionStream, vhostReloader api.ProxyReloader) *http.Server {
 
 	// Initialize email service
 	emailService := services.NewEmailService(db)
 
 	// Initialize API handlers
-	vhostHandler := api.NewVHostHandler(db, nginxConfigService, vhostService, certService, reverseProxyHandler)
-	ipGroupHandler := api.NewIPGroupHandler(db)
+	vhostHandler := api.NewVHostHandler(db, nginxConfigService, vhostService, certService, vhostReloader, cluster)
+	ipGroupHandler := api.NewIPGroupHandler(db, feeds, ipIndex, cluster)
 	dashboardHandler := api.NewDashboardHandler(db)
 	authHandler := api.NewAuthHandler(authService, emailService, cfg, db)
 	certHandler := api.NewCertificateHandler(certService)
 	settingsHandler := api.NewSettingsHandler(db)
-	blockingHandler := api.NewBlockingRuleHandler(db)
-	rateLimitHandler := api.NewRateLimitHandler(db)
-	logsHandler := api.NewLogsHandler(db)
+	blockingHandler := api.NewBlockingRuleHandler(db, cluster)
+	rateLimitHandler := api.NewRateLimitHandler(db, cluster)
+	logsHandler := api.NewLogsHandler(db, decisions)
+	banHandler := api.NewBanHandler(jail, cluster)
+	attackModeHandler := api.NewAttackModeHandler(attackMode, cluster)
+	clusterHandler := api.NewClusterHandler(cluster)
+	exportHandler := api.NewExportHandler(db, exports)
+	alertHandler := api.NewAlertHandler(alerts)
+	captureHandler := api.NewCaptureHandler(captures)
+	loggingHandler := api.NewLoggingHandler(cluster)
+	analyticsHandler := api.NewAnalyticsHandler(db)
+	reportHandler := api.NewReportHandler(reports)
 
 	// Setup admin API
 	adminRouter := gin.Default()
+	if err := middleware.TrustClientIP(adminRouter, cfg.WAF.TrustedProxies); err != nil {
+		fatal("Invalid waf.trusted_proxies", err)
+	}
 
 	// Get allowed origins from config
 	allowedOrigins := cfg.GetCORSAllowedOrigins()
@@ -296,11 +466,32 @@ func setupAdminServer(cfg *config.Config, db *sqlx.DB, nginxConfigService *servi
 
 	// API routes
 	apiV1 := adminRouter.Group("/api/v1")
-	setupAPIRoutes(apiV1, authService, authHandler, dashboardHandler, vhostHandler, ipGroupHandler, certHandler, settingsHandler, blockingHandler, rateLimitHandler, logsHandler, cfg)
+	setupAPIRoutes(apiV1, authService, authHandler, dashboardHandler, vhostHandler, ipGroupHandler, certHandler, settingsHandler, blockingHandler, rateLimitHandler, logsHandler, banHandler, attackModeHandler, clusterHandler, exportHandler, alertHandler, captureHandler, loggingHandler, analyticsHandler, reportHandler, connLimiter, trafficLog, nginxIngest, events, cfg)
 
-	// Health check
+	// Prometheus metrics, unless they have their own listener
+	if cfg.Metrics.Enabled && cfg.Metrics.Listen == "" {
+		adminRouter.GET(cfg.Metrics.Path, gin.WrapH(metrics.Handler(cfg.Metrics.BearerToken)))
+	}
+
+	// Health check; "degraded" while Redis is down and limits are per node
 	adminRouter.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
+		status := "ok"
+		redisStatus := "up"
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second)
+		defer cancel()
+		if err := redisClient.Ping(ctx).Err(); err != nil {
+			redisStatus = "down"
+			status = "degraded"
+		}
+		if limiter.Degraded() {
+			status = "degraded"
+		}
+
+		c.JSON(200, gin.H{
+			"status":  status,
+			"redis":   redisStatus,
+			"limiter": limiter.Status(),
+		})
 	})
 
 	// Create server
@@ -312,34 +503,110 @@ func setupAdminServer(cfg *config.Config, db *sqlx.DB, nginxConfigService *servi
 	}
 
 	go func() {
-		log.Printf("Starting Admin API server on %s", adminServer.Addr)
+		slog.Info("Starting Admin API server", "addr", adminServer.Addr)
 		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Admin API server error: %v", err)
+			fatal("Admin API server error", err)
 		}
 	}()
 
 	return adminServer
 }
 
+// setupMetrics registers the gauges read from running services and, when a
+// separate listen address is configured, starts the metrics server
+func setupMetrics(ctx context.Context, cfg *config.Config, db *sqlx.DB, limiter *services.FallbackLimiter,
+	connLimiter *middleware.ConnectionLimiter, trafficLog *services.TrafficLogger) *http.Server {
+	if cfg.Metrics.Path == "" {
+		cfg.Metrics.Path = "/metrics"
+	}
+
+	metrics.InstrumentDB(db)
+	go metrics.RunPostgresProbe(ctx, db, 15*time.Second)
+
+	metrics.GaugeFunc("traffic_log_queue_depth", "Traffic log entries waiting to be written.", func() float64 {
+		return float64(trafficLog.Stats().Queued)
+	})
+	metrics.GaugeFunc("traffic_log_queue_capacity", "Size of the traffic log queue.", func() float64 {
+		return float64(trafficLog.Stats().Capacity)
+	})
+	metrics.CounterFunc("traffic_log_written_total", "Traffic log entries written to Postgres.", func() float64 {
+		return float64(trafficLog.Stats().Written)
+	})
+	metrics.CounterFunc("traffic_log_dropped_total", "Traffic log entries dropped because the queue was full.", func() float64 {
+		return float64(trafficLog.Stats().Dropped)
+	})
+	metrics.CounterFunc("traffic_log_failed_total", "Traffic log entries lost to failed batch writes.", func() float64 {
+		return float64(trafficLog.Stats().Failed)
+	})
+	metrics.GaugeFunc("rate_limiter_degraded", "1 while Redis is down and rate limits are counted per node.", func() float64 {
+		if limiter.Degraded() {
+			return 1
+		}
+		return 0
+	})
+	metrics.GaugeFunc("open_connections", "Open client connections on the WAF listener.", func() float64 {
+		return float64(connLimiter.Stats().OpenConnections)
+	})
+	metrics.GaugeFunc("in_flight_requests", "Requests currently being handled by the WAF.", func() float64 {
+		return float64(connLimiter.Stats().InFlightRequests)
+	})
+	metrics.CounterFunc("rejected_connections_total", "Connections refused by the per-IP connection limit.", func() float64 {
+		return float64(connLimiter.Stats().RejectedConnections)
+	})
+	metrics.CounterFunc("rejected_requests_total", "Requests refused by the per-IP in-flight request limit.", func() float64 {
+		return float64(connLimiter.Stats().RejectedRequests)
+	})
+	metrics.CounterFunc("header_timeouts_total", "Connections closed before sending a complete request header.", func() float64 {
+		return float64(connLimiter.Stats().HeaderTimeouts)
+	})
+	metrics.CounterFunc("slow_uploads_total", "Requests aborted for uploading below the minimum data rate.", func() float64 {
+		return float64(connLimiter.Stats().SlowUploads)
+	})
+	metrics.CounterFunc("idle_connections_closed_total", "Idle keep-alive connections closed over the idle connection cap.", func() float64 {
+		return float64(connLimiter.Stats().IdleClosed)
+	})
+
+	if cfg.Metrics.Listen == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Metrics.Path, metrics.Handler(cfg.Metrics.BearerToken))
+	metricsServer := &http.Server{
+		Addr:              cfg.Metrics.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		slog.Info("Starting metrics server", "addr", metricsServer.Addr)
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("Metrics server error", err)
+		}
+	}()
+
+	return metricsServer
+}
+
 func gracefulShutdown(wafServer, adminServer *http.Server) {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down servers...")
+	slog.Info("Shutting down servers")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := wafServer.Shutdown(ctx); err != nil {
-		log.Printf("WAF server forced to shutdown: %v", err)
+		slog.Warn("WAF server forced to shutdown", "error", err)
 	}
 
 	if err := adminServer.Shutdown(ctx); err != nil {
-		log.Printf("Admin API server forced to shutdown: %v", err)
+		slog.Warn("Admin API server forced to shutdown", "error", err)
 	}
 
-	log.Println("Servers exited")
+	slog.Info("Servers exited")
 }
 
 func main() {
@@ -349,17 +616,52 @@ func main() {
 	// Load configuration
 	cfg, err := config.LoadConfig("config.yaml")
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fatal("Failed to load config", err)
+	}
+
+	// Structured logging; everything below logs through it
+	logCloser, err := logging.Setup(cfg.Logging)
+	if err != nil {
+		fatal("Invalid logging config", err)
 	}
+	defer logCloser.Close()
 
 	// Initialize dependencies
 	redisClient := initRedis(cfg)
 	db := initDatabase(cfg)
 	defer db.Close()
+	if cfg.Metrics.Enabled {
+		metrics.InstrumentRedis(redisClient)
+	}
 
 	// Initialize services
 	vhostService, certService, nginxConfigService, authService := initServices(db)
 
+	// Initialize jail for escalating temporary bans
+	limiter := services.NewFallbackLimiter(redisClient)
+	jail := services.NewJailService(redisClient, limiter, db, cfg.WAF)
+	connLimiter := middleware.NewConnectionLimiter(cfg.WAF.Conn, jail)
+
+	// Start the adaptive attack mode evaluator
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	attackMode := services.NewAttackModeService(redisClient, limiter, db, cfg.WAF.Attack)
+	go attackMode.Run(ctx)
+
+	// In-memory whitelist/blacklist index for the IP blocker
+	ipIndex := services.NewIPGroupIndex(db)
+	if err := ipIndex.Load(ctx); err != nil {
+		slog.Error("Failed to load IP groups", "error", err)
+	}
+	go ipIndex.Run(ctx, 0)
+
+	// IP reputation feeds
+	feeds := services.NewFeedService(db, cfg.WAF.Feeds)
+	go feeds.Run(ctx)
+
+	// Remove IP group entries once their expiry has passed
+	go services.RunIPExpiryPruner(ctx, db, 0)
+
 	// Initialize reverse proxy
 	reverseProxyHandler := proxy.NewReverseProxy(cfg, vhostService)
 
@@ -370,10 +672,111 @@ func main() {
 		setupVHostsAndCerts(vhostService, certService, nginxConfigService)
 	}
 
+	// Apply changes made through other replicas' admin APIs. Rules and bans
+	// are read from Postgres/Redis on every request, so those events only
+	// advance the config version; state cached in memory is reloaded.
+	cluster := services.NewClusterService(redisClient, cfg.Cluster)
+	vhostReloader := &vhostReloader{proxy: reverseProxyHandler, ipIndex: ipIndex}
+	cluster.Handle(services.ClusterEventVHost, func(services.ClusterEvent) {
+		if err := vhostReloader.ReloadVHosts(); err != nil {
+			logging.Component("cluster").Error("Failed to reload vhosts", "error", err)
+		}
+	})
+	cluster.Handle(services.ClusterEventIPGroup, func(services.ClusterEvent) {
+		ipIndex.Invalidate()
+	})
+	feeds.OnChange(func(groupID string) {
+		ipIndex.Invalidate()
+		cluster.Publish(services.ClusterEventIPGroup, groupID)
+	})
+	cluster.Handle(services.ClusterEventAttackMode, func(event services.ClusterEvent) {
+		attackMode.Refresh(event.Key)
+	})
+
+	// Initialize GeoIP service
+	geoIPService := services.NewGeoIPService(cfg.WAF.GeoIP)
+	cluster.Handle(services.ClusterEventCache, func(services.ClusterEvent) {
+		geoIPService.PurgeCache()
+	})
+	cluster.Handle(services.ClusterEventLogLevel, func(event services.ClusterEvent) {
+		// Levels are not stored, so a resync (empty key) has nothing to reload
+		component, level, ok := strings.Cut(event.Key, "=")
+		if !ok {
+			return
+		}
+		if err := logging.SetLevel(component, level); err != nil {
+			logging.Component("cluster").Error("Failed to apply log level", "component", component, "level", level, "error", err)
+		}
+	})
+	go cluster.Run(ctx)
+
+	// Traffic log partitions, retention and dashboard rollups
+	logStorage := services.NewLogStorageService(db, cfg.WAF.LogStorage)
+	go logStorage.Run(ctx)
+
+	// Background log export jobs
+	exports := services.NewLogExportService(db, cfg.Export, cluster.NodeID())
+	go exports.Run(ctx)
+
+	// Alert rule evaluation and notifications
+	alerts := services.NewAlertService(db, services.NewEmailService(db), cfg.Alerts)
+	go alerts.Run(ctx)
+
+	// Scheduled security summary reports
+	reports := services.NewReportService(db, services.NewEmailService(db), cfg.Reports)
+	go reports.Run(ctx)
+
+	// Batched traffic log writer
+	trafficLog := services.NewTrafficLogger(db, geoIPService, cfg.WAF.TrafficLog)
+	trafficLog.Start()
+
+	// Requests nginx served without the WAF, read from its access logs
+	nginxIngest := services.NewNginxIngestService(db, trafficLog, cfg.WAF.NginxIngest)
+	go nginxIngest.Run(ctx)
+
+	// Forward block and attack events to SIEM sinks
+	events := services.NewEventForwarder(cfg.SIEM, geoIPService, cluster.NodeID())
+	events.Start()
+
+	// Live stream of WAF decisions for the monitoring page
+	decisions := services.NewDecisionStream()
+
+	// Forensic captures of attack and sampled requests
+	captures := services.NewCaptureService(db, cfg.WAF.Capture)
+	captures.Start()
+	go captures.Run(ctx)
+
+	// OpenTelemetry tracing of the WAF middleware chain and upstream calls
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		slog.Warn("Tracing disabled", "error", err)
+	}
+
+	// Prometheus metrics
+	var metricsServer *http.Server
+	if cfg.Metrics.Enabled {
+		metricsServer = setupMetrics(ctx, cfg, db, limiter, connLimiter, trafficLog)
+	}
+
 	// Start servers
-	wafServer := setupWAFServer(cfg, redisClient, db, reverseProxyHandler)
-	adminServer := setupAdminServer(cfg, db, nginxConfigService, vhostService, certService, authService, reverseProxyHandler)
+	wafServer := setupWAFServer(cfg, redisClient, db, jail, connLimiter, attackMode, limiter, ipIndex, geoIPService, trafficLog, events, captures, decisions, reverseProxyHandler)
+	adminServer := setupAdminServer(cfg, db, nginxConfigService, vhostService, certService, authService, jail, connLimiter, attackMode,
+		redisClient, limiter, feeds, ipIndex, cluster, trafficLog, nginxIngest, exports, events, alerts, reports, captures, decisions, vhostReloader)
 
 	// Wait for shutdown signal
 	gracefulShutdown(wafServer, adminServer)
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	// Write out whatever is still queued
+	trafficLog.Close()
+	events.Close()
+	captures.Close()
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		logging.Component("tracing").Error("Failed to flush spans", "error", err)
+	}
 }
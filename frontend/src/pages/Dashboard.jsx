@@ -1,6 +1,6 @@
 import { useEffect, useState } from 'react'
-import { getDashboardStats, getAttacksByCountry } from '../services/api'
-import { Activity, Shield, AlertTriangle, Globe, Search, Calendar, Loader2 } from 'lucide-react'
+import { getDashboardStats, getAttacksByCountry, getBans, extendBan, liftBan } from '../services/api'
+import { Activity, Shield, AlertTriangle, Globe, Search, Calendar, Loader2, Ban } from 'lucide-react'
 import { LineChart, Line, BarChart, Bar, XAxis, YAxis, CartesianGrid, Tooltip, Legend, ResponsiveContainer } from 'recharts'
 import { format, subDays, differenceInDays } from 'date-fns'
 import logger from '../utils/logger'
@@ -29,6 +29,7 @@ const countryNames = {
 const Dashboard = () => {
   const [stats, setStats] = useState(null)
   const [countryStats, setCountryStats] = useState([])
+  const [bans, setBans] = useState([])
   const [loading, setLoading] = useState(true)
   const [fetching, setFetching] = useState(false)
   const [timeRange, setTimeRange] = useState('24h')
@@ -58,6 +59,8 @@ const Dashboard = () => {
       // Load country stats with same params
       const countryResponse = await getAttacksByCountry(params)
       setCountryStats(countryResponse.data || [])
+
+      await loadBans()
     } catch (error) {
       logger.error('Failed to load stats:', error)
     } finally {
@@ -66,6 +69,34 @@ const Dashboard = () => {
     }
   }
 
+  const loadBans = async () => {
+    try {
+      const response = await getBans()
+      setBans(response.data?.bans || [])
+    } catch (error) {
+      logger.error('Failed to load bans:', error)
+    }
+  }
+
+  const handleExtendBan = async (ip) => {
+    try {
+      await extendBan(ip, 3600)
+      await loadBans()
+    } catch (error) {
+      logger.error('Failed to extend ban:', error)
+    }
+  }
+
+  const handleLiftBan = async (ip) => {
+    if (!confirm(`Lift the ban on ${ip}?`)) return
+    try {
+      await liftBan(ip)
+      await loadBans()
+    } catch (error) {
+      logger.error('Failed to lift ban:', error)
+    }
+  }
+
   const handleRangeChange = (range) => {
     setTimeRange(range)
     setCustomRange(range === 'custom')
@@ -391,6 +422,69 @@ const Dashboard = () => {
         </div>
       </div>
 
+      {/* Active Bans */}
+      <div className="card">
+        <div className="flex items-center gap-2 mb-4">
+          <Ban className="w-5 h-5 text-red-600" />
+          <h2 className="text-xl font-semibold">Active Bans</h2>
+          <span className="px-2 py-0.5 bg-red-100 text-red-800 rounded-full text-xs font-medium">{bans.length}</span>
+        </div>
+        <div className="overflow-x-auto">
+          <table className="w-full">
+            <thead className="bg-gray-50">
+              <tr className="border-b">
+                <th className="text-left py-3 px-4 font-medium text-gray-700">IP Address</th>
+                <th className="text-left py-3 px-4 font-medium text-gray-700">Reason</th>
+                <th className="text-left py-3 px-4 font-medium text-gray-700">Level</th>
+                <th className="text-left py-3 px-4 font-medium text-gray-700">Banned At</th>
+                <th className="text-left py-3 px-4 font-medium text-gray-700">Expires</th>
+                <th className="text-right py-3 px-4 font-medium text-gray-700">Actions</th>
+              </tr>
+            </thead>
+            <tbody>
+              {bans.length > 0 ? (
+                bans.map((ban) => (
+                  <tr key={ban.ip} className="border-b hover:bg-gray-50 transition-colors">
+                    <td className="py-3 px-4 font-mono text-sm">{ban.ip}</td>
+                    <td className="py-3 px-4">
+                      <span className="px-3 py-1 bg-red-100 text-red-800 rounded-full text-xs font-medium">
+                        {ban.reason}
+                      </span>
+                    </td>
+                    <td className="py-3 px-4 text-sm">{ban.level}</td>
+                    <td className="py-3 px-4 text-sm">{format(new Date(ban.banned_at), 'MMM dd, HH:mm:ss')}</td>
+                    <td className="py-3 px-4 text-sm">
+                      {format(new Date(ban.expires_at), 'MMM dd, HH:mm:ss')}
+                      <span className="text-gray-500"> ({Math.ceil(ban.remaining_seconds / 60)} min)</span>
+                    </td>
+                    <td className="py-3 px-4 text-right space-x-2">
+                      <button
+                        onClick={() => handleExtendBan(ban.ip)}
+                        className="px-3 py-1 border rounded text-sm hover:bg-gray-50"
+                      >
+                        +1h
+                      </button>
+                      <button
+                        onClick={() => handleLiftBan(ban.ip)}
+                        className="px-3 py-1 border border-red-300 text-red-700 rounded text-sm hover:bg-red-50"
+                      >
+                        Lift
+                      </button>
+                    </td>
+                  </tr>
+                ))
+              ) : (
+                <tr>
+                  <td colSpan="6" className="py-8 text-center text-gray-500">
+                    No active bans
+                  </td>
+                </tr>
+              )}
+            </tbody>
+          </table>
+        </div>
+      </div>
+
       {/* Recent Attacks */}
       <div className="card">
         <div className="flex justify-between items-center mb-4">
@@ -1,6 +1,6 @@
 import { useEffect, useState, useRef } from 'react'
-import { getIPGroups, createIPGroup, updateIPGroup, deleteIPGroup, addIPToGroup, getGroupIPs, updateIPAddress, removeIPFromGroup, getVHosts } from '../services/api'
-import { Plus, Trash2, Shield, Edit2, Eye, Globe } from 'lucide-react'
+import { getIPGroups, createIPGroup, updateIPGroup, deleteIPGroup, addIPToGroup, getGroupIPs, updateIPAddress, removeIPFromGroup, getVHosts, getGroupFeeds, createGroupFeed, deleteGroupFeed, syncGroupFeed, importGroupIPs, exportGroupIPs } from '../services/api'
+import { Plus, Trash2, Shield, Edit2, Eye, Globe, RefreshCw, Rss, Upload, Download, Clock } from 'lucide-react'
 import ConfirmModal from '../components/ConfirmModal'
 import logger from '../utils/logger'
 
@@ -16,6 +16,16 @@ const IPGroups = () => {
   const [editingIP, setEditingIP] = useState(null)
   const [groupIPs, setGroupIPs] = useState([])
   const [loadingIPs, setLoadingIPs] = useState(false)
+  const [groupFeeds, setGroupFeeds] = useState([])
+  const [showFeedForm, setShowFeedForm] = useState(false)
+  const [syncingFeed, setSyncingFeed] = useState(null)
+  const [feedFormData, setFeedFormData] = useState({
+    name: '',
+    source: '',
+    format: 'plain',
+    csv_column: 1,
+    refresh_interval: 3600
+  })
   const [confirmModal, setConfirmModal] = useState({ isOpen: false, onConfirm: null, title: '', message: '' })
   const [vhostSearchTerm, setVhostSearchTerm] = useState('')
   const [showVhostDropdown, setShowVhostDropdown] = useState(false)
@@ -30,6 +40,10 @@ const IPGroups = () => {
     cidr_mask: null,
     description: '',
   })
+  const [showImportModal, setShowImportModal] = useState(false)
+  const [importData, setImportData] = useState({ format: 'text', ttl: '', description: '', body: '' })
+  const [importReport, setImportReport] = useState(null)
+  const [importError, setImportError] = useState('')
 
   useEffect(() => {
     loadGroups()
@@ -123,16 +137,60 @@ const IPGroups = () => {
     setSelectedGroup(group)
     setLoadingIPs(true)
     try {
-      const response = await getGroupIPs(group.id)
-      setGroupIPs(response.data || [])
+      const [ipsResponse, feedsResponse] = await Promise.all([getGroupIPs(group.id), getGroupFeeds(group.id)])
+      setGroupIPs(ipsResponse.data || [])
+      setGroupFeeds(feedsResponse.data || [])
     } catch (error) {
       logger.error('Failed to load IPs:', error)
       setGroupIPs([])
+      setGroupFeeds([])
     } finally {
       setLoadingIPs(false)
     }
   }
 
+  const handleAddFeed = async (e) => {
+    e.preventDefault()
+    try {
+      await createGroupFeed(selectedGroup.id, feedFormData)
+      setShowFeedForm(false)
+      setFeedFormData({ name: '', source: '', format: 'plain', csv_column: 1, refresh_interval: 3600 })
+      handleViewIPs(selectedGroup)
+    } catch (error) {
+      logger.error('Failed to add feed:', error)
+      alert(error.response?.data?.error || 'Failed to add feed')
+    }
+  }
+
+  const handleSyncFeed = async (feedId) => {
+    setSyncingFeed(feedId)
+    try {
+      await syncGroupFeed(selectedGroup.id, feedId)
+    } catch (error) {
+      logger.error('Failed to sync feed:', error)
+    } finally {
+      setSyncingFeed(null)
+      handleViewIPs(selectedGroup)
+    }
+  }
+
+  const handleDeleteFeed = (feed) => {
+    setConfirmModal({
+      isOpen: true,
+      title: 'Delete Feed',
+      message: `Delete feed "${feed.name}" and the ${feed.entry_count} addresses it imported?`,
+      type: 'danger',
+      onConfirm: async () => {
+        try {
+          await deleteGroupFeed(selectedGroup.id, feed.id)
+          handleViewIPs(selectedGroup)
+        } catch (error) {
+          logger.error('Failed to delete feed:', error)
+        }
+      }
+    })
+  }
+
   const handleAddIP = async (e) => {
     e.preventDefault()
     try {
@@ -150,7 +208,8 @@ const IPGroups = () => {
       id: ip.id,
       ip_address: ip.ip_address,
       cidr_mask: ip.cidr_mask,
-      description: ip.description
+      description: ip.description,
+      expires_at: ip.expires_at
     })
   }
 
@@ -166,7 +225,8 @@ const IPGroups = () => {
       await updateIPAddress(selectedGroup.id, ipId, {
         ip_address: editingIP.ip_address,
         cidr_mask: editingIP.cidr_mask || null,
-        description: editingIP.description
+        description: editingIP.description,
+        expires_at: editingIP.expires_at || null
       })
       setEditingIP(null)
       handleViewIPs(selectedGroup)
@@ -182,6 +242,53 @@ const IPGroups = () => {
     }
   }
 
+  const handleImport = async (dryRun) => {
+    setImportError('')
+    try {
+      const params = { format: importData.format, dry_run: dryRun }
+      if (importData.ttl) params.ttl = importData.ttl
+      if (importData.description) params.description = importData.description
+      const response = await importGroupIPs(selectedGroup.id, importData.body, params)
+      setImportReport(response.data)
+      if (!dryRun) handleViewIPs(selectedGroup)
+    } catch (error) {
+      logger.error('Failed to import IPs:', error)
+      setImportError(error.response?.data?.error || 'Import failed')
+    }
+  }
+
+  const handleImportFile = async (e) => {
+    const file = e.target.files?.[0]
+    if (!file) return
+    const body = await file.text()
+    let format = 'text'
+    if (file.name.endsWith('.csv')) format = 'csv'
+    else if (file.name.endsWith('.json')) format = 'json'
+    setImportData({ ...importData, body, format })
+    setImportReport(null)
+  }
+
+  const closeImportModal = () => {
+    setShowImportModal(false)
+    setImportData({ format: 'text', ttl: '', description: '', body: '' })
+    setImportReport(null)
+    setImportError('')
+  }
+
+  const handleExport = async (format) => {
+    try {
+      const response = await exportGroupIPs(selectedGroup.id, format)
+      const url = URL.createObjectURL(response.data)
+      const link = document.createElement('a')
+      link.href = url
+      link.download = `${selectedGroup.name}.${format === 'text' ? 'txt' : format}`
+      link.click()
+      URL.revokeObjectURL(url)
+    } catch (error) {
+      logger.error('Failed to export IPs:', error)
+    }
+  }
+
   const handleRemoveIP = async (ipId) => {
     try {
       await removeIPFromGroup(selectedGroup.id, ipId)
@@ -530,13 +637,146 @@ const IPGroups = () => {
               <h2 className="text-2xl font-bold">
                 {selectedGroup.name} - IP Addresses
               </h2>
-              <button
-                onClick={() => setShowIPModal(true)}
-                className="btn btn-primary btn-sm flex items-center gap-2"
-              >
-                <Plus className="w-4 h-4" />
-                Add IP
-              </button>
+              <div className="flex gap-2">
+                <button
+                  onClick={() => handleExport('csv')}
+                  className="btn btn-secondary btn-sm flex items-center gap-2"
+                  title="Export as CSV"
+                >
+                  <Download className="w-4 h-4" />
+                  Export
+                </button>
+                <button
+                  onClick={() => setShowImportModal(true)}
+                  className="btn btn-secondary btn-sm flex items-center gap-2"
+                >
+                  <Upload className="w-4 h-4" />
+                  Import
+                </button>
+                <button
+                  onClick={() => setShowIPModal(true)}
+                  className="btn btn-primary btn-sm flex items-center gap-2"
+                >
+                  <Plus className="w-4 h-4" />
+                  Add IP
+                </button>
+              </div>
+            </div>
+
+            <div className="mb-4 border rounded p-3">
+              <div className="flex justify-between items-center mb-2">
+                <h3 className="font-semibold flex items-center gap-2">
+                  <Rss className="w-4 h-4" />
+                  Feeds
+                </h3>
+                <button
+                  onClick={() => setShowFeedForm(!showFeedForm)}
+                  className="text-blue-600 hover:text-blue-800 text-sm"
+                >
+                  {showFeedForm ? 'Cancel' : '+ Subscribe to feed'}
+                </button>
+              </div>
+              {showFeedForm && (
+                <form onSubmit={handleAddFeed} className="space-y-2 mb-3">
+                  <div className="flex gap-2">
+                    <input
+                      type="text"
+                      className="input flex-1"
+                      placeholder="Name (e.g. Spamhaus DROP)"
+                      value={feedFormData.name}
+                      onChange={(e) => setFeedFormData({ ...feedFormData, name: e.target.value })}
+                      required
+                    />
+                    <select
+                      className="input w-40"
+                      value={feedFormData.format}
+                      onChange={(e) => setFeedFormData({ ...feedFormData, format: e.target.value })}
+                    >
+                      <option value="plain">Plain IP/CIDR list</option>
+                      <option value="spamhaus_drop">Spamhaus DROP</option>
+                      <option value="csv">CSV</option>
+                      <option value="tor">Tor exit list</option>
+                    </select>
+                  </div>
+                  <input
+                    type="text"
+                    className="input w-full"
+                    placeholder="https://www.spamhaus.org/drop/drop.txt or /path/to/list.txt"
+                    value={feedFormData.source}
+                    onChange={(e) => setFeedFormData({ ...feedFormData, source: e.target.value })}
+                    required
+                  />
+                  <div className="flex gap-2 items-center">
+                    {feedFormData.format === 'csv' && (
+                      <>
+                        <label className="text-sm text-gray-600">Column</label>
+                        <input
+                          type="number"
+                          className="input w-20"
+                          min="1"
+                          value={feedFormData.csv_column}
+                          onChange={(e) => setFeedFormData({ ...feedFormData, csv_column: Number.parseInt(e.target.value, 10) || 1 })}
+                        />
+                      </>
+                    )}
+                    <label className="text-sm text-gray-600">Refresh every (s)</label>
+                    <input
+                      type="number"
+                      className="input w-28"
+                      min="60"
+                      value={feedFormData.refresh_interval}
+                      onChange={(e) => setFeedFormData({ ...feedFormData, refresh_interval: Number.parseInt(e.target.value, 10) || 3600 })}
+                    />
+                    <button type="submit" className="btn btn-primary btn-sm ml-auto">Add Feed</button>
+                  </div>
+                </form>
+              )}
+              {groupFeeds.length === 0 ? (
+                <p className="text-sm text-gray-500">No feeds. Addresses are managed by hand.</p>
+              ) : (
+                <div className="space-y-1">
+                  {groupFeeds.map((feed) => (
+                    <div key={feed.id} className="flex items-center justify-between text-sm">
+                      <div>
+                        <span className="font-medium">{feed.name}</span>
+                        <span className="text-gray-500"> · {feed.format} · {feed.entry_count} entries</span>
+                        <span className={`ml-2 px-2 py-0.5 rounded text-xs ${
+                          feed.last_status === 'ok' ? 'bg-green-100 text-green-700'
+                            : feed.last_status === 'error' ? 'bg-red-100 text-red-700'
+                            : 'bg-gray-100 text-gray-600'
+                        }`} title={feed.last_error || ''}>
+                          {feed.last_status}
+                        </span>
+                        {feed.last_sync_at && (
+                          <span className="text-gray-400 text-xs ml-2">
+                            synced {new Date(feed.last_sync_at).toLocaleString()}
+                          </span>
+                        )}
+                        {feed.last_status === 'error' && feed.last_error && (
+                          <p className="text-xs text-red-600">{feed.last_error}</p>
+                        )}
+                      </div>
+                      <div className="flex gap-2">
+                        <button
+                          onClick={() => handleSyncFeed(feed.id)}
+                          className="text-blue-600 hover:text-blue-800"
+                          title="Sync now"
+                          disabled={syncingFeed === feed.id}
+                        >
+                          <RefreshCw className={`w-4 h-4 ${syncingFeed === feed.id ? 'animate-spin' : ''}`} />
+                        </button>
+                        <button
+                          onClick={() => handleDeleteFeed(feed)}
+                          className="text-red-600 hover:text-red-800"
+                          title="Delete feed"
+                        >
+                          <Trash2 className="w-4 h-4" />
+                        </button>
+                      </div>
+                    </div>
+                  ))}
+                </div>
+              )}
             </div>
 
             <div className="space-y-2 max-h-96 overflow-y-auto">
@@ -603,23 +843,35 @@ const IPGroups = () => {
                           {ip.description && (
                             <p className="text-sm text-gray-600">{ip.description}</p>
                           )}
+                          {ip.expires_at && (
+                            <p className="text-xs text-orange-600 flex items-center gap-1">
+                              <Clock className="w-3 h-3" />
+                              Expires {new Date(ip.expires_at).toLocaleString()}
+                            </p>
+                          )}
                         </div>
-                        <div className="flex gap-2">
-                          <button
-                            onClick={() => handleIPEdit(ip)}
-                            className="text-blue-600 hover:text-blue-800"
-                            title="Edit IP"
-                          >
-                            <Edit2 className="w-4 h-4" />
-                          </button>
-                          <button
-                            onClick={() => handleRemoveIP(ip.id)}
-                            className="text-red-600 hover:text-red-800"
-                            title="Delete IP"
-                          >
-                            <Trash2 className="w-4 h-4" />
-                          </button>
-                        </div>
+                        {ip.feed_id ? (
+                          <span className="text-xs text-gray-500" title="Managed by a feed">
+                            <Rss className="w-4 h-4" />
+                          </span>
+                        ) : (
+                          <div className="flex gap-2">
+                            <button
+                              onClick={() => handleIPEdit(ip)}
+                              className="text-blue-600 hover:text-blue-800"
+                              title="Edit IP"
+                            >
+                              <Edit2 className="w-4 h-4" />
+                            </button>
+                            <button
+                              onClick={() => handleRemoveIP(ip.id)}
+                              className="text-red-600 hover:text-red-800"
+                              title="Delete IP"
+                            >
+                              <Trash2 className="w-4 h-4" />
+                            </button>
+                          </div>
+                        )}
                       </>
                     )}
                   </div>
@@ -632,6 +884,7 @@ const IPGroups = () => {
               onClick={() => {
                 setSelectedGroup(null)
                 setEditingIP(null)
+                setShowFeedForm(false)
               }}
               className="btn btn-secondary w-full mt-4"
             >
@@ -706,6 +959,109 @@ const IPGroups = () => {
         </div>
       )}
 
+      {/* Bulk Import Modal */}
+      {showImportModal && (
+        <div className="fixed inset-0 bg-black bg-opacity-50 flex items-center justify-center z-50">
+          <div className="bg-white rounded-lg p-6 w-full max-w-lg">
+            <h2 className="text-2xl font-bold mb-4">Import IP Addresses</h2>
+            <div className="space-y-4">
+              <div className="flex gap-2">
+                <div className="flex-1">
+                  <label htmlFor="import-format" className="block text-sm font-medium mb-1">Format</label>
+                  <select
+                    id="import-format"
+                    className="input w-full"
+                    value={importData.format}
+                    onChange={(e) => setImportData({ ...importData, format: e.target.value })}
+                  >
+                    <option value="text">One per line</option>
+                    <option value="csv">CSV</option>
+                    <option value="json">JSON</option>
+                  </select>
+                </div>
+                <div className="flex-1">
+                  <label htmlFor="import-ttl" className="block text-sm font-medium mb-1">Expires after</label>
+                  <input
+                    id="import-ttl"
+                    type="text"
+                    className="input w-full"
+                    placeholder="e.g., 48h (empty = never)"
+                    value={importData.ttl}
+                    onChange={(e) => setImportData({ ...importData, ttl: e.target.value })}
+                  />
+                </div>
+              </div>
+              <div>
+                <label htmlFor="import-description" className="block text-sm font-medium mb-1">Default description</label>
+                <input
+                  id="import-description"
+                  type="text"
+                  className="input w-full"
+                  placeholder="e.g., INC-1234"
+                  value={importData.description}
+                  onChange={(e) => setImportData({ ...importData, description: e.target.value })}
+                />
+              </div>
+              <div>
+                <label htmlFor="import-body" className="block text-sm font-medium mb-1">Addresses</label>
+                <input type="file" accept=".txt,.csv,.json" onChange={handleImportFile} className="mb-2 text-sm" />
+                <textarea
+                  id="import-body"
+                  className="input w-full font-mono text-sm"
+                  rows="8"
+                  placeholder={'192.0.2.10\n198.51.100.0/24 # scanner'}
+                  value={importData.body}
+                  onChange={(e) => {
+                    setImportData({ ...importData, body: e.target.value })
+                    setImportReport(null)
+                  }}
+                />
+              </div>
+              {importError && (
+                <div className="text-sm text-red-600">{importError}</div>
+              )}
+              {importReport && (
+                <div className="text-sm border rounded p-3 bg-gray-50">
+                  <p>
+                    {importReport.dry_run ? 'Validation' : 'Import'}: {importReport.valid} valid, {importReport.invalid} invalid,
+                    {' '}{importReport.duplicates} duplicates, {importReport.added} {importReport.dry_run ? 'to add' : 'added'},
+                    {' '}{importReport.updated} expiry {importReport.dry_run ? 'to extend' : 'extended'}
+                  </p>
+                  {importReport.errors.length > 0 && (
+                    <ul className="mt-2 max-h-32 overflow-y-auto text-red-600 font-mono text-xs">
+                      {importReport.errors.map((err) => (
+                        <li key={`${err.line}-${err.value}`}>Line {err.line}: {err.error}</li>
+                      ))}
+                    </ul>
+                  )}
+                </div>
+              )}
+              <div className="flex gap-2">
+                <button
+                  type="button"
+                  onClick={() => handleImport(true)}
+                  className="btn btn-secondary flex-1"
+                  disabled={!importData.body.trim()}
+                >
+                  Validate
+                </button>
+                <button
+                  type="button"
+                  onClick={() => handleImport(false)}
+                  className="btn btn-primary flex-1"
+                  disabled={!importData.body.trim()}
+                >
+                  Import
+                </button>
+                <button type="button" onClick={closeImportModal} className="btn btn-secondary flex-1">
+                  Close
+                </button>
+              </div>
+            </div>
+          </div>
+        </div>
+      )}
+
       <ConfirmModal
         isOpen={confirmModal.isOpen}
         onClose={() => setConfirmModal({ ...confirmModal, isOpen: false })}
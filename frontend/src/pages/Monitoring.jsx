@@ -1,9 +1,26 @@
 import React, { useState, useEffect } from 'react';
 import { Card, CardContent, CardHeader, CardTitle } from '../components/ui/card';
 import { Tabs, TabsContent, TabsList, TabsTrigger } from '../components/ui/tabs';
-import api from '../services/api';
+import api, { streamEvents } from '../services/api';
 import logger from '../utils/logger';
 
+// Lines and decisions kept on screen while live
+const MAX_LIVE_ROWS = 500;
+
+// liveRow shapes a streamed WAF decision like a traffic log row
+const liveRow = (decision) => ({
+  id: decision.request_id || `${decision.timestamp}-${Math.random()}`,
+  timestamp: decision.timestamp,
+  host: decision.host,
+  client_ip: decision.client_ip,
+  method: decision.method,
+  url: decision.url,
+  status_code: decision.status_code,
+  is_attack: Boolean(decision.attack_type),
+  attack_type: decision.attack_type,
+  blocked: decision.decision === 'blocked',
+});
+
 const Monitoring = () => {
   const [activeTab, setActiveTab] = useState('nginx');
   const [vhosts, setVhosts] = useState([]);
@@ -13,6 +30,9 @@ const Monitoring = () => {
   const [logType, setLogType] = useState('access');
   const [nginxLogs, setNginxLogs] = useState([]);
   const [wafLogs, setWafLogs] = useState([]);
+  const [wafQuery, setWafQuery] = useState('');
+  const [wafQueryError, setWafQueryError] = useState('');
+  const [wafCursor, setWafCursor] = useState('');
   const [loading, setLoading] = useState(false);
   const [liveMode, setLiveMode] = useState(false);
   const [timeRange, setTimeRange] = useState('1D'); // 1D, 7D, or 'custom'
@@ -64,20 +84,35 @@ const Monitoring = () => {
   }, [wafTimeRange]);
 
   useEffect(() => {
-    let interval;
-    if (liveMode && activeTab === 'nginx' && selectedVhost) {
-      interval = setInterval(() => {
-        fetchNginxLogs();
-      }, 3000);
-    } else if (liveMode && activeTab === 'waf') {
-      interval = setInterval(() => {
-        fetchWAFLogs();
-      }, 3000);
-    }
-    return () => {
-      if (interval) clearInterval(interval);
+    // Live mode follows the log file or the WAF's decisions as they happen,
+    // on top of what was last loaded
+    if (!liveMode) return undefined;
+    const controller = new AbortController();
+    const onError = (error) => {
+      if (error.name !== 'AbortError') {
+        logger.error('Live stream ended:', error);
+      }
     };
-  }, [liveMode, activeTab, selectedVhost]);
+
+    if (activeTab === 'nginx' && selectedVhost) {
+      streamEvents('/logs/nginx/stream', { domain: selectedVhost, type: logType, backlog: 0 }, (event, data) => {
+        let line = data;
+        if (event === 'notice') {
+          line = `--- log file ${JSON.parse(data).notice} ---`;
+        } else if (event !== 'message') {
+          return;
+        }
+        setNginxLogs((lines) => [...lines, line].slice(-MAX_LIVE_ROWS));
+      }, controller.signal).catch(onError);
+    } else if (activeTab === 'waf') {
+      streamEvents('/logs/waf/stream', {}, (event, data) => {
+        if (event === 'decision') {
+          setWafLogs((logs) => [liveRow(JSON.parse(data)), ...logs].slice(0, MAX_LIVE_ROWS));
+        }
+      }, controller.signal).catch(onError);
+    }
+    return () => controller.abort();
+  }, [liveMode, activeTab, selectedVhost, logType]);
 
   const fetchVhosts = async () => {
     try {
@@ -109,20 +144,30 @@ const Monitoring = () => {
     }
   };
 
-  const fetchWAFLogs = async () => {
+  const fetchWAFLogs = async (cursor = '') => {
     setLoading(true);
     try {
       const response = await api.get('/logs/waf', {
         params: {
           start_date: dateRange.start,
           end_date: dateRange.end,
-          limit: 100
+          limit: 100,
+          q: wafQuery || undefined,
+          cursor: cursor || undefined
         }
       });
-      setWafLogs(response.data?.logs || []);
+      const logs = response.data?.logs || [];
+      setWafLogs(cursor ? [...wafLogs, ...logs] : logs);
+      setWafCursor(response.data?.next_cursor || '');
+      setWafQueryError('');
     } catch (error) {
       logger.error('Failed to fetch WAF logs:', error);
-      setWafLogs([]);
+      if (error.response?.status === 400) {
+        setWafQueryError(error.response.data?.error || 'Invalid search');
+      }
+      if (!cursor) {
+        setWafLogs([]);
+      }
     } finally {
       setLoading(false);
     }
@@ -390,6 +435,26 @@ const Monitoring = () => {
                     </div>
                   </div>
                 )}
+
+                {/* Search */}
+                <div>
+                  <label className="block text-sm font-medium mb-2">Search</label>
+                  <input
+                    type="text"
+                    value={wafQuery}
+                    onChange={(e) => setWafQuery(e.target.value)}
+                    onKeyDown={(e) => e.key === 'Enter' && fetchWAFLogs()}
+                    placeholder='host:shop.example.com status:>=500 ip:10.0.0.0/8 country:RU attack:XSS ua:~curl'
+                    className="w-full px-3 py-2 border rounded-lg font-mono text-sm focus:ring-2 focus:ring-blue-500"
+                  />
+                  {wafQueryError ? (
+                    <p className="text-xs text-red-600 mt-1">{wafQueryError}</p>
+                  ) : (
+                    <p className="text-xs text-gray-500 mt-1">
+                      Fields: host, ip, status, method, url, ua, country, region, city, asn, org, attack, reason, rt, bytes, is:attack|blocked|allowed. Use ~ for contains, * as wildcard, - to negate. Press Enter to search.
+                    </p>
+                  )}
+                </div>
               </div>
 
               {/* WAF Logs Table */}
@@ -477,6 +542,13 @@ const Monitoring = () => {
                     )}
                   </tbody>
                 </table>
+                {wafCursor && !loading && (
+                  <div className="text-center py-4">
+                    <button onClick={() => fetchWAFLogs(wafCursor)} className="btn btn-secondary">
+                      Load more
+                    </button>
+                  </div>
+                )}
               </div>
 
               <div className="flex justify-between items-center text-sm text-gray-500">
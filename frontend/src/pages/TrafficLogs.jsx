@@ -27,7 +27,7 @@ const TrafficLogs = () => {
     setLoading(true)
     try {
       // Load more data for client-side pagination
-      const response = await getTrafficLogs(1000, 0)
+      const response = await getTrafficLogs(1000)
       const logsData = response.data || []
       setLogs(logsData)
       setTotalLogs(logsData.length)
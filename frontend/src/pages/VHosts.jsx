@@ -54,11 +54,18 @@ const VHosts = () => {
     proxy_connect_timeout: 60,
     bot_detection_enabled: false,
     bot_detection_type: 'turnstile',
+    bot_detection_mode: 'score',
+    bot_score_challenge_threshold: 30,
+    bot_score_block_threshold: 70,
     recaptcha_version: 'v2',
     rate_limit_enabled: false,
     rate_limit_requests: 100,
     rate_limit_window: 60,
+    asn_rate_limit_requests: 0,
+    log_retention_days: 0,
+    capture_sample_percent: 0,
     region_filtering_enabled: false,
+    geoip_fail_policy: 'open',
     region_whitelist: [],
     region_blacklist: [],
     custom_locations: [],
@@ -236,11 +243,18 @@ const VHosts = () => {
         proxy_connect_timeout: 60,
         bot_detection_enabled: false,
         bot_detection_type: 'turnstile',
+        bot_detection_mode: 'score',
+        bot_score_challenge_threshold: 30,
+        bot_score_block_threshold: 70,
         recaptcha_version: 'v2',
         rate_limit_enabled: false,
         rate_limit_requests: 100,
         rate_limit_window: 60,
+        asn_rate_limit_requests: 0,
+        log_retention_days: 0,
+        capture_sample_percent: 0,
         region_filtering_enabled: false,
+        geoip_fail_policy: 'open',
         region_whitelist: [],
         region_blacklist: [],
         custom_locations: [],
@@ -378,11 +392,18 @@ const VHosts = () => {
       proxy_connect_timeout: vhost.proxy_connect_timeout || 60,
       bot_detection_enabled: vhost.bot_detection_enabled || false,
       bot_detection_type: vhost.bot_detection_type || 'turnstile',
+      bot_detection_mode: vhost.bot_detection_mode || 'score',
+      bot_score_challenge_threshold: vhost.bot_score_challenge_threshold || 30,
+      bot_score_block_threshold: vhost.bot_score_block_threshold || 70,
       recaptcha_version: vhost.recaptcha_version || 'v2',
       rate_limit_enabled: vhost.rate_limit_enabled || false,
       rate_limit_requests: vhost.rate_limit_requests || 100,
       rate_limit_window: vhost.rate_limit_window || 60,
+      asn_rate_limit_requests: vhost.asn_rate_limit_requests || 0,
+      log_retention_days: vhost.log_retention_days || 0,
+      capture_sample_percent: vhost.capture_sample_percent || 0,
       region_filtering_enabled: vhost.region_filtering_enabled || false,
+      geoip_fail_policy: vhost.geoip_fail_policy || 'open',
       region_whitelist: vhost.region_whitelist || [],
       region_blacklist: vhost.region_blacklist || [],
       custom_locations: vhost.custom_locations || [],
@@ -1198,6 +1219,28 @@ const VHosts = () => {
                         onChange={(e) => setFormData({ ...formData, proxy_connect_timeout: Number.parseInt(e.target.value) || 60 })}
                       />
                     </div>
+                    <div>
+                      <label className="label">Log Retention (days, 0 = default)</label>
+                      <input
+                        type="number"
+                        className="input"
+                        min="0"
+                        value={formData.log_retention_days}
+                        onChange={(e) => setFormData({ ...formData, log_retention_days: Number.parseInt(e.target.value) || 0 })}
+                      />
+                    </div>
+                    <div>
+                      <label className="label">Capture Sample (% of requests, 0 = attacks only)</label>
+                      <input
+                        type="number"
+                        className="input"
+                        min="0"
+                        max="100"
+                        step="0.1"
+                        value={formData.capture_sample_percent}
+                        onChange={(e) => setFormData({ ...formData, capture_sample_percent: Number.parseFloat(e.target.value) || 0 })}
+                      />
+                    </div>
                   </div>
 
                   {/* Bot Detection */}
@@ -1213,6 +1256,46 @@ const VHosts = () => {
                     </div>
                     {formData.bot_detection_enabled && (
                       <div className="space-y-3">
+                        <div>
+                          <label className="label">Detection Mode</label>
+                          <select
+                            className="input"
+                            value={formData.bot_detection_mode || 'score'}
+                            onChange={(e) => setFormData({ ...formData, bot_detection_mode: e.target.value })}
+                          >
+                            <option value="score">Behavioural Score (allow / challenge / block)</option>
+                            <option value="challenge_all">Challenge All Visitors</option>
+                          </select>
+                        </div>
+                        {formData.bot_detection_mode !== 'challenge_all' && (
+                          <div className="grid grid-cols-2 gap-3">
+                            <div>
+                              <label className="label">Challenge From Score</label>
+                              <input
+                                type="number"
+                                className="input"
+                                min="1"
+                                max="100"
+                                value={formData.bot_score_challenge_threshold}
+                                onChange={(e) => setFormData({ ...formData, bot_score_challenge_threshold: Number.parseInt(e.target.value) || 30 })}
+                              />
+                            </div>
+                            <div>
+                              <label className="label">Block From Score</label>
+                              <input
+                                type="number"
+                                className="input"
+                                min="1"
+                                max="100"
+                                value={formData.bot_score_block_threshold}
+                                onChange={(e) => setFormData({ ...formData, bot_score_block_threshold: Number.parseInt(e.target.value) || 70 })}
+                              />
+                            </div>
+                            <p className="text-xs text-gray-500 col-span-2">
+                              Score 0-100 from header, cookie, cadence and navigation heuristics. Below {formData.bot_score_challenge_threshold} is allowed.
+                            </p>
+                          </div>
+                        )}
                         <div>
                           <label className="label">Challenge Type</label>
                           <select
@@ -1288,6 +1371,19 @@ const VHosts = () => {
                             Limit: {formData.rate_limit_requests} requests per {formData.rate_limit_window} seconds per IP
                           </p>
                         </div>
+                        <div className="col-span-2">
+                          <label className="label">Requests per ASN (0 = off)</label>
+                          <input
+                            type="number"
+                            className="input"
+                            min="0"
+                            value={formData.asn_rate_limit_requests}
+                            onChange={(e) => setFormData({ ...formData, asn_rate_limit_requests: Number.parseInt(e.target.value) || 0 })}
+                          />
+                          <p className="text-xs text-gray-500 mt-1">
+                            Shared by all IPs of one network (e.g. a hosting provider) within the same window. Requires the GeoLite2-ASN database.
+                          </p>
+                        </div>
                       </div>
                     )}
                   </div>
@@ -1306,7 +1402,7 @@ const VHosts = () => {
                     {formData.region_filtering_enabled && (
                       <div className="space-y-3">
                         <div>
-                          <label className="label">Whitelist Countries (ISO codes, e.g., US,GB,ID)</label>
+                          <label className="label">Whitelist Regions (country or subdivision codes, e.g., US,GB,CA-QC)</label>
                           <input
                             type="text"
                             className="input"
@@ -1322,7 +1418,7 @@ const VHosts = () => {
                           </p>
                         </div>
                         <div>
-                          <label className="label">Blacklist Countries (ISO codes, e.g., CN,RU)</label>
+                          <label className="label">Blacklist Regions (country or subdivision codes, e.g., CN,RU,US-TX)</label>
                           <input
                             type="text"
                             className="input"
@@ -1337,12 +1433,27 @@ const VHosts = () => {
                             These countries will be blocked. Only applies if whitelist is empty.
                           </p>
                         </div>
+                        <div>
+                          <label className="label">When Location Is Unknown</label>
+                          <select
+                            className="input"
+                            value={formData.geoip_fail_policy || 'open'}
+                            onChange={(e) => setFormData({ ...formData, geoip_fail_policy: e.target.value })}
+                          >
+                            <option value="open">Allow (fail open)</option>
+                            <option value="closed">Block (fail closed)</option>
+                          </select>
+                          <p className="text-xs text-gray-500 mt-1">
+                            Applies when the GeoIP database is unavailable or has no entry for the visitor's IP.
+                          </p>
+                        </div>
                         <div className="bg-blue-50 border border-blue-200 rounded p-3 text-xs">
                           <strong>Region Filtering Logic:</strong>
                           <ul className="list-disc list-inside mt-1 space-y-1">
                             <li>If whitelist is set: ONLY whitelist countries are allowed</li>
                             <li>If whitelist is empty: All countries except blacklisted are allowed</li>
-                            <li>Uses IP-based geolocation (may not be 100% accurate)</li>
+                            <li>Subdivision codes (ISO 3166-2, e.g. US-CA) need the GeoLite2-City database</li>
+                            <li>Uses the local MaxMind GeoIP database (may not be 100% accurate)</li>
                           </ul>
                         </div>
                       </div>
@@ -39,12 +39,116 @@ export const getDashboardStats = (params = {}) => {
   return api.get('/dashboard/stats', { params })
 }
 
-export const getTrafficLogs = (limit = 100, offset = 0) =>
-  api.get('/dashboard/traffic', { params: { limit, offset } })
+export const getTrafficLogs = (limit = 100, q = '') =>
+  api.get('/dashboard/traffic', { params: { limit, q: q || undefined } })
+
+// Traffic log search: { q, start, end, range, sort, order, cursor, limit }
+export const searchLogs = (params = {}) => api.get('/logs/search', { params })
+export const getRequest = (id) => api.get(`/logs/requests/${encodeURIComponent(id)}`)
+
+// Live log streams (server-sent events). EventSource cannot send the token,
+// so the stream is read with fetch; onEvent(event, data) is called for each
+// event until the signal aborts it or the server closes the stream.
+export const streamEvents = async (path, params, onEvent, signal) => {
+  const query = new URLSearchParams(
+    Object.entries(params).filter(([, value]) => value !== undefined && value !== '')
+  )
+  const response = await fetch(`/api/v1${path}?${query}`, {
+    headers: { Authorization: `Bearer ${localStorage.getItem('token')}` },
+    signal,
+  })
+  if (!response.ok) {
+    throw new Error(`Stream failed with HTTP ${response.status}`)
+  }
+
+  const reader = response.body.pipeThrough(new TextDecoderStream()).getReader()
+  let buffer = ''
+  for (;;) {
+    const { value, done } = await reader.read()
+    if (done) return
+    buffer += value
+    let end
+    while ((end = buffer.indexOf('\n\n')) !== -1) {
+      const frame = buffer.slice(0, end)
+      buffer = buffer.slice(end + 2)
+      let event = 'message'
+      const data = []
+      for (const line of frame.split('\n')) {
+        if (line.startsWith('event: ')) event = line.slice(7)
+        else if (line.startsWith('data: ')) data.push(line.slice(6))
+      }
+      if (data.length > 0) onEvent(event, data.join('\n'))
+    }
+  }
+}
+export const exportLogs = (params = {}) => api.get('/logs/export', { params, responseType: 'blob' })
+export const getExportJobs = () => api.get('/logs/exports')
+export const getExportJob = (id) => api.get(`/logs/exports/${id}`)
+export const createExportJob = (data) => api.post('/logs/exports', data)
+export const downloadExport = (id) => api.get(`/logs/exports/${id}/download`, { responseType: 'blob' })
+export const deleteExportJob = (id) => api.delete(`/logs/exports/${id}`)
+
+// Forensic request captures: { host, client_ip, request_id, reason, attack_type, start, end, range, limit, offset }
+export const getCaptures = (params = {}) => api.get('/captures', { params })
+export const getCapture = (id) => api.get(`/captures/${id}`)
+export const replayCapture = (id, backend) => api.post(`/captures/${id}/replay`, { backend })
 
 export const getAttacksByCountry = (params = {}) =>
   api.get('/dashboard/attacks-by-country', { params })
 
+// Per-vhost analytics: { start, end, range, q, limit, granularity }
+export const getVHostTop = (domain, dimension, params = {}) =>
+  api.get(`/analytics/vhosts/${encodeURIComponent(domain)}/top/${dimension}`, { params })
+export const getVHostLatency = (domain, params = {}) =>
+  api.get(`/analytics/vhosts/${encodeURIComponent(domain)}/latency`, { params })
+export const getVHostBandwidth = (domain, params = {}) =>
+  api.get(`/analytics/vhosts/${encodeURIComponent(domain)}/bandwidth`, { params })
+
+// Temporary Ban (jail) APIs
+export const getBans = () => api.get('/bans')
+export const getBan = (ip) => api.get(`/bans/${encodeURIComponent(ip)}`)
+export const createBan = (data) => api.post('/bans', data)
+export const extendBan = (ip, seconds) => api.put(`/bans/${encodeURIComponent(ip)}/extend`, { seconds })
+export const liftBan = (ip) => api.delete(`/bans/${encodeURIComponent(ip)}`)
+
+// Attack mode APIs
+export const getAttackModes = () => api.get('/attack-mode')
+export const getAttackModeEvents = (params = {}) => api.get('/attack-mode/events', { params })
+export const setAttackMode = (domain, mode) => api.put(`/attack-mode/vhosts/${encodeURIComponent(domain)}`, { mode })
+
+// Cluster
+export const getClusterNodes = () => api.get('/cluster/nodes')
+export const invalidateClusterCaches = () => api.post('/cluster/invalidate-caches')
+
+// Log levels of the node serving the request
+export const getLogLevels = () => api.get('/logging/levels')
+export const setLogLevel = (component, level) => api.put('/logging/levels', { component, level })
+
+// Alerts
+export const getAlerts = (params = {}) => api.get('/alerts', { params })
+export const getAlertRules = () => api.get('/alerts/rules')
+export const createAlertRule = (data) => api.post('/alerts/rules', data)
+export const updateAlertRule = (id, data) => api.put(`/alerts/rules/${id}`, data)
+export const toggleAlertRule = (id) => api.patch(`/alerts/rules/${id}/toggle`)
+export const deleteAlertRule = (id) => api.delete(`/alerts/rules/${id}`)
+export const getAlertChannels = () => api.get('/alerts/channels')
+export const createAlertChannel = (data) => api.post('/alerts/channels', data)
+export const updateAlertChannel = (id, data) => api.put(`/alerts/channels/${id}`, data)
+export const deleteAlertChannel = (id) => api.delete(`/alerts/channels/${id}`)
+export const testAlertChannel = (id) => api.post(`/alerts/channels/${id}/test`)
+export const getAlertSilences = (all = false) => api.get('/alerts/silences', { params: { all } })
+export const createAlertSilence = (data) => api.post('/alerts/silences', data)
+export const deleteAlertSilence = (id) => api.delete(`/alerts/silences/${id}`)
+
+// Scheduled reports
+export const getReportSchedules = () => api.get('/reports/schedules')
+export const createReportSchedule = (data) => api.post('/reports/schedules', data)
+export const updateReportSchedule = (id, data) => api.put(`/reports/schedules/${id}`, data)
+export const deleteReportSchedule = (id) => api.delete(`/reports/schedules/${id}`)
+export const sendReportSchedule = (id) => api.post(`/reports/schedules/${id}/send`)
+// { vhost, frequency, start, end, range, format }
+export const downloadReport = (params = {}) => api.get('/reports/download', { params, responseType: 'blob' })
+
 // VHost APIs
 export const getVHosts = () => api.get('/vhosts')
 export const getVHost = (id) => api.get(`/vhosts/${id}`)
@@ -63,6 +167,15 @@ export const addIPToGroup = (groupId, data) => api.post(`/ip-groups/${groupId}/a
 export const getGroupIPs = (groupId) => api.get(`/ip-groups/${groupId}/addresses`)
 export const updateIPAddress = (groupId, ipId, data) => api.put(`/ip-groups/${groupId}/addresses/${ipId}`, data)
 export const removeIPFromGroup = (groupId, ipId) => api.delete(`/ip-groups/${groupId}/addresses/${ipId}`)
+export const getGroupFeeds = (groupId) => api.get(`/ip-groups/${groupId}/feeds`)
+export const createGroupFeed = (groupId, data) => api.post(`/ip-groups/${groupId}/feeds`, data)
+export const updateGroupFeed = (groupId, feedId, data) => api.put(`/ip-groups/${groupId}/feeds/${feedId}`, data)
+export const deleteGroupFeed = (groupId, feedId) => api.delete(`/ip-groups/${groupId}/feeds/${feedId}`)
+export const syncGroupFeed = (groupId, feedId) => api.post(`/ip-groups/${groupId}/feeds/${feedId}/sync`)
+export const importGroupIPs = (groupId, body, params = {}) =>
+  api.post(`/ip-groups/${groupId}/import`, body, { params, headers: { 'Content-Type': 'text/plain' } })
+export const exportGroupIPs = (groupId, format = 'csv') =>
+  api.get(`/ip-groups/${groupId}/export`, { params: { format }, responseType: 'blob' })
 
 // Settings APIs (public endpoint for login page)
 export const getAppSettings = () => api.get('/settings/app')
@@ -0,0 +1,368 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// AlertHandler handles alert rules, channels, silences and history
+type AlertHandler struct {
+	alerts *services.AlertService
+}
+
+// NewAlertHandler creates a new alert handler
+func NewAlertHandler(alerts *services.AlertService) *AlertHandler {
+	return &AlertHandler{alerts: alerts}
+}
+
+// alertRuleInput is the body of rule create and update requests
+type alertRuleInput struct {
+	Name           string   `json:"name" binding:"required"`
+	Type           string   `json:"type" binding:"required"`
+	VHost          string   `json:"vhost"`
+	AttackType     string   `json:"attack_type"`
+	Threshold      float64  `json:"threshold"`
+	WindowSeconds  int      `json:"window_seconds"`
+	MinRequests    int      `json:"min_requests"`
+	Severity       string   `json:"severity"`
+	ChannelIDs     []string `json:"channel_ids"`
+	RepeatInterval *int     `json:"repeat_interval_seconds"`
+	NotifyResolved *bool    `json:"notify_resolved"`
+	Enabled        *bool    `json:"enabled"`
+}
+
+func (in alertRuleInput) rule() *services.AlertRule {
+	rule := &services.AlertRule{
+		Name:           in.Name,
+		Type:           in.Type,
+		VHost:          in.VHost,
+		AttackType:     in.AttackType,
+		Threshold:      in.Threshold,
+		WindowSeconds:  in.WindowSeconds,
+		MinRequests:    in.MinRequests,
+		Severity:       in.Severity,
+		ChannelIDs:     pq.StringArray(in.ChannelIDs),
+		RepeatInterval: 3600,
+		NotifyResolved: true,
+		Enabled:        true,
+	}
+	if in.RepeatInterval != nil {
+		rule.RepeatInterval = *in.RepeatInterval
+	}
+	if in.NotifyResolved != nil {
+		rule.NotifyResolved = *in.NotifyResolved
+	}
+	if in.Enabled != nil {
+		rule.Enabled = *in.Enabled
+	}
+	return rule
+}
+
+// alertChannelInput is the body of channel create and update requests. On
+// update a missing secret keeps the stored one.
+type alertChannelInput struct {
+	Name    string  `json:"name" binding:"required"`
+	Type    string  `json:"type" binding:"required"`
+	Target  string  `json:"target" binding:"required"`
+	Secret  *string `json:"secret"`
+	Enabled *bool   `json:"enabled"`
+}
+
+func (in alertChannelInput) channel() *services.AlertChannel {
+	ch := &services.AlertChannel{Name: in.Name, Type: in.Type, Target: in.Target, Enabled: true}
+	if in.Secret != nil {
+		ch.Secret = *in.Secret
+	}
+	if in.Enabled != nil {
+		ch.Enabled = *in.Enabled
+	}
+	return ch
+}
+
+// ListAlerts returns alert history, filtered by status and rule_id
+func (h *AlertHandler) ListAlerts(c *gin.Context) {
+	status := c.Query("status")
+	if status != "" && status != services.AlertFiring && status != services.AlertResolved {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be firing or resolved"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	alerts, err := h.alerts.ListAlerts(status, c.Query("rule_id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch alerts"})
+		return
+	}
+	c.JSON(http.StatusOK, alerts)
+}
+
+// ListRules returns all alert rules
+func (h *AlertHandler) ListRules(c *gin.Context) {
+	rules, err := h.alerts.ListRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch alert rules"})
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+// GetRule returns one alert rule
+func (h *AlertHandler) GetRule(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	rule, err := h.alerts.GetRule(id)
+	if err != nil {
+		respondAlertError(c, err, "Failed to fetch alert rule")
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// CreateRule creates an alert rule
+func (h *AlertHandler) CreateRule(c *gin.Context) {
+	var input alertRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule := input.rule()
+	if err := h.alerts.CreateRule(rule); err != nil {
+		respondAlertError(c, err, "Failed to create alert rule")
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+// UpdateRule replaces an alert rule
+func (h *AlertHandler) UpdateRule(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	var input alertRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule := input.rule()
+	if err := h.alerts.UpdateRule(id, rule); err != nil {
+		respondAlertError(c, err, "Failed to update alert rule")
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// ToggleRule enables or disables an alert rule
+func (h *AlertHandler) ToggleRule(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	rule, err := h.alerts.ToggleRule(id)
+	if err != nil {
+		respondAlertError(c, err, "Failed to toggle alert rule")
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteRule deletes an alert rule and its history
+func (h *AlertHandler) DeleteRule(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	if err := h.alerts.DeleteRule(id); err != nil {
+		respondAlertError(c, err, "Failed to delete alert rule")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted"})
+}
+
+// ListChannels returns all notification channels
+func (h *AlertHandler) ListChannels(c *gin.Context) {
+	channels, err := h.alerts.ListChannels()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch alert channels"})
+		return
+	}
+	c.JSON(http.StatusOK, channels)
+}
+
+// CreateChannel creates a notification channel
+func (h *AlertHandler) CreateChannel(c *gin.Context) {
+	var input alertChannelInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ch := input.channel()
+	if err := h.alerts.CreateChannel(ch); err != nil {
+		respondAlertError(c, err, "Failed to create alert channel")
+		return
+	}
+	c.JSON(http.StatusCreated, ch)
+}
+
+// UpdateChannel replaces a notification channel
+func (h *AlertHandler) UpdateChannel(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	var input alertChannelInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ch := input.channel()
+	if err := h.alerts.UpdateChannel(id, ch, input.Secret); err != nil {
+		respondAlertError(c, err, "Failed to update alert channel")
+		return
+	}
+	c.JSON(http.StatusOK, ch)
+}
+
+// DeleteChannel deletes a notification channel
+func (h *AlertHandler) DeleteChannel(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	if err := h.alerts.DeleteChannel(id); err != nil {
+		respondAlertError(c, err, "Failed to delete alert channel")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Alert channel deleted"})
+}
+
+// TestChannel sends a test notification through a channel
+func (h *AlertHandler) TestChannel(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	if err := h.alerts.TestChannel(c.Request.Context(), id); err != nil {
+		if errors.Is(err, services.ErrAlertChannelNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Test notification failed: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Test notification sent"})
+}
+
+// ListSilences returns silences; all=true includes expired ones
+func (h *AlertHandler) ListSilences(c *gin.Context) {
+	silences, err := h.alerts.ListSilences(c.Query("all") != "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch alert silences"})
+		return
+	}
+	c.JSON(http.StatusOK, silences)
+}
+
+// CreateSilence mutes notifications for a rule and/or subject. The window is
+// given as starts_at/ends_at (RFC3339) or as a duration from now.
+func (h *AlertHandler) CreateSilence(c *gin.Context) {
+	var input struct {
+		RuleID   *string    `json:"rule_id"`
+		Subject  string     `json:"subject"`
+		StartsAt *time.Time `json:"starts_at"`
+		EndsAt   *time.Time `json:"ends_at"`
+		Duration string     `json:"duration"`
+		Comment  string     `json:"comment"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.RuleID != nil && *input.RuleID == "" {
+		input.RuleID = nil
+	}
+	if input.RuleID != nil {
+		if _, err := uuid.Parse(*input.RuleID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+			return
+		}
+	}
+
+	silence := &services.AlertSilence{RuleID: input.RuleID, Subject: input.Subject, Comment: input.Comment, StartsAt: time.Now()}
+	if input.StartsAt != nil {
+		silence.StartsAt = *input.StartsAt
+	}
+	switch {
+	case input.EndsAt != nil:
+		silence.EndsAt = *input.EndsAt
+	case input.Duration != "":
+		duration, err := time.ParseDuration(input.Duration)
+		if err != nil || duration <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+			return
+		}
+		silence.EndsAt = silence.StartsAt.Add(duration)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at or duration is required"})
+		return
+	}
+	if adminID := c.GetString("admin_id"); adminID != "" {
+		silence.CreatedBy = &adminID
+	}
+
+	if err := h.alerts.CreateSilence(silence); err != nil {
+		respondAlertError(c, err, "Failed to create alert silence")
+		return
+	}
+	c.JSON(http.StatusCreated, silence)
+}
+
+// DeleteSilence ends a silence
+func (h *AlertHandler) DeleteSilence(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	if err := h.alerts.DeleteSilence(id); err != nil {
+		respondAlertError(c, err, "Failed to delete alert silence")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Alert silence deleted"})
+}
+
+func alertID(c *gin.Context) (string, bool) {
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return "", false
+	}
+	return id, true
+}
+
+// respondAlertError maps not-found errors to 404, validation errors to 400
+// and anything else to a 500 with message
+func respondAlertError(c *gin.Context, err error, message string) {
+	var invalid *services.AlertValidationError
+	switch {
+	case errors.Is(err, services.ErrAlertRuleNotFound),
+		errors.Is(err, services.ErrAlertChannelNotFound),
+		errors.Is(err, services.ErrAlertSilenceNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.As(err, &invalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
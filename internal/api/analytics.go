@@ -0,0 +1,121 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// AnalyticsHandler answers "what is hitting my site" for one vhost: top
+// lists, response time percentiles and bandwidth over time. Every endpoint
+// reads the raw traffic logs of the vhost over the start/end or range window
+// (default 24h), narrowed by an optional q search.
+type AnalyticsHandler struct {
+	db *sqlx.DB
+}
+
+// NewAnalyticsHandler creates a new analytics handler
+func NewAnalyticsHandler(db *sqlx.DB) *AnalyticsHandler {
+	return &AnalyticsHandler{db: db}
+}
+
+// analyticsFilter builds the filter shared by the analytics endpoints: the
+// vhost, the time window and the q search
+func analyticsFilter(c *gin.Context) (*services.LogFilter, time.Time, time.Time, bool) {
+	from, to, ok := timeWindow(c, 24*time.Hour)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidWindow})
+		return nil, from, to, false
+	}
+	filter, err := services.ParseLogQuery(c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, from, to, false
+	}
+	filter.Where("host = ?", c.Param("domain")).Between(from, to)
+	return filter, from, to, true
+}
+
+// analyticsSeries resolves the filter and the granularity of the time series
+// endpoints
+func analyticsSeries(c *gin.Context) (*services.LogFilter, string, bool) {
+	filter, from, to, ok := analyticsFilter(c)
+	if !ok {
+		return nil, "", false
+	}
+	granularity, err := services.ResolveGranularity(c.Query("granularity"), from, to)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+	return filter, granularity, true
+}
+
+// GetTop returns the values of a dimension (ip, path, user_agent, referer,
+// status, country or asn) with the most requests, up to limit (default 10)
+func (h *AnalyticsHandler) GetTop(c *gin.Context) {
+	filter, from, to, ok := analyticsFilter(c)
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	entries, err := services.TopTraffic(c.Request.Context(), h.db, filter, c.Param("dimension"), limit)
+	if err != nil {
+		respondAnalyticsError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"host":      c.Param("domain"),
+		"dimension": c.Param("dimension"),
+		"from":      from,
+		"to":        to,
+		"entries":   entries,
+	})
+}
+
+// GetLatency returns the p50, p95 and p99 response times, overall and per
+// granularity (minute, hour or day; picked from the window by default)
+func (h *AnalyticsHandler) GetLatency(c *gin.Context) {
+	filter, granularity, ok := analyticsSeries(c)
+	if !ok {
+		return
+	}
+
+	latency, err := services.TrafficLatencyPercentiles(c.Request.Context(), h.db, filter, granularity)
+	if err != nil {
+		respondAnalyticsError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, latency)
+}
+
+// GetBandwidth returns requests and bytes sent, overall and per granularity
+func (h *AnalyticsHandler) GetBandwidth(c *gin.Context) {
+	filter, granularity, ok := analyticsSeries(c)
+	if !ok {
+		return
+	}
+
+	bandwidth, err := services.TrafficBandwidthSeries(c.Request.Context(), h.db, filter, granularity)
+	if err != nil {
+		respondAnalyticsError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, bandwidth)
+}
+
+func respondAnalyticsError(c *gin.Context, err error) {
+	var queryErr *services.LogQueryError
+	if errors.As(err, &queryErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": queryErr.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query traffic analytics"})
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/aleh/docode-waf/internal/models"
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// AttackModeHandler handles adaptive "under attack" mode requests
+type AttackModeHandler struct {
+	attackMode *services.AttackModeService
+	cluster    *services.ClusterService
+}
+
+// NewAttackModeHandler creates a new attack mode handler
+func NewAttackModeHandler(attackMode *services.AttackModeService, cluster *services.ClusterService) *AttackModeHandler {
+	return &AttackModeHandler{attackMode: attackMode, cluster: cluster}
+}
+
+// ListAttackModes returns the attack mode state and baseline of every vhost
+func (h *AttackModeHandler) ListAttackModes(c *gin.Context) {
+	states, err := h.attackMode.ListStates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attack mode states"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"auto_enabled": h.attackMode.Config().Enabled,
+		"vhosts":       states,
+	})
+}
+
+// GetAttackMode returns the attack mode state of a single vhost
+func (h *AttackModeHandler) GetAttackMode(c *gin.Context) {
+	state, err := h.attackMode.GetState(c.Param("domain"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+// SetAttackMode forces attack mode on or off for a vhost, or returns it to
+// automatic detection
+func (h *AttackModeHandler) SetAttackMode(c *gin.Context) {
+	var req struct {
+		Mode string `json:"mode" binding:"required,oneof=auto on off"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	changedBy := ""
+	if admin, ok := c.Get("admin"); ok {
+		if a, ok := admin.(*models.Admin); ok {
+			changedBy = a.Username
+		}
+	}
+
+	state, err := h.attackMode.SetOverride(c.Param("domain"), req.Mode, changedBy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.cluster.Publish(services.ClusterEventAttackMode, state.Domain)
+
+	c.JSON(http.StatusOK, state)
+}
+
+// ListAttackModeEvents returns recorded transitions, newest first
+func (h *AttackModeHandler) ListAttackModeEvents(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	events, err := h.attackMode.ListEvents(c.Query("domain"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attack mode events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, events)
+}
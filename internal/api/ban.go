@@ -0,0 +1,120 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/constants"
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// BanHandler handles temporary ban (jail) requests
+type BanHandler struct {
+	jail    *services.JailService
+	cluster *services.ClusterService
+}
+
+// NewBanHandler creates a new ban handler
+func NewBanHandler(jail *services.JailService, cluster *services.ClusterService) *BanHandler {
+	return &BanHandler{jail: jail, cluster: cluster}
+}
+
+// ListBans returns all active bans
+func (h *BanHandler) ListBans(c *gin.Context) {
+	bans, err := h.jail.ListBans()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch bans"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": h.jail.Enabled(),
+		"bans":    bans,
+		"total":   len(bans),
+	})
+}
+
+// GetBan returns the active ban for an IP
+func (h *BanHandler) GetBan(c *gin.Context) {
+	ban, err := h.jail.GetBan(c.Param("ip"))
+	if errors.Is(err, services.ErrBanNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": constants.ErrBanNotFound})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, ban)
+}
+
+// CreateBan bans an IP manually at its next escalation level
+func (h *BanHandler) CreateBan(c *gin.Context) {
+	var req struct {
+		IP     string `json:"ip" binding:"required"`
+		Reason string `json:"reason"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if net.ParseIP(req.IP) == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid IP address"})
+		return
+	}
+
+	ban, err := h.jail.BanIP(req.IP, req.Reason)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.cluster.Publish(services.ClusterEventBan, req.IP)
+	c.JSON(http.StatusCreated, ban)
+}
+
+// ExtendBan pushes the expiry of an active ban out by the given number of seconds
+func (h *BanHandler) ExtendBan(c *gin.Context) {
+	var req struct {
+		Seconds int `json:"seconds" binding:"required,min=1"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ban, err := h.jail.ExtendBan(c.Param("ip"), time.Duration(req.Seconds)*time.Second)
+	if errors.Is(err, services.ErrBanNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": constants.ErrBanNotFound})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.cluster.Publish(services.ClusterEventBan, c.Param("ip"))
+	c.JSON(http.StatusOK, ban)
+}
+
+// LiftBan removes an active ban
+func (h *BanHandler) LiftBan(c *gin.Context) {
+	err := h.jail.LiftBan(c.Param("ip"))
+	if errors.Is(err, services.ErrBanNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": constants.ErrBanNotFound})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.cluster.Publish(services.ClusterEventBan, c.Param("ip"))
+	c.JSON(http.StatusOK, gin.H{"message": "Ban lifted successfully"})
+}
@@ -3,8 +3,10 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/aleh/docode-waf/internal/constants"
+	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
@@ -12,12 +14,13 @@ import (
 
 // BlockingRuleHandler handles blocking rule requests
 type BlockingRuleHandler struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	cluster *services.ClusterService
 }
 
 // NewBlockingRuleHandler creates a new blocking rule handler
-func NewBlockingRuleHandler(db *sqlx.DB) *BlockingRuleHandler {
-	return &BlockingRuleHandler{db: db}
+func NewBlockingRuleHandler(db *sqlx.DB, cluster *services.ClusterService) *BlockingRuleHandler {
+	return &BlockingRuleHandler{db: db, cluster: cluster}
 }
 
 // ListBlockingRules returns all blocking rules
@@ -88,7 +91,7 @@ func (h *BlockingRuleHandler) GetBlockingRule(c *gin.Context) {
 func (h *BlockingRuleHandler) CreateBlockingRule(c *gin.Context) {
 	var input struct {
 		Name     string `json:"name" binding:"required"`
-		Type     string `json:"type" binding:"required,oneof=ip region url user_agent"`
+		Type     string `json:"type" binding:"required,oneof=ip region asn url user_agent"`
 		Pattern  string `json:"pattern" binding:"required"`
 		Action   string `json:"action" binding:"required,oneof=block challenge allow"`
 		Enabled  bool   `json:"enabled"`
@@ -102,6 +105,13 @@ func (h *BlockingRuleHandler) CreateBlockingRule(c *gin.Context) {
 		return
 	}
 
+	if input.Type == "asn" && !validASNPattern(input.Pattern) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": constants.ErrInvalidASNPattern,
+		})
+		return
+	}
+
 	id := uuid.New().String()
 	query := `
 		INSERT INTO blocking_rules (id, name, type, pattern, action, enabled, priority, created_at, updated_at)
@@ -129,6 +139,7 @@ func (h *BlockingRuleHandler) CreateBlockingRule(c *gin.Context) {
 		return
 	}
 
+	h.cluster.Publish(services.ClusterEventRule, id)
 	c.JSON(http.StatusCreated, rule)
 }
 
@@ -138,7 +149,7 @@ func (h *BlockingRuleHandler) UpdateBlockingRule(c *gin.Context) {
 
 	var input struct {
 		Name     string `json:"name"`
-		Type     string `json:"type" binding:"omitempty,oneof=ip region url user_agent"`
+		Type     string `json:"type" binding:"omitempty,oneof=ip region asn url user_agent"`
 		Pattern  string `json:"pattern"`
 		Action   string `json:"action" binding:"omitempty,oneof=block challenge allow"`
 		Enabled  *bool  `json:"enabled"`
@@ -152,6 +163,13 @@ func (h *BlockingRuleHandler) UpdateBlockingRule(c *gin.Context) {
 		return
 	}
 
+	if input.Type == "asn" && input.Pattern != "" && !validASNPattern(input.Pattern) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": constants.ErrInvalidASNPattern,
+		})
+		return
+	}
+
 	// Build dynamic update query
 	query := `UPDATE blocking_rules SET updated_at = NOW()`
 	args := []interface{}{}
@@ -207,6 +225,8 @@ func (h *BlockingRuleHandler) UpdateBlockingRule(c *gin.Context) {
 		return
 	}
 
+	h.cluster.Publish(services.ClusterEventRule, id)
+
 	// Return updated rule
 	h.GetBlockingRule(c)
 }
@@ -232,6 +252,7 @@ func (h *BlockingRuleHandler) DeleteBlockingRule(c *gin.Context) {
 		return
 	}
 
+	h.cluster.Publish(services.ClusterEventRule, id)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Blocking rule deleted successfully",
 	})
@@ -269,8 +290,20 @@ func (h *BlockingRuleHandler) ToggleBlockingRule(c *gin.Context) {
 		return
 	}
 
+	h.cluster.Publish(services.ClusterEventRule, id)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Blocking rule toggled successfully",
 		"enabled": input.Enabled,
 	})
 }
+
+// validASNPattern checks an asn rule pattern: a comma-separated list of AS
+// numbers, each written as "13335" or "AS13335"
+func validASNPattern(pattern string) bool {
+	for _, part := range strings.Split(pattern, ",") {
+		if _, ok := services.ParseASN(part); !ok {
+			return false
+		}
+	}
+	return true
+}
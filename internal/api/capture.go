@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// CaptureHandler serves forensic request captures and replays them
+type CaptureHandler struct {
+	captures *services.CaptureService
+}
+
+// NewCaptureHandler creates a new capture handler
+func NewCaptureHandler(captures *services.CaptureService) *CaptureHandler {
+	return &CaptureHandler{captures: captures}
+}
+
+// ListCaptures returns captures, newest first, filtered by host, client_ip,
+// request_id, reason, attack_type and a start/end or range window
+func (h *CaptureHandler) ListCaptures(c *gin.Context) {
+	from, to, ok := timeWindow(c, 0)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time window"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	captures, total, err := h.captures.List(c.Request.Context(), services.CaptureFilter{
+		Host:       c.Query("host"),
+		ClientIP:   c.Query("client_ip"),
+		RequestID:  c.Query("request_id"),
+		Reason:     c.Query("reason"),
+		AttackType: c.Query("attack_type"),
+		From:       from,
+		To:         to,
+		Limit:      limit,
+		Offset:     offset,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list captures"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"captures": captures, "total": total})
+}
+
+// GetCapture returns one capture with its headers and body
+func (h *CaptureHandler) GetCapture(c *gin.Context) {
+	capture, err := h.captures.Get(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, services.ErrCaptureNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Capture not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load capture"})
+		return
+	}
+	c.JSON(http.StatusOK, capture)
+}
+
+// ReplayCapture sends a capture to one of its vhost's backends and returns
+// the backend's answer. The backend defaults to the vhost's primary backend.
+func (h *CaptureHandler) ReplayCapture(c *gin.Context) {
+	var input struct {
+		Backend string `json:"backend"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	result, err := h.captures.Replay(c.Request.Context(), c.Param("id"), input.Backend)
+	switch {
+	case errors.Is(err, services.ErrCaptureNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Capture not found"})
+	case errors.Is(err, services.ErrReplayBackend):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// GetCaptureStats returns the capture writer counters
+func (h *CaptureHandler) GetCaptureStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.captures.Stats())
+}
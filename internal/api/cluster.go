@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ClusterHandler handles cluster status requests
+type ClusterHandler struct {
+	cluster *services.ClusterService
+}
+
+// NewClusterHandler creates a new cluster handler
+func NewClusterHandler(cluster *services.ClusterService) *ClusterHandler {
+	return &ClusterHandler{cluster: cluster}
+}
+
+// ListNodes returns every WAF node with its last heartbeat and the config
+// version it has applied. Nodes behind the cluster version are not in sync.
+func (h *ClusterHandler) ListNodes(c *gin.Context) {
+	nodes, version, err := h.cluster.Nodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cluster nodes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":        h.cluster.Enabled(),
+		"node_id":        h.cluster.NodeID(),
+		"config_version": version,
+		"nodes":          nodes,
+	})
+}
+
+// InvalidateCaches drops in-memory caches on every node
+func (h *ClusterHandler) InvalidateCaches(c *gin.Context) {
+	h.cluster.Broadcast(services.ClusterEventCache, "")
+	c.JSON(http.StatusOK, gin.H{"message": "Cache invalidation published"})
+}
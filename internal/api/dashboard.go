@@ -2,18 +2,20 @@ package api
 
 import (
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/aleh/docode-waf/internal/constants"
+	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
 
 const (
-	timeStartSuffix     = " 00:00:00' AND timestamp <= '"
-	timeEndSuffix       = " 23:59:59'"
-	interval24Hours     = "24 hours"
-	intervalQueryPrefix = " AND timestamp >= NOW() - INTERVAL '"
-	intervalWherePrefix = " WHERE timestamp >= NOW() - INTERVAL '"
+	rollupMinuteTable = "traffic_rollups_minute"
+	rollupHourTable   = "traffic_rollups_hour"
+	dateLayout        = "2006-01-02"
+	errInvalidWindow  = "Invalid date range, expected start and end as YYYY-MM-DD or RFC 3339 times"
 )
 
 // DashboardHandler handles dashboard requests
@@ -26,75 +28,46 @@ func NewDashboardHandler(db *sqlx.DB) *DashboardHandler {
 	return &DashboardHandler{db: db}
 }
 
-// GetStats returns dashboard statistics
+// GetStats returns dashboard statistics. Counters come from the traffic
+// rollups; only the recent attacks list reads the raw logs.
 func (h *DashboardHandler) GetStats(c *gin.Context) {
-	var totalRequests, blockedRequests, activeVHosts, attackCount, uniqueIPs int
-
-	// Parse date range from query params
-	startDate := c.Query("start")
-	endDate := c.Query("end")
-	rangeParam := c.Query("range")
-
-	// Build WHERE clause for date filtering
-	whereClause := ""
-	andClause := ""
-
-	if startDate != "" && endDate != "" {
-		// Custom date range
-		whereClause = " WHERE timestamp >= '" + startDate + timeStartSuffix + endDate + timeEndSuffix
-		andClause = " AND timestamp >= '" + startDate + timeStartSuffix + endDate + timeEndSuffix
-	} else if rangeParam != "" {
-		// Predefined ranges
-		var interval string
-		switch rangeParam {
-		case "1h":
-			interval = "1 hour"
-		case "24h":
-			interval = interval24Hours
-		case "7d":
-			interval = "7 days"
-		case "30d":
-			interval = "30 days"
-		default:
-			interval = interval24Hours
-		}
-		whereClause = intervalWherePrefix + interval + "'"
-		andClause = intervalQueryPrefix + interval + "'"
-	} else {
-		// Default to last 24 hours if no range specified
-		whereClause = intervalWherePrefix + interval24Hours + "'"
-		andClause = intervalQueryPrefix + interval24Hours + "'"
-	}
+	var totalRequests, blockedRequests, activeVHosts, attackCount, uniqueIPs int64
 
-	// Get total requests
-	h.db.Get(&totalRequests, constants.SQLCountTrafficLogs+whereClause)
+	from, to, table, ok := statsRange(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidWindow})
+		return
+	}
 
-	// Get blocked requests
-	h.db.Get(&blockedRequests, constants.SQLCountTrafficLogs+whereClause+" AND blocked = true")
+	// Get total, blocked and attack counts
+	row := h.db.QueryRowx(`
+		SELECT COALESCE(SUM(requests), 0), COALESCE(SUM(blocked), 0), COALESCE(SUM(attacks), 0)
+		FROM `+table+`
+		WHERE bucket >= $1 AND bucket < $2
+	`, from, to)
+	row.Scan(&totalRequests, &blockedRequests, &attackCount)
 
 	// Get active vhosts
 	h.db.Get(&activeVHosts, constants.SQLCountVHosts)
 
-	// Get attack count from traffic_logs
-	h.db.Get(&attackCount, constants.SQLCountTrafficLogs+whereClause+" AND is_attack = true")
-
 	// Get unique IPs
-	h.db.Get(&uniqueIPs, constants.SQLCountDistinctIPs+whereClause)
+	h.db.Get(&uniqueIPs, `
+		SELECT COUNT(DISTINCT client_ip) FROM traffic_rollups_hour_ips
+		WHERE bucket >= date_trunc('hour', $1::timestamp) AND bucket < $2
+	`, from, to)
 
 	// Get top attack types with date filter
 	var topAttackTypes []map[string]interface{}
-	topAttackQuery := `
+	rows, _ := h.db.Queryx(`
 		SELECT 
 			attack_type as name,
-			COUNT(*) as value
-		FROM traffic_logs 
-		WHERE is_attack = true AND attack_type IS NOT NULL` +
-		andClause + `
+			SUM(attacks)::bigint as value
+		FROM `+table+`
+		WHERE attack_type <> '' AND bucket >= $1 AND bucket < $2
 		GROUP BY attack_type
 		ORDER BY value DESC
 		LIMIT 10
-	`
-	rows, _ := h.db.Queryx(topAttackQuery)
+	`, from, to)
 	if rows != nil {
 		defer rows.Close()
 		for rows.Next() {
@@ -105,49 +78,39 @@ func (h *DashboardHandler) GetStats(c *gin.Context) {
 	}
 
 	// Get recent attacks with date filter
-	var recentAttacks []map[string]interface{}
-	recentAttacksQuery := `
-		SELECT 
-			timestamp,
-			client_ip,
-			attack_type,
-			url,
-			blocked,
-			country_code,
-			host,
-			CASE 
-				WHEN blocked = true THEN 'high'
-				ELSE 'medium'
-			END as severity
-		FROM traffic_logs 
-		WHERE is_attack = true` +
-		andClause + `
-		ORDER BY timestamp DESC 
-		LIMIT 20
-	`
-	rows2, _ := h.db.Queryx(recentAttacksQuery)
-	if rows2 != nil {
-		defer rows2.Close()
-		for rows2.Next() {
-			attack := make(map[string]interface{})
-			rows2.MapScan(attack)
-			recentAttacks = append(recentAttacks, attack)
+	recentAttacks := []gin.H{}
+	filter := (&services.LogFilter{}).Where("is_attack = true").Between(from, to)
+	if recent, err := services.SearchTrafficLogs(c.Request.Context(), h.db, services.LogSearch{Filter: filter, Limit: 20}); err == nil {
+		for _, attack := range recent.Logs {
+			severity := "medium"
+			if attack.Blocked {
+				severity = "high"
+			}
+			recentAttacks = append(recentAttacks, gin.H{
+				"timestamp":    attack.Timestamp,
+				"client_ip":    attack.ClientIP,
+				"attack_type":  attack.AttackType,
+				"url":          attack.URL,
+				"blocked":      attack.Blocked,
+				"country_code": attack.CountryCode,
+				"host":         attack.Host,
+				"severity":     severity,
+			})
 		}
 	}
 
 	// Get traffic by hour with date filter
 	var requestsByHour []map[string]interface{}
-	timeRangeQuery := `
+	rows3, _ := h.db.Queryx(`
 		SELECT 
-			DATE_TRUNC('hour', timestamp) as hour,
-			COUNT(*) as count,
-			SUM(CASE WHEN blocked = true THEN 1 ELSE 0 END) as blocked
-		FROM traffic_logs` +
-		whereClause + `
-		GROUP BY DATE_TRUNC('hour', timestamp)
+			DATE_TRUNC('hour', bucket) as hour,
+			SUM(requests)::bigint as count,
+			SUM(blocked)::bigint as blocked
+		FROM `+table+`
+		WHERE bucket >= $1 AND bucket < $2
+		GROUP BY DATE_TRUNC('hour', bucket)
 		ORDER BY hour ASC
-	`
-	rows3, _ := h.db.Queryx(timeRangeQuery)
+	`, from, to)
 	if rows3 != nil {
 		defer rows3.Close()
 		for rows3.Next() {
@@ -172,84 +135,122 @@ func (h *DashboardHandler) GetStats(c *gin.Context) {
 	c.JSON(http.StatusOK, stats)
 }
 
-// GetTrafficLogs returns recent traffic logs
-func (h *DashboardHandler) GetTrafficLogs(c *gin.Context) {
-	var logs []map[string]interface{}
+// statsRange resolves the stats window (default 24h) and picks the rollup
+// table to read: per-minute buckets for windows up to a day, hourly ones
+// beyond that or for calendar dates, whose minutes may already be pruned
+func statsRange(c *gin.Context) (time.Time, time.Time, string, bool) {
+	from, to, ok := timeWindow(c, 24*time.Hour)
+	if !ok {
+		return from, to, "", false
+	}
+	if c.Query("start") == "" && to.Sub(from) <= 24*time.Hour {
+		return from, to, rollupMinuteTable, true
+	}
+	return from, to, rollupHourTable, true
+}
 
-	// Get limit and offset from query params
-	limit := c.DefaultQuery("limit", "100")
-	offset := c.DefaultQuery("offset", "0")
+// timeWindow resolves the start/end or range query params to a [from, to)
+// window. Without either it covers the last fallback, or is unbounded when
+// fallback is zero.
+func timeWindow(c *gin.Context, fallback time.Duration) (time.Time, time.Time, bool) {
+	return parseWindow(c.Query("start"), c.Query("end"), c.Query("range"), fallback)
+}
 
-	query := `
-		SELECT id, timestamp, client_ip, method, url, status_code, 
-		       response_time, user_agent, blocked, block_reason, country_code, is_attack, attack_type, host
-		FROM traffic_logs 
-		ORDER BY timestamp DESC 
-		LIMIT $1 OFFSET $2
-	`
+// parseWindow resolves start and end, given as YYYY-MM-DD (end inclusive) or
+// RFC 3339 times (end exclusive), or a range of 1h, 24h, 7d or 30d
+func parseWindow(start, end, rangeParam string, fallback time.Duration) (time.Time, time.Time, bool) {
+	now := time.Now()
 
-	rows, err := h.db.Queryx(query, limit, offset)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if start != "" && end != "" {
+		from, ok := parseWindowBound(start, false)
+		if !ok {
+			return time.Time{}, time.Time{}, false
+		}
+		to, ok := parseWindowBound(end, true)
+		if !ok || !to.After(from) {
+			return time.Time{}, time.Time{}, false
+		}
+		return from, to, true
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		log := make(map[string]interface{})
-		err := rows.MapScan(log)
-		if err != nil {
-			continue
+	window := fallback
+	switch rangeParam {
+	case "":
+	case "1h":
+		window = time.Hour
+	case "7d":
+		window = 7 * 24 * time.Hour
+	case "30d":
+		window = 30 * 24 * time.Hour
+	default:
+		window = 24 * time.Hour
+	}
+	if window == 0 {
+		return time.Time{}, time.Time{}, true
+	}
+	return now.Add(-window), now, true
+}
+
+// parseWindowBound parses a date, which as an end bound covers the whole day,
+// or an RFC 3339 time converted to local time like stored timestamps
+func parseWindowBound(value string, end bool) (time.Time, bool) {
+	if t, err := time.ParseInLocation(dateLayout, value, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
 		}
-		logs = append(logs, log)
+		return t, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.Local(), true
+}
+
+// GetTrafficLogs returns recent traffic logs matching the optional q search.
+// The cursor for the next page is returned in the X-Next-Cursor header.
+func (h *DashboardHandler) GetTrafficLogs(c *gin.Context) {
+	filter, err := services.ParseLogQuery(c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	c.JSON(http.StatusOK, logs)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	h.writeLogs(c, services.LogSearch{Filter: filter, Cursor: c.Query("cursor"), Limit: limit})
 }
 
 // GetAttackLogs returns recent attack logs
 func (h *DashboardHandler) GetAttackLogs(c *gin.Context) {
-	var logs []map[string]interface{}
-
-	query := `
-		SELECT id, timestamp, client_ip, method, url, status_code,
-		       attack_type, blocked, block_reason, user_agent, host
-		FROM traffic_logs 
-		WHERE is_attack = true
-		ORDER BY timestamp DESC 
-		LIMIT 100
-	`
+	filter := (&services.LogFilter{}).Where("is_attack = true")
+	h.writeLogs(c, services.LogSearch{Filter: filter, Limit: 100})
+}
 
-	rows, err := h.db.Queryx(query)
+// writeLogs responds with one page of a search as a plain list
+func (h *DashboardHandler) writeLogs(c *gin.Context, search services.LogSearch) {
+	result, err := services.SearchTrafficLogs(c.Request.Context(), h.db, search)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondSearchError(c, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		log := make(map[string]interface{})
-		err := rows.MapScan(log)
-		if err != nil {
-			continue
-		}
-		logs = append(logs, log)
+	if result.NextCursor != "" {
+		c.Header("X-Next-Cursor", result.NextCursor)
 	}
-
-	c.JSON(http.StatusOK, logs)
+	c.JSON(http.StatusOK, result.Logs)
 }
 
 // GetAttackStats returns attack statistics grouped by type
 func (h *DashboardHandler) GetAttackStats(c *gin.Context) {
 	var stats []map[string]interface{}
 
+	// Hourly rollups cover the whole retained history
 	query := `
 		SELECT 
 			attack_type,
-			COUNT(*) as count,
-			COUNT(CASE WHEN blocked = true THEN 1 END) as blocked_count
-		FROM traffic_logs 
-		WHERE is_attack = true AND attack_type IS NOT NULL
+			SUM(attacks)::bigint as count,
+			SUM(blocked)::bigint as blocked_count
+		FROM traffic_rollups_hour 
+		WHERE attack_type <> ''
 		GROUP BY attack_type
 		ORDER BY count DESC
 		LIMIT 10
@@ -276,72 +277,26 @@ func (h *DashboardHandler) GetAttackStats(c *gin.Context) {
 
 // GetRecentAttacks returns recent attacks with details
 func (h *DashboardHandler) GetRecentAttacks(c *gin.Context) {
-	var attacks []map[string]interface{}
-
-	query := `
-		SELECT 
-			timestamp,
-			client_ip,
-			attack_type,
-			url,
-			blocked,
-			user_agent,
-			host
-		FROM traffic_logs 
-		WHERE is_attack = true
-		ORDER BY timestamp DESC 
-		LIMIT 20
-	`
-
-	rows, err := h.db.Queryx(query)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		attack := make(map[string]interface{})
-		err := rows.MapScan(attack)
-		if err != nil {
-			continue
-		}
-		attacks = append(attacks, attack)
-	}
-
-	c.JSON(http.StatusOK, attacks)
+	filter := (&services.LogFilter{}).Where("is_attack = true")
+	h.writeLogs(c, services.LogSearch{Filter: filter, Limit: 20})
 }
 
-// GetAttacksByCountry returns attack statistics by country
+// GetAttacksByCountry returns attack statistics by country, optionally
+// narrowed by a q search
 func (h *DashboardHandler) GetAttacksByCountry(c *gin.Context) {
 	var stats []map[string]interface{}
 
-	// Parse date range from query params
-	startDate := c.Query("start")
-	endDate := c.Query("end")
-	rangeParam := c.Query("range")
-
-	// Build WHERE clause for date filtering
-	whereClause := "WHERE is_attack = true"
-
-	if startDate != "" && endDate != "" {
-		whereClause += " AND timestamp >= '" + startDate + " 00:00:00' AND timestamp <= '" + endDate + " 23:59:59'"
-	} else if rangeParam != "" {
-		var interval string
-		switch rangeParam {
-		case "1h":
-			interval = "1 hour"
-		case "24h":
-			interval = "24 hours"
-		case "7d":
-			interval = "7 days"
-		case "30d":
-			interval = "30 days"
-		default:
-			interval = "24 hours"
-		}
-		whereClause += " AND timestamp >= NOW() - INTERVAL '" + interval + "'"
+	from, to, ok := timeWindow(c, 0)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidWindow})
+		return
 	}
+	filter, err := services.ParseLogQuery(c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.Where("is_attack = true").Where("country_code IS NOT NULL").Between(from, to)
 
 	query := `
 		SELECT 
@@ -350,15 +305,13 @@ func (h *DashboardHandler) GetAttacksByCountry(c *gin.Context) {
 			COUNT(CASE WHEN blocked = true THEN 1 END) as blocked_attacks,
 			COUNT(DISTINCT client_ip) as unique_ips,
 			COUNT(DISTINCT attack_type) as attack_types
-		FROM traffic_logs 
-		` + whereClause + `
-		  AND country_code IS NOT NULL
+		FROM traffic_logs` + filter.SQL() + `
 		GROUP BY country_code
 		ORDER BY total_attacks DESC
 		LIMIT 20
 	`
 
-	rows, err := h.db.Queryx(query)
+	rows, err := h.db.Queryx(query, filter.Args()...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+var exportLog = logging.Component("log_export")
+
+// ExportHandler handles bulk log exports
+type ExportHandler struct {
+	db      *sqlx.DB
+	exports *services.LogExportService
+}
+
+// NewExportHandler creates a new export handler
+func NewExportHandler(db *sqlx.DB, exports *services.LogExportService) *ExportHandler {
+	return &ExportHandler{db: db, exports: exports}
+}
+
+// exportRequest selects what to export; the window is unbounded by default
+type exportRequest struct {
+	Source string `json:"source" form:"source"`
+	Format string `json:"format" form:"format"`
+	Gzip   bool   `json:"gzip" form:"gzip"`
+	Query  string `json:"q" form:"q"`
+	Start  string `json:"start" form:"start"`
+	End    string `json:"end" form:"end"`
+	Range  string `json:"range" form:"range"`
+}
+
+func (r exportRequest) export() (services.LogExport, bool) {
+	from, to, ok := parseWindow(r.Start, r.End, r.Range, 0)
+	if r.Source == "" {
+		r.Source = services.ExportSourceTraffic
+	}
+	if r.Format == "" {
+		r.Format = services.ExportFormatCSV
+	}
+	return services.LogExport{Source: r.Source, Format: r.Format, Query: r.Query, From: from, To: to}, ok
+}
+
+// exportContentType returns the Content-Type of an export download
+func exportContentType(format string, compressed bool) string {
+	switch {
+	case compressed:
+		return "application/gzip"
+	case format == services.ExportFormatNDJSON:
+		return "application/x-ndjson"
+	default:
+		return "text/csv; charset=utf-8"
+	}
+}
+
+// flushWriter flushes the gzip stream and the response after every batch so
+// a long export reaches the client as it is read
+type flushWriter struct {
+	io.Writer
+	gz *gzip.Writer
+	c  *gin.Context
+}
+
+func (w flushWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.c.Writer.Flush()
+}
+
+// StreamExport streams traffic or attack logs as CSV or NDJSON, optionally
+// gzipped, straight from a database cursor. Errors after the first bytes are
+// sent can only truncate the response, so they are logged.
+func (h *ExportHandler) StreamExport(c *gin.Context) {
+	var req exportRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	export, ok := req.export()
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidWindow})
+		return
+	}
+	if _, err := export.Filter(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Exports can outlast the server's write timeout
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	filename := fmt.Sprintf("%s-logs-%s.%s", export.Source, time.Now().Format("20060102-150405"), export.Format)
+	writer := flushWriter{Writer: c.Writer, c: c}
+	if req.Gzip {
+		filename += ".gz"
+		writer.gz = gzip.NewWriter(c.Writer)
+		writer.Writer = writer.gz
+	}
+	c.Header("Content-Type", exportContentType(export.Format, req.Gzip))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Status(http.StatusOK)
+
+	rows, err := services.ExportLogs(c.Request.Context(), h.db, writer, export)
+	if writer.gz != nil {
+		writer.gz.Close()
+	}
+	if err != nil {
+		exportLog.Error("Streaming export failed", "rows", rows, "error", err)
+	}
+}
+
+// CreateExportJob queues an export to be written to a file in the background
+func (h *ExportHandler) CreateExportJob(c *gin.Context) {
+	var req exportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	export, ok := req.export()
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidWindow})
+		return
+	}
+
+	job, err := h.exports.Submit(export, req.Gzip, c.GetString("admin_id"))
+	if err != nil {
+		var queryErr *services.LogQueryError
+		if errors.Is(err, services.ErrUnsupportedExport) || errors.As(err, &queryErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create export job"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// ListExportJobs returns recent export jobs
+func (h *ExportHandler) ListExportJobs(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	jobs, err := h.exports.List(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch export jobs"})
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// GetExportJob returns the status of one export job
+func (h *ExportHandler) GetExportJob(c *gin.Context) {
+	job, ok := h.job(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// DownloadExport sends the file of a completed export job
+func (h *ExportHandler) DownloadExport(c *gin.Context) {
+	job, ok := h.job(c)
+	if !ok {
+		return
+	}
+	if job.Status != services.ExportJobCompleted || job.FilePath == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Export is " + job.Status, "status": job.Status})
+		return
+	}
+	if _, err := os.Stat(*job.FilePath); err != nil {
+		node := ""
+		if job.NodeID != nil {
+			node = *job.NodeID
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export file is not available on this node", "node_id": node})
+		return
+	}
+
+	c.Header("Content-Type", exportContentType(job.Format, job.Gzip))
+	c.FileAttachment(*job.FilePath, job.Filename())
+}
+
+// DeleteExportJob removes an export job and its file
+func (h *ExportHandler) DeleteExportJob(c *gin.Context) {
+	err := h.exports.Delete(c.Param("id"))
+	if errors.Is(err, services.ErrExportJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete export job"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Export job deleted"})
+}
+
+func (h *ExportHandler) job(c *gin.Context) (*services.LogExportJob, bool) {
+	id := c.Param("id")
+	if _, err := decodeID(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid export job ID"})
+		return nil, false
+	}
+	job, err := h.exports.Get(id)
+	if errors.Is(err, services.ErrExportJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch export job"})
+		return nil, false
+	}
+	return job, true
+}
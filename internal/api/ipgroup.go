@@ -1,24 +1,41 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/base64"
-	"log"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/aleh/docode-waf/internal/constants"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 )
 
+var ipGroupsLog = logging.Component("ip_groups")
+
 // IPGroupHandler handles IP group requests
 type IPGroupHandler struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	feeds   *services.FeedService
+	ipIndex *services.IPGroupIndex
+	cluster *services.ClusterService
 }
 
 // NewIPGroupHandler creates a new IP group handler
-func NewIPGroupHandler(db *sqlx.DB) *IPGroupHandler {
-	return &IPGroupHandler{db: db}
+func NewIPGroupHandler(db *sqlx.DB, feeds *services.FeedService, ipIndex *services.IPGroupIndex, cluster *services.ClusterService) *IPGroupHandler {
+	return &IPGroupHandler{db: db, feeds: feeds, ipIndex: ipIndex, cluster: cluster}
+}
+
+// changed rebuilds the IP blocker's index after a change to a group and
+// announces it to the other nodes
+func (h *IPGroupHandler) changed(groupID string) {
+	h.ipIndex.Invalidate()
+	h.cluster.Publish(services.ClusterEventIPGroup, groupID)
 }
 
 // decodeID decodes a base64-encoded ID to the original UUID string
@@ -52,6 +69,7 @@ func (h *IPGroupHandler) ListIPGroups(c *gin.Context) {
 		Type         string         `db:"type"`
 		VhostIDs     pq.StringArray `db:"vhost_ids"`
 		VhostDomains pq.StringArray `db:"vhost_domains"`
+		FeedCount    int            `db:"feed_count"`
 		CreatedAt    time.Time      `db:"created_at"`
 		UpdatedAt    time.Time      `db:"updated_at"`
 	}
@@ -60,6 +78,7 @@ func (h *IPGroupHandler) ListIPGroups(c *gin.Context) {
 		SELECT ig.id, ig.name, ig.description, ig.type,
 		       COALESCE(array_agg(DISTINCT igv.vhost_id) FILTER (WHERE igv.vhost_id IS NOT NULL), '{}') as vhost_ids,
 		       COALESCE(array_agg(DISTINCT v.domain) FILTER (WHERE v.domain IS NOT NULL), '{}') as vhost_domains,
+		       (SELECT COUNT(*) FROM ip_group_feeds f WHERE f.group_id = ig.id) as feed_count,
 		       ig.created_at, ig.updated_at
 		FROM ip_groups ig
 		LEFT JOIN ip_group_vhosts igv ON ig.id = igv.ip_group_id
@@ -85,6 +104,7 @@ func (h *IPGroupHandler) ListIPGroups(c *gin.Context) {
 			"type":          r.Type,
 			"vhost_ids":     []string(r.VhostIDs),
 			"vhost_domains": []string(r.VhostDomains),
+			"feed_count":    r.FeedCount,
 			"created_at":    r.CreatedAt,
 			"updated_at":    r.UpdatedAt,
 		})
@@ -147,13 +167,13 @@ func (h *IPGroupHandler) GetIPGroup(c *gin.Context) {
 	// Get IP addresses for this group
 	var addresses []map[string]interface{}
 	addrQuery := `
-		SELECT id, ip_address, cidr_mask, description, created_at
+		SELECT id, ip_address, cidr_mask, description, feed_id, source, expires_at, created_at
 		FROM ip_addresses 
-		WHERE group_id = $1
+		WHERE group_id = $1 AND (expires_at IS NULL OR expires_at > $2)
 		ORDER BY created_at DESC
 	`
 
-	addrRows, err := h.db.Queryx(addrQuery, id)
+	addrRows, err := h.db.Queryx(addrQuery, id, time.Now())
 	if err == nil {
 		defer addrRows.Close()
 		for addrRows.Next() {
@@ -166,6 +186,14 @@ func (h *IPGroupHandler) GetIPGroup(c *gin.Context) {
 	}
 
 	group["addresses"] = addresses
+
+	feeds, err := h.feeds.ListFeeds(id)
+	if err != nil {
+		ipGroupsLog.Error("Failed to list feeds of group", "group_id", id, "error", err)
+		feeds = []services.Feed{}
+	}
+	group["feeds"] = feeds
+
 	c.JSON(http.StatusOK, group)
 }
 
@@ -235,6 +263,7 @@ func (h *IPGroupHandler) CreateIPGroup(c *gin.Context) {
 		return
 	}
 
+	h.changed(id)
 	c.JSON(http.StatusCreated, gin.H{"id": id, "message": "IP Group created successfully"})
 }
 
@@ -283,14 +312,14 @@ func (h *IPGroupHandler) UpdateIPGroup(c *gin.Context) {
 	)
 
 	if err != nil {
-		log.Printf("[IPGroup] Failed to update group %s: %v", id, err)
+		ipGroupsLog.Error("Failed to update group", "group_id", id, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update IP group: " + err.Error()})
 		return
 	}
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
-		log.Printf("[IPGroup] Group %s not found", id)
+		ipGroupsLog.Debug("Group not found", "group_id", id)
 		c.JSON(http.StatusNotFound, gin.H{"error": "IP Group not found"})
 		return
 	}
@@ -298,14 +327,14 @@ func (h *IPGroupHandler) UpdateIPGroup(c *gin.Context) {
 	// Delete existing vhost associations
 	_, err = tx.Exec(`DELETE FROM ip_group_vhosts WHERE ip_group_id = $1`, id)
 	if err != nil {
-		log.Printf("[IPGroup] Failed to delete vhost associations for group %s: %v", id, err)
+		ipGroupsLog.Error("Failed to delete vhost associations", "group_id", id, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete vhost associations: " + err.Error()})
 		return
 	}
 
 	// Insert new vhost associations
 	if len(input.VhostIDs) > 0 {
-		log.Printf("[IPGroup] Inserting %d vhost associations for group %s", len(input.VhostIDs), id)
+		ipGroupsLog.Debug("Inserting vhost associations", "group_id", id, "vhosts", len(input.VhostIDs))
 		for _, vhostID := range input.VhostIDs {
 			if vhostID != "" {
 				_, insertErr := tx.Exec(`
@@ -314,7 +343,7 @@ func (h *IPGroupHandler) UpdateIPGroup(c *gin.Context) {
 					ON CONFLICT (ip_group_id, vhost_id) DO NOTHING
 				`, id, vhostID)
 				if insertErr != nil {
-					log.Printf("[IPGroup] Failed to insert vhost association %s for group %s: %v", vhostID, id, insertErr)
+					ipGroupsLog.Error("Failed to insert vhost association", "group_id", id, "vhost_id", vhostID, "error", insertErr)
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert vhost association: " + insertErr.Error()})
 					return
 				}
@@ -324,12 +353,13 @@ func (h *IPGroupHandler) UpdateIPGroup(c *gin.Context) {
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
-		log.Printf("[IPGroup] Failed to commit transaction for group %s: %v", id, err)
+		ipGroupsLog.Error("Failed to commit transaction", "group_id", id, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit changes: " + err.Error()})
 		return
 	}
 
-	log.Printf("[IPGroup] Successfully updated group %s", id)
+	ipGroupsLog.Info("Updated group", "group_id", id)
+	h.changed(id)
 	c.JSON(http.StatusOK, gin.H{"message": "IP Group updated successfully"})
 }
 
@@ -343,9 +373,10 @@ func (h *IPGroupHandler) AddIPAddress(c *gin.Context) {
 	}
 
 	var input struct {
-		IPAddress   string `json:"ip_address" binding:"required"`
-		CIDRMask    *int   `json:"cidr_mask"`
-		Description string `json:"description"`
+		IPAddress   string     `json:"ip_address" binding:"required"`
+		CIDRMask    *int       `json:"cidr_mask"`
+		Description string     `json:"description"`
+		ExpiresAt   *time.Time `json:"expires_at"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -353,9 +384,19 @@ func (h *IPGroupHandler) AddIPAddress(c *gin.Context) {
 		return
 	}
 
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	if input.ExpiresAt != nil {
+		// expires_at is a TIMESTAMP column, which drops the offset
+		local := input.ExpiresAt.Local()
+		input.ExpiresAt = &local
+	}
+
 	query := `
-		INSERT INTO ip_addresses (id, group_id, ip_address, cidr_mask, description, created_at)
-		VALUES (gen_random_uuid(), $1, $2, $3, $4, $5)
+		INSERT INTO ip_addresses (id, group_id, ip_address, cidr_mask, description, expires_at, created_at)
+		VALUES (gen_random_uuid(), $1, $2, $3, $4, $5, $6)
 		RETURNING id
 	`
 
@@ -365,6 +406,7 @@ func (h *IPGroupHandler) AddIPAddress(c *gin.Context) {
 		input.IPAddress,
 		input.CIDRMask,
 		input.Description,
+		input.ExpiresAt,
 		time.Now(),
 	).Scan(&id)
 
@@ -373,6 +415,7 @@ func (h *IPGroupHandler) AddIPAddress(c *gin.Context) {
 		return
 	}
 
+	h.changed(groupID)
 	c.JSON(http.StatusCreated, gin.H{"id": id, "message": "IP Address added successfully"})
 }
 
@@ -386,9 +429,10 @@ func (h *IPGroupHandler) UpdateIPAddress(c *gin.Context) {
 	}
 
 	var input struct {
-		IPAddress   string `json:"ip_address" binding:"required"`
-		CIDRMask    *int   `json:"cidr_mask"`
-		Description string `json:"description"`
+		IPAddress   string     `json:"ip_address" binding:"required"`
+		CIDRMask    *int       `json:"cidr_mask"`
+		Description string     `json:"description"`
+		ExpiresAt   *time.Time `json:"expires_at"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -396,16 +440,31 @@ func (h *IPGroupHandler) UpdateIPAddress(c *gin.Context) {
 		return
 	}
 
+	if h.isFeedAddress(c, addressID) {
+		return
+	}
+
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	if input.ExpiresAt != nil {
+		// expires_at is a TIMESTAMP column, which drops the offset
+		local := input.ExpiresAt.Local()
+		input.ExpiresAt = &local
+	}
+
 	query := `
 		UPDATE ip_addresses 
-		SET ip_address = $1, cidr_mask = $2, description = $3
-		WHERE id = $4
+		SET ip_address = $1, cidr_mask = $2, description = $3, expires_at = $4
+		WHERE id = $5
 	`
 
 	_, err = h.db.Exec(query,
 		input.IPAddress,
 		input.CIDRMask,
 		input.Description,
+		input.ExpiresAt,
 		addressID,
 	)
 
@@ -414,6 +473,8 @@ func (h *IPGroupHandler) UpdateIPAddress(c *gin.Context) {
 		return
 	}
 
+	groupID, _ := decodeID(c.Param("id"))
+	h.changed(groupID)
 	c.JSON(http.StatusOK, gin.H{"message": "IP Address updated successfully"})
 }
 
@@ -428,13 +489,13 @@ func (h *IPGroupHandler) GetIPAddresses(c *gin.Context) {
 
 	var addresses []map[string]interface{}
 	query := `
-		SELECT id, ip_address, cidr_mask, description, created_at
+		SELECT id, ip_address, cidr_mask, description, feed_id, source, expires_at, created_at
 		FROM ip_addresses 
-		WHERE group_id = $1
+		WHERE group_id = $1 AND (expires_at IS NULL OR expires_at > $2)
 		ORDER BY created_at DESC
 	`
 
-	rows, err := h.db.Queryx(query, groupID)
+	rows, err := h.db.Queryx(query, groupID, time.Now())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -458,6 +519,113 @@ func (h *IPGroupHandler) GetIPAddresses(c *gin.Context) {
 	c.JSON(http.StatusOK, addresses)
 }
 
+// maxIPImportSize caps bulk import request bodies
+const maxIPImportSize = 10 << 20
+
+// ImportIPAddresses adds many addresses to a group at once. The body is read
+// as ?format=csv|text|json (default text); ?ttl=48h or ?expires_at=<RFC 3339>
+// sets an expiry for every entry without its own, ?description= a default
+// description and ?dry_run=true validates without writing.
+func (h *IPGroupHandler) ImportIPAddresses(c *gin.Context) {
+	encodedGroupID := c.Param("id")
+	groupID, err := decodeID(encodedGroupID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID format"})
+		return
+	}
+
+	var exists bool
+	if err := h.db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM ip_groups WHERE id = $1)", groupID); err != nil || !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IP Group not found"})
+		return
+	}
+
+	opts := services.IPImportOptions{
+		Description: c.Query("description"),
+		DryRun:      c.Query("dry_run") == "true",
+	}
+	expiry := c.Query("expires_at")
+	if ttl := c.Query("ttl"); ttl != "" {
+		expiry = ttl
+	}
+	if expiry != "" {
+		expiresAt, err := services.ParseExpiry(expiry)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		opts.ExpiresAt = &expiresAt
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxIPImportSize)
+	records, report, err := services.ParseIPImport(c.DefaultQuery("format", services.IPFormatText), body, opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ImportIPs(h.db, groupID, records, report); err != nil {
+		ipGroupsLog.Error("Failed to import addresses", "group_id", groupID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import addresses: " + err.Error()})
+		return
+	}
+
+	if !report.DryRun {
+		h.changed(groupID)
+		ipGroupsLog.Info("Imported addresses", "group_id", groupID, "added", report.Added,
+			"refreshed", report.Updated, "duplicates", report.Duplicates, "invalid", report.Invalid)
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// ExportIPAddresses downloads the unexpired addresses of a group in
+// ?format=csv|text|json (default csv)
+func (h *IPGroupHandler) ExportIPAddresses(c *gin.Context) {
+	encodedGroupID := c.Param("id")
+	groupID, err := decodeID(encodedGroupID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID format"})
+		return
+	}
+
+	var name string
+	if err := h.db.Get(&name, "SELECT name FROM ip_groups WHERE id = $1", groupID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IP Group not found"})
+		return
+	}
+
+	format := c.DefaultQuery("format", services.IPFormatCSV)
+	contentType, ext := "text/csv", "csv"
+	switch format {
+	case services.IPFormatCSV:
+	case services.IPFormatText:
+		contentType, ext = "text/plain", "txt"
+	case services.IPFormatJSON:
+		contentType, ext = "application/json", "json"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": services.ErrUnsupportedIPFormat.Error()})
+		return
+	}
+
+	records, err := services.ExportIPs(h.db, groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r == '/' || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, name)
+	c.Header("Content-Type", contentType+"; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, ext))
+	if err := services.WriteIPExport(c.Writer, format, records); err != nil {
+		ipGroupsLog.Error("Failed to export group", "group_id", groupID, "error", err)
+	}
+}
+
 // DeleteIPAddress removes an IP address from a group
 func (h *IPGroupHandler) DeleteIPAddress(c *gin.Context) {
 	encodedAddressID := c.Param("addressId")
@@ -467,12 +635,18 @@ func (h *IPGroupHandler) DeleteIPAddress(c *gin.Context) {
 		return
 	}
 
+	if h.isFeedAddress(c, addressID) {
+		return
+	}
+
 	_, err = h.db.Exec("DELETE FROM ip_addresses WHERE id = $1", addressID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	groupID, _ := decodeID(c.Param("id"))
+	h.changed(groupID)
 	c.JSON(http.StatusOK, gin.H{"message": "IP Address deleted successfully"})
 }
 
@@ -499,5 +673,198 @@ func (h *IPGroupHandler) DeleteIPGroup(c *gin.Context) {
 		return
 	}
 
+	h.changed(id)
 	c.JSON(http.StatusOK, gin.H{"message": "IP Group deleted successfully"})
 }
+
+// isFeedAddress rejects changes to addresses imported from a feed, which
+// would be undone by the next sync. It reports whether a response was sent.
+func (h *IPGroupHandler) isFeedAddress(c *gin.Context, addressID string) bool {
+	var feedID sql.NullString
+	err := h.db.Get(&feedID, "SELECT feed_id FROM ip_addresses WHERE id = $1", addressID)
+	if err != nil || !feedID.Valid {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": constants.ErrFeedManagedAddress})
+	return true
+}
+
+// feedInput is the request body for creating and updating feeds
+type feedInput struct {
+	Name            string `json:"name" binding:"required"`
+	Source          string `json:"source" binding:"required"`
+	Format          string `json:"format" binding:"required,oneof=plain spamhaus_drop csv tor"`
+	CSVColumn       int    `json:"csv_column" binding:"min=0"`
+	RefreshInterval int    `json:"refresh_interval" binding:"omitempty,min=60"`
+	Enabled         *bool  `json:"enabled"`
+}
+
+func (in *feedInput) setDefaults() {
+	if in.CSVColumn == 0 {
+		in.CSVColumn = 1
+	}
+	if in.RefreshInterval == 0 {
+		in.RefreshInterval = 3600
+	}
+	if in.Enabled == nil {
+		enabled := true
+		in.Enabled = &enabled
+	}
+}
+
+// ListFeeds returns the feeds subscribed by an IP group with their last sync status
+func (h *IPGroupHandler) ListFeeds(c *gin.Context) {
+	groupID, err := decodeID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID format"})
+		return
+	}
+
+	feeds, err := h.feeds.ListFeeds(groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, feeds)
+}
+
+// CreateFeed subscribes an IP group to a feed. The first sync runs on the
+// next scheduler pass, or immediately through SyncFeed.
+func (h *IPGroupHandler) CreateFeed(c *gin.Context) {
+	groupID, err := decodeID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID format"})
+		return
+	}
+
+	var input feedInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.setDefaults()
+	if err := h.feeds.ValidateSource(input.Source); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := `
+		INSERT INTO ip_group_feeds (group_id, name, source, format, csv_column, refresh_interval, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+
+	var id string
+	err = h.db.QueryRow(query, groupID, input.Name, input.Source, input.Format,
+		input.CSVColumn, input.RefreshInterval, *input.Enabled).Scan(&id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	feed, err := h.feeds.GetFeed(groupID, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.changed(groupID)
+	c.JSON(http.StatusCreated, feed)
+}
+
+// UpdateFeed changes a feed's source, format or schedule
+func (h *IPGroupHandler) UpdateFeed(c *gin.Context) {
+	groupID, err := decodeID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID format"})
+		return
+	}
+	feedID := c.Param("feedId")
+
+	var input feedInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.setDefaults()
+	if err := h.feeds.ValidateSource(input.Source); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := `
+		UPDATE ip_group_feeds
+		SET name = $1, source = $2, format = $3, csv_column = $4, refresh_interval = $5, enabled = $6
+		WHERE id = $7 AND group_id = $8
+	`
+
+	result, err := h.db.Exec(query, input.Name, input.Source, input.Format,
+		input.CSVColumn, input.RefreshInterval, *input.Enabled, feedID, groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": constants.ErrFeedNotFound})
+		return
+	}
+
+	// Keep attribution in line with a renamed feed
+	h.db.Exec(`UPDATE ip_addresses SET source = $1, description = $1 WHERE feed_id = $2`, "feed:"+input.Name, feedID)
+
+	feed, err := h.feeds.GetFeed(groupID, feedID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.changed(groupID)
+	c.JSON(http.StatusOK, feed)
+}
+
+// DeleteFeed unsubscribes an IP group from a feed and removes its entries
+func (h *IPGroupHandler) DeleteFeed(c *gin.Context) {
+	groupID, err := decodeID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID format"})
+		return
+	}
+
+	// ip_addresses.feed_id cascades
+	result, err := h.db.Exec("DELETE FROM ip_group_feeds WHERE id = $1 AND group_id = $2", c.Param("feedId"), groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": constants.ErrFeedNotFound})
+		return
+	}
+
+	h.changed(groupID)
+	c.JSON(http.StatusOK, gin.H{"message": "Feed deleted successfully"})
+}
+
+// SyncFeed refreshes a feed immediately
+func (h *IPGroupHandler) SyncFeed(c *gin.Context) {
+	groupID, err := decodeID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID format"})
+		return
+	}
+
+	feed, err := h.feeds.GetFeed(groupID, c.Param("feedId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": constants.ErrFeedNotFound})
+		return
+	}
+
+	result, err := h.feeds.Sync(c.Request.Context(), feed)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
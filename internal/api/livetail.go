@@ -0,0 +1,275 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultStreamBacklog = 10
+	maxStreamBacklog     = 1000
+	// streamWriteTimeout drops clients that stop reading; it replaces the
+	// admin server's write timeout for the lifetime of the stream
+	streamWriteTimeout = 10 * time.Second
+	streamHeartbeat    = 15 * time.Second
+)
+
+// eventStream writes server-sent events and reports clients that are gone or
+// too slow to keep up
+type eventStream struct {
+	c  *gin.Context
+	rc *http.ResponseController
+}
+
+func newEventStream(c *gin.Context) *eventStream {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stop nginx in front of the admin API from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	// Clients wait for the headers before they start reading
+	flushError(c.Writer)
+	return &eventStream{c: c, rc: http.NewResponseController(c.Writer)}
+}
+
+// send writes one event; data is sent as is when it is a string and as JSON
+// otherwise. It returns false once the client cannot be written to.
+func (s *eventStream) send(event string, data interface{}) bool {
+	payload, ok := data.(string)
+	if !ok {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return true
+		}
+		payload = string(encoded)
+	}
+	var b strings.Builder
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(payload, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// heartbeat keeps idle connections open through proxies
+func (s *eventStream) heartbeat() bool {
+	return s.write(": ping\n\n")
+}
+
+func (s *eventStream) write(frame string) bool {
+	s.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if _, err := s.c.Writer.WriteString(frame); err != nil {
+		return false
+	}
+	return flushError(s.c.Writer) == nil
+}
+
+// flushError flushes through any wrapping writers to the connection, unlike
+// gin's Flush, so a failed write is noticed
+func flushError(w http.ResponseWriter) error {
+	for {
+		switch t := w.(type) {
+		case interface{ FlushError() error }:
+			return t.FlushError()
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		case http.Flusher:
+			t.Flush()
+			return nil
+		default:
+			return http.ErrNotSupported
+		}
+	}
+}
+
+// streamFilter parses the q (regular expression), status and ip filters
+func streamFilter(c *gin.Context) (*services.LineFilter, bool) {
+	filter, err := services.ParseLineFilter(c.Query("q"), c.Query("status"), c.Query("ip"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return filter, true
+}
+
+// StreamNginxLogs follows a vhost's nginx access or error log (SSE). The
+// last backlog lines matching the filter are sent first, then every new
+// matching line as a "message" event; rotation and truncation of the file
+// are reported as "notice" events.
+func (h *LogsHandler) StreamNginxLogs(c *gin.Context) {
+	domain := c.Query("domain")
+	logType := c.DefaultQuery("type", "access")
+
+	if domain == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errDomainRequired,
+		})
+		return
+	}
+	if logType != "access" && logType != "error" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be access or error"})
+		return
+	}
+	if strings.ContainsAny(domain, `/\`) || strings.Contains(domain, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid domain"})
+		return
+	}
+	filter, ok := streamFilter(c)
+	if !ok {
+		return
+	}
+	backlog, err := strconv.Atoi(c.DefaultQuery("backlog", strconv.Itoa(defaultStreamBacklog)))
+	if err != nil || backlog < 0 || backlog > maxStreamBacklog {
+		backlog = defaultStreamBacklog
+	}
+
+	// Log file format: {domain}_{type}.log
+	logPath := filepath.Join(nginxLogsDir, domain+"_"+logType+".log")
+	// Filtered lines are picked from a larger backlog
+	scan := backlog
+	if filter.Pattern != nil || filter.Status != "" || filter.IP != "" {
+		scan = maxStreamBacklog
+	}
+	tail, lines, err := services.OpenFileTail(logPath, scan)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Log file not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open log file"})
+		return
+	}
+	defer tail.Close()
+
+	// Access logs are written as JSON for the ingest; they are streamed and
+	// filtered in the combined format shown before
+	format := func(line string) string { return line }
+	if logType == "access" {
+		format = services.FormatNginxAccessLine
+	}
+
+	var matched []string
+	for _, line := range lines {
+		line = format(line)
+		if filter.MatchLine(line) {
+			matched = append(matched, line)
+		}
+	}
+	if len(matched) > backlog {
+		matched = matched[len(matched)-backlog:]
+	}
+
+	stream := newEventStream(c)
+	for _, line := range matched {
+		if !stream.send("message", line) {
+			return
+		}
+	}
+
+	emit := func(event services.TailEvent) bool {
+		if event.Notice != "" {
+			return stream.send("notice", gin.H{"notice": event.Notice, "file": filepath.Base(logPath)})
+		}
+		line := format(event.Line)
+		if !filter.MatchLine(line) {
+			return true
+		}
+		return stream.send("message", line)
+	}
+
+	poll := time.NewTicker(services.TailPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if !stream.heartbeat() {
+				return
+			}
+		case <-poll.C:
+			if !tail.Poll(emit) {
+				return
+			}
+		}
+	}
+}
+
+// StreamWAFDecisions streams the WAF's decisions as they are made (SSE),
+// straight from the middleware rather than from the traffic log. Each
+// decision is a "decision" event; filters are host, decision and the q, status
+// and ip filters of the log streams. A client that falls behind misses
+// decisions and is told how many in a "dropped" event.
+func (h *LogsHandler) StreamWAFDecisions(c *gin.Context) {
+	filter, ok := streamFilter(c)
+	if !ok {
+		return
+	}
+	host := c.Query("host")
+	decision := c.Query("decision")
+
+	sub, err := h.decisions.Subscribe()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer h.decisions.Unsubscribe(sub)
+
+	stream := newEventStream(c)
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if !stream.heartbeat() {
+				return
+			}
+		case event := <-sub.C:
+			if dropped := sub.Dropped(); dropped > 0 {
+				if !stream.send("dropped", gin.H{"dropped": dropped}) {
+					return
+				}
+			}
+			if host != "" && stripPort(event.Host) != host {
+				continue
+			}
+			if decision != "" && event.Decision != decision {
+				continue
+			}
+			if !filter.MatchDecision(event) {
+				continue
+			}
+			if !stream.send("decision", event) {
+				return
+			}
+		}
+	}
+}
+
+func stripPort(host string) string {
+	if idx := strings.LastIndex(host, ":"); idx != -1 && !strings.HasSuffix(host, "]") {
+		return host[:idx]
+	}
+	return host
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// LoggingHandler changes log levels at runtime. Changes are published to the
+// other nodes of the cluster and last until a node restarts; config.yaml sets
+// the levels on start.
+type LoggingHandler struct {
+	cluster *services.ClusterService
+}
+
+// NewLoggingHandler creates a new logging handler
+func NewLoggingHandler(cluster *services.ClusterService) *LoggingHandler {
+	return &LoggingHandler{cluster: cluster}
+}
+
+// GetLevels returns the default level and the effective level of every
+// component
+func (h *LoggingHandler) GetLevels(c *gin.Context) {
+	level, components := logging.Levels()
+	c.JSON(http.StatusOK, gin.H{"level": level, "components": components})
+}
+
+// SetLevel sets the level of one component, or the default level when no
+// component is given. A component set to "default" follows the default level
+// again.
+func (h *LoggingHandler) SetLevel(c *gin.Context) {
+	var input struct {
+		Component string `json:"component"`
+		Level     string `json:"level" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := logging.SetLevel(input.Component, input.Level); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.cluster.Publish(services.ClusterEventLogLevel, input.Component+"="+input.Level)
+
+	component := input.Component
+	if component == "" {
+		component = "default"
+	}
+	logging.Component("logging").Info("Log level changed", "target", component, "level", input.Level, "admin_id", c.GetString("admin_id"))
+	h.GetLevels(c)
+}
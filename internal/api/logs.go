@@ -2,11 +2,14 @@ package api
 
 import (
 	"bufio"
+	"errors"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
@@ -20,12 +23,13 @@ const (
 
 // LogsHandler handles log viewing requests
 type LogsHandler struct {
-	db *sqlx.DB
+	db        *sqlx.DB
+	decisions *services.DecisionStream
 }
 
 // NewLogsHandler creates a new logs handler
-func NewLogsHandler(db *sqlx.DB) *LogsHandler {
-	return &LogsHandler{db: db}
+func NewLogsHandler(db *sqlx.DB, decisions *services.DecisionStream) *LogsHandler {
+	return &LogsHandler{db: db, decisions: decisions}
 }
 
 // GetNginxAccessLogs returns nginx access logs for a specific vhost
@@ -50,6 +54,10 @@ func (h *LogsHandler) GetNginxAccessLogs(c *gin.Context) {
 		})
 		return
 	}
+	// Access logs are written as JSON for the ingest; show them as before
+	for i, line := range logs {
+		logs[i] = services.FormatNginxAccessLine(line)
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"domain": domain,
@@ -90,108 +98,121 @@ func (h *LogsHandler) GetNginxErrorLogs(c *gin.Context) {
 	})
 }
 
-// GetWAFLogs returns WAF logs from database
+// GetWAFLogs returns WAF logs from database for whole days, optionally
+// narrowed by a q search and paged with cursor
 func (h *LogsHandler) GetWAFLogs(c *gin.Context) {
-	startDate := c.DefaultQuery("start_date", time.Now().Add(-24*time.Hour).Format("2006-01-02"))
-	endDate := c.DefaultQuery("end_date", time.Now().Format("2006-01-02"))
-	limit := c.DefaultQuery("limit", "100")
+	startDate := c.DefaultQuery("start_date", time.Now().Add(-24*time.Hour).Format(dateLayout))
+	endDate := c.DefaultQuery("end_date", time.Now().Format(dateLayout))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
 	isAttack := c.Query("is_attack")
 
-	query := `
-		SELECT id, timestamp, client_ip, method, url, status_code, 
-		       response_time, user_agent, blocked, block_reason, 
-		       country_code, is_attack, attack_type, host
-		FROM traffic_logs
-		WHERE timestamp >= $1::date AND timestamp < ($2::date + interval '1 day')
-	`
-
-	args := []interface{}{startDate, endDate}
-
-	if isAttack != "" {
-		query += ` AND is_attack = $3`
-		args = append(args, isAttack == "true")
-		query += ` ORDER BY timestamp DESC LIMIT $4`
-	} else {
-		query += ` ORDER BY timestamp DESC LIMIT $3`
+	from, err := time.ParseInLocation(dateLayout, startDate, time.Local)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start_date must be YYYY-MM-DD"})
+		return
+	}
+	end, err := time.ParseInLocation(dateLayout, endDate, time.Local)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end_date must be YYYY-MM-DD"})
+		return
 	}
 
-	args = append(args, limit)
-
-	var logs []struct {
-		ID           string    `db:"id" json:"id"`
-		Timestamp    time.Time `db:"timestamp" json:"timestamp"`
-		ClientIP     string    `db:"client_ip" json:"client_ip"`
-		Method       string    `db:"method" json:"method"`
-		URL          string    `db:"url" json:"url"`
-		StatusCode   int       `db:"status_code" json:"status_code"`
-		ResponseTime int       `db:"response_time" json:"response_time"`
-		UserAgent    string    `db:"user_agent" json:"user_agent"`
-		Blocked      bool      `db:"blocked" json:"blocked"`
-		BlockReason  *string   `db:"block_reason" json:"block_reason"`
-		CountryCode  *string   `db:"country_code" json:"country_code"`
-		IsAttack     bool      `db:"is_attack" json:"is_attack"`
-		AttackType   *string   `db:"attack_type" json:"attack_type"`
-		Host         string    `db:"host" json:"host"`
+	filter, err := services.ParseLogQuery(c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.Between(from, end.AddDate(0, 0, 1))
+	if isAttack != "" {
+		filter.Where("is_attack = ?", isAttack == "true")
 	}
 
-	if err := h.db.Select(&logs, query, args...); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to fetch WAF logs",
-		})
+	result, err := services.SearchTrafficLogs(c.Request.Context(), h.db, services.LogSearch{
+		Filter: filter,
+		Cursor: c.Query("cursor"),
+		Limit:  limit,
+	})
+	if err != nil {
+		respondSearchError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"logs":       logs,
-		"start_date": startDate,
-		"end_date":   endDate,
-		"total":      len(logs),
+		"logs":        result.Logs,
+		"next_cursor": result.NextCursor,
+		"start_date":  startDate,
+		"end_date":    endDate,
+		"total":       len(result.Logs),
 	})
 }
 
-// StreamNginxLogs streams nginx logs in real-time (SSE)
-func (h *LogsHandler) StreamNginxLogs(c *gin.Context) {
-	domain := c.Query("domain")
-	logType := c.DefaultQuery("type", "access")
+// SearchLogs searches traffic logs with the query language of
+// services.ParseLogQuery, within the start/end or range window. Results are
+// sorted by sort (timestamp, status, response_time or bytes_sent) in order
+// (desc by default) and paged by passing next_cursor back as cursor.
+func (h *LogsHandler) SearchLogs(c *gin.Context) {
+	from, to, ok := timeWindow(c, 0)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidWindow})
+		return
+	}
 
-	if domain == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": errDomainRequired,
-		})
+	filter, err := services.ParseLogQuery(c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	filter.Between(from, to)
 
-	// Log file format: {domain}_{type}.log
-	logPath := filepath.Join(nginxLogsDir, domain+"_"+logType+".log")
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+
+	result, err := services.SearchTrafficLogs(c.Request.Context(), h.db, services.LogSearch{
+		Filter:    filter,
+		Sort:      c.Query("sort"),
+		Ascending: order == "asc",
+		Cursor:    c.Query("cursor"),
+		Limit:     limit,
+	})
+	if err != nil {
+		respondSearchError(c, err)
+		return
+	}
 
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
+	c.JSON(http.StatusOK, gin.H{
+		"logs":        result.Logs,
+		"next_cursor": result.NextCursor,
+		"count":       len(result.Logs),
+	})
+}
 
-	// Stream last 10 lines immediately
-	logs, _ := readLogFile(logPath, "10")
-	for _, line := range logs {
-		c.SSEvent("message", line)
-		c.Writer.Flush()
+// respondSearchError reports bad queries, sorts and cursors as 400s
+func respondSearchError(c *gin.Context, err error) {
+	var queryErr *services.LogQueryError
+	if errors.As(err, &queryErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": queryErr.Error()})
+		return
 	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search traffic logs"})
+}
 
-	// Poll for new lines every 5 seconds
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-c.Request.Context().Done():
-			return
-		case <-ticker.C:
-			// Check for new lines
-			newLogs, err := readLogFile(logPath, "1")
-			if err == nil && len(newLogs) > 0 {
-				c.SSEvent("message", newLogs[0])
-				c.Writer.Flush()
-			}
-		}
+// GetRequest explains the decision for one request, looked up by the
+// reference shown on block pages (its X-Request-ID)
+func (h *LogsHandler) GetRequest(c *gin.Context) {
+	explanation, err := services.ExplainRequest(c.Request.Context(), h.db, c.Param("id"))
+	if errors.Is(err, services.ErrRequestNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No logged request has this ID; it may not be written yet or be past retention"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up request"})
+		return
 	}
+	c.JSON(http.StatusOK, explanation)
 }
 
 // Helper function to read log file
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/aleh/docode-waf/internal/constants"
+	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
@@ -12,12 +13,13 @@ import (
 
 // RateLimitHandler handles rate limit rule requests
 type RateLimitHandler struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	cluster *services.ClusterService
 }
 
 // NewRateLimitHandler creates a new rate limit handler
-func NewRateLimitHandler(db *sqlx.DB) *RateLimitHandler {
-	return &RateLimitHandler{db: db}
+func NewRateLimitHandler(db *sqlx.DB, cluster *services.ClusterService) *RateLimitHandler {
+	return &RateLimitHandler{db: db, cluster: cluster}
 }
 
 // ListRateLimitRules returns all rate limit rules
@@ -125,6 +127,7 @@ func (h *RateLimitHandler) CreateRateLimitRule(c *gin.Context) {
 		return
 	}
 
+	h.cluster.Publish(services.ClusterEventRule, id)
 	c.JSON(http.StatusCreated, rule)
 }
 
@@ -197,6 +200,8 @@ func (h *RateLimitHandler) UpdateRateLimitRule(c *gin.Context) {
 		return
 	}
 
+	h.cluster.Publish(services.ClusterEventRule, id)
+
 	// Return updated rule
 	h.GetRateLimitRule(c)
 }
@@ -222,6 +227,7 @@ func (h *RateLimitHandler) DeleteRateLimitRule(c *gin.Context) {
 		return
 	}
 
+	h.cluster.Publish(services.ClusterEventRule, id)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Rate limit rule deleted successfully",
 	})
@@ -259,6 +265,7 @@ func (h *RateLimitHandler) ToggleRateLimitRule(c *gin.Context) {
 		return
 	}
 
+	h.cluster.Publish(services.ClusterEventRule, id)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Rate limit rule toggled successfully",
 		"enabled": input.Enabled,
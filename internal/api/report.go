@@ -0,0 +1,209 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// ReportHandler handles report schedules and on-demand reports
+type ReportHandler struct {
+	reports *services.ReportService
+}
+
+// NewReportHandler creates a new report handler
+func NewReportHandler(reports *services.ReportService) *ReportHandler {
+	return &ReportHandler{reports: reports}
+}
+
+// reportScheduleInput is the body of schedule create and update requests
+type reportScheduleInput struct {
+	Name       string   `json:"name" binding:"required"`
+	VHost      string   `json:"vhost"`
+	Frequency  string   `json:"frequency"`
+	Weekday    *int     `json:"weekday"`
+	SendHour   *int     `json:"send_hour"`
+	Recipients string   `json:"recipients"`
+	AdminIDs   []string `json:"admin_ids"`
+	Enabled    *bool    `json:"enabled"`
+}
+
+func (in reportScheduleInput) schedule() *services.ReportSchedule {
+	schedule := &services.ReportSchedule{
+		Name:       in.Name,
+		VHost:      in.VHost,
+		Frequency:  in.Frequency,
+		Weekday:    1,
+		SendHour:   8,
+		Recipients: in.Recipients,
+		AdminIDs:   pq.StringArray(in.AdminIDs),
+		Enabled:    true,
+	}
+	if in.Weekday != nil {
+		schedule.Weekday = *in.Weekday
+	}
+	if in.SendHour != nil {
+		schedule.SendHour = *in.SendHour
+	}
+	if in.Enabled != nil {
+		schedule.Enabled = *in.Enabled
+	}
+	return schedule
+}
+
+// ListSchedules returns all report schedules
+func (h *ReportHandler) ListSchedules(c *gin.Context) {
+	schedules, err := h.reports.ListSchedules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch report schedules"})
+		return
+	}
+	c.JSON(http.StatusOK, schedules)
+}
+
+// GetSchedule returns one report schedule
+func (h *ReportHandler) GetSchedule(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	schedule, err := h.reports.GetSchedule(id)
+	if err != nil {
+		respondReportError(c, err, "Failed to fetch report schedule")
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+// CreateSchedule creates a report schedule
+func (h *ReportHandler) CreateSchedule(c *gin.Context) {
+	var input reportScheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	schedule := input.schedule()
+	if adminID := c.GetString("admin_id"); adminID != "" {
+		schedule.CreatedBy = &adminID
+	}
+	if err := h.reports.CreateSchedule(schedule); err != nil {
+		respondReportError(c, err, "Failed to create report schedule")
+		return
+	}
+	c.JSON(http.StatusCreated, schedule)
+}
+
+// UpdateSchedule replaces a report schedule
+func (h *ReportHandler) UpdateSchedule(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	var input reportScheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	schedule := input.schedule()
+	if err := h.reports.UpdateSchedule(id, schedule); err != nil {
+		respondReportError(c, err, "Failed to update report schedule")
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+// DeleteSchedule deletes a report schedule
+func (h *ReportHandler) DeleteSchedule(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	if err := h.reports.DeleteSchedule(id); err != nil {
+		respondReportError(c, err, "Failed to delete report schedule")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Report schedule deleted"})
+}
+
+// SendSchedule emails a schedule's latest complete period now
+func (h *ReportHandler) SendSchedule(c *gin.Context) {
+	id, ok := alertID(c)
+	if !ok {
+		return
+	}
+	if err := h.reports.SendSchedule(c.Request.Context(), id); err != nil {
+		if errors.Is(err, services.ErrReportScheduleNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Report could not be sent: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Report sent"})
+}
+
+// DownloadReport builds a report of vhost (all vhosts when empty) on demand.
+// The period is the start/end or range window, or else the latest complete
+// day or week given by frequency (default weekly). format=json returns the
+// data instead of the HTML page.
+func (h *ReportHandler) DownloadReport(c *gin.Context) {
+	var from, to time.Time
+	var err error
+	if c.Query("start") != "" || c.Query("range") != "" {
+		var ok bool
+		if from, to, ok = timeWindow(c, 0); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidWindow})
+			return
+		}
+	} else if from, to, err = services.ReportPeriod(c.Query("frequency"), time.Now()); err != nil {
+		respondReportError(c, err, "")
+		return
+	}
+
+	vhost := strings.ToLower(c.Query("vhost"))
+	if strings.ContainsAny(vhost, "\"/\\ ") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid vhost"})
+		return
+	}
+
+	report, err := h.reports.BuildReport(c.Request.Context(), vhost, from, to)
+	if err != nil {
+		respondReportError(c, err, "Failed to build report")
+		return
+	}
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+
+	body, err := services.RenderReport(report)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render report"})
+		return
+	}
+	name := "waf-report-" + from.Format(dateLayout)
+	if report.VHost != "" {
+		name += "-" + report.VHost
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+name+`.html"`)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(body))
+}
+
+// respondReportError maps not-found errors to 404, validation errors to 400
+// and anything else to a 500 with message
+func respondReportError(c *gin.Context, err error, message string) {
+	var invalid *services.ReportValidationError
+	switch {
+	case errors.Is(err, services.ErrReportScheduleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.As(err, &invalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
@@ -2,21 +2,21 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/aleh/docode-waf/internal/constants"
+	"github.com/aleh/docode-waf/internal/logging"
 	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 )
 
-const (
-	proxyReloadWarningMsg = "Warning: Failed to reload proxy map: %v\n"
-)
+var vhostLog = logging.Component("vhost")
 
 // VHostHandler handles virtual host requests
 type ProxyReloader interface {
@@ -29,16 +29,18 @@ type VHostHandler struct {
 	vhostService       *services.VHostService
 	certService        *services.CertificateService
 	proxyReloader      ProxyReloader
+	cluster            *services.ClusterService
 }
 
 // NewVHostHandler creates a new vhost handler
-func NewVHostHandler(db *sqlx.DB, nginxConfigService *services.NginxConfigService, vhostService *services.VHostService, certService *services.CertificateService, proxyReloader ProxyReloader) *VHostHandler {
+func NewVHostHandler(db *sqlx.DB, nginxConfigService *services.NginxConfigService, vhostService *services.VHostService, certService *services.CertificateService, proxyReloader ProxyReloader, cluster *services.ClusterService) *VHostHandler {
 	return &VHostHandler{
 		db:                 db,
 		nginxConfigService: nginxConfigService,
 		vhostService:       vhostService,
 		certService:        certService,
 		proxyReloader:      proxyReloader,
+		cluster:            cluster,
 	}
 }
 
@@ -65,10 +67,20 @@ func (h *VHostHandler) ListVHosts(c *gin.Context) {
 		ProxyConnectTimeout int             `db:"proxy_connect_timeout" json:"proxy_connect_timeout"`
 		BotDetectionEnabled bool            `db:"bot_detection_enabled" json:"bot_detection_enabled"`
 		BotDetectionType    string          `db:"bot_detection_type" json:"bot_detection_type"`
+		BotDetectionMode    string          `db:"bot_detection_mode" json:"bot_detection_mode"`
+		BotScoreChallenge   int             `db:"bot_score_challenge_threshold" json:"bot_score_challenge_threshold"`
+		BotScoreBlock       int             `db:"bot_score_block_threshold" json:"bot_score_block_threshold"`
 		RecaptchaVersion    string          `db:"recaptcha_version" json:"recaptcha_version"`
 		RateLimitEnabled    bool            `db:"rate_limit_enabled" json:"rate_limit_enabled"`
 		RateLimitRequests   int             `db:"rate_limit_requests" json:"rate_limit_requests"`
 		RateLimitWindow     int             `db:"rate_limit_window" json:"rate_limit_window"`
+		ASNRateLimit        int             `db:"asn_rate_limit_requests" json:"asn_rate_limit_requests"`
+		LogRetentionDays    int             `db:"log_retention_days" json:"log_retention_days"`
+		CaptureSample       float64         `db:"capture_sample_percent" json:"capture_sample_percent"`
+		RegionWhitelist     pq.StringArray  `db:"region_whitelist" json:"region_whitelist"`
+		RegionBlacklist     pq.StringArray  `db:"region_blacklist" json:"region_blacklist"`
+		RegionFiltering     bool            `db:"region_filtering_enabled" json:"region_filtering_enabled"`
+		GeoIPFailPolicy     string          `db:"geoip_fail_policy" json:"geoip_fail_policy"`
 		CustomHeaders       json.RawMessage `db:"custom_headers" json:"custom_headers"`
 		CreatedAt           time.Time       `db:"created_at" json:"created_at"`
 		UpdatedAt           time.Time       `db:"updated_at" json:"updated_at"`
@@ -83,7 +95,17 @@ func (h *VHostHandler) ListVHosts(c *gin.Context) {
 		       websocket_enabled, http_version, tls_version, max_upload_size,
 		       proxy_read_timeout, proxy_connect_timeout,
 		       bot_detection_enabled, bot_detection_type, recaptcha_version,
+		       COALESCE(bot_detection_mode, 'challenge_all') as bot_detection_mode,
+		       COALESCE(bot_score_challenge_threshold, 30) as bot_score_challenge_threshold,
+		       COALESCE(bot_score_block_threshold, 70) as bot_score_block_threshold,
 		       rate_limit_enabled, rate_limit_requests, rate_limit_window,
+		       COALESCE(asn_rate_limit_requests, 0) as asn_rate_limit_requests,
+		       COALESCE(log_retention_days, 0) as log_retention_days,
+		       COALESCE(capture_sample_percent, 0) as capture_sample_percent,
+		       COALESCE(region_whitelist, '{}') as region_whitelist,
+		       COALESCE(region_blacklist, '{}') as region_blacklist,
+		       COALESCE(region_filtering_enabled, false) as region_filtering_enabled,
+		       COALESCE(geoip_fail_policy, 'open') as geoip_fail_policy,
 		       custom_headers, created_at, updated_at
 		FROM vhosts 
 		ORDER BY created_at DESC
@@ -154,34 +176,44 @@ func (h *VHostHandler) ListVHosts(c *gin.Context) {
 		}
 
 		response = append(response, map[string]interface{}{
-			"id":                    vhost.ID,
-			"name":                  vhost.Name,
-			"domain":                vhost.Domain,
-			"backend_url":           vhost.BackendURL,
-			"backends":              backends,
-			"load_balance_method":   loadBalanceMethod,
-			"custom_config":         customConfig,
-			"ssl_enabled":           vhost.SSLEnabled,
-			"ssl_certificate_id":    vhost.SSLCertificateID,
-			"ssl_cert_path":         vhost.SSLCertPath,
-			"ssl_key_path":          vhost.SSLKeyPath,
-			"enabled":               vhost.Enabled,
-			"websocket_enabled":     vhost.WebsocketEnabled,
-			"http_version":          vhost.HTTPVersion,
-			"tls_version":           vhost.TLSVersion,
-			"max_upload_size":       vhost.MaxUploadSize,
-			"proxy_read_timeout":    vhost.ProxyReadTimeout,
-			"proxy_connect_timeout": vhost.ProxyConnectTimeout,
-			"bot_detection_enabled": vhost.BotDetectionEnabled,
-			"bot_detection_type":    vhost.BotDetectionType,
-			"recaptcha_version":     vhost.RecaptchaVersion,
-			"rate_limit_enabled":    vhost.RateLimitEnabled,
-			"rate_limit_requests":   vhost.RateLimitRequests,
-			"rate_limit_window":     vhost.RateLimitWindow,
-			"custom_headers":        vhost.CustomHeaders,
-			"custom_locations":      customLocs,
-			"created_at":            vhost.CreatedAt,
-			"updated_at":            vhost.UpdatedAt,
+			"id":                            vhost.ID,
+			"name":                          vhost.Name,
+			"domain":                        vhost.Domain,
+			"backend_url":                   vhost.BackendURL,
+			"backends":                      backends,
+			"load_balance_method":           loadBalanceMethod,
+			"custom_config":                 customConfig,
+			"ssl_enabled":                   vhost.SSLEnabled,
+			"ssl_certificate_id":            vhost.SSLCertificateID,
+			"ssl_cert_path":                 vhost.SSLCertPath,
+			"ssl_key_path":                  vhost.SSLKeyPath,
+			"enabled":                       vhost.Enabled,
+			"websocket_enabled":             vhost.WebsocketEnabled,
+			"http_version":                  vhost.HTTPVersion,
+			"tls_version":                   vhost.TLSVersion,
+			"max_upload_size":               vhost.MaxUploadSize,
+			"proxy_read_timeout":            vhost.ProxyReadTimeout,
+			"proxy_connect_timeout":         vhost.ProxyConnectTimeout,
+			"bot_detection_enabled":         vhost.BotDetectionEnabled,
+			"bot_detection_type":            vhost.BotDetectionType,
+			"bot_detection_mode":            vhost.BotDetectionMode,
+			"recaptcha_version":             vhost.RecaptchaVersion,
+			"bot_score_challenge_threshold": vhost.BotScoreChallenge,
+			"bot_score_block_threshold":     vhost.BotScoreBlock,
+			"rate_limit_enabled":            vhost.RateLimitEnabled,
+			"rate_limit_requests":           vhost.RateLimitRequests,
+			"rate_limit_window":             vhost.RateLimitWindow,
+			"asn_rate_limit_requests":       vhost.ASNRateLimit,
+			"log_retention_days":            vhost.LogRetentionDays,
+			"capture_sample_percent":        vhost.CaptureSample,
+			"region_whitelist":              vhost.RegionWhitelist,
+			"region_blacklist":              vhost.RegionBlacklist,
+			"region_filtering_enabled":      vhost.RegionFiltering,
+			"geoip_fail_policy":             vhost.GeoIPFailPolicy,
+			"custom_headers":                vhost.CustomHeaders,
+			"custom_locations":              customLocs,
+			"created_at":                    vhost.CreatedAt,
+			"updated_at":                    vhost.UpdatedAt,
 		})
 	}
 
@@ -294,13 +326,20 @@ func (h *VHostHandler) CreateVHost(c *gin.Context) {
 		ProxyConnectTimeout    int                      `json:"proxy_connect_timeout"`
 		BotDetectionEnabled    bool                     `json:"bot_detection_enabled"`
 		BotDetectionType       string                   `json:"bot_detection_type"`
+		BotDetectionMode       string                   `json:"bot_detection_mode" binding:"omitempty,oneof=challenge_all score"`
+		BotScoreChallenge      int                      `json:"bot_score_challenge_threshold"`
+		BotScoreBlock          int                      `json:"bot_score_block_threshold"`
 		RecaptchaVersion       string                   `json:"recaptcha_version"`
 		RateLimitEnabled       bool                     `json:"rate_limit_enabled"`
 		RateLimitRequests      int                      `json:"rate_limit_requests"`
 		RateLimitWindow        int                      `json:"rate_limit_window"`
+		ASNRateLimit           int                      `json:"asn_rate_limit_requests" binding:"min=0"`
+		LogRetentionDays       int                      `json:"log_retention_days" binding:"min=0"`
+		CaptureSamplePercent   float64                  `json:"capture_sample_percent" binding:"min=0,max=100"`
 		RegionWhitelist        []string                 `json:"region_whitelist"`
 		RegionBlacklist        []string                 `json:"region_blacklist"`
 		RegionFilteringEnabled bool                     `json:"region_filtering_enabled"`
+		GeoIPFailPolicy        string                   `json:"geoip_fail_policy" binding:"omitempty,oneof=open closed"`
 		CustomHeaders          map[string]interface{}   `json:"custom_headers"`
 		CustomLocations        []map[string]interface{} `json:"custom_locations"`
 	}
@@ -326,6 +365,14 @@ func (h *VHostHandler) CreateVHost(c *gin.Context) {
 	if input.RecaptchaVersion == "" {
 		input.RecaptchaVersion = "v2"
 	}
+	setBotScoreDefaults(&input.BotDetectionMode, &input.BotScoreChallenge, &input.BotScoreBlock)
+	if err := validateBotScoreBands(input.BotScoreChallenge, input.BotScoreBlock); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.GeoIPFailPolicy == "" {
+		input.GeoIPFailPolicy = "open"
+	}
 	if input.RateLimitRequests == 0 {
 		input.RateLimitRequests = 100
 	}
@@ -366,8 +413,10 @@ func (h *VHostHandler) CreateVHost(c *gin.Context) {
 		                   bot_detection_enabled, bot_detection_type, recaptcha_version,
 		                   rate_limit_enabled, rate_limit_requests, rate_limit_window,
 		                   region_whitelist, region_blacklist, region_filtering_enabled,
-		                   custom_headers, created_at, updated_at)
-		VALUES (gen_random_uuid(), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29)
+		                   custom_headers, created_at, updated_at,
+		                   bot_detection_mode, bot_score_challenge_threshold, bot_score_block_threshold,
+		                   geoip_fail_policy, asn_rate_limit_requests, log_retention_days, capture_sample_percent)
+		VALUES (gen_random_uuid(), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36)
 		RETURNING id
 	`
 
@@ -402,6 +451,13 @@ func (h *VHostHandler) CreateVHost(c *gin.Context) {
 		customHeadersJSON,
 		time.Now(),
 		time.Now(),
+		input.BotDetectionMode,
+		input.BotScoreChallenge,
+		input.BotScoreBlock,
+		input.GeoIPFailPolicy,
+		input.ASNRateLimit,
+		input.LogRetentionDays,
+		input.CaptureSamplePercent,
 	).Scan(&id)
 
 	if err != nil {
@@ -456,7 +512,7 @@ func (h *VHostHandler) CreateVHost(c *gin.Context) {
 
 	// Generate nginx config for this vhost
 	if err := h.nginxConfigService.GenerateVHostConfig(vhost); err != nil {
-		fmt.Printf("Warning: Failed to generate nginx config: %v\n", err)
+		vhostLog.Warn("Failed to generate nginx config", "domain", vhost.Domain, "error", err)
 	}
 
 	// Reload nginx
@@ -465,9 +521,10 @@ func (h *VHostHandler) CreateVHost(c *gin.Context) {
 	// Reload proxy map to include new vhost
 	if h.proxyReloader != nil {
 		if err := h.proxyReloader.ReloadVHosts(); err != nil {
-			fmt.Printf(proxyReloadWarningMsg, err)
+			vhostLog.Warn("Failed to reload proxy map", "error", err)
 		}
 	}
+	h.cluster.Publish(services.ClusterEventVHost, id)
 
 	c.JSON(http.StatusCreated, gin.H{"id": id, "message": "VHost created successfully"})
 }
@@ -496,13 +553,20 @@ func (h *VHostHandler) UpdateVHost(c *gin.Context) {
 		ProxyConnectTimeout    int                      `json:"proxy_connect_timeout"`
 		BotDetectionEnabled    bool                     `json:"bot_detection_enabled"`
 		BotDetectionType       string                   `json:"bot_detection_type"`
+		BotDetectionMode       string                   `json:"bot_detection_mode" binding:"omitempty,oneof=challenge_all score"`
+		BotScoreChallenge      int                      `json:"bot_score_challenge_threshold"`
+		BotScoreBlock          int                      `json:"bot_score_block_threshold"`
 		RecaptchaVersion       string                   `json:"recaptcha_version"`
 		RateLimitEnabled       bool                     `json:"rate_limit_enabled"`
 		RateLimitRequests      int                      `json:"rate_limit_requests"`
 		RateLimitWindow        int                      `json:"rate_limit_window"`
+		ASNRateLimit           int                      `json:"asn_rate_limit_requests" binding:"min=0"`
+		LogRetentionDays       int                      `json:"log_retention_days" binding:"min=0"`
+		CaptureSamplePercent   float64                  `json:"capture_sample_percent" binding:"min=0,max=100"`
 		RegionWhitelist        []string                 `json:"region_whitelist"`
 		RegionBlacklist        []string                 `json:"region_blacklist"`
 		RegionFilteringEnabled bool                     `json:"region_filtering_enabled"`
+		GeoIPFailPolicy        string                   `json:"geoip_fail_policy" binding:"omitempty,oneof=open closed"`
 		CustomHeaders          map[string]interface{}   `json:"custom_headers"`
 		CustomLocations        []map[string]interface{} `json:"custom_locations"`
 	}
@@ -521,8 +585,11 @@ func (h *VHostHandler) UpdateVHost(c *gin.Context) {
 		    bot_detection_enabled = $18, bot_detection_type = $19, recaptcha_version = $20,
 		    rate_limit_enabled = $21, rate_limit_requests = $22, rate_limit_window = $23,
 		    region_whitelist = $24, region_blacklist = $25, region_filtering_enabled = $26,
-		    custom_headers = $27, updated_at = $28
-		WHERE id = $29
+		    custom_headers = $27, updated_at = $28,
+		    bot_detection_mode = $29, bot_score_challenge_threshold = $30, bot_score_block_threshold = $31,
+		    geoip_fail_policy = $32, asn_rate_limit_requests = $33, log_retention_days = $34,
+		    capture_sample_percent = $35
+		WHERE id = $36
 	`
 
 	// Set defaults
@@ -547,6 +614,14 @@ func (h *VHostHandler) UpdateVHost(c *gin.Context) {
 	if input.LoadBalanceMethod == "" {
 		input.LoadBalanceMethod = "round_robin"
 	}
+	setBotScoreDefaults(&input.BotDetectionMode, &input.BotScoreChallenge, &input.BotScoreBlock)
+	if err := validateBotScoreBands(input.BotScoreChallenge, input.BotScoreBlock); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.GeoIPFailPolicy == "" {
+		input.GeoIPFailPolicy = "open"
+	}
 
 	// Marshal custom_headers to JSON
 	customHeadersJSON, err := json.Marshal(input.CustomHeaders)
@@ -591,11 +666,18 @@ func (h *VHostHandler) UpdateVHost(c *gin.Context) {
 		input.RegionFilteringEnabled,
 		customHeadersJSON,
 		time.Now(),
+		input.BotDetectionMode,
+		input.BotScoreChallenge,
+		input.BotScoreBlock,
+		input.GeoIPFailPolicy,
+		input.ASNRateLimit,
+		input.LogRetentionDays,
+		input.CaptureSamplePercent,
 		id,
 	)
 
 	if err != nil {
-		fmt.Printf("Error updating vhost: %v\n", err)
+		vhostLog.Error("Failed to update vhost", "id", id, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -603,7 +685,7 @@ func (h *VHostHandler) UpdateVHost(c *gin.Context) {
 	// Delete existing custom locations and insert new ones
 	_, err = h.db.Exec("DELETE FROM vhost_locations WHERE vhost_id = $1", id)
 	if err != nil {
-		fmt.Printf("Error deleting old locations: %v\n", err)
+		vhostLog.Error("Failed to delete old locations", "id", id, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete old locations: " + err.Error()})
 		return
 	}
@@ -631,7 +713,7 @@ func (h *VHostHandler) UpdateVHost(c *gin.Context) {
 				time.Now(),
 			)
 			if err != nil {
-				fmt.Printf("Error creating location in UpdateVHost: %v, loc data: %+v\n", err, loc)
+				vhostLog.Error("Failed to create location", "id", id, "path", loc["path"], "error", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create location: " + err.Error()})
 				return
 			}
@@ -656,7 +738,7 @@ func (h *VHostHandler) UpdateVHost(c *gin.Context) {
 
 	// Regenerate nginx config for this vhost
 	if err := h.nginxConfigService.GenerateVHostConfig(vhost); err != nil {
-		fmt.Printf("Warning: Failed to generate nginx config: %v\n", err)
+		vhostLog.Warn("Failed to generate nginx config", "domain", vhost.Domain, "error", err)
 	}
 
 	// Reload nginx
@@ -665,9 +747,10 @@ func (h *VHostHandler) UpdateVHost(c *gin.Context) {
 	// Reload proxy map
 	if h.proxyReloader != nil {
 		if err := h.proxyReloader.ReloadVHosts(); err != nil {
-			fmt.Printf(proxyReloadWarningMsg, err)
+			vhostLog.Warn("Failed to reload proxy map", "error", err)
 		}
 	}
+	h.cluster.Publish(services.ClusterEventVHost, id)
 
 	c.JSON(http.StatusOK, gin.H{"message": "VHost updated successfully"})
 }
@@ -698,7 +781,7 @@ func (h *VHostHandler) DeleteVHost(c *gin.Context) {
 
 	// Delete nginx config
 	if err := h.nginxConfigService.DeleteVHostConfig(vhost.Domain); err != nil {
-		fmt.Printf("Warning: Failed to delete nginx config: %v\n", err)
+		vhostLog.Warn("Failed to delete nginx config", "domain", vhost.Domain, "error", err)
 	}
 
 	// Delete log files
@@ -707,11 +790,11 @@ func (h *VHostHandler) DeleteVHost(c *gin.Context) {
 	errorLogPath := fmt.Sprintf("%s/%s_error.log", logDir, vhost.Domain)
 
 	if err := os.Remove(accessLogPath); err != nil && !os.IsNotExist(err) {
-		fmt.Printf("Warning: Failed to delete access log %s: %v\n", accessLogPath, err)
+		vhostLog.Warn("Failed to delete access log", "path", accessLogPath, "error", err)
 	}
 
 	if err := os.Remove(errorLogPath); err != nil && !os.IsNotExist(err) {
-		fmt.Printf("Warning: Failed to delete error log %s: %v\n", errorLogPath, err)
+		vhostLog.Warn("Failed to delete error log", "path", errorLogPath, "error", err)
 	}
 
 	// Reload nginx
@@ -720,9 +803,10 @@ func (h *VHostHandler) DeleteVHost(c *gin.Context) {
 	// Reload proxy map
 	if h.proxyReloader != nil {
 		if err := h.proxyReloader.ReloadVHosts(); err != nil {
-			fmt.Printf(proxyReloadWarningMsg, err)
+			vhostLog.Warn("Failed to reload proxy map", "error", err)
 		}
 	}
+	h.cluster.Publish(services.ClusterEventVHost, id)
 
 	c.JSON(http.StatusOK, gin.H{"message": "VHost deleted successfully"})
 }
@@ -772,7 +856,7 @@ func (h *VHostHandler) UpdateVHostConfig(c *gin.Context) {
 	backupPath := configPath + ".backup"
 	if existingContent, err := os.ReadFile(configPath); err == nil {
 		if err := os.WriteFile(backupPath, existingContent, 0644); err != nil {
-			fmt.Printf("Warning: Failed to create backup: %v\n", err)
+			vhostLog.Warn("Failed to back up nginx config", "path", backupPath, "error", err)
 		}
 	}
 
@@ -792,15 +876,40 @@ func (h *VHostHandler) UpdateVHostConfig(c *gin.Context) {
 	})
 }
 
+// setBotScoreDefaults fills in the bot detection mode and score bands when
+// they are not provided. Vhosts challenge every visitor unless score mode is
+// chosen explicitly.
+func setBotScoreDefaults(mode *string, challengeThreshold, blockThreshold *int) {
+	if *mode == "" {
+		*mode = "challenge_all"
+	}
+	if *challengeThreshold == 0 {
+		*challengeThreshold = 30
+	}
+	if *blockThreshold == 0 {
+		*blockThreshold = 70
+	}
+}
+
+// validateBotScoreBands checks that the challenge band starts above zero and
+// below the block band, which ends at the maximum score of 100
+func validateBotScoreBands(challengeThreshold, blockThreshold int) error {
+	if challengeThreshold <= 0 || challengeThreshold >= blockThreshold || blockThreshold > 100 {
+		return errors.New("bot score thresholds must satisfy 0 < bot_score_challenge_threshold < bot_score_block_threshold <= 100")
+	}
+	return nil
+}
+
 // reloadNginx sends reload signal to nginx
 func (h *VHostHandler) reloadNginx() {
 	// Instead of using docker exec, we'll create a reload signal file
 	// A separate script or nginx itself can watch this file
 	signalFile := "/data/nginx/.reload"
 	if err := os.WriteFile(signalFile, []byte(time.Now().Format(time.RFC3339)), 0644); err != nil {
-		fmt.Printf("Warning: Failed to create reload signal: %v\n", err)
+		vhostLog.Warn("Failed to create nginx reload signal", "path", signalFile, "error", err)
+		return
 	}
-	fmt.Println("Nginx reload signal created, manual reload may be needed: docker compose exec nginx-proxy nginx -s reload")
+	vhostLog.Info("Nginx reload signal created, manual reload may be needed: docker compose exec nginx-proxy nginx -s reload")
 }
 
 // RegenerateAllConfigs regenerates nginx config files for all vhosts
@@ -834,9 +943,10 @@ func (h *VHostHandler) RegenerateAllConfigs(c *gin.Context) {
 	// Reload proxy map
 	if h.proxyReloader != nil {
 		if err := h.proxyReloader.ReloadVHosts(); err != nil {
-			fmt.Printf(proxyReloadWarningMsg, err)
+			vhostLog.Warn("Failed to reload proxy map", "error", err)
 		}
 	}
+	h.cluster.Publish(services.ClusterEventVHost, "")
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":     "Configs regenerated successfully",
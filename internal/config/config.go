@@ -17,6 +17,13 @@ type Config struct {
 	SSL       SSLConfig       `yaml:"ssl"`
 	Logging   LoggingConfig   `yaml:"logging"`
 	Turnstile TurnstileConfig `yaml:"turnstile"`
+	Cluster   ClusterConfig   `yaml:"cluster"`
+	Export    ExportConfig    `yaml:"export"`
+	SIEM      SIEMConfig      `yaml:"siem"`
+	Alerts    AlertsConfig    `yaml:"alerts"`
+	Reports   ReportsConfig   `yaml:"reports"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Tracing   TracingConfig   `yaml:"tracing"`
 }
 
 type ServerConfig struct {
@@ -47,10 +54,23 @@ type RedisConfig struct {
 }
 
 type WAFConfig struct {
-	RateLimit RateLimitConfig `yaml:"rate_limit"`
-	HTTPFlood HTTPFloodConfig `yaml:"http_flood"`
-	AntiBot   AntiBotConfig   `yaml:"anti_bot"`
-	GeoIP     GeoIPConfig     `yaml:"geoip"`
+	// TrustedProxies are the peers (the nginx front proxy) whose X-Real-IP
+	// header is taken as the client IP; other peers are the client themselves
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	HTTPFlood   HTTPFloodConfig   `yaml:"http_flood"`
+	AntiBot     AntiBotConfig     `yaml:"anti_bot"`
+	GeoIP       GeoIPConfig       `yaml:"geoip"`
+	Jail        JailConfig        `yaml:"jail"`
+	Conn        ConnLimitConfig   `yaml:"connection_limits"`
+	Attack      AttackModeConfig  `yaml:"attack_mode"`
+	Feeds       FeedConfig        `yaml:"feeds"`
+	TrafficLog  TrafficLogConfig  `yaml:"traffic_log"`
+	LogStorage  LogStorageConfig  `yaml:"log_storage"`
+	RequestID   RequestIDConfig   `yaml:"request_id"`
+	Capture     CaptureConfig     `yaml:"capture"`
+	NginxIngest NginxIngestConfig `yaml:"nginx_ingest"`
 }
 
 type RateLimitConfig struct {
@@ -72,9 +92,231 @@ type AntiBotConfig struct {
 	BlacklistUserAgents []string `yaml:"blacklist_user_agents"`
 }
 
+// JailConfig controls escalating temporary bans. Offences are weighted and
+// counted per IP over OffenceWindow seconds; reaching OffenceThreshold bans the
+// IP for the next duration in BanDurations (seconds). The first level falls
+// back to HTTPFlood.BlockDuration when BanDurations is empty.
+type JailConfig struct {
+	Enabled          bool  `yaml:"enabled"`
+	OffenceThreshold int   `yaml:"offence_threshold"`
+	OffenceWindow    int   `yaml:"offence_window"`
+	BanDurations     []int `yaml:"ban_durations"`
+	EscalationReset  int   `yaml:"escalation_reset"`
+}
+
+// ConnLimitConfig protects the WAF listener against slowloris style and
+// connection-level DoS. Per-IP connection limits and header timeout offences
+// apply to the TCP peer, so they only cover clients connecting directly;
+// connections from TrustedProxies (e.g. the nginx front proxy) are not
+// counted, and nginx enforces its own limits for the clients it proxies.
+// In-flight request limits use the forwarded client IP.
+type ConnLimitConfig struct {
+	MaxConnectionsPerIP      int           `yaml:"max_connections_per_ip"`
+	MaxInFlightRequestsPerIP int           `yaml:"max_inflight_requests_per_ip"`
+	ReadHeaderTimeout        time.Duration `yaml:"read_header_timeout"`
+	MaxHeaderBytes           int           `yaml:"max_header_bytes"`
+	MinUploadRate            int           `yaml:"min_upload_rate"`
+	UploadGracePeriod        time.Duration `yaml:"upload_grace_period"`
+	IdleTimeout              time.Duration `yaml:"idle_timeout"`
+	MaxIdleConnections       int           `yaml:"max_idle_connections"`
+	TrustedProxies           []string      `yaml:"trusted_proxies"`
+}
+
+// AttackModeConfig controls the adaptive "under attack" mode. Each vhost's
+// normal request rate and error rate are learned as a moving baseline; the
+// vhost enters attack mode when traffic exceeds TriggerFactor times the
+// baseline and leaves it once traffic stays below ReleaseFactor times the
+// baseline for Cooldown.
+type AttackModeConfig struct {
+	Enabled            bool          `yaml:"enabled"`
+	TriggerFactor      float64       `yaml:"trigger_factor"`
+	ReleaseFactor      float64       `yaml:"release_factor"`
+	MinRPS             float64       `yaml:"min_rps"`
+	MinErrorRate       float64       `yaml:"min_error_rate"`
+	Warmup             time.Duration `yaml:"warmup"`
+	Cooldown           time.Duration `yaml:"cooldown"`
+	EvaluationInterval time.Duration `yaml:"evaluation_interval"`
+	RateLimitFactor    float64       `yaml:"rate_limit_factor"`
+	RateLimitRequests  int           `yaml:"rate_limit_requests"`
+	RateLimitWindow    int           `yaml:"rate_limit_window"`
+}
+
+// RequestIDConfig controls request IDs. Header (default X-Request-ID) is
+// forwarded to backends and returned to clients; an incoming value is kept
+// only when the TCP peer is in TrustedProxies, otherwise a new ID is issued.
+type RequestIDConfig struct {
+	Header         string   `yaml:"header"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// CaptureConfig controls forensic request captures. Requests flagged as
+// attacks, and a vhost's capture_sample_percent of other requests, are stored
+// with their headers and up to MaxBodyBytes of body in request_captures for
+// Retention. Header names in RedactHeaders and JSON or form fields in
+// RedactFields are replaced before storage. Replays give up after
+// ReplayTimeout.
+type CaptureConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	MaxBodyBytes  int           `yaml:"max_body_bytes"`
+	QueueSize     int           `yaml:"queue_size"`
+	Retention     time.Duration `yaml:"retention"`
+	RedactHeaders []string      `yaml:"redact_headers"`
+	RedactFields  []string      `yaml:"redact_fields"`
+	ReplayTimeout time.Duration `yaml:"replay_timeout"`
+}
+
+// NginxIngestConfig controls the ingest of nginx access logs into
+// traffic_logs. The JSON access log of every enabled vhost in LogDir is
+// followed, every PollInterval, by one replica at a time. Requests nginx
+// served without passing them to the WAF, such as cached static assets, are
+// written to the traffic log pipeline with log_source nginx.
+type NginxIngestConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	LogDir       string        `yaml:"log_dir"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// TrafficLogConfig controls the asynchronous traffic log writer. Requests are
+// queued in memory (QueueSize) and written by Workers in batches of up to
+// BatchSize rows, at least every FlushInterval. When the queue is full a
+// request waits up to EnqueueTimeout for room and is then left out of the log.
+type TrafficLogConfig struct {
+	QueueSize      int           `yaml:"queue_size"`
+	BatchSize      int           `yaml:"batch_size"`
+	Workers        int           `yaml:"workers"`
+	FlushInterval  time.Duration `yaml:"flush_interval"`
+	FlushTimeout   time.Duration `yaml:"flush_timeout"`
+	EnqueueTimeout time.Duration `yaml:"enqueue_timeout"`
+}
+
+// LogStorageConfig controls traffic_logs partitioning, retention and the
+// rollup tables the dashboard reads. Partitions are created PartitionsAhead
+// intervals in advance and dropped once older than the longest retention;
+// vhosts with a shorter log_retention_days have their rows deleted earlier.
+type LogStorageConfig struct {
+	PartitionInterval     string        `yaml:"partition_interval"` // daily or hourly
+	PartitionsAhead       int           `yaml:"partitions_ahead"`
+	Retention             time.Duration `yaml:"retention"`
+	MinuteRollupRetention time.Duration `yaml:"minute_rollup_retention"`
+	HourRollupRetention   time.Duration `yaml:"hour_rollup_retention"`
+	MaintenanceInterval   time.Duration `yaml:"maintenance_interval"`
+	RollupInterval        time.Duration `yaml:"rollup_interval"`
+	RollupLateness        time.Duration `yaml:"rollup_lateness"`
+}
+
+type FeedConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	FetchTimeout  time.Duration `yaml:"fetch_timeout"`
+	MaxEntries    int           `yaml:"max_entries"`
+	MaxSize       int64         `yaml:"max_size"`
+	LocalDir      string        `yaml:"local_dir"`
+}
+
 type GeoIPConfig struct {
-	Enabled      bool   `yaml:"enabled"`
-	DatabasePath string `yaml:"database_path"`
+	Enabled          bool          `yaml:"enabled"`
+	DatabasePath     string        `yaml:"database_path"`
+	ASNDatabasePath  string        `yaml:"asn_database_path"`
+	CityDatabasePath string        `yaml:"city_database_path"`
+	CacheSize        int           `yaml:"cache_size"`
+	ReloadInterval   time.Duration `yaml:"reload_interval"`
+}
+
+// ClusterConfig lets several WAF replicas behind one load balancer share
+// configuration changes over Redis pub/sub. Each node heartbeats every
+// HeartbeatInterval and is reported as down after NodeTimeout without one.
+// NodeID defaults to the hostname.
+type ClusterConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	NodeID            string        `yaml:"node_id"`
+	Channel           string        `yaml:"channel"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	NodeTimeout       time.Duration `yaml:"node_timeout"`
+}
+
+// ExportConfig controls asynchronous log export jobs. Files are written to
+// Dir by Workers and deleted with their job after Retention; jobs running
+// longer than JobTimeout are cancelled.
+type ExportConfig struct {
+	Dir        string        `yaml:"dir"`
+	Workers    int           `yaml:"workers"`
+	Retention  time.Duration `yaml:"retention"`
+	JobTimeout time.Duration `yaml:"job_timeout"`
+}
+
+// SIEMConfig forwards block and attack events to external collectors. Each
+// sink has its own buffer, so a slow or unreachable collector only drops its
+// own events.
+type SIEMConfig struct {
+	Enabled bool             `yaml:"enabled"`
+	Sinks   []SIEMSinkConfig `yaml:"sinks"`
+}
+
+// SIEMSinkConfig describes one event destination. Format is syslog
+// (RFC 5424), cef or json; Transport is udp, tcp, tls or file. Events below
+// MinSeverity, or not matching a non-empty VHosts or AttackTypes list, are
+// skipped. Failed writes are retried with backoff from RetryInterval up to
+// MaxRetryInterval while new events wait in a BufferSize queue.
+type SIEMSinkConfig struct {
+	Name             string        `yaml:"name"`
+	Format           string        `yaml:"format"`
+	Transport        string        `yaml:"transport"`
+	Address          string        `yaml:"address"`
+	Path             string        `yaml:"path"`
+	Facility         int           `yaml:"facility"`
+	AppName          string        `yaml:"app_name"`
+	TLSCAFile        string        `yaml:"tls_ca_file"`
+	TLSSkipVerify    bool          `yaml:"tls_skip_verify"`
+	MinSeverity      string        `yaml:"min_severity"`
+	VHosts           []string      `yaml:"vhosts"`
+	AttackTypes      []string      `yaml:"attack_types"`
+	BufferSize       int           `yaml:"buffer_size"`
+	DialTimeout      time.Duration `yaml:"dial_timeout"`
+	RetryInterval    time.Duration `yaml:"retry_interval"`
+	MaxRetryInterval time.Duration `yaml:"max_retry_interval"`
+}
+
+// AlertsConfig controls the alert rule evaluator. Rules are checked every
+// EvaluationInterval; backend probes and notification requests give up after
+// ProbeTimeout and NotifyTimeout.
+type AlertsConfig struct {
+	Enabled            bool          `yaml:"enabled"`
+	EvaluationInterval time.Duration `yaml:"evaluation_interval"`
+	ProbeTimeout       time.Duration `yaml:"probe_timeout"`
+	NotifyTimeout      time.Duration `yaml:"notify_timeout"`
+}
+
+// ReportsConfig controls scheduled email reports. Schedules are checked every
+// CheckInterval; certificates expiring within CertificateDays of a report's
+// end are listed in it.
+type ReportsConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	CheckInterval   time.Duration `yaml:"check_interval"`
+	CertificateDays int           `yaml:"certificate_days"`
+}
+
+// MetricsConfig controls the Prometheus endpoint. It is served on the admin
+// server unless Listen gives it its own address; BearerToken, when set, must
+// be sent by the scraper.
+type MetricsConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Listen      string `yaml:"listen"`
+	Path        string `yaml:"path"`
+	BearerToken string `yaml:"bearer_token"`
+}
+
+// TracingConfig controls OpenTelemetry tracing. Spans are exported over
+// OTLP/HTTP to Endpoint (host:port or a full URL); SampleRatio of new traces
+// are kept. An incoming traceparent is only continued when
+// TrustIncomingTraceparent is set, so clients cannot force sampling.
+type TracingConfig struct {
+	Enabled                  bool              `yaml:"enabled"`
+	Endpoint                 string            `yaml:"endpoint"`
+	Insecure                 bool              `yaml:"insecure"`
+	Headers                  map[string]string `yaml:"headers"`
+	ServiceName              string            `yaml:"service_name"`
+	SampleRatio              float64           `yaml:"sample_ratio"`
+	TrustIncomingTraceparent bool              `yaml:"trust_incoming_traceparent"`
 }
 
 type SSLConfig struct {
@@ -82,11 +324,18 @@ type SSLConfig struct {
 	CertDir  string `yaml:"cert_dir"`
 }
 
+// LoggingConfig controls the structured logger. Level is the default for
+// every component; Components overrides it per component (e.g. ip_blocker:
+// debug). With Output file, the log is rotated at MaxSizeMB and MaxBackups
+// old files are kept.
 type LoggingConfig struct {
-	Level    string `yaml:"level"`
-	Format   string `yaml:"format"`
-	Output   string `yaml:"output"`
-	FilePath string `yaml:"file_path"`
+	Level      string            `yaml:"level"`
+	Format     string            `yaml:"format"`
+	Output     string            `yaml:"output"`
+	FilePath   string            `yaml:"file_path"`
+	MaxSizeMB  int               `yaml:"max_size_mb"`
+	MaxBackups int               `yaml:"max_backups"`
+	Components map[string]string `yaml:"components"`
 }
 
 type TurnstileConfig struct {
@@ -190,6 +439,11 @@ func (c *Config) overrideFromEnv() {
 		}
 	}
 
+	// WAF - Client IP
+	if val := os.Getenv("WAF_TRUSTED_PROXIES"); val != "" {
+		c.WAF.TrustedProxies = splitAndTrim(val, ",")
+	}
+
 	// WAF - Rate Limit
 	if val := os.Getenv("WAF_RATE_LIMIT_ENABLED"); val != "" {
 		c.WAF.RateLimit.Enabled = val == "true"
@@ -220,6 +474,97 @@ func (c *Config) overrideFromEnv() {
 		}
 	}
 
+	// WAF - Jail
+	if val := os.Getenv("WAF_JAIL_ENABLED"); val != "" {
+		c.WAF.Jail.Enabled = val == "true"
+	}
+	if val := os.Getenv("WAF_JAIL_OFFENCE_THRESHOLD"); val != "" {
+		if threshold, err := strconv.Atoi(val); err == nil {
+			c.WAF.Jail.OffenceThreshold = threshold
+		}
+	}
+	if val := os.Getenv("WAF_JAIL_OFFENCE_WINDOW"); val != "" {
+		if window, err := strconv.Atoi(val); err == nil {
+			c.WAF.Jail.OffenceWindow = window
+		}
+	}
+	if val := os.Getenv("WAF_JAIL_ESCALATION_RESET"); val != "" {
+		if reset, err := strconv.Atoi(val); err == nil {
+			c.WAF.Jail.EscalationReset = reset
+		}
+	}
+	if val := os.Getenv("WAF_JAIL_BAN_DURATIONS"); val != "" {
+		durations := []int{}
+		for _, part := range splitAndTrim(val, ",") {
+			if duration, err := strconv.Atoi(part); err == nil {
+				durations = append(durations, duration)
+			}
+		}
+		c.WAF.Jail.BanDurations = durations
+	}
+
+	// WAF - Connection limits
+	if val := os.Getenv("WAF_MAX_CONNECTIONS_PER_IP"); val != "" {
+		if limit, err := strconv.Atoi(val); err == nil {
+			c.WAF.Conn.MaxConnectionsPerIP = limit
+		}
+	}
+	if val := os.Getenv("WAF_MAX_INFLIGHT_REQUESTS_PER_IP"); val != "" {
+		if limit, err := strconv.Atoi(val); err == nil {
+			c.WAF.Conn.MaxInFlightRequestsPerIP = limit
+		}
+	}
+	if val := os.Getenv("WAF_READ_HEADER_TIMEOUT"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WAF.Conn.ReadHeaderTimeout = duration
+		}
+	}
+	if val := os.Getenv("WAF_MAX_HEADER_BYTES"); val != "" {
+		if size, err := strconv.Atoi(val); err == nil {
+			c.WAF.Conn.MaxHeaderBytes = size
+		}
+	}
+	if val := os.Getenv("WAF_MIN_UPLOAD_RATE"); val != "" {
+		if rate, err := strconv.Atoi(val); err == nil {
+			c.WAF.Conn.MinUploadRate = rate
+		}
+	}
+	if val := os.Getenv("WAF_IDLE_TIMEOUT"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WAF.Conn.IdleTimeout = duration
+		}
+	}
+	if val := os.Getenv("WAF_MAX_IDLE_CONNECTIONS"); val != "" {
+		if limit, err := strconv.Atoi(val); err == nil {
+			c.WAF.Conn.MaxIdleConnections = limit
+		}
+	}
+
+	// WAF - Attack mode
+	if val := os.Getenv("WAF_ATTACK_MODE_ENABLED"); val != "" {
+		c.WAF.Attack.Enabled = val == "true"
+	}
+	if val := os.Getenv("WAF_ATTACK_MODE_TRIGGER_FACTOR"); val != "" {
+		if factor, err := strconv.ParseFloat(val, 64); err == nil {
+			c.WAF.Attack.TriggerFactor = factor
+		}
+	}
+	if val := os.Getenv("WAF_ATTACK_MODE_RELEASE_FACTOR"); val != "" {
+		if factor, err := strconv.ParseFloat(val, 64); err == nil {
+			c.WAF.Attack.ReleaseFactor = factor
+		}
+	}
+	if val := os.Getenv("WAF_ATTACK_MODE_MIN_RPS"); val != "" {
+		if rps, err := strconv.ParseFloat(val, 64); err == nil {
+			c.WAF.Attack.MinRPS = rps
+		}
+	}
+	if val := os.Getenv("WAF_ATTACK_MODE_COOLDOWN"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WAF.Attack.Cooldown = duration
+		}
+	}
+
 	// WAF - Anti Bot
 	if val := os.Getenv("WAF_ANTI_BOT_ENABLED"); val != "" {
 		c.WAF.AntiBot.Enabled = val == "true"
@@ -228,6 +573,151 @@ func (c *Config) overrideFromEnv() {
 		c.WAF.AntiBot.ChallengeMode = val
 	}
 
+	// WAF - Traffic log
+	if val := os.Getenv("WAF_TRAFFIC_LOG_QUEUE_SIZE"); val != "" {
+		if size, err := strconv.Atoi(val); err == nil {
+			c.WAF.TrafficLog.QueueSize = size
+		}
+	}
+	if val := os.Getenv("WAF_TRAFFIC_LOG_BATCH_SIZE"); val != "" {
+		if size, err := strconv.Atoi(val); err == nil {
+			c.WAF.TrafficLog.BatchSize = size
+		}
+	}
+	if val := os.Getenv("WAF_TRAFFIC_LOG_WORKERS"); val != "" {
+		if workers, err := strconv.Atoi(val); err == nil {
+			c.WAF.TrafficLog.Workers = workers
+		}
+	}
+	if val := os.Getenv("WAF_TRAFFIC_LOG_FLUSH_INTERVAL"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WAF.TrafficLog.FlushInterval = duration
+		}
+	}
+
+	// WAF - Log storage
+	if val := os.Getenv("WAF_LOG_PARTITION_INTERVAL"); val != "" {
+		c.WAF.LogStorage.PartitionInterval = val
+	}
+	if val := os.Getenv("WAF_LOG_RETENTION"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WAF.LogStorage.Retention = duration
+		}
+	}
+	if val := os.Getenv("WAF_LOG_ROLLUP_INTERVAL"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WAF.LogStorage.RollupInterval = duration
+		}
+	}
+
+	// WAF - IP reputation feeds
+	if val := os.Getenv("WAF_FEEDS_ENABLED"); val != "" {
+		c.WAF.Feeds.Enabled = val == "true"
+	}
+	if val := os.Getenv("WAF_FEEDS_FETCH_TIMEOUT"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WAF.Feeds.FetchTimeout = duration
+		}
+	}
+	if val := os.Getenv("WAF_FEEDS_MAX_ENTRIES"); val != "" {
+		if maxEntries, err := strconv.Atoi(val); err == nil {
+			c.WAF.Feeds.MaxEntries = maxEntries
+		}
+	}
+	if val := os.Getenv("WAF_FEEDS_LOCAL_DIR"); val != "" {
+		c.WAF.Feeds.LocalDir = val
+	}
+
+	// WAF - Request captures
+	if val := os.Getenv("WAF_CAPTURE_ENABLED"); val != "" {
+		c.WAF.Capture.Enabled = val == "true"
+	}
+	if val := os.Getenv("WAF_CAPTURE_MAX_BODY_BYTES"); val != "" {
+		if size, err := strconv.Atoi(val); err == nil {
+			c.WAF.Capture.MaxBodyBytes = size
+		}
+	}
+	if val := os.Getenv("WAF_CAPTURE_RETENTION"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WAF.Capture.Retention = duration
+		}
+	}
+
+	// WAF - nginx access log ingest
+	if val := os.Getenv("WAF_NGINX_INGEST_ENABLED"); val != "" {
+		c.WAF.NginxIngest.Enabled = val == "true"
+	}
+	if val := os.Getenv("WAF_NGINX_LOG_DIR"); val != "" {
+		c.WAF.NginxIngest.LogDir = val
+	}
+
+	// Cluster
+	if val := os.Getenv("CLUSTER_ENABLED"); val != "" {
+		c.Cluster.Enabled = val == "true"
+	}
+	if val := os.Getenv("CLUSTER_NODE_ID"); val != "" {
+		c.Cluster.NodeID = val
+	}
+	if val := os.Getenv("CLUSTER_HEARTBEAT_INTERVAL"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.Cluster.HeartbeatInterval = duration
+		}
+	}
+
+	// Log exports
+	if val := os.Getenv("EXPORT_DIR"); val != "" {
+		c.Export.Dir = val
+	}
+	if val := os.Getenv("EXPORT_WORKERS"); val != "" {
+		if workers, err := strconv.Atoi(val); err == nil {
+			c.Export.Workers = workers
+		}
+	}
+
+	// SIEM forwarding
+	if val := os.Getenv("SIEM_ENABLED"); val != "" {
+		c.SIEM.Enabled = val == "true"
+	}
+
+	// Alerts
+	if val := os.Getenv("ALERTS_ENABLED"); val != "" {
+		c.Alerts.Enabled = val == "true"
+	}
+	if val := os.Getenv("ALERTS_EVALUATION_INTERVAL"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.Alerts.EvaluationInterval = duration
+		}
+	}
+
+	// Scheduled reports
+	if val := os.Getenv("REPORTS_ENABLED"); val != "" {
+		c.Reports.Enabled = val == "true"
+	}
+
+	// Metrics
+	if val := os.Getenv("METRICS_ENABLED"); val != "" {
+		c.Metrics.Enabled = val == "true"
+	}
+	if val := os.Getenv("METRICS_LISTEN"); val != "" {
+		c.Metrics.Listen = val
+	}
+	if val := os.Getenv("METRICS_TOKEN"); val != "" {
+		c.Metrics.BearerToken = val
+	}
+
+	// Tracing
+	if val := os.Getenv("TRACING_ENABLED"); val != "" {
+		c.Tracing.Enabled = val == "true"
+	}
+	if val := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); val != "" {
+		c.Tracing.Endpoint = val
+	}
+	if val := os.Getenv("TRACING_SAMPLE_RATIO"); val != "" {
+		if ratio, err := strconv.ParseFloat(val, 64); err == nil {
+			c.Tracing.SampleRatio = ratio
+		}
+	}
+
 	// WAF - GeoIP
 	if val := os.Getenv("WAF_GEOIP_ENABLED"); val != "" {
 		c.WAF.GeoIP.Enabled = val == "true"
@@ -235,6 +725,22 @@ func (c *Config) overrideFromEnv() {
 	if val := os.Getenv("WAF_GEOIP_DATABASE_PATH"); val != "" {
 		c.WAF.GeoIP.DatabasePath = val
 	}
+	if val := os.Getenv("WAF_GEOIP_ASN_DATABASE_PATH"); val != "" {
+		c.WAF.GeoIP.ASNDatabasePath = val
+	}
+	if val := os.Getenv("WAF_GEOIP_CITY_DATABASE_PATH"); val != "" {
+		c.WAF.GeoIP.CityDatabasePath = val
+	}
+	if val := os.Getenv("WAF_GEOIP_CACHE_SIZE"); val != "" {
+		if size, err := strconv.Atoi(val); err == nil {
+			c.WAF.GeoIP.CacheSize = size
+		}
+	}
+	if val := os.Getenv("WAF_GEOIP_RELOAD_INTERVAL"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WAF.GeoIP.ReloadInterval = duration
+		}
+	}
 
 	// SSL
 	if val := os.Getenv("SSL_AUTO_CERT"); val != "" {
@@ -12,6 +12,7 @@ const (
 	RouteCertificateID   = "/certificates/:id"
 	RouteBlockingRuleID  = "/blocking-rules/:id"
 	RouteRateLimitRuleID = "/rate-limit-rules/:id"
+	RouteBanIP           = "/bans/:ip"
 )
 
 // SQL query constants
@@ -26,4 +27,8 @@ const (
 	ErrVHostNotFound         = "VHost not found"
 	ErrBlockingRuleNotFound  = "Blocking rule not found"
 	ErrRateLimitRuleNotFound = "Rate limit rule not found"
+	ErrBanNotFound           = "Ban not found"
+	ErrInvalidASNPattern     = "ASN pattern must be a comma-separated list of AS numbers, e.g. AS16509,14061"
+	ErrFeedNotFound          = "Feed not found"
+	ErrFeedManagedAddress    = "This address is managed by a feed; edit or remove the feed instead"
 )
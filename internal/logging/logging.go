@@ -0,0 +1,269 @@
+// Package logging is the structured, leveled logger of the WAF. Every
+// package logs through a component logger from Component; each component
+// can have its own level, changeable at runtime, and falls back to the
+// default level otherwise.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aleh/docode-waf/internal/config"
+)
+
+var (
+	defaultLevel slog.LevelVar
+
+	// root is where every component writes; replaced by Setup
+	root atomic.Pointer[slog.Handler]
+
+	componentsMu sync.Mutex
+	components   = map[string]*componentLevel{}
+)
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	root.Store(&h)
+}
+
+// componentLevel is a component's level override; without one it follows
+// the default level
+type componentLevel struct {
+	level atomic.Int64
+	set   atomic.Bool
+}
+
+func (l *componentLevel) get() slog.Level {
+	if l.set.Load() {
+		return slog.Level(l.level.Load())
+	}
+	return defaultLevel.Level()
+}
+
+func lookup(name string) *componentLevel {
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	level, ok := components[name]
+	if !ok {
+		level = &componentLevel{}
+		components[name] = level
+	}
+	return level
+}
+
+// Component returns the logger of a component, such as "traffic_log". It
+// can be created before Setup runs, e.g. in a package variable.
+func Component(name string) *slog.Logger {
+	return slog.New(&componentHandler{
+		level: lookup(name),
+		ops:   []handlerOp{{attrs: []slog.Attr{slog.String("component", name)}}},
+	})
+}
+
+// Setup configures output, format and levels from cfg, makes the component
+// logger the slog default and sends the standard log package through it.
+// The returned closer closes the log file, if any.
+func Setup(cfg config.LoggingConfig) (io.Closer, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	defaultLevel.Set(level)
+	for name, value := range cfg.Components {
+		if err := SetLevel(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	var closer io.Closer = nopCloser{}
+	switch strings.ToLower(cfg.Output) {
+	case "", "stdout":
+	case "stderr":
+		out = os.Stderr
+	case "file":
+		file, err := newRotatingFile(cfg.FilePath, cfg.MaxSizeMB, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = file, file
+	default:
+		return nil, fmt.Errorf("unknown log output %q (use stdout, stderr or file)", cfg.Output)
+	}
+
+	// Levels are checked per component before records get here
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", "json":
+		h = slog.NewJSONHandler(out, options)
+	case "text":
+		h = slog.NewTextHandler(out, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q (use json or text)", cfg.Format)
+	}
+	root.Store(&h)
+
+	slog.SetDefault(Component("waf"))
+	// Whatever still uses the log package, e.g. dependencies, ends up here
+	// too, at info level
+	log.SetFlags(0)
+	log.SetOutput(stdlogWriter{})
+	return closer, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q (use debug, info, warn or error)", value)
+	}
+	return level, nil
+}
+
+// SetLevel sets the level of a known component, or the default level when
+// component is empty. An empty level or "default" makes the component follow
+// the default level again.
+func SetLevel(component, value string) error {
+	if component == "" {
+		level, err := ParseLevel(value)
+		if err != nil {
+			return err
+		}
+		defaultLevel.Set(level)
+		return nil
+	}
+
+	componentsMu.Lock()
+	l, ok := components[component]
+	componentsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown log component %q", component)
+	}
+	if value == "" || strings.EqualFold(value, "default") {
+		l.set.Store(false)
+		return nil
+	}
+	level, err := ParseLevel(value)
+	if err != nil {
+		return err
+	}
+	l.level.Store(int64(level))
+	l.set.Store(true)
+	return nil
+}
+
+// ComponentLevel is the effective level of one component
+type ComponentLevel struct {
+	Component string `json:"component"`
+	Level     string `json:"level"`
+	Override  bool   `json:"override"`
+}
+
+// Levels returns the default level and the level of every known component
+func Levels() (string, []ComponentLevel) {
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	levels := make([]ComponentLevel, 0, len(components))
+	for name, l := range components {
+		levels = append(levels, ComponentLevel{Component: name, Level: levelName(l.get()), Override: l.set.Load()})
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].Component < levels[j].Component })
+	return levelName(defaultLevel.Level()), levels
+}
+
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// componentHandler filters by the component's level and writes to the
+// current root handler, so loggers created before Setup pick up its output
+type componentHandler struct {
+	level *componentLevel
+	ops   []handlerOp
+
+	// built caches the root handler with ops applied
+	built atomic.Pointer[builtHandler]
+}
+
+// handlerOp is a WithAttrs or WithGroup call, replayed on the root handler
+type handlerOp struct {
+	attrs []slog.Attr
+	group string
+}
+
+type builtHandler struct {
+	root    *slog.Handler
+	handler slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.get()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	current := root.Load()
+	built := h.built.Load()
+	if built == nil || built.root != current {
+		handler := *current
+		for _, op := range h.ops {
+			if op.group != "" {
+				handler = handler.WithGroup(op.group)
+			} else {
+				handler = handler.WithAttrs(op.attrs)
+			}
+		}
+		built = &builtHandler{root: current, handler: handler}
+		h.built.Store(built)
+	}
+	return built.handler.Handle(ctx, r)
+}
+
+func (h *componentHandler) with(op handlerOp) *componentHandler {
+	ops := make([]handlerOp, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &componentHandler{level: h.level, ops: append(ops, op)}
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	return h.with(handlerOp{attrs: attrs})
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(handlerOp{group: name})
+}
+
+// stdlogWriter turns lines of the standard log package into records. A
+// leading "[Component]" becomes the component.
+type stdlogWriter struct{}
+
+func (stdlogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimRight(string(p), "\n")
+	component := "stdlog"
+	if strings.HasPrefix(message, "[") {
+		if end := strings.Index(message, "] "); end > 0 {
+			component = strings.ReplaceAll(strings.ToLower(message[1:end]), " ", "_")
+			message = message[end+2:]
+		}
+	}
+	Component(component).Info(message)
+	return len(p), nil
+}
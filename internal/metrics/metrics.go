@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "waf"
+
+// Request decisions used as the "decision" label
+const (
+	DecisionAllowed    = "allowed"
+	DecisionBlocked    = "blocked"
+	DecisionChallenged = "challenged"
+	DecisionAttack     = "attack"
+)
+
+// Registry holds every WAF metric. A dedicated registry keeps metrics from
+// third-party libraries that register globally out of the scrape.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts data-plane requests by vhost, status code and decision
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests handled by the WAF by vhost, status code and decision.",
+	}, []string{"vhost", "status", "decision"})
+
+	// HTTPRequestDuration observes end-to-end request latency. Status is the
+	// class (2xx, 4xx...) to keep the number of series down.
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "End-to-end request latency by vhost, status class and decision.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"vhost", "status", "decision"})
+
+	// Blocks counts rejected requests by the middleware that rejected them
+	Blocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocks_total",
+		Help:      "Requests blocked by middleware and reason.",
+	}, []string{"middleware", "reason"})
+
+	// RateLimitHits counts requests rejected by each limiter
+	RateLimitHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_hits_total",
+		Help:      "Requests that hit a rate limit, by limiter.",
+	}, []string{"limiter"})
+
+	// RedisCommandDuration observes Redis command latency
+	RedisCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Redis command latency by command.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+
+	// RedisErrors counts failed Redis commands; missing keys are not errors
+	RedisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Failed Redis commands by command.",
+	}, []string{"command"})
+
+	// PostgresDuration observes the latency of instrumented Postgres operations
+	PostgresDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "postgres_operation_duration_seconds",
+		Help:      "Postgres latency by operation (ping probe, traffic log COPY).",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"operation"})
+
+	// PostgresErrors counts failed Postgres operations
+	PostgresErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "postgres_errors_total",
+		Help:      "Failed Postgres operations by operation.",
+	}, []string{"operation"})
+
+	// UpstreamDuration observes backend response time, up to the response headers
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time until the backend returned response headers, by backend.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"backend"})
+
+	// UpstreamRequests counts proxied requests by backend and status class
+	UpstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_requests_total",
+		Help:      "Requests proxied to backends by backend and status class.",
+	}, []string{"backend", "status"})
+
+	// UpstreamErrors counts proxied requests that got no response
+	UpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Proxied requests that failed without a response, by backend and kind.",
+	}, []string{"backend", "kind"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{Namespace: namespace}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		Blocks,
+		RateLimitHits,
+		RedisCommandDuration,
+		RedisErrors,
+		PostgresDuration,
+		PostgresErrors,
+		UpstreamDuration,
+		UpstreamRequests,
+		UpstreamErrors,
+	)
+}
+
+// ObservePostgres records the outcome of a Postgres operation
+func ObservePostgres(operation string, start time.Time, err error) {
+	PostgresDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		PostgresErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// GaugeFunc registers a gauge whose value is read on every scrape
+func GaugeFunc(name, help string, fn func() float64) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// CounterFunc registers a counter whose value is read on every scrape
+func CounterFunc(name, help string, fn func() float64) {
+	Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// StatusClass returns "2xx", "4xx"... for an HTTP status code
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// Handler serves the registry in the Prometheus exposition format. When token
+// is set scrapes must send it as a bearer token.
+func Handler(token string) http.Handler {
+	handler := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	if token == "" {
+		return handler
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimSpace(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare([]byte(auth), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
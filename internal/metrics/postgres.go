@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+var metricsLog = logging.Component("metrics")
+
+// InstrumentDB exports connection pool stats and certificate expiry times
+// read from db on every scrape
+func InstrumentDB(db *sqlx.DB) {
+	Registry.MustRegister(
+		collectors.NewDBStatsCollector(db.DB, "postgres"),
+		&certificateCollector{db: db},
+	)
+}
+
+// RunPostgresProbe pings Postgres every interval so latency and outages are
+// visible even when no traffic is being logged
+func RunPostgresProbe(ctx context.Context, db *sqlx.DB, interval time.Duration) {
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		start := time.Now()
+		err := db.PingContext(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		ObservePostgres("ping", start, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var certificateExpiryDesc = prometheus.NewDesc(
+	namespace+"_certificate_expiry_timestamp_seconds",
+	"Expiry of stored TLS certificates as a Unix timestamp.",
+	[]string{"name", "common_name"}, nil,
+)
+
+// certificateCollector reads certificate expiry times when scraped
+type certificateCollector struct {
+	db *sqlx.DB
+}
+
+func (c *certificateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certificateExpiryDesc
+}
+
+func (c *certificateCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var certs []struct {
+		Name       string    `db:"name"`
+		CommonName string    `db:"common_name"`
+		ValidTo    time.Time `db:"valid_to"`
+	}
+	// valid_to is written from the certificate's NotAfter, which is UTC
+	err := c.db.SelectContext(ctx, &certs, `SELECT name, COALESCE(common_name, '') AS common_name, valid_to FROM certificates`)
+	if err != nil {
+		metricsLog.Error("Failed to read certificate expiry", "error", err)
+		return
+	}
+	for _, cert := range certs {
+		ch <- prometheus.MustNewConstMetric(certificateExpiryDesc, prometheus.GaugeValue,
+			float64(cert.ValidTo.Unix()), cert.Name, cert.CommonName)
+	}
+}
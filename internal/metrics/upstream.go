@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// InstrumentTransport wraps the reverse proxy transport to record latency,
+// status and errors per backend (host:port of the upstream URL)
+func InstrumentTransport(next http.RoundTripper) http.RoundTripper {
+	return upstreamTransport{next: next}
+}
+
+type upstreamTransport struct {
+	next http.RoundTripper
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backend := req.URL.Host
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	UpstreamDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		UpstreamErrors.WithLabelValues(backend, upstreamErrorKind(req, err)).Inc()
+		return nil, err
+	}
+	UpstreamRequests.WithLabelValues(backend, StatusClass(resp.StatusCode)).Inc()
+	return resp, nil
+}
+
+// upstreamErrorKind sorts transport errors into a few stable label values
+func upstreamErrorKind(req *http.Request, err error) string {
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.Is(req.Context().Err(), context.Canceled):
+		return "canceled"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// AttackModeMiddleware feeds per-vhost traffic counters to the adaptive attack
+// mode and, while a vhost is under attack, only serves cacheable GET/HEAD
+// requests. Later middleware reads the "attack_mode" context flag to challenge
+// every new visitor and tighten rate limits.
+func AttackModeMiddleware(attackMode *services.AttackModeService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		domain := c.Request.Host
+		if colonIdx := strings.Index(domain, ":"); colonIdx != -1 {
+			domain = domain[:colonIdx]
+		}
+
+		defer func() {
+			attackMode.RecordRequest(c.Request.Host, c.Writer.Status())
+		}()
+
+		if !attackMode.IsActive(domain) {
+			c.Next()
+			return
+		}
+
+		c.Set("attack_mode", true)
+
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			markBlocked(c, "attack_mode", "non_cacheable", "Under attack mode: non-cacheable request")
+			c.Header("Retry-After", fmt.Sprintf("%d", int(attackMode.Config().Cooldown.Seconds())))
+			c.Header("Content-Type", "text/html; charset=utf-8")
+			c.String(http.StatusServiceUnavailable, getAttackModePageHTML(domain, c.GetString("request_id")))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// getAttackModePageHTML returns HTML for requests refused while a vhost is
+// under attack mode
+func getAttackModePageHTML(domain, requestID string) string {
+	return `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Temporarily Restricted - DoCode WAF</title>
+    <style>
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+        }
+
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            background: linear-gradient(135deg, #ffa726 0%, #fb8c00 50%, #f57c00 100%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            padding: 20px;
+        }
+
+        .container {
+            background: white;
+            border-radius: 20px;
+            box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
+            max-width: 500px;
+            width: 100%;
+            padding: 40px;
+            text-align: center;
+        }
+
+        h1 {
+            color: #2d3748;
+            font-size: 28px;
+            margin-bottom: 10px;
+        }
+
+        .subtitle {
+            color: #718096;
+            margin-bottom: 20px;
+            line-height: 1.6;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>🚧 Temporarily Restricted</h1>
+        <p class="subtitle"><strong>` + domain + `</strong> is currently under heavy load and is only serving pages, not form submissions or other changes.</p>
+        <p class="subtitle">Please try again in a few minutes.</p>
+
+        ` + referenceHTML(requestID) + `
+        <p style="margin-top: 30px; color: #a0aec0; font-size: 14px;">
+            🛡️ Protected by DoCode WAF
+        </p>
+    </div>
+</body>
+</html>`
+}
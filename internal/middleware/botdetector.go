@@ -1,24 +1,39 @@
 package middleware
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"os"
 	"regexp"
 	"strings"
 
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
 )
 
+var botDetectorLog = logging.Component("bot_detector")
+
 var badBotPatterns = []string{
 	"(?i)(bot|crawler|spider|scraper)",
 	"(?i)(wget|curl|python-requests)",
 	"(?i)(semrush|ahrefs|majestic)",
 }
 
-// BotDetectorMiddleware detects and blocks known bad bots based on vhost settings
-func BotDetectorMiddleware(db *sqlx.DB) gin.HandlerFunc {
+// Bot detection modes
+const (
+	BotModeChallengeAll = "challenge_all"
+	BotModeScore        = "score"
+)
+
+// BotDetectorMiddleware detects and blocks bots based on vhost settings.
+// In score mode each request is scored from header and behaviour heuristics
+// and the vhost's score bands decide whether to allow, challenge or block it.
+// While the vhost is in attack mode every new visitor is challenged.
+func BotDetectorMiddleware(db *sqlx.DB, redisClient *redis.Client, health services.RedisHealth) gin.HandlerFunc {
 	compiledPatterns := make([]*regexp.Regexp, 0, len(badBotPatterns))
 	for _, pattern := range badBotPatterns {
 		re, err := regexp.Compile(pattern)
@@ -36,36 +51,76 @@ func BotDetectorMiddleware(db *sqlx.DB) gin.HandlerFunc {
 
 		// Check if bot detection is enabled for this vhost
 		var vhostSettings struct {
-			BotDetectionEnabled bool   `db:"bot_detection_enabled"`
-			BotDetectionType    string `db:"bot_detection_type"`
-			RecaptchaVersion    string `db:"recaptcha_version"`
+			BotDetectionEnabled        bool   `db:"bot_detection_enabled"`
+			BotDetectionType           string `db:"bot_detection_type"`
+			BotDetectionMode           string `db:"bot_detection_mode"`
+			BotScoreChallengeThreshold int    `db:"bot_score_challenge_threshold"`
+			BotScoreBlockThreshold     int    `db:"bot_score_block_threshold"`
+			RecaptchaVersion           string `db:"recaptcha_version"`
 		}
 
-		err := db.Get(&vhostSettings, "SELECT bot_detection_enabled, bot_detection_type, recaptcha_version FROM vhosts WHERE domain = $1", domain)
+		query := `
+			SELECT bot_detection_enabled, bot_detection_type, recaptcha_version,
+			       COALESCE(bot_detection_mode, 'challenge_all') as bot_detection_mode,
+			       COALESCE(bot_score_challenge_threshold, 30) as bot_score_challenge_threshold,
+			       COALESCE(bot_score_block_threshold, 70) as bot_score_block_threshold
+			FROM vhosts WHERE domain = $1
+		`
+		err := db.Get(&vhostSettings, query, domain)
 		if err != nil {
-			log.Printf("[Bot Detector] Error getting vhost settings for domain %s: %v", domain, err)
+			botDetectorLog.Error("Failed to get vhost settings", "domain", domain, "error", err)
 			c.Next()
 			return
 		}
 
+		if c.GetBool("attack_mode") {
+			vhostSettings.BotDetectionEnabled = true
+			vhostSettings.BotDetectionMode = BotModeChallengeAll
+		}
+
 		// If bot detection is disabled for this vhost, skip
 		if !vhostSettings.BotDetectionEnabled {
 			c.Next()
 			return
 		}
 
-		// Check if user has already passed bot detection (cookie/session)
+		passedChallenge := false
 		if passed, _ := c.Cookie("bot_check_passed_" + domain); passed == "true" {
-			c.Next()
-			return
+			passedChallenge = true
+		}
+
+		action := BotActionChallenge
+		if vhostSettings.BotDetectionMode == BotModeScore {
+			if isLegitimateBot(c.GetHeader("User-Agent")) {
+				c.Next()
+				return
+			}
+
+			score := scoreRequest(c, redisClient, health, compiledPatterns, domain)
+			action = score.Action(vhostSettings.BotScoreChallengeThreshold, vhostSettings.BotScoreBlockThreshold)
+			c.Set("bot_score", score.Total)
+
+			if score.Total > 0 && botDetectorLog.Enabled(c.Request.Context(), slog.LevelDebug) {
+				botDetectorLog.Debug("Scored request", "domain", domain, "client_ip", c.ClientIP(),
+					"score", score.Total, "action", action, "components", score.String())
+			}
 		}
 
-		// Bot detection is enabled - show challenge to all visitors
-		// They must complete the challenge before accessing the site
-		c.Header("Content-Type", "text/html; charset=utf-8")
-		c.String(http.StatusForbidden, getBotChallengeHTML(domain, vhostSettings.BotDetectionType, vhostSettings.RecaptchaVersion))
-		c.Abort()
-		return
+		switch {
+		case action == BotActionBlock:
+			markBlocked(c, "bot_detector", "bot_score", "Bot score exceeded block threshold")
+			c.Header("Content-Type", "text/html; charset=utf-8")
+			c.String(http.StatusForbidden, getBotBlockedPageHTML(domain, c.GetString("request_id")))
+			c.Abort()
+		case action == BotActionAllow || passedChallenge:
+			c.Next()
+		default:
+			// Visitor must complete the challenge before accessing the site
+			c.Set("challenged", true)
+			c.Header("Content-Type", "text/html; charset=utf-8")
+			c.String(http.StatusForbidden, getBotChallengeHTML(domain, vhostSettings.BotDetectionType, vhostSettings.RecaptchaVersion, c.GetString("request_id")))
+			c.Abort()
+		}
 	}
 }
 
@@ -92,9 +147,10 @@ func isLegitimateBot(userAgent string) bool {
 }
 
 // getBotChallengeHTML returns HTML for bot detection challenge
-func getBotChallengeHTML(domain, challengeType, recaptchaVersion string) string {
-	// Log the challenge type for debugging
-	log.Printf("[Bot Detector] Generating challenge for domain %s with type: '%s'", domain, challengeType)
+func getBotChallengeHTML(domain, challengeType, recaptchaVersion, requestID string) string {
+	if botDetectorLog.Enabled(context.Background(), slog.LevelDebug) {
+		botDetectorLog.Debug("Generating challenge", "domain", domain, "type", challengeType)
+	}
 
 	var challengeContent, challengeTitle, challengeSubtitle string
 
@@ -490,6 +546,70 @@ func getBotChallengeHTML(domain, challengeType, recaptchaVersion string) string
         
         ` + challengeContent + `
         
+        ` + referenceHTML(requestID) + `
+        <p style="margin-top: 30px; color: #a0aec0; font-size: 14px;">
+            🛡️ Protected by DoCode WAF
+        </p>
+    </div>
+</body>
+</html>`
+}
+
+// getBotBlockedPageHTML returns HTML for requests blocked by the bot score
+func getBotBlockedPageHTML(domain, requestID string) string {
+	return `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Access Denied - DoCode WAF</title>
+    <style>
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+        }
+        
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            padding: 20px;
+        }
+        
+        .container {
+            background: white;
+            border-radius: 20px;
+            box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
+            max-width: 500px;
+            width: 100%;
+            padding: 40px;
+            text-align: center;
+        }
+        
+        h1 {
+            color: #2d3748;
+            font-size: 28px;
+            margin-bottom: 10px;
+        }
+        
+        .subtitle {
+            color: #718096;
+            margin-bottom: 20px;
+            line-height: 1.6;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>🤖 Automated Traffic Detected</h1>
+        <p class="subtitle">Your request to <strong>` + domain + `</strong> looks automated and has been blocked.</p>
+        <p class="subtitle">If you are using a regular browser, make sure cookies are enabled and try again later.</p>
+        
+        ` + referenceHTML(requestID) + `
         <p style="margin-top: 30px; color: #a0aec0; font-size: 14px;">
             🛡️ Protected by DoCode WAF
         </p>
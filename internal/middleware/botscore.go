@@ -0,0 +1,293 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Bot score actions
+const (
+	BotActionAllow     = "allow"
+	BotActionChallenge = "challenge"
+	BotActionBlock     = "block"
+)
+
+const (
+	// cookieProbeName is set on every scored response; clients that never send
+	// it back after several requests most likely do not keep a cookie jar
+	cookieProbeName = "__waf_cp"
+
+	botTimingSamples   = 20
+	botTimingTTL       = 10 * time.Minute
+	botNavigationTTL   = 30 * time.Minute
+	botCookieMinVisits = 3
+	botCadenceMinGaps  = 5
+	botNavigationPages = 10
+)
+
+var assetExtensions = map[string]bool{
+	".css": true, ".js": true, ".png": true, ".jpg": true, ".jpeg": true,
+	".gif": true, ".svg": true, ".ico": true, ".webp": true, ".avif": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".eot": true,
+}
+
+// BotScore holds the total score of a request and the components it is built from
+type BotScore struct {
+	Total      int
+	Components map[string]int
+}
+
+func (s *BotScore) add(component string, points int) {
+	if points == 0 {
+		return
+	}
+	s.Components[component] += points
+	s.Total += points
+}
+
+// String renders the components in a stable order for logging
+func (s *BotScore) String() string {
+	names := make([]string, 0, len(s.Components))
+	for name := range s.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, s.Components[name]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Action maps the score onto the vhost's score bands
+func (s *BotScore) Action(challengeThreshold, blockThreshold int) string {
+	switch {
+	case blockThreshold > 0 && s.Total >= blockThreshold:
+		return BotActionBlock
+	case challengeThreshold > 0 && s.Total >= challengeThreshold:
+		return BotActionChallenge
+	default:
+		return BotActionAllow
+	}
+}
+
+// scoreRequest computes the bot score for the current request from header
+// heuristics and the client's recent request history stored in Redis. The
+// history is left out while Redis is degraded.
+func scoreRequest(c *gin.Context, redisClient *redis.Client, health services.RedisHealth, uaPatterns []*regexp.Regexp, domain string) *BotScore {
+	score := &BotScore{Components: make(map[string]int)}
+	userAgent := c.GetHeader("User-Agent")
+
+	// User agent
+	if userAgent == "" {
+		score.add("ua_missing", 30)
+	} else {
+		for _, re := range uaPatterns {
+			if re.MatchString(userAgent) {
+				score.add("ua_bad_pattern", 40)
+				break
+			}
+		}
+	}
+
+	scoreAcceptHeaders(c, score, userAgent)
+	scoreHeaderFingerprint(c, score, userAgent)
+
+	if redisClient != nil && (health == nil || !health.Degraded()) {
+		scoreHistory(c, redisClient, health, score, domain)
+	}
+
+	if score.Total > 100 {
+		score.Total = 100
+	}
+	return score
+}
+
+func scoreAcceptHeaders(c *gin.Context, score *BotScore, userAgent string) {
+	accept := c.GetHeader("Accept")
+	switch {
+	case accept == "":
+		score.add("accept_missing", 15)
+	case accept == "*/*" && looksLikeBrowser(userAgent) && !isAssetPath(c.Request.URL.Path):
+		// Browsers always advertise text/html on navigations
+		score.add("accept_generic", 5)
+	}
+
+	if c.GetHeader("Accept-Language") == "" {
+		score.add("accept_language_missing", 15)
+	}
+
+	acceptEncoding := strings.ToLower(c.GetHeader("Accept-Encoding"))
+	switch {
+	case acceptEncoding == "":
+		score.add("accept_encoding_missing", 10)
+	case !strings.Contains(acceptEncoding, "gzip") && !strings.Contains(acceptEncoding, "br"):
+		score.add("accept_encoding_odd", 5)
+	}
+}
+
+// proxyHeaderNames are set by the nginx front proxy rather than the client
+var proxyHeaderNames = map[string]bool{
+	"host": true, "x-real-ip": true, "x-client-protocol": true, "x-forwarded-for": true,
+	"x-forwarded-proto": true, "x-forwarded-host": true, "x-forwarded-port": true,
+	"connection": true, "upgrade": true,
+}
+
+// scoreHeaderFingerprint checks header casing and order against what a browser
+// with the claimed user agent would send. Headers added by the nginx front
+// proxy are ignored; nginx keeps the client's own headers in their original
+// order after its own. Only HTTP/1.x requests are checked: over HTTP/2 and
+// HTTP/3 browsers send lowercase names, and nginx passes those on as is.
+func scoreHeaderFingerprint(c *gin.Context, score *BotScore, userAgent string) {
+	if !strings.HasPrefix(clientProtocol(c), "HTTP/1.") {
+		return
+	}
+	names, ok := rawHeaderNames(c.Request)
+	if !ok || len(names) == 0 {
+		return
+	}
+
+	allLower := true
+	position := make(map[string]int)
+	for i, name := range names {
+		lower := strings.ToLower(name)
+		if proxyHeaderNames[lower] {
+			continue
+		}
+		if name != lower {
+			allLower = false
+		}
+		if _, seen := position[lower]; !seen {
+			position[lower] = i
+		}
+	}
+	if len(position) == 0 {
+		return
+	}
+
+	// HTTP/1.1 browsers send Title-Case header names
+	if allLower && looksLikeBrowser(userAgent) {
+		score.add("header_casing", 10)
+	}
+
+	if !looksLikeBrowser(userAgent) {
+		return
+	}
+
+	// Every major browser sends User-Agent and Accept before Accept-Encoding
+	// and Accept-Language; HTTP libraries spoofing a browser UA often do not
+	uaPos, hasUA := position["user-agent"]
+	acceptPos, hasAccept := position["accept"]
+	encodingPos, hasEncoding := position["accept-encoding"]
+	if hasEncoding && ((hasUA && encodingPos < uaPos) || (hasAccept && encodingPos < acceptPos)) {
+		score.add("header_order", 10)
+	}
+}
+
+// scoreHistory records the request in Redis and scores cookie support,
+// request cadence and navigation patterns of the client
+func scoreHistory(c *gin.Context, redisClient *redis.Client, health services.RedisHealth, score *BotScore, domain string) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), services.RedisRequestTimeout)
+	defer cancel()
+	clientIP := c.ClientIP()
+	timingKey := fmt.Sprintf("botscore:timing:%s:%s", domain, clientIP)
+	navKey := fmt.Sprintf("botscore:nav:%s:%s", domain, clientIP)
+
+	navField := "pages"
+	if isAssetPath(c.Request.URL.Path) {
+		navField = "assets"
+	}
+
+	pipe := redisClient.Pipeline()
+	pipe.LPush(ctx, timingKey, time.Now().UnixMilli())
+	pipe.LTrim(ctx, timingKey, 0, botTimingSamples-1)
+	pipe.Expire(ctx, timingKey, botTimingTTL)
+	timingCmd := pipe.LRange(ctx, timingKey, 0, -1)
+	pipe.HIncrBy(ctx, navKey, navField, 1)
+	pipe.Expire(ctx, navKey, botNavigationTTL)
+	navCmd := pipe.HGetAll(ctx, navKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		if health != nil {
+			health.ReportError(err)
+		}
+		return
+	}
+
+	timestamps := timingCmd.Val()
+	nav := navCmd.Val()
+
+	// Cookie support: the probe cookie is set on the first scored response
+	if _, err := c.Cookie(cookieProbeName); err != nil {
+		if len(timestamps) > botCookieMinVisits {
+			score.add("cookies_unsupported", 15)
+		}
+		c.SetCookie(cookieProbeName, "1", int(botNavigationTTL.Seconds()), "/", "", false, true)
+	}
+
+	scoreCadence(timestamps, score)
+
+	pages, _ := strconv.Atoi(nav["pages"])
+	assets, _ := strconv.Atoi(nav["assets"])
+	if pages >= botNavigationPages && assets == 0 {
+		score.add("no_asset_fetches", 15)
+	} else if pages >= botNavigationPages && float64(assets)/float64(pages) < 0.1 {
+		score.add("low_asset_ratio", 5)
+	}
+}
+
+// scoreCadence flags clients that request too fast or at machine-regular intervals
+func scoreCadence(timestamps []string, score *BotScore) {
+	if len(timestamps) < botCadenceMinGaps+1 {
+		return
+	}
+
+	// Timestamps are newest first
+	gaps := make([]float64, 0, len(timestamps)-1)
+	for i := 0; i < len(timestamps)-1; i++ {
+		newer, err1 := strconv.ParseInt(timestamps[i], 10, 64)
+		older, err2 := strconv.ParseInt(timestamps[i+1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return
+		}
+		gaps = append(gaps, float64(newer-older))
+	}
+
+	var sum float64
+	for _, gap := range gaps {
+		sum += gap
+	}
+	mean := sum / float64(len(gaps))
+
+	var variance float64
+	for _, gap := range gaps {
+		variance += (gap - mean) * (gap - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(gaps)))
+
+	if mean < 200 {
+		score.add("cadence_fast", 10)
+	}
+	if mean > 0 && stddev/mean < 0.1 {
+		score.add("cadence_regular", 15)
+	}
+}
+
+func isAssetPath(p string) bool {
+	return assetExtensions[strings.ToLower(path.Ext(p))]
+}
+
+func looksLikeBrowser(userAgent string) bool {
+	return strings.HasPrefix(userAgent, "Mozilla/")
+}
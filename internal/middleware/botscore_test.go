@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headerContext returns a context for a request nginx forwarded with the raw
+// header block and the client protocol it reported
+func headerContext(raw, protocol string) *gin.Context {
+	conn := &headerCaptureConn{}
+	conn.capture([]byte(raw))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), connContextKey{}, conn))
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	c.Set("client_protocol", protocol)
+	return c
+}
+
+func TestScoreHeaderFingerprint(t *testing.T) {
+	const chrome = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	// nginx puts its own headers first, then the client's as they arrived
+	const lowercase = "GET / HTTP/1.1\r\nHost: example.com\r\nX-Real-IP: 203.0.113.7\r\nX-Client-Protocol: HTTP/2.0\r\n" +
+		"accept-encoding: gzip, br\r\nuser-agent: " + chrome + "\r\naccept: text/html\r\naccept-language: en\r\n\r\n"
+	const titleCase = "GET / HTTP/1.1\r\nHost: example.com\r\nX-Real-IP: 203.0.113.7\r\nX-Client-Protocol: HTTP/1.1\r\n" +
+		"User-Agent: " + chrome + "\r\nAccept: text/html\r\nAccept-Encoding: gzip, br\r\nAccept-Language: en\r\n\r\n"
+
+	tests := []struct {
+		name     string
+		raw      string
+		protocol string
+		want     map[string]int
+	}{
+		{"HTTP/2 browser", lowercase, "HTTP/2.0", map[string]int{}},
+		{"HTTP/3 browser", lowercase, "HTTP/3.0", map[string]int{}},
+		{"HTTP/1.1 lowercase client", lowercase, "HTTP/1.1", map[string]int{"header_casing": 10, "header_order": 10}},
+		{"HTTP/1.1 browser", titleCase, "HTTP/1.1", map[string]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score := &BotScore{Components: make(map[string]int)}
+			scoreHeaderFingerprint(headerContext(tt.raw, tt.protocol), score, chrome)
+			if len(score.Components) != len(tt.want) {
+				t.Fatalf("components = %v, want %v", score.Components, tt.want)
+			}
+			for component, points := range tt.want {
+				if score.Components[component] != points {
+					t.Errorf("components = %v, want %v", score.Components, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/metrics"
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// CaptureMiddleware stores a forensic capture of requests flagged as attacks
+// and of a vhost's sampled share of other requests. The decision is made
+// before the request is handled, so the body of a captured request is read
+// up front (up to the configured limit) and handed on unchanged; requests
+// that are not captured are not touched. It is registered ahead of the
+// blocking middleware so blocked requests are captured with their decision.
+func CaptureMiddleware(captures *services.CaptureService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !captures.Enabled() {
+			c.Next()
+			return
+		}
+
+		reason := ""
+		var rule *services.CaptureRule
+		// Plain bot traffic is left to the bot detector, as with the jail
+		if match := detectAttack(c); match != nil && match.Type != "Bot Traffic" {
+			reason = services.CaptureReasonAttack
+			rule = &services.CaptureRule{Type: match.Type, Pattern: match.Pattern, Field: match.Field}
+		} else if percent := captures.SamplePercent(c.Request.Host); percent > 0 && rand.Float64()*100 < percent {
+			reason = services.CaptureReasonSample
+		}
+		if reason == "" {
+			c.Next()
+			return
+		}
+
+		header := c.Request.Header.Clone()
+		body, truncated := prefetchBody(c.Request, captures.MaxBodyBytes())
+		bodySize := c.Request.ContentLength
+		if bodySize < 0 {
+			bodySize = int64(len(body))
+		}
+
+		c.Next()
+
+		decision := requestDecision(c)
+		if decision == metrics.DecisionAllowed && rule != nil {
+			decision = metrics.DecisionAttack
+		}
+		captures.Enqueue(services.CaptureEntry{
+			Timestamp:     time.Now(),
+			RequestID:     c.GetString("request_id"),
+			Host:          c.Request.Host,
+			ClientIP:      c.ClientIP(),
+			Method:        c.Request.Method,
+			URL:           c.Request.URL.String(),
+			Proto:         c.Request.Proto,
+			Header:        header,
+			Body:          body,
+			BodySize:      bodySize,
+			BodyTruncated: truncated,
+			Reason:        reason,
+			Rule:          rule,
+			Decision:      decision,
+			BlockSource:   c.GetString("block_source"),
+			BlockReason:   c.GetString("block_reason"),
+			StatusCode:    c.Writer.Status(),
+		})
+	}
+}
+
+// prefetchBody reads up to limit bytes of the request body and puts them
+// back in front of the rest, so later readers see the whole body. A read
+// error is passed on to them once the prefetched bytes are consumed.
+func prefetchBody(req *http.Request, limit int) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, false
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, int64(limit)+1))
+	rest := io.Reader(req.Body)
+	if err != nil {
+		rest = errorReader{err: err}
+	}
+	req.Body = prefetchedBody{
+		Reader: io.MultiReader(bytes.NewReader(data), rest),
+		Closer: req.Body,
+	}
+
+	truncated := len(data) > limit || err != nil
+	if len(data) > limit {
+		data = data[:limit]
+	}
+	return data, truncated
+}
+
+type prefetchedBody struct {
+	io.Reader
+	io.Closer
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"net"
+	"strings"
+
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/gin-gonic/gin"
+)
+
+var clientIPLog = logging.Component("client_ip")
+
+const (
+	// clientIPHeader carries the address nginx accepted the connection from.
+	// nginx overwrites it, unlike X-Forwarded-For, which it appends to
+	// whatever the client sent.
+	clientIPHeader = "X-Real-IP"
+
+	// clientProtocolHeader carries the HTTP version the client spoke to
+	// nginx ($server_protocol); nginx itself always talks HTTP/1.1 to the WAF
+	clientProtocolHeader = "X-Client-Protocol"
+)
+
+// TrustClientIP makes c.ClientIP() return the X-Real-IP sent by one of the
+// trusted proxies. Requests from any other peer are attributed to the peer
+// itself, whatever headers they carry.
+func TrustClientIP(engine *gin.Engine, trustedProxies []string) error {
+	engine.ForwardedByClientIP = true
+	engine.RemoteIPHeaders = []string{clientIPHeader}
+	return engine.SetTrustedProxies(trustedProxies)
+}
+
+// ClientIPMiddleware replaces X-Real-IP with the resolved client IP so the
+// backend, and anything reading the header directly, sees the same address
+// as the WAF checks. It also stores the client's HTTP version as
+// "client_protocol", taken from X-Client-Protocol only for trusted proxies.
+func ClientIPMiddleware(trustedProxies []string) gin.HandlerFunc {
+	var trusted []*net.IPNet
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			clientIPLog.Warn("Ignoring invalid trusted proxy", "cidr", proxy, "error", err)
+			continue
+		}
+		trusted = append(trusted, network)
+	}
+
+	return func(c *gin.Context) {
+		c.Request.Header.Set(clientIPHeader, c.ClientIP())
+
+		protocol := c.Request.Proto
+		if forwarded := c.GetHeader(clientProtocolHeader); forwarded != "" && peerTrusted(c, trusted) {
+			protocol = forwarded
+		}
+		c.Set("client_protocol", protocol)
+		c.Next()
+	}
+}
+
+// clientProtocol returns the HTTP version the client used, e.g. "HTTP/2.0"
+func clientProtocol(c *gin.Context) string {
+	if protocol := c.GetString("client_protocol"); protocol != "" {
+		return protocol
+	}
+	return c.Request.Proto
+}
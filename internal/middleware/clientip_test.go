@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestClientIPTrustsOnlyProxyRealIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	if err := TrustClientIP(router, []string{"10.0.0.0/8"}); err != nil {
+		t.Fatalf("TrustClientIP: %v", err)
+	}
+	router.Use(ClientIPMiddleware([]string{"10.0.0.0/8"}))
+
+	var clientIP, forwarded, protocol string
+	router.GET("/", func(c *gin.Context) {
+		clientIP = c.ClientIP()
+		forwarded = c.Request.Header.Get("X-Real-IP")
+		protocol = clientProtocol(c)
+	})
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		realIP       string
+		xff          string
+		want         string
+		wantProtocol string
+	}{
+		{"nginx", "10.0.0.5:4000", "203.0.113.7", "198.51.100.1, 203.0.113.7", "203.0.113.7", "HTTP/2.0"},
+		{"nginx without X-Real-IP", "10.0.0.5:4000", "", "198.51.100.1", "10.0.0.5", "HTTP/2.0"},
+		{"direct client", "203.0.113.9:4000", "198.51.100.1", "198.51.100.1", "203.0.113.9", "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			req.Header.Set("X-Forwarded-For", tt.xff)
+			req.Header.Set("X-Client-Protocol", "HTTP/2.0")
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			if clientIP != tt.want || forwarded != tt.want {
+				t.Errorf("client IP = %s, X-Real-IP = %s, want %s", clientIP, forwarded, tt.want)
+			}
+			if protocol != tt.wantProtocol {
+				t.Errorf("client protocol = %s, want %s", protocol, tt.wantProtocol)
+			}
+		})
+	}
+}
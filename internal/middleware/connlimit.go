@@ -0,0 +1,356 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/metrics"
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+var connLimitLog = logging.Component("conn_limit")
+
+// errUploadTooSlow is returned from the request body when the client uploads
+// slower than the configured minimum data rate
+var errUploadTooSlow = errors.New("upload data rate below minimum")
+
+// ConnectionStats is a snapshot of the connection limiter counters
+type ConnectionStats struct {
+	OpenConnections     int64  `json:"open_connections"`
+	IdleConnections     int64  `json:"idle_connections"`
+	InFlightRequests    int64  `json:"inflight_requests"`
+	RejectedConnections uint64 `json:"rejected_connections"`
+	RejectedRequests    uint64 `json:"rejected_requests"`
+	HeaderTimeouts      uint64 `json:"header_timeouts"`
+	SlowUploads         uint64 `json:"slow_uploads"`
+	IdleClosed          uint64 `json:"idle_closed"`
+}
+
+// ConnectionLimiter enforces per-IP connection and in-flight request limits,
+// a minimum upload data rate and an idle connection cap on the WAF listener
+type ConnectionLimiter struct {
+	cfg     config.ConnLimitConfig
+	jail    *services.JailService
+	trusted []*net.IPNet
+
+	mu       sync.Mutex
+	conns    map[string]int
+	inflight map[string]int
+	fresh    map[net.Conn]time.Time
+	idle     map[net.Conn]struct{}
+
+	openConnections     atomic.Int64
+	inflightRequests    atomic.Int64
+	rejectedConnections atomic.Uint64
+	rejectedRequests    atomic.Uint64
+	headerTimeouts      atomic.Uint64
+	slowUploads         atomic.Uint64
+	idleClosed          atomic.Uint64
+}
+
+// NewConnectionLimiter creates a limiter from the waf.connection_limits config
+func NewConnectionLimiter(cfg config.ConnLimitConfig, jail *services.JailService) *ConnectionLimiter {
+	l := &ConnectionLimiter{
+		cfg:      cfg,
+		jail:     jail,
+		conns:    make(map[string]int),
+		inflight: make(map[string]int),
+		fresh:    make(map[net.Conn]time.Time),
+		idle:     make(map[net.Conn]struct{}),
+	}
+
+	for _, cidr := range cfg.TrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			connLimitLog.Warn("Ignoring invalid trusted proxy", "cidr", cidr, "error", err)
+			continue
+		}
+		l.trusted = append(l.trusted, network)
+	}
+
+	return l
+}
+
+// ConfigureServer applies the header, idle and connection state settings to
+// the WAF server
+func (l *ConnectionLimiter) ConfigureServer(srv *http.Server) {
+	if l.cfg.ReadHeaderTimeout > 0 {
+		srv.ReadHeaderTimeout = l.cfg.ReadHeaderTimeout
+	}
+	if l.cfg.MaxHeaderBytes > 0 {
+		srv.MaxHeaderBytes = l.cfg.MaxHeaderBytes
+	}
+	if l.cfg.IdleTimeout > 0 {
+		srv.IdleTimeout = l.cfg.IdleTimeout
+	}
+	srv.ConnState = l.connState
+}
+
+// Stats returns the current counters
+func (l *ConnectionLimiter) Stats() ConnectionStats {
+	l.mu.Lock()
+	idle := int64(len(l.idle))
+	l.mu.Unlock()
+
+	return ConnectionStats{
+		OpenConnections:     l.openConnections.Load(),
+		IdleConnections:     idle,
+		InFlightRequests:    l.inflightRequests.Load(),
+		RejectedConnections: l.rejectedConnections.Load(),
+		RejectedRequests:    l.rejectedRequests.Load(),
+		HeaderTimeouts:      l.headerTimeouts.Load(),
+		SlowUploads:         l.slowUploads.Load(),
+		IdleClosed:          l.idleClosed.Load(),
+	}
+}
+
+// Listener wraps the WAF listener with the per-IP connection limit
+func (l *ConnectionLimiter) Listener(inner net.Listener) net.Listener {
+	return &connLimitListener{Listener: inner, limiter: l}
+}
+
+// Middleware enforces the per-IP in-flight request limit and the minimum
+// upload data rate
+func (l *ConnectionLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientIP := c.ClientIP()
+
+		if limit := l.cfg.MaxInFlightRequestsPerIP; limit > 0 {
+			l.mu.Lock()
+			if l.inflight[clientIP] >= limit {
+				l.mu.Unlock()
+				l.rejectedRequests.Add(1)
+				go recordOffence(l.jail, clientIP, services.OffenceConnLimit)
+
+				markBlocked(c, "connection_limit", "too_many_requests", "Too many concurrent requests")
+				metrics.RateLimitHits.WithLabelValues("inflight").Inc()
+				c.Header("Retry-After", "1")
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+					"error":      "Too many concurrent requests",
+					"request_id": c.GetString("request_id"),
+				})
+				return
+			}
+			l.inflight[clientIP]++
+			l.mu.Unlock()
+
+			defer func() {
+				l.mu.Lock()
+				if l.inflight[clientIP] <= 1 {
+					delete(l.inflight, clientIP)
+				} else {
+					l.inflight[clientIP]--
+				}
+				l.mu.Unlock()
+			}()
+		}
+
+		l.inflightRequests.Add(1)
+		defer l.inflightRequests.Add(-1)
+
+		if l.cfg.MinUploadRate > 0 && c.Request.Body != nil && c.Request.Body != http.NoBody {
+			c.Request.Body = &minRateReader{
+				ReadCloser: c.Request.Body,
+				controller: http.NewResponseController(c.Writer),
+				minRate:    float64(l.cfg.MinUploadRate),
+				grace:      l.uploadGrace(),
+				start:      time.Now(),
+				onSlow: func() {
+					l.slowUploads.Add(1)
+					connLimitLog.Info("Aborted slow upload", "client_ip", clientIP)
+					go recordOffence(l.jail, clientIP, services.OffenceSlowClient)
+				},
+			}
+		}
+
+		c.Next()
+	}
+}
+
+func (l *ConnectionLimiter) uploadGrace() time.Duration {
+	if l.cfg.UploadGracePeriod > 0 {
+		return l.cfg.UploadGracePeriod
+	}
+	return 10 * time.Second
+}
+
+func (l *ConnectionLimiter) isTrusted(ip net.IP) bool {
+	for _, network := range l.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// connState tracks idle connections for the idle cap and connections that
+// close before sending a complete request header (slowloris). A connection
+// over the idle cap is closed after l.mu is released, as closing it releases
+// its per-IP slot under the same lock.
+func (l *ConnectionLimiter) connState(conn net.Conn, state http.ConnState) {
+	var overIdle net.Conn
+	defer func() {
+		if overIdle != nil {
+			overIdle.Close()
+		}
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch state {
+	case http.StateNew:
+		l.fresh[conn] = time.Now()
+	case http.StateActive:
+		delete(l.fresh, conn)
+		delete(l.idle, conn)
+	case http.StateIdle:
+		l.idle[conn] = struct{}{}
+		if limit := l.cfg.MaxIdleConnections; limit > 0 && len(l.idle) > limit {
+			delete(l.idle, conn)
+			l.idleClosed.Add(1)
+			overIdle = conn
+		}
+	case http.StateHijacked, http.StateClosed:
+		delete(l.idle, conn)
+		if opened, ok := l.fresh[conn]; ok {
+			delete(l.fresh, conn)
+			if l.cfg.ReadHeaderTimeout > 0 && time.Since(opened) >= l.cfg.ReadHeaderTimeout {
+				l.headerTimeouts.Add(1)
+				if ip := peerIP(conn); ip != nil && !l.isTrusted(ip) {
+					go recordOffence(l.jail, ip.String(), services.OffenceSlowClient)
+				}
+			}
+		}
+	}
+}
+
+type connLimitListener struct {
+	net.Listener
+	limiter *ConnectionLimiter
+}
+
+func (ln *connLimitListener) Accept() (net.Conn, error) {
+	l := ln.limiter
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := peerIP(conn)
+		if ip == nil || l.cfg.MaxConnectionsPerIP <= 0 || l.isTrusted(ip) {
+			l.openConnections.Add(1)
+			return &limitedConn{Conn: conn, limiter: l}, nil
+		}
+
+		key := ip.String()
+		l.mu.Lock()
+		if l.conns[key] >= l.cfg.MaxConnectionsPerIP {
+			l.mu.Unlock()
+			l.rejectedConnections.Add(1)
+			conn.Close()
+			go recordOffence(l.jail, key, services.OffenceConnLimit)
+			continue
+		}
+		l.conns[key]++
+		l.mu.Unlock()
+
+		l.openConnections.Add(1)
+		return &limitedConn{Conn: conn, limiter: l, ip: key}, nil
+	}
+}
+
+// limitedConn releases its per-IP connection slot when closed
+type limitedConn struct {
+	net.Conn
+	limiter *ConnectionLimiter
+	ip      string
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		l := c.limiter
+		l.openConnections.Add(-1)
+		if c.ip == "" {
+			return
+		}
+		l.mu.Lock()
+		if l.conns[c.ip] <= 1 {
+			delete(l.conns, c.ip)
+		} else {
+			l.conns[c.ip]--
+		}
+		l.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// NetConn exposes the underlying connection for header fingerprinting
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// minRateReader aborts request bodies that arrive slower than minRate bytes
+// per second once the grace period has passed. Each read must also make
+// progress within the grace period so a stalled client cannot hold the
+// connection until the server's ReadTimeout.
+type minRateReader struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	minRate    float64
+	grace      time.Duration
+	start      time.Time
+	read       int64
+	failed     bool
+	onSlow     func()
+}
+
+func (r *minRateReader) Read(p []byte) (int, error) {
+	if r.failed {
+		return 0, errUploadTooSlow
+	}
+
+	_ = r.controller.SetReadDeadline(time.Now().Add(r.grace))
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return n, r.fail()
+	}
+
+	elapsed := time.Since(r.start)
+	if err == nil && elapsed > r.grace && float64(r.read)/elapsed.Seconds() < r.minRate {
+		return n, r.fail()
+	}
+
+	if err == io.EOF {
+		// Body complete; restore the server's own deadline handling
+		_ = r.controller.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+func (r *minRateReader) fail() error {
+	r.failed = true
+	r.onSlow()
+	return errUploadTooSlow
+}
+
+func peerIP(conn net.Conn) net.IP {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return addr.IP
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+)
+
+// acceptLimited accepts n loopback connections through the limiter's listener.
+// The accepted connections are left to the caller to close, so a deadlocked
+// limiter fails the test instead of hanging its cleanup.
+func acceptLimited(t *testing.T, l *ConnectionLimiter, n int) []net.Conn {
+	t.Helper()
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { inner.Close() })
+	ln := l.Listener(inner)
+
+	conns := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func TestConnStateClosesIdleOverCapWithoutDeadlock(t *testing.T) {
+	l := NewConnectionLimiter(config.ConnLimitConfig{
+		MaxConnectionsPerIP: 10,
+		MaxIdleConnections:  1,
+	}, nil)
+	conns := acceptLimited(t, l, 2)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, conn := range conns {
+			l.connState(conn, http.StateNew)
+			l.connState(conn, http.StateActive)
+			l.connState(conn, http.StateIdle)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connState deadlocked closing an idle connection over the cap")
+	}
+	defer conns[0].Close()
+
+	stats := l.Stats()
+	if stats.IdleClosed != 1 {
+		t.Errorf("IdleClosed = %d, want 1", stats.IdleClosed)
+	}
+	if stats.IdleConnections != 1 {
+		t.Errorf("IdleConnections = %d, want 1", stats.IdleConnections)
+	}
+	if stats.OpenConnections != 1 {
+		t.Errorf("OpenConnections = %d, want 1", stats.OpenConnections)
+	}
+
+	l.mu.Lock()
+	slots := l.conns["127.0.0.1"]
+	l.mu.Unlock()
+	if slots != 1 {
+		t.Errorf("per-IP slots = %d, want 1 after closing the idle connection", slots)
+	}
+}
+
+func TestLimitedConnCloseReleasesSlot(t *testing.T) {
+	l := NewConnectionLimiter(config.ConnLimitConfig{MaxConnectionsPerIP: 1}, nil)
+	conns := acceptLimited(t, l, 1)
+
+	conns[0].Close()
+	if open := l.Stats().OpenConnections; open != 0 {
+		t.Errorf("OpenConnections = %d, want 0 after close", open)
+	}
+	l.mu.Lock()
+	_, held := l.conns["127.0.0.1"]
+	l.mu.Unlock()
+	if held {
+		t.Error("per-IP slot still held after close")
+	}
+}
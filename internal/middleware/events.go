@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// SecurityEventMiddleware reports block and attack decisions to the SIEM
+// forwarder. It is registered before the blocking middleware so requests they
+// reject are seen too; attack detection is reused from LoggingMiddleware.
+func SecurityEventMiddleware(events *services.EventForwarder) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if !events.Enabled() {
+			return
+		}
+
+		status := c.Writer.Status()
+		blocked := c.GetBool("blocked") || status == http.StatusForbidden || status == http.StatusTooManyRequests
+
+		attackType := ""
+		if value, ok := c.Get("attack_type"); ok {
+			attackType, _ = value.(string)
+		} else if _, detected := detectAttackType(c); detected != "" {
+			attackType = detected
+		}
+		if !blocked && attackType == "" {
+			return
+		}
+
+		action := services.EventActionDetected
+		reason := ""
+		if blocked {
+			action = services.EventActionBlocked
+			reason = c.GetString("block_reason")
+			if reason == "" && status == http.StatusTooManyRequests {
+				reason = "Rate limit exceeded"
+			}
+		}
+
+		host := c.Request.Host
+		if idx := strings.LastIndex(host, ":"); idx != -1 && !strings.HasSuffix(host, "]") {
+			host = host[:idx]
+		}
+
+		events.Publish(services.SecurityEvent{
+			Timestamp:  time.Now(),
+			Action:     action,
+			Severity:   services.EventSeverity(attackType, blocked),
+			ClientIP:   c.ClientIP(),
+			Host:       host,
+			Method:     c.Request.Method,
+			URL:        c.Request.URL.String(),
+			StatusCode: status,
+			UserAgent:  c.GetHeader("User-Agent"),
+			AttackType: attackType,
+			Reason:     reason,
+			RequestID:  c.GetString("request_id"),
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// maxCapturedHeaderBytes limits how much of each request on a connection is
+// buffered for header fingerprinting
+const maxCapturedHeaderBytes = 8192
+
+type connContextKey struct{}
+
+// headerCaptureConn records the raw header names (original casing and order)
+// of the current request on the connection. net/http canonicalises header
+// keys and stores them in a map, so this is the only place where the client's
+// own casing and ordering can still be observed. Capture restarts when the
+// connection goes idle between keep-alive requests (see
+// HeaderCaptureConnState).
+type headerCaptureConn struct {
+	net.Conn
+
+	mu    sync.Mutex
+	buf   []byte
+	done  bool
+	names []string
+}
+
+func (c *headerCaptureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.capture(p[:n])
+	}
+	return n, err
+}
+
+func (c *headerCaptureConn) capture(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done {
+		return
+	}
+
+	c.buf = append(c.buf, p...)
+	end := bytes.Index(c.buf, []byte("\r\n\r\n"))
+	if end == -1 {
+		if len(c.buf) >= maxCapturedHeaderBytes {
+			c.done = true
+			c.buf = nil
+		}
+		return
+	}
+
+	c.names = parseRawHeaderNames(c.buf[:end])
+	c.done = true
+	c.buf = nil
+}
+
+// reset discards the previous request's header names and captures the next
+// request read from the connection
+func (c *headerCaptureConn) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = nil
+	c.names = nil
+	c.done = false
+}
+
+// headerNames returns the captured header names, or false if the header
+// block has not been (or could not be) captured
+func (c *headerCaptureConn) headerNames() ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.names == nil {
+		return nil, false
+	}
+	return c.names, true
+}
+
+// parseRawHeaderNames extracts header names from a raw HTTP/1.x header block,
+// skipping the request line. It returns nil when the block does not start
+// with a request line, e.g. when a pipelined request was buffered by net/http
+// before capture restarted. The first byte of the request line may be
+// missing, as net/http reads ahead one byte while a request is served.
+func parseRawHeaderNames(block []byte) []string {
+	lines := bytes.Split(block, []byte("\r\n"))
+	if !bytes.Contains(lines[0], []byte(" HTTP/1.")) {
+		return nil
+	}
+	if len(lines) < 2 {
+		return []string{}
+	}
+
+	names := make([]string, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		names = append(names, string(bytes.TrimSpace(line[:colon])))
+	}
+	return names
+}
+
+type headerCaptureListener struct {
+	net.Listener
+}
+
+func (l *headerCaptureListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &headerCaptureConn{Conn: conn}, nil
+}
+
+// NewHeaderCaptureListener wraps a listener so that the raw header order and
+// casing of each request can be used by the bot detector. Set
+// http.Server.ConnState with HeaderCaptureConnState so keep-alive requests
+// are captured too.
+func NewHeaderCaptureListener(l net.Listener) net.Listener {
+	return &headerCaptureListener{Listener: l}
+}
+
+// HeaderCaptureConnState restarts header capture when a connection goes idle
+// between requests, then calls next (if any). Without it every request on a
+// keep-alive connection would report the header names of the first one.
+func HeaderCaptureConnState(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(conn net.Conn, state http.ConnState) {
+		if hc, ok := conn.(*headerCaptureConn); ok && state == http.StateIdle {
+			hc.reset()
+		}
+		if next != nil {
+			next(conn, state)
+		}
+	}
+}
+
+// ConnContext stores the accepted connection in the request context.
+// Use it as http.Server.ConnContext for the WAF server.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// rawHeaderNames returns the header names exactly as the client sent them
+func rawHeaderNames(r *http.Request) ([]string, bool) {
+	conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return nil, false
+	}
+	for conn != nil {
+		if hc, ok := conn.(*headerCaptureConn); ok {
+			return hc.headerNames()
+		}
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+	return nil, false
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseRawHeaderNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+		want  []string
+	}{
+		{"request", "GET / HTTP/1.1\r\nHost: a\r\nuser-agent: x\r\nAccept:*/*", []string{"Host", "user-agent", "Accept"}},
+		{"no headers", "GET / HTTP/1.0", []string{}},
+		{"first byte read ahead", "ET / HTTP/1.1\r\nHost: a", []string{"Host"}},
+		{"not a request line", "name=value\r\nHost: a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRawHeaderNames([]byte(tt.block))
+			if (got == nil) != (tt.want == nil) || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("parseRawHeaderNames = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderCaptureKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			names, ok := rawHeaderNames(r)
+			if !ok {
+				io.WriteString(w, "none")
+				return
+			}
+			io.WriteString(w, strings.Join(names, ","))
+		}),
+		ConnContext: ConnContext,
+		ConnState:   HeaderCaptureConnState(nil),
+	}
+	go srv.Serve(NewHeaderCaptureListener(ln))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	requests := []struct {
+		raw  string
+		want string
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\nUser-Agent: x\r\n\r\n", "Host,User-Agent"},
+		{"GET / HTTP/1.1\r\nuser-agent: x\r\nhost: a\r\nAccept: */*\r\n\r\n", "user-agent,host,Accept"},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n\r\nbody", "Host,Content-Length"},
+		{"GET / HTTP/1.1\r\nX-Last: 1\r\nHost: a\r\n\r\n", "X-Last,Host"},
+	}
+	for i, req := range requests {
+		if _, err := io.WriteString(conn, req.raw); err != nil {
+			t.Fatalf("request %d: write: %v", i, err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("request %d: read response: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != req.want {
+			t.Errorf("request %d: header names = %q, want %q", i, body, req.want)
+		}
+	}
+}
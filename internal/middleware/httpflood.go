@@ -1,44 +1,44 @@
 package middleware
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/aleh/docode-waf/internal/metrics"
+	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
-	"github.com/redis/go-redis/v9"
 )
 
-// HTTPFloodProtectionMiddleware protects against HTTP flood attacks
-func HTTPFloodProtectionMiddleware(redisClient *redis.Client, maxRequests int, window time.Duration) gin.HandlerFunc {
+// HTTPFloodProtectionMiddleware protects against HTTP flood attacks.
+// Clients that exceed the threshold are handed to the jail and banned.
+func HTTPFloodProtectionMiddleware(limiter services.LimiterBackend, jail *services.JailService, maxRequests int, window time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		clientIP := c.ClientIP()
 		key := fmt.Sprintf("httpflood:%s", clientIP)
-		ctx := context.Background()
 
 		// Get request count in time window
-		count, err := redisClient.Get(ctx, key).Int()
-		if err != nil && err != redis.Nil {
+		count, _, err := limiter.Count(key)
+		if err != nil {
 			c.Next()
 			return
 		}
 
 		// Check if threshold exceeded
-		if count >= maxRequests {
+		if count >= int64(maxRequests) {
+			recordOffence(jail, clientIP, services.OffenceHTTPFlood)
+			markBlocked(c, "http_flood", "flood", "HTTP flood threshold exceeded")
+			metrics.RateLimitHits.WithLabelValues("http_flood").Inc()
 			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error": "Too many requests detected",
+				"error":      "Too many requests detected",
+				"request_id": c.GetString("request_id"),
 			})
 			c.Abort()
 			return
 		}
 
 		// Increment counter with expiration
-		pipe := redisClient.Pipeline()
-		pipe.Incr(ctx, key)
-		pipe.Expire(ctx, key, window)
-		_, err = pipe.Exec(ctx)
-		if err != nil {
+		if _, err := limiter.Increment(key, window); err != nil {
 			c.Next()
 			return
 		}
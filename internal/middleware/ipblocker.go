@@ -2,33 +2,25 @@ package middleware
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
 
-// IPBlockerMiddleware blocks requests from blacklisted IPs and allows only whitelisted IPs
-func IPBlockerMiddleware(db *sqlx.DB) gin.HandlerFunc {
+var ipBlockerLog = logging.Component("ip_blocker")
+
+// IPBlockerMiddleware blocks requests from blacklisted IPs and allows only
+// whitelisted IPs. Group membership is answered from ipIndex.
+func IPBlockerMiddleware(db *sqlx.DB, ipIndex *services.IPGroupIndex, geoIP *services.GeoIPService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Try to get real client IP from X-Forwarded-For or X-Real-IP headers
 		clientIP := c.ClientIP()
-		xForwardedFor := c.GetHeader("X-Forwarded-For")
-		xRealIP := c.GetHeader("X-Real-IP")
-
-		// Use X-Real-IP if available (set by nginx/proxy)
-		if xRealIP != "" {
-			clientIP = xRealIP
-		} else if xForwardedFor != "" {
-			// X-Forwarded-For can contain multiple IPs, take the first one
-			ips := strings.Split(xForwardedFor, ",")
-			if len(ips) > 0 {
-				clientIP = strings.TrimSpace(ips[0])
-			}
-		}
 
 		// Get current vhost domain
 		domain := c.Request.Host
@@ -37,48 +29,53 @@ func IPBlockerMiddleware(db *sqlx.DB) gin.HandlerFunc {
 			domain = domain[:colonIdx]
 		}
 
-		// Debug logging
-		log.Printf("[IP Blocker] Client IP: %s, Domain: %s, X-Forwarded-For: %s, X-Real-IP: %s, RemoteAddr: %s",
-			clientIP, domain, xForwardedFor, xRealIP, c.Request.RemoteAddr)
+		// Checked first so a disabled debug line costs nothing
+		if ipBlockerLog.Enabled(c.Request.Context(), slog.LevelDebug) {
+			ipBlockerLog.Debug("Checking request", "client_ip", clientIP, "domain", domain,
+				"remote_addr", c.Request.RemoteAddr)
+		}
 
-		// Check if vhost has an active whitelist
-		hasWhitelist, err := vhostHasActiveWhitelist(db, domain)
+		clientAddr, err := netip.ParseAddr(clientIP)
 		if err != nil {
-			log.Printf("[IP Blocker] Error checking whitelist for domain %s: %v", domain, err)
+			ipBlockerLog.Warn("Failed to parse client IP", "client_ip", clientIP)
 		}
 
 		// Check whitelist first (both global and vhost-specific)
-		whitelisted, err := isIPInGroup(db, clientIP, domain, "whitelist")
-		if err == nil && whitelisted {
-			log.Printf("[IP Blocker] IP %s is whitelisted for domain %s", clientIP, domain)
+		if ipIndex.Contains("whitelist", domain, clientAddr) {
+			if ipBlockerLog.Enabled(c.Request.Context(), slog.LevelDebug) {
+				ipBlockerLog.Debug("IP is whitelisted", "client_ip", clientIP, "domain", domain)
+			}
 			c.Next()
 			return
 		}
 
 		// If vhost has an active whitelist and IP is not in it, block the request
-		if hasWhitelist {
-			log.Printf("[IP Blocker] IP %s is NOT in whitelist for domain %s - blocking request (whitelist mode)", clientIP, domain)
+		if ipIndex.HasWhitelist(domain) {
+			ipBlockerLog.Info("Blocked IP not in whitelist", "client_ip", clientIP, "domain", domain)
+			markBlocked(c, "ip_blocker", "not_whitelisted", "IP not in whitelist")
 			c.Header("Content-Type", "text/html; charset=utf-8")
-			c.String(http.StatusForbidden, getWhitelistBlockedPageHTML(clientIP, domain))
+			c.String(http.StatusForbidden, getWhitelistBlockedPageHTML(clientIP, domain, c.GetString("request_id")))
 			c.Abort()
 			return
 		}
 
 		// Check blacklist (both global and vhost-specific)
-		blacklisted, err := isIPInGroup(db, clientIP, domain, "blacklist")
-		if err == nil && blacklisted {
-			log.Printf("[IP Blocker] IP %s is blacklisted for domain %s - blocking request", clientIP, domain)
+		if ipIndex.Contains("blacklist", domain, clientAddr) {
+			ipBlockerLog.Info("Blocked blacklisted IP", "client_ip", clientIP, "domain", domain)
+			markBlocked(c, "ip_blocker", "blacklisted", "IP blacklisted")
 			c.Header("Content-Type", "text/html; charset=utf-8")
-			c.String(http.StatusForbidden, getBlockedPageHTML(db, clientIP, c.Request.Host))
+			c.String(http.StatusForbidden, getBlockedPageHTML(db, clientIP, c.Request.Host, c.GetString("request_id")))
 			c.Abort()
 			return
 		}
 
 		// Check blocking rules
-		blocked, reason := checkBlockingRules(db, c)
+		blocked, reason := checkBlockingRules(db, geoIP, c)
 		if blocked {
+			markBlocked(c, "ip_blocker", "blocking_rule", reason)
 			c.JSON(http.StatusForbidden, gin.H{
-				"error": reason,
+				"error":      reason,
+				"request_id": c.GetString("request_id"),
 			})
 			c.Abort()
 			return
@@ -88,40 +85,8 @@ func IPBlockerMiddleware(db *sqlx.DB) gin.HandlerFunc {
 	}
 }
 
-// vhostHasActiveWhitelist checks if a domain has any active whitelist groups
-func vhostHasActiveWhitelist(db *sqlx.DB, domain string) (bool, error) {
-	query := `
-		SELECT COUNT(*) > 0
-		FROM ip_groups ig
-		JOIN ip_group_vhosts igv ON ig.id = igv.ip_group_id
-		JOIN vhosts v ON igv.vhost_id = v.id
-		WHERE ig.type = 'whitelist' AND v.domain = $1
-	`
-	var hasWhitelist bool
-	err := db.Get(&hasWhitelist, query, domain)
-	if err != nil {
-		return false, err
-	}
-
-	// Also check global whitelists (no vhost associations)
-	if !hasWhitelist {
-		globalQuery := `
-			SELECT COUNT(*) > 0
-			FROM ip_groups ig
-			WHERE ig.type = 'whitelist' 
-			AND NOT EXISTS (SELECT 1 FROM ip_group_vhosts WHERE ip_group_id = ig.id)
-		`
-		err = db.Get(&hasWhitelist, globalQuery)
-		if err != nil {
-			return false, err
-		}
-	}
-
-	return hasWhitelist, nil
-}
-
 // getWhitelistBlockedPageHTML returns a styled HTML page for whitelist-blocked users
-func getWhitelistBlockedPageHTML(clientIP, domain string) string {
+func getWhitelistBlockedPageHTML(clientIP, domain, requestID string) string {
 	return fmt.Sprintf(`<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -203,77 +168,14 @@ func getWhitelistBlockedPageHTML(clientIP, domain string) string {
         <div class="message">
             <p>This domain uses <strong>IP Whitelist</strong> access control. Only pre-approved IP addresses can access this resource. Please contact your System Administrator to request access.</p>
         </div>
+        %s
         <div class="footer">Protected by DoCode WAF</div>
     </div>
 </body>
-</html>`, clientIP, domain)
-}
-
-func isIPInGroup(db *sqlx.DB, clientIP, domain, groupType string) (bool, error) {
-	// Check both global rules (no vhost associations) and vhost-specific rules
-	// Updated to use ip_group_vhosts junction table
-	query := `
-		SELECT DISTINCT ia.ip_address, ia.cidr_mask 
-		FROM ip_addresses ia
-		JOIN ip_groups ig ON ia.group_id = ig.id
-		LEFT JOIN ip_group_vhosts igv ON ig.id = igv.ip_group_id
-		LEFT JOIN vhosts v ON igv.vhost_id = v.id
-		WHERE ig.type = $1 
-		AND (
-			-- Global rules: no vhost associations
-			NOT EXISTS (SELECT 1 FROM ip_group_vhosts WHERE ip_group_id = ig.id)
-			OR 
-			-- Vhost-specific rules: matches current domain
-			v.domain = $2
-		)
-	`
-
-	var addresses []struct {
-		IPAddress string `db:"ip_address"`
-		CIDRMask  *int   `db:"cidr_mask"`
-	}
-
-	err := db.Select(&addresses, query, groupType, domain)
-	if err != nil {
-		log.Printf("[IP Blocker] Error querying %s for domain %s: %v", groupType, domain, err)
-		return false, err
-	}
-
-	log.Printf("[IP Blocker] Checking client IP %s against %d %s entries for domain %s", clientIP, len(addresses), groupType, domain)
-
-	clientIPParsed := net.ParseIP(clientIP)
-	if clientIPParsed == nil {
-		log.Printf("[IP Blocker] Failed to parse client IP: %s", clientIP)
-		return false, nil
-	}
-
-	for _, addr := range addresses {
-		// Check if CIDR is specified
-		if addr.CIDRMask != nil && *addr.CIDRMask > 0 {
-			// Build CIDR notation
-			cidr := fmt.Sprintf("%s/%d", addr.IPAddress, *addr.CIDRMask)
-			log.Printf("[IP Blocker] Checking CIDR: %s", cidr)
-
-			_, ipNet, err := net.ParseCIDR(cidr)
-			if err == nil && ipNet.Contains(clientIPParsed) {
-				log.Printf("[IP Blocker] MATCH! IP %s is in CIDR %s", clientIP, cidr)
-				return true, nil
-			}
-		} else {
-			// Exact IP match
-			log.Printf("[IP Blocker] Checking exact IP: %s", addr.IPAddress)
-			if addr.IPAddress == clientIP {
-				log.Printf("[IP Blocker] MATCH! IP %s matches exactly", clientIP)
-				return true, nil
-			}
-		}
-	}
-
-	log.Printf("[IP Blocker] No match found for IP %s in %s", clientIP, groupType)
-	return false, nil
+</html>`, clientIP, domain, referenceHTML(requestID))
 }
 
-func checkBlockingRules(db *sqlx.DB, c *gin.Context) (bool, string) {
+func checkBlockingRules(db *sqlx.DB, geoIP *services.GeoIPService, c *gin.Context) (bool, string) {
 	clientIP := c.ClientIP()
 	userAgent := c.GetHeader("User-Agent")
 	url := c.Request.URL.Path
@@ -294,6 +196,15 @@ func checkBlockingRules(db *sqlx.DB, c *gin.Context) (bool, string) {
 		return false, ""
 	}
 
+	// Resolved lazily, only when a region or asn rule is enabled
+	var geo *services.GeoIPRecord
+	lookup := func() *services.GeoIPRecord {
+		if geo == nil {
+			geo = geoIP.LookupOrUnknown(clientIP)
+		}
+		return geo
+	}
+
 	for _, rule := range rules {
 		matched := false
 
@@ -302,6 +213,10 @@ func checkBlockingRules(db *sqlx.DB, c *gin.Context) (bool, string) {
 			if matchIP(clientIP, rule.Pattern) {
 				matched = true
 			}
+		case "region":
+			matched = matchRegionRule(lookup(), rule.Pattern)
+		case "asn":
+			matched = matchASNRule(lookup(), rule.Pattern)
 		case "url":
 			if strings.Contains(url, rule.Pattern) {
 				matched = true
@@ -313,6 +228,9 @@ func checkBlockingRules(db *sqlx.DB, c *gin.Context) (bool, string) {
 		}
 
 		if matched && rule.Action == "block" {
+			if rule.Type == "asn" {
+				return true, fmt.Sprintf("Blocked by security rule (AS%d)", lookup().ASN)
+			}
 			return true, "Blocked by security rule"
 		}
 	}
@@ -320,6 +238,34 @@ func checkBlockingRules(db *sqlx.DB, c *gin.Context) (bool, string) {
 	return false, ""
 }
 
+// matchRegionRule matches a comma-separated list of country or subdivision
+// codes, e.g. "CN,RU,US-TX"
+func matchRegionRule(geo *services.GeoIPRecord, pattern string) bool {
+	if geo.Private {
+		return false
+	}
+	for _, entry := range strings.Split(pattern, ",") {
+		if geo.MatchesRegion(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchASNRule matches a comma-separated list of AS numbers, e.g.
+// "AS16509,AS14061". Without the ASN database nothing matches.
+func matchASNRule(geo *services.GeoIPRecord, pattern string) bool {
+	if geo.ASN == 0 {
+		return false
+	}
+	for _, entry := range strings.Split(pattern, ",") {
+		if asn, ok := services.ParseASN(entry); ok && asn == geo.ASN {
+			return true
+		}
+	}
+	return false
+}
+
 func matchIP(ip, pattern string) bool {
 	// Check if pattern is CIDR
 	if strings.Contains(pattern, "/") {
@@ -335,7 +281,7 @@ func matchIP(ip, pattern string) bool {
 }
 
 // getBlockedPageHTML returns a styled HTML page for blocked users
-func getBlockedPageHTML(db *sqlx.DB, clientIP, host string) string {
+func getBlockedPageHTML(db *sqlx.DB, clientIP, host, requestID string) string {
 	// Get application name from vhost
 	// var appName string
 	// query := "SELECT name FROM vhosts WHERE domain = $1 LIMIT 1"
@@ -592,6 +538,7 @@ func getBlockedPageHTML(db *sqlx.DB, clientIP, host string) string {
             </div>
         </div>
         
+        ` + referenceHTML(requestID) + `
         <div class="footer">
             <p>Protected by DoCode WAF (Web Application Firewall)</p>
         </div>
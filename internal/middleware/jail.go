@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+var jailLog = logging.Component("jail")
+
+// JailMiddleware rejects requests from IPs that are serving a temporary ban
+func JailMiddleware(jail *services.JailService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !jail.Enabled() {
+			c.Next()
+			return
+		}
+
+		ban, banned := jail.IsBanned(c.ClientIP())
+		if !banned {
+			c.Next()
+			return
+		}
+
+		domain := c.Request.Host
+		if colonIdx := strings.Index(domain, ":"); colonIdx != -1 {
+			domain = domain[:colonIdx]
+		}
+
+		markBlocked(c, "jail", "banned", "Jailed: "+ban.Reason)
+		c.Header("Retry-After", fmt.Sprintf("%d", ban.RemainingSeconds))
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.String(http.StatusForbidden, getJailBlockedPageHTML(domain, ban.RemainingSeconds, c.GetString("request_id")))
+		c.Abort()
+	}
+}
+
+// recordOffence reports an offence to the jail and logs when it results in a ban
+func recordOffence(jail *services.JailService, ip, reason string) {
+	if !jail.Enabled() {
+		return
+	}
+
+	ban, err := jail.RecordOffence(ip, reason)
+	if err != nil {
+		jailLog.Error("Failed to record offence", "reason", reason, "ip", ip, "error", err)
+		return
+	}
+	if ban != nil {
+		jailLog.Info("Banned IP", "ip", ip, "seconds", ban.RemainingSeconds, "level", ban.Level, "reason", reason)
+	}
+}
+
+// getJailBlockedPageHTML returns HTML for requests from temporarily banned IPs
+func getJailBlockedPageHTML(domain string, retryAfter int, requestID string) string {
+	return `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Temporarily Banned - DoCode WAF</title>
+    <style>
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+        }
+
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            background: linear-gradient(135deg, #f093fb 0%, #f5576c 100%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            padding: 20px;
+        }
+
+        .container {
+            background: white;
+            border-radius: 20px;
+            box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
+            max-width: 500px;
+            width: 100%;
+            padding: 40px;
+            text-align: center;
+        }
+
+        h1 {
+            color: #2d3748;
+            font-size: 28px;
+            margin-bottom: 10px;
+        }
+
+        .subtitle {
+            color: #718096;
+            margin-bottom: 20px;
+            line-height: 1.6;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>⛔ Temporarily Banned</h1>
+        <p class="subtitle">Your IP address has been temporarily banned from <strong>` + domain + `</strong> after repeated suspicious requests.</p>
+        <p class="subtitle">Please try again in ` + fmt.Sprintf("%d", (retryAfter+59)/60) + ` minute(s).</p>
+
+        ` + referenceHTML(requestID) + `
+        <p style="margin-top: 30px; color: #a0aec0; font-size: 14px;">
+            🛡️ Protected by DoCode WAF
+        </p>
+    </div>
+</body>
+</html>`
+}
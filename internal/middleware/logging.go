@@ -1,66 +1,23 @@
 package middleware
 
 import (
-	"log"
 	"net"
+	"net/http"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/aleh/docode-waf/internal/services"
+	"github.com/aleh/docode-waf/internal/tracing"
 	"github.com/gin-gonic/gin"
-	"github.com/jmoiron/sqlx"
-	"github.com/oschwald/geoip2-golang"
 )
 
-var (
-	geoipDB     *geoip2.Reader
-	geoipDBOnce sync.Once
-)
-
-// initGeoIP initializes the GeoIP database
-func initGeoIP() {
-	geoipDBOnce.Do(func() {
-		db, err := geoip2.Open("GeoLite2-Country.mmdb")
-		if err != nil {
-			log.Printf("Warning: Failed to load GeoIP database: %v", err)
-			return
-		}
-		geoipDB = db
-		log.Println("GeoIP database loaded successfully")
-	})
-}
-
-// getCountryCode extracts country code from IP address using GeoIP2
-// Returns country code or "XX" if unknown
-func getCountryCode(ip string) string {
-	// Ensure GeoIP database is initialized
-	initGeoIP()
-
-	// Parse IP
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return "XX"
-	}
-
-	// Check if private/local IP
-	if parsedIP.IsPrivate() || parsedIP.IsLoopback() {
-		return "XX"
-	}
-
-	// Lookup country from GeoIP database
-	if geoipDB != nil {
-		record, err := geoipDB.Country(parsedIP)
-		if err == nil && record.Country.IsoCode != "" {
-			return record.Country.IsoCode
-		}
-	}
-
-	// Return XX if lookup fails
-	return "XX"
-}
-
-// LoggingMiddleware logs all HTTP traffic
-func LoggingMiddleware(db *sqlx.DB) gin.HandlerFunc {
+// LoggingMiddleware logs all HTTP traffic and reports detected attacks and
+// 404 scanning to the jail. It is registered ahead of the blocking middleware
+// so rejected requests are logged with the decision that rejected them.
+// Everything needed is copied out of the context before the handler returns;
+// the entry is written by the traffic logger and the decision is published
+// to live stream clients, if there are any.
+func LoggingMiddleware(trafficLog *services.TrafficLogger, jail *services.JailService, decisions *services.DecisionStream) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
 
@@ -70,18 +27,94 @@ func LoggingMiddleware(db *sqlx.DB) gin.HandlerFunc {
 		// Calculate response time
 		duration := time.Since(start)
 
-		// Log to database asynchronously
-		go logTraffic(db, c, duration)
+		// The proxy has returned; only the logging work itself is in this span
+		ctx, span := tracing.Start(c.Request.Context(), "waf.logging")
+		defer span.End()
+
+		clientIP := c.ClientIP()
+		status := c.Writer.Status()
+		isAttack, attackType := detectAttackType(c)
+		c.Set("attack_type", attackType)
+		blocked := c.GetBool("blocked") || status == http.StatusForbidden
+
+		blockReason := ""
+		if blocked {
+			blockReason = c.GetString("block_reason")
+		}
+
+		// Feed the jail; plain bot traffic is left to the bot detector and
+		// blocked requests were already dealt with by the middleware that
+		// blocked them
+		if !blocked && isAttack && attackType != "Bot Traffic" {
+			go recordOffence(jail, clientIP, services.OffenceAttack)
+		} else if status == http.StatusNotFound && !isAssetPath(c.Request.URL.Path) {
+			go recordOffence(jail, clientIP, services.OffenceNotFoundHit)
+		}
+
+		entry := services.TrafficLogEntry{
+			Timestamp:    time.Now(),
+			ClientIP:     clientIP,
+			Method:       c.Request.Method,
+			URL:          c.Request.URL.String(),
+			StatusCode:   status,
+			ResponseTime: int(duration.Milliseconds()),
+			BytesSent:    c.Writer.Size(),
+			UserAgent:    c.GetHeader("User-Agent"),
+			Referer:      c.Request.Referer(),
+			Blocked:      blocked,
+			BlockReason:  blockReason,
+			IsAttack:     isAttack,
+			AttackType:   attackType,
+			Host:         c.Request.Host,
+			TraceID:      tracing.TraceID(ctx),
+			RequestID:    c.GetString("request_id"),
+			Decision:     requestDecision(c),
+			BlockSource:  c.GetString("block_source"),
+		}
+		trafficLog.Enqueue(entry)
+
+		if decisions.Active() {
+			decisions.Publish(&services.LiveDecision{
+				Timestamp:    entry.Timestamp,
+				RequestID:    entry.RequestID,
+				ClientIP:     entry.ClientIP,
+				Host:         entry.Host,
+				Method:       entry.Method,
+				URL:          entry.URL,
+				StatusCode:   entry.StatusCode,
+				ResponseTime: entry.ResponseTime,
+				UserAgent:    entry.UserAgent,
+				Decision:     entry.Decision,
+				BlockSource:  entry.BlockSource,
+				BlockReason:  entry.BlockReason,
+				AttackType:   entry.AttackType,
+			})
+		}
 	}
 }
 
+// attackMatch is the attack rule a request matched
+type attackMatch struct {
+	Type    string
+	Pattern string
+	Field   string // url or user_agent
+}
+
 // detectAttackType analyzes request for attack patterns
-// Skips detection for private/local IPs to avoid false positives during testing
 func detectAttackType(c *gin.Context) (bool, string) {
+	if match := detectAttack(c); match != nil {
+		return true, match.Type
+	}
+	return false, ""
+}
+
+// detectAttack returns the first attack rule the request matches, or nil
+// Skips detection for private/local IPs to avoid false positives during testing
+func detectAttack(c *gin.Context) *attackMatch {
 	// Skip attack detection for private/local IPs
 	clientIP := net.ParseIP(c.ClientIP())
 	if clientIP != nil && (clientIP.IsPrivate() || clientIP.IsLoopback()) {
-		return false, ""
+		return nil
 	}
 
 	url := c.Request.URL.String()
@@ -92,7 +125,7 @@ func detectAttackType(c *gin.Context) (bool, string) {
 		"admin'--", "' OR ''='", "1' AND '1'='1", "SELECT * FROM"}
 	for _, pattern := range sqlPatterns {
 		if strings.Contains(strings.ToUpper(url), strings.ToUpper(pattern)) {
-			return true, "SQL Injection"
+			return &attackMatch{Type: "SQL Injection", Pattern: pattern, Field: "url"}
 		}
 	}
 
@@ -101,7 +134,7 @@ func detectAttackType(c *gin.Context) (bool, string) {
 		"<img", "alert(", "<iframe"}
 	for _, pattern := range xssPatterns {
 		if strings.Contains(strings.ToLower(url), strings.ToLower(pattern)) {
-			return true, "XSS"
+			return &attackMatch{Type: "XSS", Pattern: pattern, Field: "url"}
 		}
 	}
 
@@ -109,7 +142,7 @@ func detectAttackType(c *gin.Context) (bool, string) {
 	pathTraversalPatterns := []string{"../", "..\\", "/etc/passwd", "windows/system32", "../../"}
 	for _, pattern := range pathTraversalPatterns {
 		if strings.Contains(strings.ToLower(url), strings.ToLower(pattern)) {
-			return true, "Path Traversal"
+			return &attackMatch{Type: "Path Traversal", Pattern: pattern, Field: "url"}
 		}
 	}
 
@@ -117,7 +150,7 @@ func detectAttackType(c *gin.Context) (bool, string) {
 	cmdPatterns := []string{";ls", ";cat", ";whoami", "|ls", "|cat", "&ls", "$("}
 	for _, pattern := range cmdPatterns {
 		if strings.Contains(url, pattern) {
-			return true, "Command Injection"
+			return &attackMatch{Type: "Command Injection", Pattern: pattern, Field: "url"}
 		}
 	}
 
@@ -131,7 +164,7 @@ func detectAttackType(c *gin.Context) (bool, string) {
 	for _, path := range adminPaths {
 		// Check if URL starts with admin path or has it after domain
 		if strings.HasPrefix(urlLower, path) || strings.Contains(urlLower, "://"+c.Request.Host+path) {
-			return true, "Admin Scan"
+			return &attackMatch{Type: "Admin Scan", Pattern: path, Field: "url"}
 		}
 	}
 
@@ -139,7 +172,7 @@ func detectAttackType(c *gin.Context) (bool, string) {
 	adminFilePatterns := []string{"/admin/login", "/admin/index", "/login.php", "/admin.asp"}
 	for _, pattern := range adminFilePatterns {
 		if strings.Contains(urlLower, pattern) {
-			return true, "Admin Scan"
+			return &attackMatch{Type: "Admin Scan", Pattern: pattern, Field: "url"}
 		}
 	}
 
@@ -156,89 +189,9 @@ func detectAttackType(c *gin.Context) (bool, string) {
 	botPatterns := []string{"bot", "crawler", "spider", "python", "curl", "wget"}
 	for _, pattern := range botPatterns {
 		if strings.Contains(strings.ToLower(userAgent), pattern) {
-			return true, "Bot Traffic"
+			return &attackMatch{Type: "Bot Traffic", Pattern: pattern, Field: "user_agent"}
 		}
 	}
 
-	return false, ""
-}
-
-func logTraffic(db *sqlx.DB, c *gin.Context, duration time.Duration) {
-	// Detect attack
-	isAttack, attackType := detectAttackType(c)
-	blocked := c.GetBool("blocked") || c.Writer.Status() == 403
-
-	query := `
-		INSERT INTO traffic_logs (
-			id, timestamp, client_ip, method, url, status_code, 
-			response_time, bytes_sent, user_agent, blocked, block_reason,
-			is_attack, attack_type, country_code, host
-		) VALUES (
-			gen_random_uuid(), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14
-		)
-	`
-
-	blockReason := ""
-	if blocked {
-		if val, exists := c.Get("block_reason"); exists {
-			blockReason = val.(string)
-		}
-	}
-
-	countryCode := getCountryCode(c.ClientIP())
-
-	// Get the HTTP Host header and try to find the matching vhost domain
-	httpHost := c.Request.Host
-	host := lookupVHostDomain(db, httpHost)
-
-	_, err := db.Exec(query,
-		time.Now(),
-		c.ClientIP(),
-		c.Request.Method,
-		c.Request.URL.String(), // Changed from Path to String to include query params
-		c.Writer.Status(),
-		int(duration.Milliseconds()),
-		c.Writer.Size(),
-		c.GetHeader("User-Agent"),
-		blocked,
-		blockReason,
-		isAttack,
-		attackType,
-		countryCode,
-		host,
-	)
-
-	if err != nil {
-		// Log error but don't fail the request
-		println("Failed to log traffic:", err.Error())
-	}
-}
-
-// lookupVHostDomain finds the vhost domain from database based on HTTP Host header
-// If Host is an IP or doesn't match any vhost, returns the original Host value (for fallback)
-// If a matching vhost is found by domain, returns the domain name
-func lookupVHostDomain(db *sqlx.DB, httpHost string) string {
-	// Remove port if present (host:port)
-	hostOnly := httpHost
-	if idx := strings.LastIndex(httpHost, ":"); idx != -1 {
-		hostOnly = httpHost[:idx]
-	}
-
-	// First, check if the host is already a domain in our vhosts table
-	var domain string
-	err := db.Get(&domain, "SELECT domain FROM vhosts WHERE domain = $1 AND enabled = true LIMIT 1", hostOnly)
-	if err == nil {
-		return domain
-	}
-
-	// If not found by exact domain match, try to find any enabled vhost
-	// This handles cases where request comes via IP address
-	// We'll return the first enabled vhost domain as it's likely the primary one
-	err = db.Get(&domain, "SELECT domain FROM vhosts WHERE enabled = true ORDER BY created_at ASC LIMIT 1")
-	if err == nil {
-		return domain
-	}
-
-	// Fallback to original host if no vhost found
-	return httpHost
+	return nil
 }
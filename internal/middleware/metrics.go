@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/metrics"
+	"github.com/aleh/docode-waf/internal/tracing"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// markBlocked flags the request as blocked for logging and SIEM forwarding,
+// counts the block by middleware and reason and tags the current span. The
+// reason label must come from a fixed set; the free-form message only goes to
+// the logs.
+func markBlocked(c *gin.Context, source, reason, message string) {
+	c.Set("blocked", true)
+	c.Set("block_source", source)
+	c.Set("block_reason", message)
+	metrics.Blocks.WithLabelValues(source, reason).Inc()
+	tracing.Annotate(c, attribute.String("waf.block.middleware", source), attribute.String("waf.block.reason", reason))
+}
+
+// requestDecision is what the WAF did with a request once the chain has run
+func requestDecision(c *gin.Context) string {
+	switch {
+	case c.GetBool("challenged"):
+		return metrics.DecisionChallenged
+	case c.GetBool("blocked"):
+		return metrics.DecisionBlocked
+	case c.GetString("attack_type") != "":
+		return metrics.DecisionAttack
+	default:
+		return metrics.DecisionAllowed
+	}
+}
+
+// MetricsMiddleware records request counts and latency by vhost, status and
+// decision. It is registered first so requests rejected by any other
+// middleware are counted. Hosts that are not configured vhosts are reported
+// as "other" so scanners cannot blow up the number of series.
+func MetricsMiddleware(knownVHost func(host string) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		host := c.Request.Host
+		if idx := strings.LastIndex(host, ":"); idx != -1 && !strings.HasSuffix(host, "]") {
+			host = host[:idx]
+		}
+		if !knownVHost(host) {
+			host = "other"
+		}
+
+		decision := requestDecision(c)
+		status := c.Writer.Status()
+		metrics.HTTPRequests.WithLabelValues(host, strconv.Itoa(status), decision).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(host, metrics.StatusClass(status), decision).Observe(time.Since(start).Seconds())
+	}
+}
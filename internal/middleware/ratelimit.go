@@ -1,20 +1,26 @@
 package middleware
 
 import (
-	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/metrics"
+	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
-	"github.com/redis/go-redis/v9"
 )
 
-// RateLimiterMiddleware implements per-vhost rate limiting using Redis
-func RateLimiterMiddleware(redisClient *redis.Client, db *sqlx.DB) gin.HandlerFunc {
+var rateLimitLog = logging.Component("rate_limiter")
+
+// RateLimiterMiddleware implements per-vhost rate limiting on the limiter
+// backend (Redis, or per-node counters while Redis is down).
+// Limits are tightened while the vhost is in attack mode. An optional per-ASN
+// limit caps the combined traffic of all IPs in one autonomous system, which
+// catches scrapers rotating through a hosting provider's address space.
+func RateLimiterMiddleware(limiter services.LimiterBackend, db *sqlx.DB, jail *services.JailService, attackMode *services.AttackModeService, geoIP *services.GeoIPService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get current vhost domain
 		domain := c.Request.Host
@@ -27,15 +33,26 @@ func RateLimiterMiddleware(redisClient *redis.Client, db *sqlx.DB) gin.HandlerFu
 			RateLimitEnabled  bool `db:"rate_limit_enabled"`
 			RateLimitRequests int  `db:"rate_limit_requests"`
 			RateLimitWindow   int  `db:"rate_limit_window"`
+			ASNRateLimit      int  `db:"asn_rate_limit_requests"`
 		}
 
-		err := db.Get(&vhostSettings, "SELECT rate_limit_enabled, rate_limit_requests, rate_limit_window FROM vhosts WHERE domain = $1", domain)
+		err := db.Get(&vhostSettings, `SELECT rate_limit_enabled, rate_limit_requests, rate_limit_window,
+			COALESCE(asn_rate_limit_requests, 0) as asn_rate_limit_requests FROM vhosts WHERE domain = $1`, domain)
 		if err != nil {
-			log.Printf("[Rate Limiter] Error getting vhost settings for domain %s: %v", domain, err)
+			rateLimitLog.Error("Failed to get vhost settings", "domain", domain, "error", err)
 			c.Next()
 			return
 		}
 
+		key := "ratelimit"
+		if c.GetBool("attack_mode") {
+			// Applies even to vhosts that have rate limiting disabled
+			vhostSettings.RateLimitRequests, vhostSettings.RateLimitWindow = attackMode.EffectiveRateLimit(
+				vhostSettings.RateLimitEnabled, vhostSettings.RateLimitRequests, vhostSettings.RateLimitWindow)
+			vhostSettings.RateLimitEnabled = true
+			key = "ratelimit:attack"
+		}
+
 		// If rate limiting is disabled for this vhost, skip
 		if !vhostSettings.RateLimitEnabled {
 			c.Next()
@@ -43,20 +60,17 @@ func RateLimiterMiddleware(redisClient *redis.Client, db *sqlx.DB) gin.HandlerFu
 		}
 
 		clientIP := c.ClientIP()
-		key := fmt.Sprintf("ratelimit:%s:%s", domain, clientIP)
-		ctx := context.Background()
+		key = fmt.Sprintf("%s:%s:%s", key, domain, clientIP)
 
-		// Get current count
-		count, err := redisClient.Get(ctx, key).Int()
-		if err != nil && err != redis.Nil {
+		// Get current count and TTL for reset time
+		count, ttl, err := limiter.Count(key)
+		if err != nil {
 			c.Next()
 			return
 		}
 
 		// Check if limit exceeded
-		if count >= vhostSettings.RateLimitRequests {
-			// Get TTL for reset time
-			ttl, _ := redisClient.TTL(ctx, key).Result()
+		if count >= int64(vhostSettings.RateLimitRequests) {
 			resetTime := time.Now().Add(ttl).Unix()
 
 			// Set headers
@@ -66,22 +80,47 @@ func RateLimiterMiddleware(redisClient *redis.Client, db *sqlx.DB) gin.HandlerFu
 			c.Header("Retry-After", fmt.Sprintf("%d", int(ttl.Seconds())))
 			c.Header("Content-Type", "text/html; charset=utf-8")
 
-			c.String(http.StatusTooManyRequests, getRateLimitHTML(domain, vhostSettings.RateLimitRequests, vhostSettings.RateLimitWindow, int(ttl.Seconds())))
+			markBlocked(c, "rate_limit", "vhost_limit", "Rate limit exceeded")
+			metrics.RateLimitHits.WithLabelValues("vhost").Inc()
+			c.String(http.StatusTooManyRequests, getRateLimitHTML(domain, vhostSettings.RateLimitRequests, vhostSettings.RateLimitWindow, int(ttl.Seconds()), c.GetString("request_id")))
+			c.Abort()
+
+			// Every rejected request counts towards a jail ban
+			recordOffence(jail, clientIP, services.OffenceRateLimit)
+			return
+		}
+
+		window := time.Duration(vhostSettings.RateLimitWindow) * time.Second
+		if vhostSettings.ASNRateLimit > 0 {
+			if asn := geoIP.LookupOrUnknown(clientIP).ASN; asn != 0 {
+				asnKey := fmt.Sprintf("ratelimit:asn:%s:%d", domain, asn)
+				asnCount, asnTTL, err := limiter.Count(asnKey)
+				if err == nil && asnCount >= int64(vhostSettings.ASNRateLimit) {
+					// The whole network is over its share; no jail offence for
+					// an individual IP that may only have sent one request
+					markBlocked(c, "rate_limit", "asn_limit", fmt.Sprintf("ASN rate limit exceeded (AS%d)", asn))
+					metrics.RateLimitHits.WithLabelValues("asn").Inc()
+					c.Header("Retry-After", fmt.Sprintf("%d", int(asnTTL.Seconds())))
+					c.Header("Content-Type", "text/html; charset=utf-8")
+					c.String(http.StatusTooManyRequests, getRateLimitHTML(domain, vhostSettings.ASNRateLimit, vhostSettings.RateLimitWindow, int(asnTTL.Seconds()), c.GetString("request_id")))
+					c.Abort()
+					return
+				}
+				if err == nil {
+					limiter.Increment(asnKey, window)
+				}
+			}
 		}
 
 		// Increment counter
-		pipe := redisClient.Pipeline()
-		pipe.Incr(ctx, key)
-		pipe.Expire(ctx, key, time.Duration(vhostSettings.RateLimitWindow)*time.Second)
-		_, err = pipe.Exec(ctx)
-		if err != nil {
+		if _, err := limiter.Increment(key, window); err != nil {
 			c.Next()
 			return
 		}
 
 		// Add rate limit headers
 		c.Header("X-RateLimit-Limit", fmt.Sprintf("%d", vhostSettings.RateLimitRequests))
-		c.Header("X-RateLimit-Remaining", fmt.Sprintf("%d", vhostSettings.RateLimitRequests-count-1))
+		c.Header("X-RateLimit-Remaining", fmt.Sprintf("%d", vhostSettings.RateLimitRequests-int(count)-1))
 		c.Header("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(time.Duration(vhostSettings.RateLimitWindow)*time.Second).Unix()))
 
 		c.Next()
@@ -89,7 +128,7 @@ func RateLimiterMiddleware(redisClient *redis.Client, db *sqlx.DB) gin.HandlerFu
 }
 
 // getRateLimitHTML returns HTML for rate limit exceeded page
-func getRateLimitHTML(domain string, limit, window, retryAfter int) string {
+func getRateLimitHTML(domain string, limit, window, retryAfter int, requestID string) string {
 	return `<!DOCTYPE html>
 <html>
 <head>
@@ -350,6 +389,7 @@ func getRateLimitHTML(domain string, limit, window, retryAfter int) string {
             </ul>
         </div>
         
+        ` + referenceHTML(requestID) + `
         <p class="footer">
             🛡️ Protected by DoCode WAF
         </p>
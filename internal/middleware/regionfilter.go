@@ -2,17 +2,28 @@ package middleware
 
 import (
 	"fmt"
-	"log"
-	"net"
+	"log/slog"
 	"net/http"
-	"strings"
 
+	"github.com/aleh/docode-waf/internal/logging"
 	"github.com/aleh/docode-waf/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
 
-// RegionFilter middleware checks if request is from allowed/blocked region
+var regionFilterLog = logging.Component("region_filter")
+
+// GeoIP fail policies
+const (
+	GeoIPFailOpen   = "open"
+	GeoIPFailClosed = "closed"
+)
+
+// RegionFilter middleware checks if request is from allowed/blocked region.
+// List entries are country codes ("US") or, when the City database is loaded,
+// ISO 3166-2 subdivision codes ("US-CA"). When the country cannot be
+// determined the vhost's GeoIP fail policy decides whether the request is
+// allowed (open) or blocked (closed).
 func RegionFilter(db *sqlx.DB, geoIPService *services.GeoIPService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		domain := c.Request.Host
@@ -22,20 +33,22 @@ func RegionFilter(db *sqlx.DB, geoIPService *services.GeoIPService) gin.HandlerF
 			RegionWhitelist        []string `db:"region_whitelist"`
 			RegionBlacklist        []string `db:"region_blacklist"`
 			RegionFilteringEnabled bool     `db:"region_filtering_enabled"`
+			GeoIPFailPolicy        string   `db:"geoip_fail_policy"`
 		}
 
 		query := `
 			SELECT 
 				COALESCE(region_whitelist, '{}') as region_whitelist,
 				COALESCE(region_blacklist, '{}') as region_blacklist,
-				COALESCE(region_filtering_enabled, false) as region_filtering_enabled
+				COALESCE(region_filtering_enabled, false) as region_filtering_enabled,
+				COALESCE(geoip_fail_policy, 'open') as geoip_fail_policy
 			FROM vhosts 
 			WHERE domain = $1 AND enabled = true
 		`
 
 		err := db.Get(&vhostSettings, query, domain)
 		if err != nil {
-			log.Printf("[Region Filter] Error getting vhost settings for domain %s: %v", domain, err)
+			regionFilterLog.Error("Failed to get vhost settings", "domain", domain, "error", err)
 			c.Next()
 			return
 		}
@@ -47,59 +60,86 @@ func RegionFilter(db *sqlx.DB, geoIPService *services.GeoIPService) gin.HandlerF
 		}
 
 		// Get client IP
-		clientIP := getClientIP(c.Request)
-		log.Printf("[Region Filter] Checking IP %s for domain %s", clientIP, domain)
+		clientIP := c.ClientIP()
+		debug := regionFilterLog.Enabled(c.Request.Context(), slog.LevelDebug)
+		if debug {
+			regionFilterLog.Debug("Checking IP", "client_ip", clientIP, "domain", domain)
+		}
 
 		// Lookup country code
-		countryCode, err := geoIPService.GetCountryCode(clientIP)
+		record, err := geoIPService.LookupIP(clientIP)
 		if err != nil {
-			log.Printf("[Region Filter] Failed to lookup IP %s: %v", clientIP, err)
-			// On error, allow the request (fail open)
+			if vhostSettings.GeoIPFailPolicy == GeoIPFailClosed {
+				regionFilterLog.Warn("GeoIP lookup failed, blocking (fail closed)", "client_ip", clientIP, "error", err)
+				markBlocked(c, "region_filter", "unknown_region", "Region unknown (GeoIP fail closed)")
+				c.Header("Content-Type", "text/html; charset=utf-8")
+				c.String(http.StatusForbidden, getRegionBlockedPageHTML(domain, "XX", "unknown", c.GetString("request_id")))
+				c.Abort()
+				return
+			}
+			regionFilterLog.Warn("GeoIP lookup failed, allowing (fail open)", "client_ip", clientIP, "error", err)
 			c.Next()
 			return
 		}
 
-		log.Printf("[Region Filter] IP %s resolved to country: %s", clientIP, countryCode)
+		// Private and loopback addresses are never region filtered
+		if record.Private {
+			c.Next()
+			return
+		}
+		region := record.CountryCode
+		if record.Region() != "" {
+			region = record.Region()
+		}
 
-		// Check whitelist first (if not empty, only whitelist countries are allowed)
-		if len(vhostSettings.RegionWhitelist) > 0 {
-			allowed := false
-			for _, allowedCountry := range vhostSettings.RegionWhitelist {
-				if allowedCountry == countryCode {
-					allowed = true
-					break
-				}
-			}
-			if !allowed {
-				log.Printf("[Region Filter] Blocked IP %s from country %s (not in whitelist)", clientIP, countryCode)
-				c.HTML(http.StatusForbidden, "", getRegionBlockedPageHTML(domain, countryCode, "whitelist"))
-				c.Abort()
-				return
-			}
+		if debug {
+			regionFilterLog.Debug("IP resolved to region", "client_ip", clientIP, "region", region)
+		}
+
+		// Check whitelist first (if not empty, only whitelist regions are allowed)
+		if len(vhostSettings.RegionWhitelist) > 0 && !matchesAnyRegion(record, vhostSettings.RegionWhitelist) {
+			regionFilterLog.Info("Blocked region not in whitelist", "client_ip", clientIP, "region", region, "domain", domain)
+			markBlocked(c, "region_filter", "not_whitelisted", "Region "+region+" not in whitelist")
+			c.HTML(http.StatusForbidden, "", getRegionBlockedPageHTML(domain, region, "whitelist", c.GetString("request_id")))
+			c.Abort()
+			return
 		}
 
 		// Check blacklist (if whitelist is empty or passed)
-		if len(vhostSettings.RegionBlacklist) > 0 {
-			for _, blockedCountry := range vhostSettings.RegionBlacklist {
-				if blockedCountry == countryCode {
-					log.Printf("[Region Filter] Blocked IP %s from blacklisted country %s", clientIP, countryCode)
-					c.HTML(http.StatusForbidden, "", getRegionBlockedPageHTML(domain, countryCode, "blacklist"))
-					c.Abort()
-					return
-				}
-			}
+		if matchesAnyRegion(record, vhostSettings.RegionBlacklist) {
+			regionFilterLog.Info("Blocked blacklisted region", "client_ip", clientIP, "region", region, "domain", domain)
+			markBlocked(c, "region_filter", "blacklisted", "Region "+region+" blacklisted")
+			c.HTML(http.StatusForbidden, "", getRegionBlockedPageHTML(domain, region, "blacklist", c.GetString("request_id")))
+			c.Abort()
+			return
 		}
 
-		log.Printf("[Region Filter] Allowed IP %s from country %s", clientIP, countryCode)
+		if debug {
+			regionFilterLog.Debug("Allowed region", "client_ip", clientIP, "region", region)
+		}
 		c.Next()
 	}
 }
 
+// matchesAnyRegion reports whether the record matches any country or
+// subdivision entry in the list
+func matchesAnyRegion(record *services.GeoIPRecord, entries []string) bool {
+	for _, entry := range entries {
+		if record.MatchesRegion(entry) {
+			return true
+		}
+	}
+	return false
+}
+
 // getRegionBlockedPageHTML returns HTML for region-blocked page
-func getRegionBlockedPageHTML(domain, countryCode, listType string) string {
+func getRegionBlockedPageHTML(domain, countryCode, listType, requestID string) string {
 	reason := "not in the allowed regions"
-	if listType == "blacklist" {
+	switch listType {
+	case "blacklist":
 		reason = "from a blocked region"
+	case "unknown":
+		reason = "from a region that could not be determined"
 	}
 
 	return fmt.Sprintf(`<!DOCTYPE html>
@@ -202,7 +242,7 @@ func getRegionBlockedPageHTML(domain, countryCode, listType string) string {
         </p>
         <div class="info">
             <div class="info-item">
-                <span class="info-label">Your Country:</span>
+                <span class="info-label">Your Region:</span>
                 <span class="info-value">%s</span>
             </div>
             <div class="info-item">
@@ -210,33 +250,11 @@ func getRegionBlockedPageHTML(domain, countryCode, listType string) string {
                 <span class="info-value">%s</span>
             </div>
         </div>
+        %s
         <p class="footer">
             If you believe this is an error, please contact the website administrator.
         </p>
     </div>
 </body>
-</html>`, domain, countryCode, reason)
-}
-
-// getClientIP extracts the real client IP from request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		ips := strings.Split(xff, ",")
-		return strings.TrimSpace(ips[0])
-	}
-
-	// Check X-Real-IP header
-	xri := r.Header.Get("X-Real-IP")
-	if xri != "" {
-		return xri
-	}
-
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return ip
+</html>`, domain, countryCode, reason, referenceHTML(requestID))
 }
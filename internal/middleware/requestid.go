@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"html"
+	"net"
+	"regexp"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var requestIDLog = logging.Component("request_id")
+
+const defaultRequestIDHeader = "X-Request-ID"
+
+// validRequestID limits accepted incoming IDs to what is safe to log, put in
+// headers and print on block pages
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{8,128}$`)
+
+// RequestIDMiddleware gives every request an ID before any other WAF
+// middleware runs. An incoming ID is kept only when the TCP peer is one of
+// the trusted proxies; otherwise a new one is generated. The ID is stored as
+// "request_id", forwarded to the backend and returned in the response.
+func RequestIDMiddleware(cfg config.RequestIDConfig) gin.HandlerFunc {
+	header := cfg.Header
+	if header == "" {
+		header = defaultRequestIDHeader
+	}
+
+	var trusted []*net.IPNet
+	for _, cidr := range cfg.TrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			requestIDLog.Warn("Ignoring invalid trusted proxy", "cidr", cidr, "error", err)
+			continue
+		}
+		trusted = append(trusted, network)
+	}
+
+	return func(c *gin.Context) {
+		id := c.GetHeader(header)
+		if id == "" || !validRequestID.MatchString(id) || !peerTrusted(c, trusted) {
+			id = uuid.NewString()
+		}
+
+		c.Set("request_id", id)
+		c.Request.Header.Set(header, id)
+		c.Header(header, id)
+		c.Next()
+	}
+}
+
+// peerTrusted reports whether the direct peer of the request, not the
+// forwarded client IP, is in one of the networks
+func peerTrusted(c *gin.Context, networks []*net.IPNet) bool {
+	if len(networks) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		host = c.Request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// referenceHTML is the support reference printed on block pages
+func referenceHTML(requestID string) string {
+	if requestID == "" {
+		return ""
+	}
+	return `<p style="margin-top: 20px; color: #718096; font-size: 13px;">Reference: <code style="user-select: all;">` +
+		html.EscapeString(requestID) + `</code><br>Please quote this reference when contacting support.</p>`
+}
@@ -12,8 +12,10 @@ import (
 	"time"
 
 	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/metrics"
 	"github.com/aleh/docode-waf/internal/models"
 	"github.com/aleh/docode-waf/internal/services"
+	"github.com/aleh/docode-waf/internal/tracing"
 )
 
 type ReverseProxy struct {
@@ -70,7 +72,7 @@ func (rp *ReverseProxy) LoadVHosts(vhosts []*models.VHost) {
 		}
 
 		proxy := httputil.NewSingleHostReverseProxy(target)
-		proxy.Transport = rp.transport
+		proxy.Transport = metrics.InstrumentTransport(tracing.InstrumentTransport(rp.transport))
 		proxy.ErrorHandler = rp.errorHandler
 
 		// Modify request before forwarding
@@ -96,6 +98,12 @@ func (rp *ReverseProxy) ReloadVHosts() error {
 	return nil
 }
 
+// HasVHost reports whether host is an enabled virtual host
+func (rp *ReverseProxy) HasVHost(host string) bool {
+	_, exists := rp.proxies[host]
+	return exists
+}
+
 func (rp *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	host := r.Host
 	// Remove port from host if present
@@ -122,15 +130,9 @@ func (rp *ReverseProxy) errorHandler(w http.ResponseWriter, r *http.Request, err
 	http.Error(w, "Bad Gateway", http.StatusBadGateway)
 }
 
+// getClientIP returns the client IP the WAF middleware resolved into
+// X-Real-IP. X-Forwarded-For is left alone, its first entry is client input.
 func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		ips := strings.Split(xff, ",")
-		return strings.TrimSpace(ips[0])
-	}
-
-	// Check X-Real-IP header
 	xri := r.Header.Get("X-Real-IP")
 	if xri != "" {
 		return xri
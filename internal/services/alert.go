@@ -0,0 +1,1037 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var alertsLog = logging.Component("alerts")
+
+// Alert rule types
+const (
+	AlertRuleAttackCount       = "attack_count"
+	AlertRuleBlockedRatio      = "blocked_ratio"
+	AlertRuleErrorRate         = "error_rate"
+	AlertRuleBackendUnhealthy  = "backend_unhealthy"
+	AlertRuleCertificateExpiry = "certificate_expiry"
+)
+
+// Alert channel types
+const (
+	AlertChannelWebhook = "webhook"
+	AlertChannelSlack   = "slack"
+	AlertChannelEmail   = "email"
+)
+
+// Alert states and severities
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+
+	AlertSeverityInfo     = "info"
+	AlertSeverityWarning  = "warning"
+	AlertSeverityCritical = "critical"
+)
+
+const (
+	defaultAlertEvaluationInterval       = time.Minute
+	defaultAlertProbeTimeout             = 5 * time.Second
+	defaultAlertNotifyTimeout            = 10 * time.Second
+	alertEvaluationLockID          int64 = 0x77616603
+	// alertRawWindow is the longest window counted from traffic_logs; longer
+	// windows are read from the minute rollups
+	alertRawWindow     = time.Hour
+	alertProbeParallel = 8
+)
+
+var (
+	ErrAlertRuleNotFound    = errors.New("alert rule not found")
+	ErrAlertChannelNotFound = errors.New("alert channel not found")
+	ErrAlertSilenceNotFound = errors.New("alert silence not found")
+)
+
+// AlertValidationError reports an invalid rule, channel or silence
+type AlertValidationError struct {
+	Reason string
+}
+
+func (e *AlertValidationError) Error() string {
+	return e.Reason
+}
+
+func invalidAlert(format string, args ...interface{}) error {
+	return &AlertValidationError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// AlertRule is a condition checked by the evaluator. Threshold is a count
+// for attack_count and backend_unhealthy (failing backends), a percentage
+// for blocked_ratio and error_rate, and days before expiry for
+// certificate_expiry.
+type AlertRule struct {
+	ID             string         `db:"id" json:"id"`
+	Name           string         `db:"name" json:"name"`
+	Type           string         `db:"type" json:"type"`
+	VHost          string         `db:"vhost" json:"vhost"`
+	AttackType     string         `db:"attack_type" json:"attack_type"`
+	Threshold      float64        `db:"threshold" json:"threshold"`
+	WindowSeconds  int            `db:"window_seconds" json:"window_seconds"`
+	MinRequests    int            `db:"min_requests" json:"min_requests"`
+	Severity       string         `db:"severity" json:"severity"`
+	ChannelIDs     pq.StringArray `db:"channel_ids" json:"channel_ids"`
+	RepeatInterval int            `db:"repeat_interval_seconds" json:"repeat_interval_seconds"`
+	NotifyResolved bool           `db:"notify_resolved" json:"notify_resolved"`
+	Enabled        bool           `db:"enabled" json:"enabled"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// Validate checks a rule and fills in defaults
+func (r *AlertRule) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return invalidAlert("name is required")
+	}
+	switch r.Type {
+	case AlertRuleAttackCount, AlertRuleBlockedRatio, AlertRuleErrorRate, AlertRuleBackendUnhealthy, AlertRuleCertificateExpiry:
+	default:
+		return invalidAlert("unknown rule type %q", r.Type)
+	}
+	if r.Threshold < 0 {
+		return invalidAlert("threshold must not be negative")
+	}
+	if (r.Type == AlertRuleBlockedRatio || r.Type == AlertRuleErrorRate) && r.Threshold > 100 {
+		return invalidAlert("threshold is a percentage and must be at most 100")
+	}
+	if r.Type == AlertRuleCertificateExpiry && r.Threshold == 0 {
+		return invalidAlert("threshold must be the number of days before expiry")
+	}
+	if r.WindowSeconds <= 0 {
+		r.WindowSeconds = 300
+	}
+	if r.MinRequests < 0 || r.RepeatInterval < 0 {
+		return invalidAlert("min_requests and repeat_interval_seconds must not be negative")
+	}
+	if r.Severity == "" {
+		r.Severity = AlertSeverityWarning
+	}
+	switch r.Severity {
+	case AlertSeverityInfo, AlertSeverityWarning, AlertSeverityCritical:
+	default:
+		return invalidAlert("unknown severity %q", r.Severity)
+	}
+	if r.ChannelIDs == nil {
+		r.ChannelIDs = pq.StringArray{}
+	}
+	for _, id := range r.ChannelIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			return invalidAlert("invalid channel ID %q", id)
+		}
+	}
+	r.VHost = strings.ToLower(strings.TrimSpace(r.VHost))
+	return nil
+}
+
+func (r *AlertRule) window() time.Duration {
+	return time.Duration(r.WindowSeconds) * time.Second
+}
+
+// AlertChannel is a notification destination. Target is a URL for webhook
+// and slack channels and a comma-separated address list for email.
+type AlertChannel struct {
+	ID        string    `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	Type      string    `db:"type" json:"type"`
+	Target    string    `db:"target" json:"target"`
+	Secret    string    `db:"secret" json:"-"`
+	HasSecret bool      `db:"-" json:"has_secret"`
+	Enabled   bool      `db:"enabled" json:"enabled"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// Validate checks a channel's type and target
+func (ch *AlertChannel) Validate() error {
+	ch.Name = strings.TrimSpace(ch.Name)
+	ch.Target = strings.TrimSpace(ch.Target)
+	if ch.Name == "" {
+		return invalidAlert("name is required")
+	}
+	switch ch.Type {
+	case AlertChannelWebhook, AlertChannelSlack:
+		u, err := url.Parse(ch.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalidAlert("target must be an http(s) URL")
+		}
+	case AlertChannelEmail:
+		if len(ch.recipients()) == 0 {
+			return invalidAlert("target must list at least one email address")
+		}
+		for _, addr := range ch.recipients() {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return invalidAlert("invalid email address %q", addr)
+			}
+		}
+	default:
+		return invalidAlert("unknown channel type %q", ch.Type)
+	}
+	return nil
+}
+
+func (ch *AlertChannel) recipients() []string {
+	var addrs []string
+	for _, addr := range strings.Split(ch.Target, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// AlertSilence mutes notifications between StartsAt and EndsAt for one rule
+// (or all when RuleID is nil) and one subject (or all when empty). Alerts
+// are still recorded while silenced.
+type AlertSilence struct {
+	ID        string    `db:"id" json:"id"`
+	RuleID    *string   `db:"rule_id" json:"rule_id"`
+	Subject   string    `db:"subject" json:"subject"`
+	StartsAt  time.Time `db:"starts_at" json:"starts_at"`
+	EndsAt    time.Time `db:"ends_at" json:"ends_at"`
+	Comment   string    `db:"comment" json:"comment"`
+	CreatedBy *string   `db:"created_by" json:"created_by,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+func (s *AlertSilence) matches(ruleID, subject string, now time.Time) bool {
+	if now.Before(wallClock(s.StartsAt)) || !now.Before(wallClock(s.EndsAt)) {
+		return false
+	}
+	if s.RuleID != nil && *s.RuleID != ruleID {
+		return false
+	}
+	return s.Subject == "" || strings.EqualFold(s.Subject, subject)
+}
+
+// Alert is one firing (or since resolved) occurrence of a rule for a subject
+type Alert struct {
+	ID              string     `db:"id" json:"id"`
+	RuleID          string     `db:"rule_id" json:"rule_id"`
+	RuleName        string     `db:"rule_name" json:"rule_name"`
+	Subject         string     `db:"subject" json:"subject"`
+	Status          string     `db:"status" json:"status"`
+	Severity        string     `db:"severity" json:"severity"`
+	Message         string     `db:"message" json:"message"`
+	Value           float64    `db:"value" json:"value"`
+	Threshold       float64    `db:"threshold" json:"threshold"`
+	Silenced        bool       `db:"silenced" json:"silenced"`
+	Notifications   int        `db:"notifications" json:"notifications"`
+	LastError       *string    `db:"last_error" json:"last_error,omitempty"`
+	StartedAt       time.Time  `db:"started_at" json:"started_at"`
+	LastEvaluatedAt time.Time  `db:"last_evaluated_at" json:"last_evaluated_at"`
+	LastNotifiedAt  *time.Time `db:"last_notified_at" json:"last_notified_at,omitempty"`
+	ResolvedAt      *time.Time `db:"resolved_at" json:"resolved_at,omitempty"`
+}
+
+// AlertNotification is the JSON body posted to generic webhooks
+type AlertNotification struct {
+	AlertID    string     `json:"alert_id"`
+	Status     string     `json:"status"`
+	RuleID     string     `json:"rule_id"`
+	Rule       string     `json:"rule"`
+	Type       string     `json:"type"`
+	Subject    string     `json:"subject,omitempty"`
+	Severity   string     `json:"severity"`
+	Message    string     `json:"message"`
+	Value      float64    `json:"value"`
+	Threshold  float64    `json:"threshold"`
+	StartedAt  time.Time  `json:"started_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// alertSample is the outcome of checking a rule for one subject
+type alertSample struct {
+	subject string
+	value   float64
+	firing  bool
+	message string
+}
+
+// AlertService stores alert rules, channels and silences and evaluates the
+// rules in the background. Evaluation runs under an advisory lock, so only
+// one replica checks rules and sends notifications at a time.
+type AlertService struct {
+	db     *sqlx.DB
+	email  *EmailService
+	cfg    config.AlertsConfig
+	client *http.Client
+	probe  *http.Client
+}
+
+// NewAlertService creates the service and fills in config defaults
+func NewAlertService(db *sqlx.DB, email *EmailService, cfg config.AlertsConfig) *AlertService {
+	if cfg.EvaluationInterval <= 0 {
+		cfg.EvaluationInterval = defaultAlertEvaluationInterval
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = defaultAlertProbeTimeout
+	}
+	if cfg.NotifyTimeout <= 0 {
+		cfg.NotifyTimeout = defaultAlertNotifyTimeout
+	}
+
+	return &AlertService{
+		db:     db,
+		email:  email,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.NotifyTimeout},
+		probe: &http.Client{
+			Timeout: cfg.ProbeTimeout,
+			// A redirect is an answer; the backend is up
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// Run evaluates the rules every EvaluationInterval until ctx is done
+func (s *AlertService) Run(ctx context.Context) {
+	if !s.cfg.Enabled {
+		alertsLog.Info("Evaluation disabled")
+		return
+	}
+	alertsLog.Info("Evaluating rules", "interval", s.cfg.EvaluationInterval.String())
+
+	ticker := time.NewTicker(s.cfg.EvaluationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := withAdvisoryLock(ctx, s.db, alertEvaluationLockID, func(*sqlx.Conn) {
+				s.Evaluate(ctx)
+			})
+			if err != nil {
+				alertsLog.Error("Evaluation skipped", "error", err)
+			}
+		}
+	}
+}
+
+// Evaluate checks every enabled rule once, opening, re-notifying and
+// resolving alerts as needed
+func (s *AlertService) Evaluate(ctx context.Context) {
+	// Alerts of disabled rules are closed without a notification
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE alerts SET status = 'resolved', resolved_at = $1
+		WHERE status = 'firing' AND rule_id IN (SELECT id FROM alert_rules WHERE NOT enabled)
+	`, time.Now()); err != nil {
+		alertsLog.Error("Failed to close alerts of disabled rules", "error", err)
+	}
+
+	rules := []AlertRule{}
+	if err := s.db.SelectContext(ctx, &rules, `SELECT * FROM alert_rules WHERE enabled ORDER BY created_at`); err != nil {
+		alertsLog.Error("Failed to load rules", "error", err)
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+	silences, err := s.ListSilences(true)
+	if err != nil {
+		alertsLog.Error("Failed to load silences", "error", err)
+		return
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		samples, err := s.check(ctx, rule)
+		if err != nil {
+			alertsLog.Error("Failed to evaluate rule", "rule", rule.Name, "error", err)
+			continue
+		}
+		s.apply(ctx, rule, samples, silences)
+	}
+}
+
+// check evaluates a rule into one sample per subject
+func (s *AlertService) check(ctx context.Context, rule *AlertRule) ([]alertSample, error) {
+	switch rule.Type {
+	case AlertRuleBackendUnhealthy:
+		return s.checkBackends(ctx, rule)
+	case AlertRuleCertificateExpiry:
+		return s.checkCertificates(ctx, rule)
+	}
+
+	counts, err := s.trafficCounts(ctx, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	where := "all vhosts"
+	if rule.VHost != "" {
+		where = rule.VHost
+	}
+	window := rule.window().String()
+	sample := alertSample{subject: rule.VHost}
+	switch rule.Type {
+	case AlertRuleAttackCount:
+		kind := "attacks"
+		if rule.AttackType != "" {
+			kind = rule.AttackType + " attacks"
+		}
+		sample.value = float64(counts.Attacks)
+		sample.firing = sample.value > rule.Threshold
+		sample.message = fmt.Sprintf("%d %s on %s in the last %s (threshold %g)", counts.Attacks, kind, where, window, rule.Threshold)
+	case AlertRuleBlockedRatio, AlertRuleErrorRate:
+		part, kind := counts.Blocked, "blocked"
+		if rule.Type == AlertRuleErrorRate {
+			part, kind = counts.Errors, "5xx errors"
+		}
+		if counts.Requests > 0 {
+			sample.value = float64(part) * 100 / float64(counts.Requests)
+		}
+		sample.firing = counts.Requests > 0 && counts.Requests >= int64(rule.MinRequests) && sample.value > rule.Threshold
+		sample.message = fmt.Sprintf("%.1f%% %s on %s in the last %s (%d of %d requests, threshold %g%%)",
+			sample.value, kind, where, window, part, counts.Requests, rule.Threshold)
+	}
+	return []alertSample{sample}, nil
+}
+
+type alertTrafficCounts struct {
+	Requests int64 `db:"requests"`
+	Blocked  int64 `db:"blocked"`
+	Attacks  int64 `db:"attacks"`
+	Errors   int64 `db:"errors"`
+}
+
+// trafficCounts counts the rule's window from traffic_logs, or from the
+// minute rollups for windows longer than alertRawWindow
+func (s *AlertService) trafficCounts(ctx context.Context, rule *AlertRule) (alertTrafficCounts, error) {
+	to := time.Now()
+	from := to.Add(-rule.window())
+	args := []interface{}{from, to}
+
+	var query string
+	if rule.window() > alertRawWindow {
+		attackFilter := ""
+		if rule.AttackType != "" {
+			args = append(args, rule.AttackType)
+			attackFilter = fmt.Sprintf(" FILTER (WHERE attack_type = $%d)", len(args))
+		}
+		query = `
+			SELECT COALESCE(SUM(requests), 0)::bigint AS requests,
+			       COALESCE(SUM(blocked), 0)::bigint AS blocked,
+			       COALESCE(SUM(attacks)` + attackFilter + `, 0)::bigint AS attacks,
+			       COALESCE(SUM(requests) FILTER (WHERE status_code >= 500), 0)::bigint AS errors
+			FROM traffic_rollups_minute
+			WHERE bucket >= $1 AND bucket < $2`
+	} else {
+		attackFilter := "is_attack"
+		if rule.AttackType != "" {
+			args = append(args, rule.AttackType)
+			attackFilter = fmt.Sprintf("is_attack AND attack_type = $%d", len(args))
+		}
+		query = `
+			SELECT COUNT(*) AS requests,
+			       COUNT(*) FILTER (WHERE blocked) AS blocked,
+			       COUNT(*) FILTER (WHERE ` + attackFilter + `) AS attacks,
+			       COUNT(*) FILTER (WHERE status_code >= 500) AS errors
+			FROM traffic_logs
+			WHERE timestamp >= $1 AND timestamp < $2`
+	}
+	if rule.VHost != "" {
+		args = append(args, rule.VHost)
+		query += fmt.Sprintf(" AND host = $%d", len(args))
+	}
+
+	var counts alertTrafficCounts
+	err := s.db.GetContext(ctx, &counts, query, args...)
+	return counts, err
+}
+
+// checkBackends probes every backend of the enabled vhosts. A backend is
+// unhealthy when it cannot be reached or answers with a 5xx; a vhost fires
+// when more than Threshold of its backends are unhealthy.
+func (s *AlertService) checkBackends(ctx context.Context, rule *AlertRule) ([]alertSample, error) {
+	var vhosts []struct {
+		Domain     string `db:"domain"`
+		BackendURL string `db:"backend_url"`
+		Backends   string `db:"backends"`
+	}
+	query := `SELECT domain, COALESCE(backend_url, '') AS backend_url, COALESCE(backends::text, '[]') AS backends
+		FROM vhosts WHERE enabled = true`
+	args := []interface{}{}
+	if rule.VHost != "" {
+		query += " AND domain = $1"
+		args = append(args, rule.VHost)
+	}
+	if err := s.db.SelectContext(ctx, &vhosts, query, args...); err != nil {
+		return nil, err
+	}
+
+	type probe struct {
+		vhost int
+		url   string
+		err   error
+	}
+	var probes []*probe
+	for i, vhost := range vhosts {
+		seen := map[string]bool{}
+		var backends []string
+		json.Unmarshal([]byte(vhost.Backends), &backends)
+		for _, backend := range append([]string{vhost.BackendURL}, backends...) {
+			if backend = strings.TrimSpace(backend); backend != "" && !seen[backend] {
+				seen[backend] = true
+				probes = append(probes, &probe{vhost: i, url: backend})
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, alertProbeParallel)
+	for _, p := range probes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p *probe) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			p.err = s.probeBackend(ctx, p.url)
+		}(p)
+	}
+	wg.Wait()
+
+	samples := make([]alertSample, len(vhosts))
+	total := make([]int, len(vhosts))
+	failures := make([][]string, len(vhosts))
+	for _, p := range probes {
+		total[p.vhost]++
+		if p.err != nil {
+			failures[p.vhost] = append(failures[p.vhost], fmt.Sprintf("%s (%v)", p.url, p.err))
+		}
+	}
+	for i, vhost := range vhosts {
+		failed := len(failures[i])
+		samples[i] = alertSample{
+			subject: vhost.Domain,
+			value:   float64(failed),
+			firing:  failed > 0 && float64(failed) > rule.Threshold,
+			message: fmt.Sprintf("%d of %d backends of %s are healthy", total[i]-failed, total[i], vhost.Domain),
+		}
+		if failed > 0 {
+			samples[i].message = fmt.Sprintf("%d of %d backends of %s are unhealthy: %s",
+				failed, total[i], vhost.Domain, strings.Join(failures[i], ", "))
+		}
+	}
+	return samples, nil
+}
+
+func (s *AlertService) probeBackend(ctx context.Context, backend string) error {
+	if !strings.Contains(backend, "://") {
+		backend = "http://" + backend
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backend, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "docode-waf-healthcheck")
+	resp, err := s.probe.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkCertificates fires for every certificate expiring within Threshold
+// days. Certificate validity is stored in UTC.
+func (s *AlertService) checkCertificates(ctx context.Context, rule *AlertRule) ([]alertSample, error) {
+	var certs []struct {
+		Name       string    `db:"name"`
+		CommonName string    `db:"common_name"`
+		ValidTo    time.Time `db:"valid_to"`
+	}
+	query := `SELECT name, COALESCE(common_name, '') AS common_name, valid_to FROM certificates`
+	args := []interface{}{}
+	if rule.VHost != "" {
+		query += " WHERE LOWER(common_name) = $1 OR LOWER(name) = $1"
+		args = append(args, rule.VHost)
+	}
+	if err := s.db.SelectContext(ctx, &certs, query, args...); err != nil {
+		return nil, err
+	}
+
+	samples := make([]alertSample, 0, len(certs))
+	for _, cert := range certs {
+		subject := cert.CommonName
+		if subject == "" {
+			subject = cert.Name
+		}
+		days := time.Until(cert.ValidTo).Hours() / 24
+		sample := alertSample{subject: subject, value: days, firing: days < rule.Threshold}
+		if days < 0 {
+			sample.message = fmt.Sprintf("Certificate %s expired on %s", subject, cert.ValidTo.Format("2006-01-02"))
+		} else {
+			sample.message = fmt.Sprintf("Certificate %s expires in %d days (%s)", subject, int(days), cert.ValidTo.Format("2006-01-02"))
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// apply reconciles a rule's samples with its open alerts. There is at most
+// one open alert per rule and subject; it is notified when opened, again
+// every RepeatInterval while firing, and once more when it resolves.
+func (s *AlertService) apply(ctx context.Context, rule *AlertRule, samples []alertSample, silences []AlertSilence) {
+	open := []Alert{}
+	if err := s.db.SelectContext(ctx, &open, `SELECT * FROM alerts WHERE rule_id = $1 AND status = 'firing'`, rule.ID); err != nil {
+		alertsLog.Error("Failed to load open alerts", "rule", rule.Name, "error", err)
+		return
+	}
+	bySubject := make(map[string]*Alert, len(open))
+	for i := range open {
+		bySubject[open[i].Subject] = &open[i]
+	}
+
+	now := time.Now()
+	for _, sample := range samples {
+		existing := bySubject[sample.subject]
+		delete(bySubject, sample.subject)
+		silenced := isSilenced(silences, rule.ID, sample.subject, now)
+
+		if !sample.firing {
+			if existing != nil {
+				s.resolve(ctx, rule, existing, sample.message, silenced)
+			}
+			continue
+		}
+
+		alert := existing
+		if alert == nil {
+			alert = &Alert{}
+			err := s.db.GetContext(ctx, alert, `
+				INSERT INTO alerts (rule_id, rule_name, subject, status, severity, message, value, threshold,
+				                    silenced, started_at, last_evaluated_at)
+				VALUES ($1, $2, $3, 'firing', $4, $5, $6, $7, $8, $9, $9)
+				RETURNING *
+			`, rule.ID, rule.Name, sample.subject, rule.Severity, sample.message, sample.value, rule.Threshold, silenced, now)
+			if err != nil {
+				alertsLog.Error("Failed to open alert", "rule", rule.Name, "error", err)
+				continue
+			}
+			alertsLog.Warn("Alert firing", "rule", rule.Name, "message", sample.message)
+		} else {
+			alert.Message, alert.Value, alert.Silenced = sample.message, sample.value, silenced
+			s.db.ExecContext(ctx, `
+				UPDATE alerts SET message = $2, value = $3, silenced = $4, severity = $5, last_evaluated_at = $6
+				WHERE id = $1
+			`, alert.ID, sample.message, sample.value, silenced, rule.Severity, now)
+		}
+
+		if silenced {
+			continue
+		}
+		due := alert.LastNotifiedAt == nil ||
+			(rule.RepeatInterval > 0 && now.Sub(wallClock(*alert.LastNotifiedAt)) >= time.Duration(rule.RepeatInterval)*time.Second)
+		if due {
+			s.notify(ctx, rule, alert)
+		}
+	}
+
+	// Subjects that are gone (a deleted vhost or certificate) are resolved
+	for _, alert := range bySubject {
+		s.resolve(ctx, rule, alert, alert.Message, isSilenced(silences, rule.ID, alert.Subject, now))
+	}
+}
+
+func isSilenced(silences []AlertSilence, ruleID, subject string, now time.Time) bool {
+	for i := range silences {
+		if silences[i].matches(ruleID, subject, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *AlertService) resolve(ctx context.Context, rule *AlertRule, alert *Alert, message string, silenced bool) {
+	now := time.Now()
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE alerts SET status = 'resolved', message = $2, resolved_at = $3, last_evaluated_at = $3
+		WHERE id = $1
+	`, alert.ID, message, now); err != nil {
+		alertsLog.Error("Failed to resolve alert", "rule", rule.Name, "error", err)
+		return
+	}
+	alertsLog.Info("Alert resolved", "rule", rule.Name, "message", message)
+
+	alert.Status, alert.Message, alert.ResolvedAt = AlertResolved, message, &now
+	if rule.NotifyResolved && alert.Notifications > 0 && !silenced {
+		s.notify(ctx, rule, alert)
+	}
+}
+
+// notify sends an alert to each of the rule's enabled channels and records
+// the attempt
+func (s *AlertService) notify(ctx context.Context, rule *AlertRule, alert *Alert) {
+	if len(rule.ChannelIDs) == 0 {
+		return
+	}
+	channels := []AlertChannel{}
+	if err := s.db.SelectContext(ctx, &channels, `SELECT * FROM alert_channels WHERE enabled AND id = ANY($1::uuid[])`, rule.ChannelIDs); err != nil {
+		alertsLog.Error("Failed to load channels", "rule", rule.Name, "error", err)
+		return
+	}
+
+	notification := AlertNotification{
+		AlertID:    alert.ID,
+		Status:     alert.Status,
+		RuleID:     rule.ID,
+		Rule:       rule.Name,
+		Type:       rule.Type,
+		Subject:    alert.Subject,
+		Severity:   alert.Severity,
+		Message:    alert.Message,
+		Value:      alert.Value,
+		Threshold:  alert.Threshold,
+		StartedAt:  wallClock(alert.StartedAt),
+		ResolvedAt: alert.ResolvedAt,
+	}
+
+	var errs []string
+	for i := range channels {
+		if err := s.send(ctx, &channels[i], notification); err != nil {
+			alertsLog.Error("Failed to notify channel", "channel", channels[i].Name, "error", err)
+			errs = append(errs, channels[i].Name+": "+err.Error())
+		}
+	}
+
+	var lastError interface{}
+	if len(errs) > 0 {
+		lastError = strings.Join(errs, "; ")
+	}
+	s.db.ExecContext(ctx, `
+		UPDATE alerts SET notifications = notifications + 1, last_notified_at = $2, last_error = $3 WHERE id = $1
+	`, alert.ID, time.Now(), lastError)
+}
+
+// send delivers one notification to a channel
+func (s *AlertService) send(ctx context.Context, ch *AlertChannel, n AlertNotification) error {
+	switch ch.Type {
+	case AlertChannelSlack:
+		return s.postJSON(ctx, ch.Target, "", slackPayload(n))
+	case AlertChannelEmail:
+		subject, body := alertEmail(n)
+		for _, to := range ch.recipients() {
+			if err := s.email.SendEmail(to, subject, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return s.postJSON(ctx, ch.Target, ch.Secret, n)
+	}
+}
+
+// postJSON posts a JSON body; with a secret the body is signed with
+// HMAC-SHA256 in the X-WAF-Signature header
+func (s *AlertService) postJSON(ctx context.Context, target, secret string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "docode-waf-alerts")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-WAF-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func alertTitle(n AlertNotification) string {
+	title := fmt.Sprintf("[%s] %s: %s", strings.ToUpper(n.Status), strings.ToUpper(n.Severity), n.Rule)
+	if n.Subject != "" {
+		title += " (" + n.Subject + ")"
+	}
+	return title
+}
+
+// slackPayload builds an incoming-webhook message, also accepted by
+// Mattermost and Rocket.Chat
+func slackPayload(n AlertNotification) map[string]interface{} {
+	color := "#f59e0b"
+	switch {
+	case n.Status == AlertResolved:
+		color = "#16a34a"
+	case n.Severity == AlertSeverityCritical:
+		color = "#dc2626"
+	case n.Severity == AlertSeverityInfo:
+		color = "#2563eb"
+	}
+	return map[string]interface{}{
+		"text": alertTitle(n),
+		"attachments": []map[string]interface{}{{
+			"color":  color,
+			"text":   n.Message,
+			"footer": "Docode WAF",
+			"ts":     n.StartedAt.Unix(),
+		}},
+	}
+}
+
+func alertEmail(n AlertNotification) (string, string) {
+	subject := "WAF alert " + alertTitle(n)
+	body := fmt.Sprintf(`
+<!DOCTYPE html>
+<html>
+<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
+    <h2>%s</h2>
+    <p>%s</p>
+    <p><strong>Rule:</strong> %s<br>
+       <strong>Severity:</strong> %s<br>
+       <strong>Value:</strong> %g (threshold %g)<br>
+       <strong>Started:</strong> %s</p>
+</body>
+</html>
+`, html.EscapeString(alertTitle(n)), html.EscapeString(n.Message), html.EscapeString(n.Rule),
+		html.EscapeString(n.Severity), n.Value, n.Threshold, n.StartedAt.Format(time.RFC1123))
+	return subject, body
+}
+
+// TestChannel sends a sample notification through a channel
+func (s *AlertService) TestChannel(ctx context.Context, id string) error {
+	ch, err := s.GetChannel(id)
+	if err != nil {
+		return err
+	}
+	return s.send(ctx, ch, AlertNotification{
+		Status:    AlertFiring,
+		Rule:      "Test notification",
+		Type:      "test",
+		Severity:  AlertSeverityInfo,
+		Message:   "This is a test notification from Docode WAF",
+		StartedAt: time.Now(),
+	})
+}
+
+// ListAlerts returns alert history, newest first, optionally filtered by
+// status and rule
+func (s *AlertService) ListAlerts(status, ruleID string, limit int) ([]Alert, error) {
+	alerts := []Alert{}
+	err := s.db.Select(&alerts, `
+		SELECT * FROM alerts
+		WHERE ($1 = '' OR status = $1) AND ($2 = '' OR rule_id::text = $2)
+		ORDER BY started_at DESC
+		LIMIT $3
+	`, status, ruleID, limit)
+	return alerts, err
+}
+
+// ListRules returns all rules
+func (s *AlertService) ListRules() ([]AlertRule, error) {
+	rules := []AlertRule{}
+	err := s.db.Select(&rules, `SELECT * FROM alert_rules ORDER BY created_at DESC`)
+	return rules, err
+}
+
+// GetRule returns one rule
+func (s *AlertService) GetRule(id string) (*AlertRule, error) {
+	var rule AlertRule
+	err := s.db.Get(&rule, `SELECT * FROM alert_rules WHERE id = $1`, id)
+	if err == sql.ErrNoRows {
+		return nil, ErrAlertRuleNotFound
+	}
+	return &rule, err
+}
+
+// CreateRule validates and stores a rule
+func (s *AlertService) CreateRule(rule *AlertRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	return s.db.Get(rule, `
+		INSERT INTO alert_rules (name, type, vhost, attack_type, threshold, window_seconds, min_requests, severity,
+		                         channel_ids, repeat_interval_seconds, notify_resolved, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING *
+	`, rule.Name, rule.Type, rule.VHost, rule.AttackType, rule.Threshold, rule.WindowSeconds, rule.MinRequests,
+		rule.Severity, rule.ChannelIDs, rule.RepeatInterval, rule.NotifyResolved, rule.Enabled)
+}
+
+// UpdateRule validates and replaces a rule
+func (s *AlertService) UpdateRule(id string, rule *AlertRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	err := s.db.Get(rule, `
+		UPDATE alert_rules SET name = $2, type = $3, vhost = $4, attack_type = $5, threshold = $6,
+		       window_seconds = $7, min_requests = $8, severity = $9, channel_ids = $10,
+		       repeat_interval_seconds = $11, notify_resolved = $12, enabled = $13, updated_at = NOW()
+		WHERE id = $1
+		RETURNING *
+	`, id, rule.Name, rule.Type, rule.VHost, rule.AttackType, rule.Threshold, rule.WindowSeconds, rule.MinRequests,
+		rule.Severity, rule.ChannelIDs, rule.RepeatInterval, rule.NotifyResolved, rule.Enabled)
+	if err == sql.ErrNoRows {
+		return ErrAlertRuleNotFound
+	}
+	return err
+}
+
+// ToggleRule flips a rule's enabled flag
+func (s *AlertService) ToggleRule(id string) (*AlertRule, error) {
+	var rule AlertRule
+	err := s.db.Get(&rule, `UPDATE alert_rules SET enabled = NOT enabled, updated_at = NOW() WHERE id = $1 RETURNING *`, id)
+	if err == sql.ErrNoRows {
+		return nil, ErrAlertRuleNotFound
+	}
+	return &rule, err
+}
+
+// DeleteRule removes a rule with its alerts and silences
+func (s *AlertService) DeleteRule(id string) error {
+	return deleteByID(s.db, "alert_rules", id, ErrAlertRuleNotFound)
+}
+
+// ListChannels returns all channels
+func (s *AlertService) ListChannels() ([]AlertChannel, error) {
+	channels := []AlertChannel{}
+	err := s.db.Select(&channels, `SELECT * FROM alert_channels ORDER BY created_at DESC`)
+	for i := range channels {
+		channels[i].HasSecret = channels[i].Secret != ""
+	}
+	return channels, err
+}
+
+// GetChannel returns one channel
+func (s *AlertService) GetChannel(id string) (*AlertChannel, error) {
+	var ch AlertChannel
+	err := s.db.Get(&ch, `SELECT * FROM alert_channels WHERE id = $1`, id)
+	if err == sql.ErrNoRows {
+		return nil, ErrAlertChannelNotFound
+	}
+	ch.HasSecret = ch.Secret != ""
+	return &ch, err
+}
+
+// CreateChannel validates and stores a channel
+func (s *AlertService) CreateChannel(ch *AlertChannel) error {
+	if err := ch.Validate(); err != nil {
+		return err
+	}
+	err := s.db.Get(ch, `
+		INSERT INTO alert_channels (name, type, target, secret, enabled)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING *
+	`, ch.Name, ch.Type, ch.Target, ch.Secret, ch.Enabled)
+	ch.HasSecret = ch.Secret != ""
+	return err
+}
+
+// UpdateChannel validates and replaces a channel. A nil secret keeps the
+// stored one.
+func (s *AlertService) UpdateChannel(id string, ch *AlertChannel, secret *string) error {
+	if err := ch.Validate(); err != nil {
+		return err
+	}
+	err := s.db.Get(ch, `
+		UPDATE alert_channels SET name = $2, type = $3, target = $4, secret = COALESCE($5, secret),
+		       enabled = $6, updated_at = NOW()
+		WHERE id = $1
+		RETURNING *
+	`, id, ch.Name, ch.Type, ch.Target, secret, ch.Enabled)
+	if err == sql.ErrNoRows {
+		return ErrAlertChannelNotFound
+	}
+	ch.HasSecret = ch.Secret != ""
+	return err
+}
+
+// DeleteChannel removes a channel and unlinks it from rules
+func (s *AlertService) DeleteChannel(id string) error {
+	if err := deleteByID(s.db, "alert_channels", id, ErrAlertChannelNotFound); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`UPDATE alert_rules SET channel_ids = array_remove(channel_ids, $1::uuid) WHERE $1::uuid = ANY(channel_ids)`, id)
+	return err
+}
+
+// ListSilences returns silences, only those not yet over when activeOnly
+func (s *AlertService) ListSilences(activeOnly bool) ([]AlertSilence, error) {
+	silences := []AlertSilence{}
+	err := s.db.Select(&silences, `
+		SELECT * FROM alert_silences WHERE NOT $1 OR ends_at > $2 ORDER BY starts_at DESC
+	`, activeOnly, time.Now())
+	return silences, err
+}
+
+// CreateSilence stores a silence window
+func (s *AlertService) CreateSilence(silence *AlertSilence) error {
+	if !silence.EndsAt.After(silence.StartsAt) {
+		return invalidAlert("ends_at must be after starts_at")
+	}
+	if silence.RuleID != nil {
+		if _, err := s.GetRule(*silence.RuleID); err != nil {
+			return err
+		}
+	}
+	return s.db.Get(silence, `
+		INSERT INTO alert_silences (rule_id, subject, starts_at, ends_at, comment, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING *
+	`, silence.RuleID, strings.TrimSpace(silence.Subject), silence.StartsAt.Local(), silence.EndsAt.Local(),
+		silence.Comment, silence.CreatedBy)
+}
+
+// DeleteSilence removes a silence
+func (s *AlertService) DeleteSilence(id string) error {
+	return deleteByID(s.db, "alert_silences", id, ErrAlertSilenceNotFound)
+}
+
+func deleteByID(db *sqlx.DB, table, id string, notFound error) error {
+	result, err := db.Exec(`DELETE FROM `+table+` WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFound
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultTopLimit = 10
+	maxTopLimit     = 100
+	// maxAnalyticsBuckets bounds a time series, e.g. minutes over a week
+	maxAnalyticsBuckets = 2000
+)
+
+// Granularities of analytics time series
+const (
+	GranularityMinute = "minute"
+	GranularityHour   = "hour"
+	GranularityDay    = "day"
+)
+
+var granularitySteps = map[string]time.Duration{
+	GranularityMinute: time.Minute,
+	GranularityHour:   time.Hour,
+	GranularityDay:    24 * time.Hour,
+}
+
+// trafficDimension is what a top list groups traffic logs by; label, if
+// set, describes each value, such as the organisation of an ASN
+type trafficDimension struct {
+	expr  string
+	label string
+}
+
+// trafficDimensions are the dimensions of top lists. Paths drop the query
+// string so /search?q=a and /search?q=b count as one path.
+var trafficDimensions = map[string]trafficDimension{
+	"ip":         {expr: "client_ip"},
+	"path":       {expr: "split_part(COALESCE(url, ''), '?', 1)"},
+	"user_agent": {expr: "COALESCE(user_agent, '')"},
+	"referer":    {expr: "COALESCE(referer, '')"},
+	"status":     {expr: "COALESCE(status_code, 0)::text"},
+	"country":    {expr: "COALESCE(country_code, '')"},
+	"asn":        {expr: "COALESCE(asn::text, '')", label: "MAX(as_org)"},
+}
+
+// TrafficDimensions returns the dimensions TopTraffic accepts, sorted
+func TrafficDimensions() []string {
+	names := make([]string, 0, len(trafficDimensions))
+	for name := range trafficDimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TrafficTopEntry is one value of a top list and the traffic it had
+type TrafficTopEntry struct {
+	Value    string  `db:"value" json:"value"`
+	Label    *string `db:"label" json:"label,omitempty"`
+	Requests int64   `db:"requests" json:"requests"`
+	Blocked  int64   `db:"blocked" json:"blocked"`
+	Attacks  int64   `db:"attacks" json:"attacks"`
+	Bytes    int64   `db:"bytes" json:"bytes"`
+}
+
+// TrafficLatency is the response time distribution of a window in
+// milliseconds, overall and per bucket
+type TrafficLatency struct {
+	Granularity string                 `json:"granularity"`
+	Requests    int64                  `json:"requests"`
+	Avg         float64                `json:"avg"`
+	P50         float64                `json:"p50"`
+	P95         float64                `json:"p95"`
+	P99         float64                `json:"p99"`
+	Series      []TrafficLatencyBucket `json:"series"`
+}
+
+// TrafficLatencyBucket is the response time distribution of one bucket
+type TrafficLatencyBucket struct {
+	Bucket   time.Time `db:"bucket" json:"bucket"`
+	Requests int64     `db:"requests" json:"requests"`
+	Avg      float64   `db:"avg" json:"avg"`
+	P50      float64   `db:"p50" json:"p50"`
+	P95      float64   `db:"p95" json:"p95"`
+	P99      float64   `db:"p99" json:"p99"`
+}
+
+// TrafficBandwidth is the traffic of a window, overall and per bucket
+type TrafficBandwidth struct {
+	Granularity string                   `json:"granularity"`
+	Requests    int64                    `json:"requests"`
+	Blocked     int64                    `json:"blocked"`
+	Bytes       int64                    `json:"bytes"`
+	Series      []TrafficBandwidthBucket `json:"series"`
+}
+
+// TrafficBandwidthBucket is the traffic of one bucket
+type TrafficBandwidthBucket struct {
+	Bucket   time.Time `db:"bucket" json:"bucket"`
+	Requests int64     `db:"requests" json:"requests"`
+	Blocked  int64     `db:"blocked" json:"blocked"`
+	Bytes    int64     `db:"bytes" json:"bytes"`
+}
+
+// ResolveGranularity checks a requested granularity against the [from, to)
+// window. Without one, the finest that keeps the series short is picked:
+// minutes up to 6 hours, hours up to a week and days beyond.
+func ResolveGranularity(granularity string, from, to time.Time) (string, error) {
+	window := to.Sub(from)
+	if granularity == "" {
+		switch {
+		case window <= 6*time.Hour:
+			return GranularityMinute, nil
+		case window <= 7*24*time.Hour:
+			return GranularityHour, nil
+		default:
+			return GranularityDay, nil
+		}
+	}
+	step, ok := granularitySteps[granularity]
+	if !ok {
+		return "", &LogQueryError{Term: granularity, Reason: "granularity must be minute, hour or day"}
+	}
+	if window/step > maxAnalyticsBuckets {
+		return "", &LogQueryError{Term: granularity, Reason: "too many buckets for the time range, use a coarser granularity"}
+	}
+	return granularity, nil
+}
+
+// TopTraffic returns the values of a dimension with the most requests
+// matching filter, e.g. the busiest client IPs of a vhost
+func TopTraffic(ctx context.Context, db *sqlx.DB, filter *LogFilter, dimension string, limit int) ([]TrafficTopEntry, error) {
+	dim, ok := trafficDimensions[dimension]
+	if !ok {
+		return nil, &LogQueryError{Term: dimension, Reason: "unknown dimension, use one of " + strings.Join(TrafficDimensions(), ", ")}
+	}
+	if limit <= 0 {
+		limit = defaultTopLimit
+	}
+	limit = min(limit, maxTopLimit)
+
+	label := "NULL::text"
+	if dim.label != "" {
+		label = dim.label
+	}
+	query := `
+		SELECT ` + dim.expr + ` AS value, ` + label + ` AS label,
+		       COUNT(*) AS requests,
+		       COUNT(*) FILTER (WHERE blocked) AS blocked,
+		       COUNT(*) FILTER (WHERE is_attack) AS attacks,
+		       COALESCE(SUM(bytes_sent), 0)::bigint AS bytes
+		FROM traffic_logs` + filter.SQL() + `
+		GROUP BY 1
+		ORDER BY requests DESC, value
+		LIMIT ` + strconv.Itoa(limit)
+
+	entries := []TrafficTopEntry{}
+	if err := db.SelectContext(ctx, &entries, query, filter.Args()...); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// TrafficLatencyPercentiles returns the p50, p95 and p99 response times of
+// the requests matching filter, overall and per granularity bucket
+func TrafficLatencyPercentiles(ctx context.Context, db *sqlx.DB, filter *LogFilter, granularity string) (*TrafficLatency, error) {
+	const percentiles = `
+		       COUNT(response_time) AS requests,
+		       COALESCE(AVG(response_time), 0)::float8 AS avg,
+		       COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY response_time), 0)::float8 AS p50,
+		       COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY response_time), 0)::float8 AS p95,
+		       COALESCE(percentile_cont(0.99) WITHIN GROUP (ORDER BY response_time), 0)::float8 AS p99`
+
+	latency := &TrafficLatency{Granularity: granularity, Series: []TrafficLatencyBucket{}}
+	row := db.QueryRowxContext(ctx, `SELECT`+percentiles+` FROM traffic_logs`+filter.SQL(), filter.Args()...)
+	if err := row.Scan(&latency.Requests, &latency.Avg, &latency.P50, &latency.P95, &latency.P99); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT date_trunc('` + granularity + `', timestamp) AS bucket,` + percentiles + `
+		FROM traffic_logs` + filter.SQL() + `
+		GROUP BY 1
+		ORDER BY 1`
+	if err := db.SelectContext(ctx, &latency.Series, query, filter.Args()...); err != nil {
+		return nil, err
+	}
+	return latency, nil
+}
+
+// TrafficBandwidthSeries returns the requests and bytes sent matching filter,
+// overall and per granularity bucket
+func TrafficBandwidthSeries(ctx context.Context, db *sqlx.DB, filter *LogFilter, granularity string) (*TrafficBandwidth, error) {
+	query := `
+		SELECT date_trunc('` + granularity + `', timestamp) AS bucket,
+		       COUNT(*) AS requests,
+		       COUNT(*) FILTER (WHERE blocked) AS blocked,
+		       COALESCE(SUM(bytes_sent), 0)::bigint AS bytes
+		FROM traffic_logs` + filter.SQL() + `
+		GROUP BY 1
+		ORDER BY 1`
+
+	bandwidth := &TrafficBandwidth{Granularity: granularity, Series: []TrafficBandwidthBucket{}}
+	if err := db.SelectContext(ctx, &bandwidth.Series, query, filter.Args()...); err != nil {
+		return nil, err
+	}
+	for _, bucket := range bandwidth.Series {
+		bandwidth.Requests += bucket.Requests
+		bandwidth.Blocked += bucket.Blocked
+		bandwidth.Bytes += bucket.Bytes
+	}
+	return bandwidth, nil
+}
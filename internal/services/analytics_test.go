@@ -0,0 +1,61 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResolveGranularity(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		granularity string
+		window      time.Duration
+		want        string
+		wantErr     bool
+	}{
+		{"default for an hour", "", time.Hour, GranularityMinute, false},
+		{"default for 6 hours", "", 6 * time.Hour, GranularityMinute, false},
+		{"default for a day", "", 24 * time.Hour, GranularityHour, false},
+		{"default for a week", "", 7 * 24 * time.Hour, GranularityHour, false},
+		{"default for a month", "", 30 * 24 * time.Hour, GranularityDay, false},
+		{"default for an empty window", "", 0, GranularityMinute, false},
+		{"minutes over a day", GranularityMinute, 24 * time.Hour, GranularityMinute, false},
+		{"minutes at the bucket limit", GranularityMinute, maxAnalyticsBuckets * time.Minute, GranularityMinute, false},
+		{"minutes past the bucket limit", GranularityMinute, (maxAnalyticsBuckets + 1) * time.Minute, "", true},
+		{"minutes over a week", GranularityMinute, 7 * 24 * time.Hour, "", true},
+		{"hours over a month", GranularityHour, 30 * 24 * time.Hour, GranularityHour, false},
+		{"days over a year", GranularityDay, 365 * 24 * time.Hour, GranularityDay, false},
+		{"unknown", "week", 24 * time.Hour, "", true},
+		{"case sensitive", "Hour", 24 * time.Hour, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveGranularity(tt.granularity, from, from.Add(tt.window))
+			if tt.wantErr {
+				var queryErr *LogQueryError
+				if !errors.As(err, &queryErr) {
+					t.Fatalf("ResolveGranularity = %q, %v; want a LogQueryError", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ResolveGranularity = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrafficDimensions(t *testing.T) {
+	got := TrafficDimensions()
+	if len(got) != len(trafficDimensions) {
+		t.Fatalf("TrafficDimensions = %v", got)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i-1] >= got[i] {
+			t.Errorf("TrafficDimensions is not sorted: %v", got)
+		}
+	}
+}
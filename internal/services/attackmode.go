@@ -0,0 +1,568 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+var attackModeLog = logging.Component("attack_mode")
+
+// Attack mode overrides
+const (
+	AttackModeAuto = "auto"
+	AttackModeOn   = "on"
+	AttackModeOff  = "off"
+)
+
+const (
+	attackModeBucketTTL           = 5 * time.Minute
+	attackModeFlushInterval       = time.Second
+	attackModeFlushTimeout        = 5 * time.Second
+	attackModeLockID        int64 = 0x77616607
+	// baselineAlpha is the weight of the newest sample in the moving baseline
+	baselineAlpha = 0.05
+)
+
+// AttackModeState is the current protective state of a vhost
+type AttackModeState struct {
+	Domain            string    `json:"domain"`
+	Active            bool      `json:"active"`
+	Override          string    `json:"override"`
+	Reason            string    `json:"reason"`
+	Since             time.Time `json:"since"`
+	RPS               float64   `json:"rps"`
+	ErrorRate         float64   `json:"error_rate"`
+	BaselineRPS       float64   `json:"baseline_rps"`
+	BaselineErrorRate float64   `json:"baseline_error_rate"`
+	BaselineSamples   int       `json:"baseline_samples"`
+}
+
+// AttackModeEvent is a recorded transition into or out of attack mode
+type AttackModeEvent struct {
+	ID                string    `db:"id" json:"id"`
+	Domain            string    `db:"domain" json:"domain"`
+	Active            bool      `db:"active" json:"active"`
+	Source            string    `db:"source" json:"source"`
+	Reason            string    `db:"reason" json:"reason"`
+	RPS               float64   `db:"rps" json:"rps"`
+	BaselineRPS       float64   `db:"baseline_rps" json:"baseline_rps"`
+	ErrorRate         float64   `db:"error_rate" json:"error_rate"`
+	BaselineErrorRate float64   `db:"baseline_error_rate" json:"baseline_error_rate"`
+	ChangedBy         string    `db:"changed_by" json:"changed_by"`
+	CreatedAt         time.Time `db:"created_at" json:"created_at"`
+}
+
+// AttackModeService learns per-vhost traffic baselines from Redis counters and
+// switches vhosts into a protective mode when traffic spikes past them.
+// Requests are counted in memory and added to the shared Redis counters once
+// per second. One replica at a time evaluates the counters; the others
+// reload the resulting state.
+type AttackModeService struct {
+	redis  *redis.Client
+	health RedisHealth
+	db     *sqlx.DB
+	cfg    config.AttackModeConfig
+
+	// active caches the state for the hot path; refreshed on every evaluation
+	mu     sync.RWMutex
+	active map[string]bool
+
+	// vhosts are the enabled vhost domains, the only ones counted
+	vhosts atomic.Pointer[map[string]bool]
+
+	countsMu sync.Mutex
+	counts   map[attackModeBucket]*attackModeCounts
+}
+
+// attackModeBucket identifies one domain's counters in one evaluation bucket
+type attackModeBucket struct {
+	domain string
+	bucket int64
+}
+
+type attackModeCounts struct {
+	requests int64
+	failures int64
+}
+
+// NewAttackModeService creates the service and fills in config defaults
+func NewAttackModeService(redisClient *redis.Client, health RedisHealth, db *sqlx.DB, cfg config.AttackModeConfig) *AttackModeService {
+	if cfg.TriggerFactor <= 1 {
+		cfg.TriggerFactor = 4
+	}
+	if cfg.ReleaseFactor <= 0 || cfg.ReleaseFactor >= cfg.TriggerFactor {
+		cfg.ReleaseFactor = 1.5
+	}
+	if cfg.MinRPS <= 0 {
+		cfg.MinRPS = 20
+	}
+	if cfg.MinErrorRate <= 0 {
+		cfg.MinErrorRate = 0.2
+	}
+	if cfg.Warmup <= 0 {
+		cfg.Warmup = 10 * time.Minute
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 5 * time.Minute
+	}
+	if cfg.EvaluationInterval < time.Second {
+		cfg.EvaluationInterval = 10 * time.Second
+	}
+	if cfg.RateLimitFactor <= 0 || cfg.RateLimitFactor > 1 {
+		cfg.RateLimitFactor = 0.5
+	}
+	if cfg.RateLimitRequests <= 0 {
+		cfg.RateLimitRequests = 60
+	}
+	if cfg.RateLimitWindow <= 0 {
+		cfg.RateLimitWindow = 60
+	}
+
+	return &AttackModeService{
+		redis:  redisClient,
+		health: health,
+		db:     db,
+		cfg:    cfg,
+		active: make(map[string]bool),
+		counts: make(map[attackModeBucket]*attackModeCounts),
+	}
+}
+
+// Config returns the effective configuration
+func (s *AttackModeService) Config() config.AttackModeConfig {
+	return s.cfg
+}
+
+// IsActive reports whether the vhost is currently in attack mode
+func (s *AttackModeService) IsActive(domain string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active[domain]
+}
+
+// RecordRequest counts a request to host and whether it ended in an error
+// into the current evaluation bucket. Hosts that are not an enabled vhost are
+// ignored. The count is kept in memory until the next flush.
+func (s *AttackModeService) RecordRequest(host string, status int) {
+	domain := hostDomain(host)
+	if vhosts := s.vhosts.Load(); vhosts == nil || !(*vhosts)[domain] {
+		return
+	}
+
+	key := attackModeBucket{domain: domain, bucket: s.bucket(time.Now())}
+	s.countsMu.Lock()
+	defer s.countsMu.Unlock()
+	counts := s.counts[key]
+	if counts == nil {
+		counts = &attackModeCounts{}
+		s.counts[key] = counts
+	}
+	counts.requests++
+	// Only upstream failures count; the WAF's own 403/429 responses would
+	// otherwise keep a vhost in attack mode forever
+	if status >= 500 {
+		counts.failures++
+	}
+}
+
+// flush adds the counts recorded since the last flush to the Redis counters
+// shared by all replicas. Counts are dropped while Redis is degraded.
+func (s *AttackModeService) flush() {
+	s.countsMu.Lock()
+	counts := s.counts
+	s.counts = make(map[attackModeBucket]*attackModeCounts, len(counts))
+	s.countsMu.Unlock()
+
+	if len(counts) == 0 || redisDegraded(s.health) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), attackModeFlushTimeout)
+	defer cancel()
+
+	pipe := s.redis.Pipeline()
+	for key, c := range counts {
+		reqKey := fmt.Sprintf("attackmode:req:%s:%d", key.domain, key.bucket)
+		pipe.IncrBy(ctx, reqKey, c.requests)
+		pipe.Expire(ctx, reqKey, attackModeBucketTTL)
+		if c.failures > 0 {
+			errKey := fmt.Sprintf("attackmode:err:%s:%d", key.domain, key.bucket)
+			pipe.IncrBy(ctx, errKey, c.failures)
+			pipe.Expire(ctx, errKey, attackModeBucketTTL)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		attackModeLog.Error("Failed to flush request counters", "error", err)
+		reportRedisError(s.health, err)
+	}
+}
+
+// Run counts requests, and evaluates every vhost once per evaluation interval
+// while holding the cluster-wide attack mode lock, until ctx is done.
+// Replicas that do not hold the lock reload the state the evaluator stored.
+// With automatic detection disabled only admin overrides take effect.
+func (s *AttackModeService) Run(ctx context.Context) {
+	s.loadVHosts(ctx)
+	s.evaluateLocked(ctx)
+
+	flushTicker := time.NewTicker(attackModeFlushInterval)
+	defer flushTicker.Stop()
+	evaluateTicker := time.NewTicker(s.cfg.EvaluationInterval)
+	defer evaluateTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush()
+			return
+		case <-flushTicker.C:
+			s.flush()
+		case <-evaluateTicker.C:
+			s.flush()
+			s.loadVHosts(ctx)
+			s.evaluateLocked(ctx)
+		}
+	}
+}
+
+// loadVHosts reloads the enabled vhost domains; the previous list is kept on
+// failure
+func (s *AttackModeService) loadVHosts(ctx context.Context) {
+	var domains []string
+	if err := s.db.SelectContext(ctx, &domains, "SELECT domain FROM vhosts WHERE enabled = true"); err != nil {
+		attackModeLog.Error("Failed to load vhost domains", "error", err)
+		return
+	}
+	vhosts := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		vhosts[domain] = true
+	}
+	s.vhosts.Store(&vhosts)
+}
+
+// domains returns the enabled vhost domains in order
+func (s *AttackModeService) domains() []string {
+	vhosts := s.vhosts.Load()
+	if vhosts == nil {
+		return nil
+	}
+	domains := make([]string, 0, len(*vhosts))
+	for domain := range *vhosts {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func (s *AttackModeService) evaluateLocked(ctx context.Context) {
+	held := false
+	err := withAdvisoryLock(ctx, s.db, attackModeLockID, func(*sqlx.Conn) {
+		held = true
+		s.evaluateAll(ctx)
+	})
+	if err != nil {
+		attackModeLog.Error("Evaluation skipped", "error", err)
+	}
+	if !held {
+		s.Refresh("")
+	}
+}
+
+func (s *AttackModeService) evaluateAll(ctx context.Context) {
+	domains := s.domains()
+	active := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		on, err := s.evaluate(ctx, domain)
+		if err != nil {
+			attackModeLog.Error("Failed to evaluate domain", "domain", domain, "error", err)
+			on = s.IsActive(domain)
+		}
+		active[domain] = on
+	}
+
+	s.mu.Lock()
+	s.active = active
+	s.mu.Unlock()
+}
+
+// evaluate reads the last completed bucket, updates the baseline when traffic
+// is normal and applies the trigger/release hysteresis
+func (s *AttackModeService) evaluate(ctx context.Context, domain string) (bool, error) {
+	state, err := s.GetState(domain)
+	if err != nil {
+		return false, err
+	}
+
+	bucket := s.bucket(time.Now()) - 1
+	requests, _ := s.redis.Get(ctx, fmt.Sprintf("attackmode:req:%s:%d", domain, bucket)).Float64()
+	failures, _ := s.redis.Get(ctx, fmt.Sprintf("attackmode:err:%s:%d", domain, bucket)).Float64()
+
+	rps := requests / s.cfg.EvaluationInterval.Seconds()
+	errorRate := 0.0
+	if requests > 0 {
+		errorRate = failures / requests
+	}
+	state.RPS = rps
+	state.ErrorRate = errorRate
+
+	stateKey := attackModeStateKey(domain)
+	s.redis.HSet(ctx, stateKey, "rps", rps, "error_rate", errorRate)
+
+	switch state.Override {
+	case AttackModeOn:
+		return true, nil
+	case AttackModeOff:
+		return false, nil
+	}
+	if !s.cfg.Enabled {
+		return false, nil
+	}
+
+	warm := time.Duration(state.BaselineSamples)*s.cfg.EvaluationInterval >= s.cfg.Warmup
+
+	if !state.Active {
+		spike := warm && rps >= s.cfg.MinRPS && rps > state.BaselineRPS*s.cfg.TriggerFactor
+		errorSpike := warm && rps >= s.cfg.MinRPS && errorRate >= s.cfg.MinErrorRate &&
+			errorRate > state.BaselineErrorRate*s.cfg.TriggerFactor
+
+		if spike || errorSpike {
+			reason := fmt.Sprintf("RPS %.1f exceeds baseline %.1f x %.1f", rps, state.BaselineRPS, s.cfg.TriggerFactor)
+			if !spike {
+				reason = fmt.Sprintf("error rate %.0f%% exceeds baseline %.0f%% x %.1f",
+					errorRate*100, state.BaselineErrorRate*100, s.cfg.TriggerFactor)
+			}
+			return true, s.transition(ctx, state, true, "auto", reason, "")
+		}
+
+		// Only normal traffic is learned into the baseline
+		s.updateBaseline(ctx, domain, state, rps, errorRate)
+		return false, nil
+	}
+
+	calm := (rps < s.cfg.MinRPS || rps <= state.BaselineRPS*s.cfg.ReleaseFactor) &&
+		(errorRate < s.cfg.MinErrorRate || errorRate <= state.BaselineErrorRate*s.cfg.ReleaseFactor)
+	if !calm {
+		s.redis.HDel(ctx, stateKey, "calm_since")
+		return true, nil
+	}
+
+	calmSince, err := s.redis.HGet(ctx, stateKey, "calm_since").Int64()
+	if err != nil {
+		s.redis.HSet(ctx, stateKey, "calm_since", time.Now().Unix())
+		return true, nil
+	}
+	if time.Since(time.Unix(calmSince, 0)) < s.cfg.Cooldown {
+		return true, nil
+	}
+
+	reason := fmt.Sprintf("traffic below baseline x %.1f for %s", s.cfg.ReleaseFactor, s.cfg.Cooldown)
+	return false, s.transition(ctx, state, false, "auto", reason, "")
+}
+
+func (s *AttackModeService) updateBaseline(ctx context.Context, domain string, state *AttackModeState, rps, errorRate float64) {
+	baselineRPS := rps
+	baselineErrorRate := errorRate
+	if state.BaselineSamples > 0 {
+		baselineRPS = baselineAlpha*rps + (1-baselineAlpha)*state.BaselineRPS
+		baselineErrorRate = baselineAlpha*errorRate + (1-baselineAlpha)*state.BaselineErrorRate
+	}
+
+	s.redis.HSet(ctx, fmt.Sprintf("attackmode:baseline:%s", domain),
+		"rps", baselineRPS,
+		"error_rate", baselineErrorRate,
+		"samples", state.BaselineSamples+1,
+	)
+}
+
+// transition stores the new state and records the event
+func (s *AttackModeService) transition(ctx context.Context, state *AttackModeState, active bool, source, reason, changedBy string) error {
+	stateKey := attackModeStateKey(state.Domain)
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, stateKey,
+		"active", strconv.FormatBool(active),
+		"reason", reason,
+		"since", time.Now().Unix(),
+	)
+	pipe.HDel(ctx, stateKey, "calm_since")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	if active {
+		attackModeLog.Warn("Entered attack mode", "domain", state.Domain, "source", source, "reason", reason)
+	} else {
+		attackModeLog.Info("Left attack mode", "domain", state.Domain, "source", source, "reason", reason)
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO attack_mode_events (domain, active, source, reason, rps, baseline_rps,
+		                                error_rate, baseline_error_rate, changed_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, state.Domain, active, source, reason, state.RPS, state.BaselineRPS,
+		state.ErrorRate, state.BaselineErrorRate, changedBy)
+	return err
+}
+
+// GetState returns the stored state and baseline of a vhost
+func (s *AttackModeService) GetState(domain string) (*AttackModeState, error) {
+	ctx := context.Background()
+
+	fields, err := s.redis.HGetAll(ctx, attackModeStateKey(domain)).Result()
+	if err != nil {
+		return nil, err
+	}
+	baseline, err := s.redis.HGetAll(ctx, fmt.Sprintf("attackmode:baseline:%s", domain)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &AttackModeState{
+		Domain:   domain,
+		Active:   fields["active"] == "true",
+		Override: fields["override"],
+		Reason:   fields["reason"],
+	}
+	if state.Override == "" {
+		state.Override = AttackModeAuto
+	}
+	if since, err := strconv.ParseInt(fields["since"], 10, 64); err == nil {
+		state.Since = time.Unix(since, 0)
+	}
+	state.RPS, _ = strconv.ParseFloat(fields["rps"], 64)
+	state.ErrorRate, _ = strconv.ParseFloat(fields["error_rate"], 64)
+	state.BaselineRPS, _ = strconv.ParseFloat(baseline["rps"], 64)
+	state.BaselineErrorRate, _ = strconv.ParseFloat(baseline["error_rate"], 64)
+	state.BaselineSamples, _ = strconv.Atoi(baseline["samples"])
+
+	return state, nil
+}
+
+// ListStates returns the state of every enabled vhost
+func (s *AttackModeService) ListStates() ([]AttackModeState, error) {
+	domains := s.domains()
+	states := make([]AttackModeState, 0, len(domains))
+	for _, domain := range domains {
+		state, err := s.GetState(domain)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, *state)
+	}
+	return states, nil
+}
+
+// SetOverride forces attack mode on or off for a vhost, or hands it back to
+// the automatic detector
+func (s *AttackModeService) SetOverride(domain, mode, changedBy string) (*AttackModeState, error) {
+	if mode != AttackModeAuto && mode != AttackModeOn && mode != AttackModeOff {
+		return nil, fmt.Errorf("invalid mode %q", mode)
+	}
+
+	ctx := context.Background()
+	state, err := s.GetState(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.redis.HSet(ctx, attackModeStateKey(domain), "override", mode).Err(); err != nil {
+		return nil, err
+	}
+	state.Override = mode
+
+	// Forcing a state is a transition in its own right; going back to auto
+	// keeps the current state until the detector decides otherwise
+	if mode != AttackModeAuto {
+		active := mode == AttackModeOn
+		if active != state.Active {
+			if err := s.transition(ctx, state, active, "manual", "forced "+mode+" by admin", changedBy); err != nil {
+				return nil, err
+			}
+			state.Active = active
+			state.Since = time.Now()
+		}
+
+		s.mu.Lock()
+		s.active[domain] = active
+		s.mu.Unlock()
+	}
+
+	return state, nil
+}
+
+// Refresh reloads the cached state of a vhost, or of every vhost when domain
+// is empty, after another node changed it
+func (s *AttackModeService) Refresh(domain string) {
+	domains := []string{domain}
+	if domain == "" {
+		domains = s.domains()
+	}
+
+	for _, d := range domains {
+		state, err := s.GetState(d)
+		if err != nil {
+			attackModeLog.Error("Failed to refresh domain", "domain", d, "error", err)
+			continue
+		}
+		active := state.Active
+		switch state.Override {
+		case AttackModeOn:
+			active = true
+		case AttackModeOff:
+			active = false
+		}
+
+		s.mu.Lock()
+		s.active[d] = active
+		s.mu.Unlock()
+	}
+}
+
+// ListEvents returns recent transitions, optionally for a single vhost
+func (s *AttackModeService) ListEvents(domain string, limit int) ([]AttackModeEvent, error) {
+	events := []AttackModeEvent{}
+	query := `
+		SELECT id, domain, active, source, COALESCE(reason, '') as reason, rps, baseline_rps,
+		       error_rate, baseline_error_rate, COALESCE(changed_by, '') as changed_by, created_at
+		FROM attack_mode_events
+		WHERE ($1 = '' OR domain = $1)
+		ORDER BY created_at DESC
+		LIMIT $2
+	`
+	err := s.db.Select(&events, query, domain, limit)
+	return events, err
+}
+
+// EffectiveRateLimit returns the rate limit to apply to a vhost in attack
+// mode: its own limit tightened by the configured factor, or the attack mode
+// default when it has none
+func (s *AttackModeService) EffectiveRateLimit(enabled bool, requests, window int) (int, int) {
+	if !enabled || requests <= 0 || window <= 0 {
+		return s.cfg.RateLimitRequests, s.cfg.RateLimitWindow
+	}
+	tightened := int(float64(requests) * s.cfg.RateLimitFactor)
+	if tightened < 1 {
+		tightened = 1
+	}
+	return tightened, window
+}
+
+func (s *AttackModeService) bucket(t time.Time) int64 {
+	return t.Unix() / int64(s.cfg.EvaluationInterval.Seconds())
+}
+
+func attackModeStateKey(domain string) string {
+	return fmt.Sprintf("attackmode:state:%s", domain)
+}
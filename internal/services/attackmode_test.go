@@ -0,0 +1,52 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/aleh/docode-waf/internal/config"
+)
+
+func TestAttackModeRecordRequest(t *testing.T) {
+	s := NewAttackModeService(nil, nil, nil, config.AttackModeConfig{})
+	s.RecordRequest("shop.example.com", 200)
+	if len(s.counts) != 0 {
+		t.Fatal("requests must not be counted before the vhost list is loaded")
+	}
+
+	vhosts := map[string]bool{"shop.example.com": true}
+	s.vhosts.Store(&vhosts)
+
+	s.RecordRequest("shop.example.com", 200)
+	s.RecordRequest("shop.example.com:8443", 502)
+	s.RecordRequest("shop.example.com", 429)
+	s.RecordRequest("unknown.example.com", 200)
+	s.RecordRequest("203.0.113.7:80", 200)
+
+	// The calls may straddle two evaluation buckets
+	var requests, failures int64
+	for key, counts := range s.counts {
+		if key.domain != "shop.example.com" {
+			t.Errorf("counted %q, want only the enabled vhost", key.domain)
+		}
+		requests += counts.requests
+		failures += counts.failures
+	}
+	if requests != 3 || failures != 1 {
+		t.Errorf("requests = %d, failures = %d; want 3 and 1", requests, failures)
+	}
+}
+
+func TestHostDomain(t *testing.T) {
+	tests := map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": "example.com",
+		"[2001:db8::1]:80": "2001:db8::1",
+		"2001:db8::1":      "2001:db8::1",
+		"":                 "",
+	}
+	for host, want := range tests {
+		if got := hostDomain(host); got != want {
+			t.Errorf("hostDomain(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,727 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/metrics"
+	"github.com/jmoiron/sqlx"
+)
+
+var captureLog = logging.Component("capture")
+
+const (
+	defaultCaptureMaxBodyBytes        = 16 * 1024
+	defaultCaptureQueueSize           = 1000
+	defaultCaptureRetention           = 14 * 24 * time.Hour
+	defaultCaptureReplayTimeout       = 10 * time.Second
+	captureSampleRefresh              = 30 * time.Second
+	captureCleanupInterval            = time.Hour
+	captureWriteTimeout               = 5 * time.Second
+	captureCloseTimeout               = 10 * time.Second
+	captureReplayMaxBody              = 64 * 1024
+	captureRetentionLockID      int64 = 0x77616604
+
+	// CaptureReasonAttack and CaptureReasonSample are why a request was captured
+	CaptureReasonAttack = "attack"
+	CaptureReasonSample = "sample"
+
+	redactedValue = "[REDACTED]"
+)
+
+var defaultCaptureRedactHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Api-Key"}
+
+var defaultCaptureRedactFields = []string{"password", "passwd", "token", "secret", "api_key", "apikey", "access_token", "refresh_token", "client_secret"}
+
+// replayDropHeaders are managed by the replay client itself
+var replayDropHeaders = []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length", "Te", "Trailer", "Upgrade", "Accept-Encoding"}
+
+// ErrCaptureNotFound is returned for an unknown capture ID
+var ErrCaptureNotFound = errors.New("capture not found")
+
+// ErrReplayBackend is returned when a replay names a backend that does not
+// serve the captured vhost
+var ErrReplayBackend = errors.New("backend is not configured for the captured vhost")
+
+// CaptureRule is the attack rule that flagged a request
+type CaptureRule struct {
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+	Field   string `json:"field"` // url or user_agent
+}
+
+// CaptureEntry is one request copied out of the gin context. Redaction
+// happens on the writer side so the request path only pays for the copy.
+type CaptureEntry struct {
+	Timestamp     time.Time
+	RequestID     string
+	Host          string
+	ClientIP      string
+	Method        string
+	URL           string
+	Proto         string
+	Header        http.Header
+	Body          []byte
+	BodySize      int64
+	BodyTruncated bool
+	Reason        string
+	Rule          *CaptureRule
+	Decision      string
+	BlockSource   string
+	BlockReason   string
+	StatusCode    int
+}
+
+// RequestCapture is a stored capture. Body is returned separately as text
+// or base64 by Get.
+type RequestCapture struct {
+	ID            string          `db:"id" json:"id"`
+	RequestID     *string         `db:"request_id" json:"request_id"`
+	CapturedAt    time.Time       `db:"captured_at" json:"captured_at"`
+	Host          string          `db:"host" json:"host"`
+	ClientIP      string          `db:"client_ip" json:"client_ip"`
+	Method        string          `db:"method" json:"method"`
+	URL           string          `db:"url" json:"url"`
+	Proto         string          `db:"proto" json:"proto"`
+	Headers       json.RawMessage `db:"headers" json:"headers,omitempty"`
+	Body          []byte          `db:"body" json:"-"`
+	BodySize      int64           `db:"body_size" json:"body_size"`
+	BodyTruncated bool            `db:"body_truncated" json:"body_truncated"`
+	Reason        string          `db:"capture_reason" json:"capture_reason"`
+	AttackType    *string         `db:"attack_type" json:"attack_type"`
+	MatchedRule   json.RawMessage `db:"matched_rule" json:"matched_rule,omitempty"`
+	Decision      *string         `db:"decision" json:"decision"`
+	BlockSource   *string         `db:"block_source" json:"block_source"`
+	BlockReason   *string         `db:"block_reason" json:"block_reason"`
+	StatusCode    *int            `db:"status_code" json:"status_code"`
+
+	BodyText     *string `db:"-" json:"body_text,omitempty"`
+	BodyBase64   *string `db:"-" json:"body_base64,omitempty"`
+	BodyCaptured int     `db:"-" json:"body_captured"`
+}
+
+// CaptureFilter narrows a capture listing
+type CaptureFilter struct {
+	Host       string
+	ClientIP   string
+	RequestID  string
+	Reason     string
+	AttackType string
+	From       time.Time
+	To         time.Time
+	Limit      int
+	Offset     int
+}
+
+// ReplayResult is the backend's answer to a replayed capture
+type ReplayResult struct {
+	CaptureID     string      `json:"capture_id"`
+	Backend       string      `json:"backend"`
+	URL           string      `json:"url"`
+	StatusCode    int         `json:"status_code"`
+	Headers       http.Header `json:"headers"`
+	Body          string      `json:"body"`
+	BodyEncoding  string      `json:"body_encoding"` // text or base64
+	BodyTruncated bool        `json:"body_truncated"`
+	DurationMs    int64       `json:"duration_ms"`
+	Warnings      []string    `json:"warnings,omitempty"`
+}
+
+// CaptureStats reports the state of the capture writer
+type CaptureStats struct {
+	Queued   int    `json:"queued"`
+	Capacity int    `json:"capacity"`
+	Written  uint64 `json:"written"`
+	Dropped  uint64 `json:"dropped"`
+	Failed   uint64 `json:"failed"`
+}
+
+// CaptureService stores forensic captures of attack and sampled requests in
+// request_captures, deletes them after the retention period and replays them
+// against a vhost's backends. Captures are queued and written by a single
+// writer; when Postgres falls behind they are dropped and counted.
+type CaptureService struct {
+	db  *sqlx.DB
+	cfg config.CaptureConfig
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan CaptureEntry
+	wg     sync.WaitGroup
+
+	redactHeaders map[string]bool
+	jsonFields    *regexp.Regexp
+	formFields    *regexp.Regexp
+
+	// samples maps vhost domains to their capture_sample_percent
+	samples atomic.Value
+
+	replay *http.Client
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+// NewCaptureService creates the service and fills in config defaults. Call
+// Start to launch the writer and Run for sampling rates and retention.
+func NewCaptureService(db *sqlx.DB, cfg config.CaptureConfig) *CaptureService {
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultCaptureMaxBodyBytes
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultCaptureQueueSize
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = defaultCaptureRetention
+	}
+	if cfg.ReplayTimeout <= 0 {
+		cfg.ReplayTimeout = defaultCaptureReplayTimeout
+	}
+	if cfg.RedactHeaders == nil {
+		cfg.RedactHeaders = defaultCaptureRedactHeaders
+	}
+	if cfg.RedactFields == nil {
+		cfg.RedactFields = defaultCaptureRedactFields
+	}
+
+	s := &CaptureService{
+		db:            db,
+		cfg:           cfg,
+		queue:         make(chan CaptureEntry, cfg.QueueSize),
+		redactHeaders: make(map[string]bool),
+		replay: &http.Client{
+			Timeout: cfg.ReplayTimeout,
+			// The redirect is the answer being investigated
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	for _, name := range cfg.RedactHeaders {
+		s.redactHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+
+	var fields []string
+	for _, field := range cfg.RedactFields {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, regexp.QuoteMeta(field))
+		}
+	}
+	if len(fields) > 0 {
+		names := strings.Join(fields, "|")
+		// "field": in JSON; the value after it is found by jsonValueEnd
+		s.jsonFields = regexp.MustCompile(`(?i)"(?:` + names + `)"\s*:\s*`)
+		// field=value in form bodies
+		s.formFields = regexp.MustCompile(`(?i)((?:^|&)(?:` + names + `)=)[^&]*`)
+	}
+	s.samples.Store(map[string]float64{})
+	return s
+}
+
+// Enabled reports whether requests should be captured at all
+func (s *CaptureService) Enabled() bool {
+	return s.cfg.Enabled
+}
+
+// MaxBodyBytes is how much of a request body is kept
+func (s *CaptureService) MaxBodyBytes() int {
+	return s.cfg.MaxBodyBytes
+}
+
+// SamplePercent returns the share of requests to capture for a host, from
+// the cached vhost settings
+func (s *CaptureService) SamplePercent(host string) float64 {
+	if idx := strings.LastIndex(host, ":"); idx != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:idx]
+	}
+	return s.samples.Load().(map[string]float64)[host]
+}
+
+// Start launches the writer
+func (s *CaptureService) Start() {
+	if !s.cfg.Enabled {
+		captureLog.Info("Request captures disabled")
+		return
+	}
+	s.wg.Add(1)
+	go s.writer()
+	captureLog.Info("Capturing attack and sampled requests", "max_body_bytes", s.cfg.MaxBodyBytes, "retention", s.cfg.Retention.String())
+}
+
+// Enqueue queues a capture for writing and drops it when the queue is full
+func (s *CaptureService) Enqueue(entry CaptureEntry) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		s.dropped.Add(1)
+		return false
+	}
+
+	select {
+	case s.queue <- entry:
+		return true
+	default:
+		if s.dropped.Add(1)%100 == 1 {
+			captureLog.Warn("Queue full, dropping captures", "dropped", s.dropped.Load())
+		}
+		return false
+	}
+}
+
+// Close stops accepting captures and waits for queued ones to be written
+func (s *CaptureService) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(captureCloseTimeout):
+		captureLog.Warn("Gave up waiting for the writer", "queued", len(s.queue))
+	}
+}
+
+// Stats returns the writer counters
+func (s *CaptureService) Stats() CaptureStats {
+	return CaptureStats{
+		Queued:   len(s.queue),
+		Capacity: cap(s.queue),
+		Written:  s.written.Load(),
+		Dropped:  s.dropped.Load(),
+		Failed:   s.failed.Load(),
+	}
+}
+
+// Run refreshes the per-vhost sampling rates and deletes expired captures
+// until ctx is done. Deletion runs on one replica at a time.
+func (s *CaptureService) Run(ctx context.Context) {
+	if !s.cfg.Enabled {
+		return
+	}
+
+	s.refreshSamples(ctx)
+	s.cleanup(ctx)
+
+	sampleTicker := time.NewTicker(captureSampleRefresh)
+	defer sampleTicker.Stop()
+	cleanupTicker := time.NewTicker(captureCleanupInterval)
+	defer cleanupTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sampleTicker.C:
+			s.refreshSamples(ctx)
+		case <-cleanupTicker.C:
+			s.cleanup(ctx)
+		}
+	}
+}
+
+func (s *CaptureService) refreshSamples(ctx context.Context) {
+	var rows []struct {
+		Domain  string  `db:"domain"`
+		Percent float64 `db:"capture_sample_percent"`
+	}
+	err := s.db.SelectContext(ctx, &rows, `
+		SELECT domain, capture_sample_percent FROM vhosts
+		WHERE enabled = true AND capture_sample_percent > 0`)
+	if err != nil {
+		captureLog.Error("Failed to load sampling rates", "error", err)
+		return
+	}
+
+	samples := make(map[string]float64, len(rows))
+	for _, row := range rows {
+		samples[row.Domain] = row.Percent
+	}
+	s.samples.Store(samples)
+}
+
+func (s *CaptureService) cleanup(ctx context.Context) {
+	err := withAdvisoryLock(ctx, s.db, captureRetentionLockID, func(conn *sqlx.Conn) {
+		start := time.Now()
+		result, err := conn.ExecContext(ctx, "DELETE FROM request_captures WHERE captured_at < $1", time.Now().Add(-s.cfg.Retention))
+		metrics.ObservePostgres("capture_retention", start, err)
+		if err != nil {
+			captureLog.Error("Failed to delete expired captures", "error", err)
+			return
+		}
+		if deleted, _ := result.RowsAffected(); deleted > 0 {
+			captureLog.Info("Deleted expired captures", "deleted", deleted, "retention", s.cfg.Retention.String())
+		}
+	})
+	if err != nil {
+		captureLog.Error("Retention cleanup skipped", "error", err)
+	}
+}
+
+func (s *CaptureService) writer() {
+	defer s.wg.Done()
+	for entry := range s.queue {
+		if err := s.insert(entry); err != nil {
+			if s.failed.Add(1)%100 == 1 {
+				captureLog.Error("Failed to store capture", "failed", s.failed.Load(), "error", err)
+			}
+			continue
+		}
+		s.written.Add(1)
+	}
+}
+
+func (s *CaptureService) insert(entry CaptureEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), captureWriteTimeout)
+	defer cancel()
+
+	headers, err := json.Marshal(s.redactHeader(entry.Header))
+	if err != nil {
+		return err
+	}
+	var rule []byte
+	var attackType string
+	if entry.Rule != nil {
+		if rule, err = json.Marshal(entry.Rule); err != nil {
+			return err
+		}
+		attackType = entry.Rule.Type
+	}
+	var body []byte
+	if len(entry.Body) > 0 {
+		body = s.redactBody(entry.Body)
+	}
+
+	start := time.Now()
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO request_captures (request_id, captured_at, host, client_ip, method, url, proto, headers,
+		                              body, body_size, body_truncated, capture_reason, attack_type, matched_rule,
+		                              decision, block_source, block_reason, status_code)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)`,
+		nullIfEmpty(entry.RequestID),
+		entry.Timestamp,
+		entry.Host,
+		entry.ClientIP,
+		entry.Method,
+		entry.URL,
+		entry.Proto,
+		string(headers),
+		body,
+		entry.BodySize,
+		entry.BodyTruncated,
+		entry.Reason,
+		nullIfEmpty(attackType),
+		nullIfEmpty(string(rule)),
+		nullIfEmpty(entry.Decision),
+		nullIfEmpty(entry.BlockSource),
+		nullIfEmpty(entry.BlockReason),
+		nullIfZero(int64(entry.StatusCode)),
+	)
+	metrics.ObservePostgres("capture_insert", start, err)
+	return err
+}
+
+// redactHeader replaces the values of the configured headers
+func (s *CaptureService) redactHeader(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		if s.redactHeaders[http.CanonicalHeaderKey(name)] {
+			values = []string{redactedValue}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+// redactBody replaces the values of the configured JSON and form fields.
+// Both are matched textually so truncated bodies are redacted too.
+func (s *CaptureService) redactBody(body []byte) []byte {
+	if s.jsonFields == nil {
+		return body
+	}
+	body = s.redactJSON(body)
+	return s.formFields.ReplaceAll(body, []byte("${1}"+redactedValue))
+}
+
+// redactJSON replaces whole JSON values, including arrays and objects, of
+// the configured fields
+func (s *CaptureService) redactJSON(body []byte) []byte {
+	var out []byte
+	last := 0
+	for _, loc := range s.jsonFields.FindAllIndex(body, -1) {
+		if loc[0] < last {
+			// Inside a value that was replaced already
+			continue
+		}
+		out = append(out, body[last:loc[1]]...)
+		out = append(out, `"`+redactedValue+`"`...)
+		last = jsonValueEnd(body, loc[1])
+	}
+	if out == nil {
+		return body
+	}
+	return append(out, body[last:]...)
+}
+
+// jsonValueEnd returns the offset just past the JSON value starting at
+// start, or the end of body for a value cut off by truncation
+func jsonValueEnd(body []byte, start int) int {
+	depth := 0
+	inString := false
+	for i := start; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			if depth == 0 {
+				// The end of the enclosing object ends a number or literal
+				return i
+			}
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		case depth == 0 && (c == ',' || c == ' ' || c == '\t' || c == '\r' || c == '\n'):
+			return i
+		}
+	}
+	return len(body)
+}
+
+const captureColumns = `id, request_id, captured_at, host, client_ip, method, url, proto, body_size, body_truncated,
+	capture_reason, attack_type, COALESCE(matched_rule, 'null'::jsonb) AS matched_rule, decision, block_source,
+	block_reason, status_code`
+
+// List returns captures matching the filter, newest first, without headers
+// and bodies, and the total number of matches
+func (s *CaptureService) List(ctx context.Context, filter CaptureFilter) ([]RequestCapture, int, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Host != "" {
+		add("host = $%d", filter.Host)
+	}
+	if filter.ClientIP != "" {
+		add("client_ip = $%d", filter.ClientIP)
+	}
+	if filter.RequestID != "" {
+		add("request_id = $%d", filter.RequestID)
+	}
+	if filter.Reason != "" {
+		add("capture_reason = $%d", filter.Reason)
+	}
+	if filter.AttackType != "" {
+		add("attack_type = $%d", filter.AttackType)
+	}
+	if !filter.From.IsZero() {
+		add("captured_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		add("captured_at < $%d", filter.To)
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := s.db.GetContext(ctx, &total, "SELECT COUNT(*) FROM request_captures "+where, args...); err != nil {
+		return nil, 0, err
+	}
+
+	captures := []RequestCapture{}
+	query := fmt.Sprintf("SELECT %s FROM request_captures %s ORDER BY captured_at DESC LIMIT $%d OFFSET $%d",
+		captureColumns, where, len(args)+1, len(args)+2)
+	if err := s.db.SelectContext(ctx, &captures, query, append(args, filter.Limit, filter.Offset)...); err != nil {
+		return nil, 0, err
+	}
+	return captures, total, nil
+}
+
+// Get returns one capture with its headers and body. The body is returned as
+// text when it is valid UTF-8 and as base64 otherwise.
+func (s *CaptureService) Get(ctx context.Context, id string) (*RequestCapture, error) {
+	var capture RequestCapture
+	err := s.db.GetContext(ctx, &capture, "SELECT "+captureColumns+", headers, body FROM request_captures WHERE id = $1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCaptureNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	capture.BodyCaptured = len(capture.Body)
+	if len(capture.Body) > 0 {
+		if utf8.Valid(capture.Body) {
+			text := string(capture.Body)
+			capture.BodyText = &text
+		} else {
+			encoded := base64.StdEncoding.EncodeToString(capture.Body)
+			capture.BodyBase64 = &encoded
+		}
+	}
+	return &capture, nil
+}
+
+// Replay sends a capture to one of its vhost's backends, the primary
+// backend when none is given. Redacted headers are left out and redacted
+// body fields are sent as stored, so the backend may answer differently than
+// it did to the original request; the warnings say when that can happen.
+func (s *CaptureService) Replay(ctx context.Context, id, backend string) (*ReplayResult, error) {
+	capture, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var vhost struct {
+		BackendURL string `db:"backend_url"`
+		Backends   string `db:"backends"`
+	}
+	hostOnly := capture.Host
+	if idx := strings.LastIndex(hostOnly, ":"); idx != -1 && !strings.HasSuffix(hostOnly, "]") {
+		hostOnly = hostOnly[:idx]
+	}
+	err = s.db.GetContext(ctx, &vhost, `
+		SELECT COALESCE(backend_url, '') AS backend_url, COALESCE(backends::text, '[]') AS backends
+		FROM vhosts WHERE domain = $1`, hostOnly)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: vhost %s no longer exists", ErrReplayBackend, hostOnly)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backends []string
+	json.Unmarshal([]byte(vhost.Backends), &backends)
+	target := ""
+	for _, candidate := range append([]string{vhost.BackendURL}, backends...) {
+		candidate = strings.TrimRight(strings.TrimSpace(candidate), "/")
+		if candidate == "" {
+			continue
+		}
+		if backend == "" || strings.TrimRight(strings.TrimSpace(backend), "/") == candidate {
+			target = candidate
+			break
+		}
+	}
+	if target == "" {
+		return nil, ErrReplayBackend
+	}
+
+	base, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL %q: %w", target, err)
+	}
+	original, err := url.Parse(capture.URL)
+	if err != nil {
+		return nil, fmt.Errorf("captured URL cannot be parsed: %w", err)
+	}
+	replayURL := *base
+	replayURL.Path = strings.TrimRight(base.Path, "/") + original.Path
+	replayURL.RawPath = ""
+	replayURL.RawQuery = original.RawQuery
+
+	var warnings []string
+	if capture.BodyTruncated {
+		warnings = append(warnings, fmt.Sprintf("Only the first %d of %d body bytes were captured; the truncated body was sent", len(capture.Body), capture.BodySize))
+	}
+	if bytes.Contains(capture.Body, []byte(redactedValue)) {
+		warnings = append(warnings, "Redacted body fields were sent as "+redactedValue)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, capture.Method, replayURL.String(), bytes.NewReader(capture.Body))
+	if err != nil {
+		return nil, err
+	}
+	var header http.Header
+	if len(capture.Headers) > 0 {
+		json.Unmarshal(capture.Headers, &header)
+	}
+	for name, values := range header {
+		if len(values) == 1 && values[0] == redactedValue {
+			warnings = append(warnings, "Redacted header "+name+" was left out")
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	for _, name := range replayDropHeaders {
+		req.Header.Del(name)
+	}
+	req.Host = capture.Host
+	req.Header.Set("X-WAF-Replay", capture.ID)
+
+	start := time.Now()
+	resp, err := s.replay.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("replay failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, captureReplayMaxBody+1))
+	if err != nil {
+		warnings = append(warnings, "Reading the response body failed: "+err.Error())
+	}
+	result := &ReplayResult{
+		CaptureID:     capture.ID,
+		Backend:       target,
+		URL:           replayURL.String(),
+		StatusCode:    resp.StatusCode,
+		Headers:       resp.Header,
+		BodyTruncated: len(body) > captureReplayMaxBody,
+		DurationMs:    time.Since(start).Milliseconds(),
+		Warnings:      warnings,
+	}
+	if result.BodyTruncated {
+		body = body[:captureReplayMaxBody]
+	}
+	if utf8.Valid(body) {
+		result.Body, result.BodyEncoding = string(body), "text"
+	} else {
+		result.Body, result.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+
+	captureLog.Info("Replayed capture", "capture_id", capture.ID, "target", target, "status", resp.StatusCode)
+	return result, nil
+}
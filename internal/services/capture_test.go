@@ -0,0 +1,79 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aleh/docode-waf/internal/config"
+)
+
+func TestCaptureRedactBody(t *testing.T) {
+	s := NewCaptureService(nil, config.CaptureConfig{})
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"json string", `{"user":"alice","password":"hunter2"}`, `{"user":"alice","password":"[REDACTED]"}`},
+		{"json escaped quote", `{"token":"a\"b","next":"/"}`, `{"token":"[REDACTED]","next":"/"}`},
+		{"json number", `{"api_key": 12345, "page": 2}`, `{"api_key": "[REDACTED]", "page": 2}`},
+		{"json nested", `{"auth":{"client_secret":"s3"}}`, `{"auth":{"client_secret":"[REDACTED]"}}`},
+		{"json case insensitive", `{"Password" : "x"}`, `{"Password" : "[REDACTED]"}`},
+		{"json truncated value", `{"user":"alice","password":"hun`, `{"user":"alice","password":"[REDACTED]"`},
+		{"json array", `{"token":["a","b"],"page":2}`, `{"token":"[REDACTED]","page":2}`},
+		{"json object", `{"password":{"old":"a","new":"b]}"},"x":1}`, `{"password":"[REDACTED]","x":1}`},
+		{"json last number", `{"secret":42}`, `{"secret":"[REDACTED]"}`},
+		{"json truncated object", `{"secret":{"v":"ab`, `{"secret":"[REDACTED]"`},
+		{"json similar name", `{"password_hint":"pet","mytoken":"x"}`, `{"password_hint":"pet","mytoken":"x"}`},
+		{"form", `user=alice&password=hunter2&next=%2F`, `user=alice&password=[REDACTED]&next=%2F`},
+		{"form first field", `access_token=abc&x=1`, `access_token=[REDACTED]&x=1`},
+		{"form truncated value", `user=alice&secret=abc`, `user=alice&secret=[REDACTED]`},
+		{"form similar name", `mytoken=abc&password_hint=pet`, `mytoken=abc&password_hint=pet`},
+		{"plain text", `password is hunter2`, `password is hunter2`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(s.redactBody([]byte(tt.body))); got != tt.want {
+				t.Errorf("redactBody(%s) = %s, want %s", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaptureRedactBodyConfiguredFields(t *testing.T) {
+	s := NewCaptureService(nil, config.CaptureConfig{RedactFields: []string{" card.number ", ""}})
+	got := string(s.redactBody([]byte(`{"card.number":"4111","password":"x"}&card.number=4111&cardxnumber=1`)))
+	want := `{"card.number":"[REDACTED]","password":"x"}&card.number=[REDACTED]&cardxnumber=1`
+	if got != want {
+		t.Errorf("redactBody = %s, want %s", got, want)
+	}
+
+	// An explicitly empty list turns body redaction off
+	s = NewCaptureService(nil, config.CaptureConfig{RedactFields: []string{}})
+	if got := string(s.redactBody([]byte(`password=x`))); got != "password=x" {
+		t.Errorf("redactBody = %s, want the body unchanged", got)
+	}
+}
+
+func TestCaptureRedactHeader(t *testing.T) {
+	s := NewCaptureService(nil, config.CaptureConfig{})
+	header := http.Header{
+		"Authorization": {"Bearer abc"},
+		"Cookie":        {"a=1", "b=2"},
+		"x-api-key":     {"k"},
+		"Accept":        {"*/*"},
+	}
+	got := s.redactHeader(header)
+	for _, name := range []string{"Authorization", "Cookie", "x-api-key"} {
+		if values := got[name]; len(values) != 1 || values[0] != redactedValue {
+			t.Errorf("%s = %v, want it redacted", name, values)
+		}
+	}
+	if got.Get("Accept") != "*/*" {
+		t.Errorf("Accept = %q, want it kept", got.Get("Accept"))
+	}
+	if header.Get("Authorization") != "Bearer abc" {
+		t.Error("redactHeader must not modify the request headers")
+	}
+}
@@ -0,0 +1,379 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/redis/go-redis/v9"
+)
+
+var clusterLog = logging.Component("cluster")
+
+// Cluster event types
+const (
+	ClusterEventVHost      = "vhost"
+	ClusterEventRule       = "rule"
+	ClusterEventIPGroup    = "ip_group"
+	ClusterEventBan        = "ban"
+	ClusterEventAttackMode = "attack_mode"
+	ClusterEventCache      = "cache"
+	// ClusterEventLogLevel carries "component=level", with an empty
+	// component for the default level
+	ClusterEventLogLevel = "log_level"
+)
+
+const (
+	clusterVersionKey       = "cluster:config_version"
+	clusterNodesKey         = "cluster:nodes"
+	defaultClusterChannel   = "waf:cluster:events"
+	defaultClusterHeartbeat = 10 * time.Second
+	defaultClusterNodeTTL   = 30 * time.Second
+	clusterNodeRetention    = 24 * time.Hour
+	clusterPublishTimeout   = 2 * time.Second
+)
+
+// ClusterEvent is a change published to every node. An empty Key means the
+// whole kind of state changed, which is how missed events are resynced.
+type ClusterEvent struct {
+	Type    string    `json:"type"`
+	Key     string    `json:"key,omitempty"`
+	Version int64     `json:"version"`
+	Origin  string    `json:"origin"`
+	At      time.Time `json:"at"`
+}
+
+// ClusterNode is the heartbeat of one WAF replica
+type ClusterNode struct {
+	ID            string    `json:"id"`
+	Hostname      string    `json:"hostname"`
+	ConfigVersion int64     `json:"config_version"`
+	EventsApplied int64     `json:"events_applied"`
+	StartedAt     time.Time `json:"started_at"`
+	LastSeen      time.Time `json:"last_seen"`
+	Alive         bool      `json:"alive"`
+	InSync        bool      `json:"in_sync"`
+	Self          bool      `json:"self"`
+}
+
+// ClusterHandler applies an event published by another node
+type ClusterHandler func(event ClusterEvent)
+
+// ClusterService propagates configuration changes between WAF replicas over
+// Redis pub/sub. Every published change bumps a cluster-wide config version;
+// nodes record the version they have applied in their heartbeat and resync
+// everything when they notice they fell behind, since pub/sub drops messages
+// while a subscriber is disconnected.
+type ClusterService struct {
+	redis     *redis.Client
+	cfg       config.ClusterConfig
+	hostname  string
+	startedAt time.Time
+
+	mu       sync.RWMutex
+	handlers map[string][]ClusterHandler
+
+	version atomic.Int64
+	applied atomic.Int64
+}
+
+// NewClusterService creates the service and fills in config defaults
+func NewClusterService(redisClient *redis.Client, cfg config.ClusterConfig) *ClusterService {
+	hostname, _ := os.Hostname()
+	if cfg.NodeID == "" {
+		cfg.NodeID = hostname
+	}
+	if cfg.NodeID == "" {
+		cfg.NodeID = fmt.Sprintf("waf-%d", os.Getpid())
+	}
+	if cfg.Channel == "" {
+		cfg.Channel = defaultClusterChannel
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultClusterHeartbeat
+	}
+	if cfg.NodeTimeout <= cfg.HeartbeatInterval {
+		cfg.NodeTimeout = max(defaultClusterNodeTTL, 3*cfg.HeartbeatInterval)
+	}
+
+	return &ClusterService{
+		redis:     redisClient,
+		cfg:       cfg,
+		hostname:  hostname,
+		startedAt: time.Now(),
+		handlers:  make(map[string][]ClusterHandler),
+	}
+}
+
+// Enabled reports whether changes are shared with other nodes
+func (s *ClusterService) Enabled() bool {
+	return s != nil && s.cfg.Enabled
+}
+
+// NodeID returns the ID this node heartbeats under
+func (s *ClusterService) NodeID() string {
+	return s.cfg.NodeID
+}
+
+// ConfigVersion returns the last config version applied on this node
+func (s *ClusterService) ConfigVersion() int64 {
+	return s.version.Load()
+}
+
+// Handle registers fn for events of the given type published by other nodes
+func (s *ClusterService) Handle(eventType string, fn ClusterHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[eventType] = append(s.handlers[eventType], fn)
+}
+
+// Publish announces a change that the caller has already applied locally.
+// Failures are logged rather than returned: the change itself succeeded and
+// other nodes catch up through the version check in their heartbeat.
+func (s *ClusterService) Publish(eventType, key string) {
+	if s == nil {
+		return
+	}
+	if !s.cfg.Enabled {
+		s.version.Add(1)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterPublishTimeout)
+	defer cancel()
+
+	version, err := s.redis.Incr(ctx, clusterVersionKey).Result()
+	if err != nil {
+		clusterLog.Error("Failed to bump config version", "event", eventType, "error", err)
+		return
+	}
+	s.advance(version)
+
+	payload, _ := json.Marshal(ClusterEvent{
+		Type:    eventType,
+		Key:     key,
+		Version: version,
+		Origin:  s.cfg.NodeID,
+		At:      time.Now(),
+	})
+	if err := s.redis.Publish(ctx, s.cfg.Channel, payload).Err(); err != nil {
+		clusterLog.Error("Failed to publish event", "event", eventType, "error", err)
+	}
+}
+
+// Broadcast applies an event on this node and publishes it to the others
+func (s *ClusterService) Broadcast(eventType, key string) {
+	if s == nil {
+		return
+	}
+	s.dispatch(ClusterEvent{Type: eventType, Key: key, Origin: s.cfg.NodeID, At: time.Now()})
+	s.Publish(eventType, key)
+}
+
+// Run subscribes to cluster events and heartbeats until ctx is done
+func (s *ClusterService) Run(ctx context.Context) {
+	if !s.Enabled() {
+		return
+	}
+
+	// A starting node loads everything from the database, so it begins in
+	// sync with whatever has been published so far
+	if version, err := s.redis.Get(ctx, clusterVersionKey).Int64(); err == nil {
+		s.advance(version)
+	}
+
+	pubsub := s.redis.Subscribe(ctx, s.cfg.Channel)
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+
+	clusterLog.Info("Node joined", "node_id", s.cfg.NodeID, "channel", s.cfg.Channel, "config_version", s.version.Load())
+	s.heartbeat(ctx)
+
+	ticker := time.NewTicker(s.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.leave()
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			s.receive(msg.Payload)
+		case <-ticker.C:
+			s.heartbeat(ctx)
+		}
+	}
+}
+
+func (s *ClusterService) receive(payload string) {
+	var event ClusterEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		clusterLog.Warn("Ignoring malformed event", "error", err)
+		return
+	}
+	if event.Origin == s.cfg.NodeID {
+		return
+	}
+
+	// A gap means events were lost while disconnected
+	if current := s.version.Load(); event.Version > current+1 {
+		s.resync(event.Version)
+		return
+	}
+
+	s.dispatch(event)
+	s.applied.Add(1)
+	s.advance(event.Version)
+}
+
+func (s *ClusterService) dispatch(event ClusterEvent) {
+	s.mu.RLock()
+	handlers := s.handlers[event.Type]
+	s.mu.RUnlock()
+
+	for _, fn := range handlers {
+		fn(event)
+	}
+}
+
+// resync reapplies every kind of state after missed events
+func (s *ClusterService) resync(version int64) {
+	clusterLog.Info("Node is behind the cluster, resyncing", "node_id", s.cfg.NodeID, "config_version", s.version.Load(), "cluster_version", version)
+
+	s.mu.RLock()
+	types := make([]string, 0, len(s.handlers))
+	for eventType := range s.handlers {
+		types = append(types, eventType)
+	}
+	s.mu.RUnlock()
+
+	for _, eventType := range types {
+		s.dispatch(ClusterEvent{Type: eventType, Version: version, At: time.Now()})
+	}
+	s.applied.Add(1)
+	s.advance(version)
+}
+
+// advance moves the local version forward; events can arrive out of order
+func (s *ClusterService) advance(version int64) {
+	for {
+		current := s.version.Load()
+		if version <= current || s.version.CompareAndSwap(current, version) {
+			return
+		}
+	}
+}
+
+func (s *ClusterService) heartbeat(ctx context.Context) {
+	if version, err := s.redis.Get(ctx, clusterVersionKey).Int64(); err == nil && version > s.version.Load() {
+		s.resync(version)
+	}
+
+	now := time.Now()
+	pipe := s.redis.TxPipeline()
+	pipe.ZAdd(ctx, clusterNodesKey, redis.Z{Score: float64(now.Unix()), Member: s.cfg.NodeID})
+	pipe.HSet(ctx, clusterNodeKey(s.cfg.NodeID),
+		"hostname", s.hostname,
+		"config_version", s.version.Load(),
+		"events_applied", s.applied.Load(),
+		"started_at", s.startedAt.Unix(),
+		"last_seen", now.Unix(),
+	)
+	pipe.Expire(ctx, clusterNodeKey(s.cfg.NodeID), clusterNodeRetention)
+	// Forget nodes that have been gone for a day
+	pipe.ZRemRangeByScore(ctx, clusterNodesKey, "-inf", "("+strconv.FormatInt(now.Add(-clusterNodeRetention).Unix(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		clusterLog.Warn("Heartbeat failed", "error", err)
+	}
+}
+
+// leave removes this node from the view on a clean shutdown
+func (s *ClusterService) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterPublishTimeout)
+	defer cancel()
+
+	pipe := s.redis.TxPipeline()
+	pipe.ZRem(ctx, clusterNodesKey, s.cfg.NodeID)
+	pipe.Del(ctx, clusterNodeKey(s.cfg.NodeID))
+	pipe.Exec(ctx)
+}
+
+// Nodes returns every node that heartbeated within the last day, alive nodes
+// first, along with the cluster-wide config version
+func (s *ClusterService) Nodes() ([]ClusterNode, int64, error) {
+	if !s.Enabled() {
+		return []ClusterNode{s.self()}, s.version.Load(), nil
+	}
+
+	ctx := context.Background()
+	version, err := s.redis.Get(ctx, clusterVersionKey).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+
+	ids, err := s.redis.ZRevRange(ctx, clusterNodesKey, 0, -1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	alive := []ClusterNode{}
+	down := []ClusterNode{}
+	for _, id := range ids {
+		fields, err := s.redis.HGetAll(ctx, clusterNodeKey(id)).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		node := ClusterNode{ID: id, Hostname: fields["hostname"], Self: id == s.cfg.NodeID}
+		node.ConfigVersion, _ = strconv.ParseInt(fields["config_version"], 10, 64)
+		node.EventsApplied, _ = strconv.ParseInt(fields["events_applied"], 10, 64)
+		if startedAt, err := strconv.ParseInt(fields["started_at"], 10, 64); err == nil {
+			node.StartedAt = time.Unix(startedAt, 0)
+		}
+		if lastSeen, err := strconv.ParseInt(fields["last_seen"], 10, 64); err == nil {
+			node.LastSeen = time.Unix(lastSeen, 0)
+		}
+		node.Alive = now.Sub(node.LastSeen) <= s.cfg.NodeTimeout
+		node.InSync = node.ConfigVersion >= version
+
+		if node.Alive {
+			alive = append(alive, node)
+		} else {
+			down = append(down, node)
+		}
+	}
+
+	return append(alive, down...), version, nil
+}
+
+func (s *ClusterService) self() ClusterNode {
+	return ClusterNode{
+		ID:            s.cfg.NodeID,
+		Hostname:      s.hostname,
+		ConfigVersion: s.version.Load(),
+		EventsApplied: s.applied.Load(),
+		StartedAt:     s.startedAt,
+		LastSeen:      time.Now(),
+		Alive:         true,
+		InSync:        true,
+		Self:          true,
+	}
+}
+
+func clusterNodeKey(id string) string {
+	return fmt.Sprintf("cluster:node:%s", id)
+}
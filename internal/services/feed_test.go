@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aleh/docode-waf/internal/config"
+)
+
+func entryKeys(entries []IPEntry) []string {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key()
+	}
+	return keys
+}
+
+func TestParseFeed(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    string
+		csvColumn int
+		body      string
+		want      []string
+	}{
+		{
+			name:   "plain with comments and duplicates",
+			format: FeedFormatPlain,
+			body:   "# header\n192.0.2.1\n198.51.100.0/24 ; listed\n\n192.0.2.1\nnot-an-ip\n2001:db8::/32\n",
+			want:   []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32"},
+		},
+		{
+			name:   "host-sized networks become addresses",
+			format: FeedFormatPlain,
+			body:   "192.0.2.7/32\n10.1.2.3/8\n",
+			want:   []string{"192.0.2.7", "10.0.0.0/8"},
+		},
+		{
+			name:   "too broad networks are skipped",
+			format: FeedFormatPlain,
+			body:   "0.0.0.0/0\n192.0.2.1\n",
+			want:   []string{"192.0.2.1"},
+		},
+		{
+			name:   "spamhaus drop",
+			format: FeedFormatSpamhausDrop,
+			body:   "; Spamhaus DROP List\n1.10.16.0/20 ; SBL256894\n1.19.0.0/16 ; SBL434604\n",
+			want:   []string{"1.10.16.0/20", "1.19.0.0/16"},
+		},
+		{
+			name:   "tor exit addresses",
+			format: FeedFormatTor,
+			body:   "ExitNode 0011BD2485AD45D984EC4159C88FC066E5E3300E\nPublished 2024-01-01 00:00:00\nExitAddress 192.0.2.9 2024-01-01 00:10:00\n",
+			want:   []string{"192.0.2.9"},
+		},
+		{
+			name:   "tor bulk exit list",
+			format: FeedFormatTor,
+			body:   "192.0.2.10\n192.0.2.11\n",
+			want:   []string{"192.0.2.10", "192.0.2.11"},
+		},
+		{
+			name:      "csv column",
+			format:    FeedFormatCSV,
+			csvColumn: 2,
+			body:      "id,address,score\n1,192.0.2.20,90\n2, 198.51.100.0/25,75\n3\n",
+			want:      []string{"192.0.2.20", "198.51.100.0/25"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := ParseFeed(tt.format, strings.NewReader(tt.body), tt.csvColumn)
+			if err != nil {
+				t.Fatalf("ParseFeed: %v", err)
+			}
+			if got := entryKeys(entries); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseFeed("xml", strings.NewReader(""), 0); err == nil {
+		t.Error("unknown format should fail")
+	}
+}
+
+// testFeedService returns a feed service that fetches through srv's client,
+// since the default client refuses loopback addresses
+func testFeedService(srv *httptest.Server, cfg config.FeedConfig) *FeedService {
+	s := NewFeedService(nil, cfg)
+	if srv != nil {
+		s.SetHTTPClient(srv.Client())
+	}
+	return s
+}
+
+func TestFeedFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "DoCode-WAF feed importer" {
+			t.Errorf("User-Agent = %q", r.Header.Get("User-Agent"))
+		}
+		switch r.URL.Path {
+		case "/drop.txt":
+			w.Write([]byte("1.10.16.0/20 ; SBL256894\n192.0.2.1\n"))
+		case "/empty.txt":
+			w.Write([]byte("# nothing listed today\n"))
+		case "/big.txt":
+			w.Write([]byte("192.0.2.1\n192.0.2.2\n192.0.2.3\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s := testFeedService(srv, config.FeedConfig{MaxEntries: 2})
+	ctx := context.Background()
+
+	entries, err := s.fetch(ctx, &Feed{Source: srv.URL + "/drop.txt", Format: FeedFormatSpamhausDrop})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if got := strings.Join(entryKeys(entries), ","); got != "1.10.16.0/20,192.0.2.1" {
+		t.Errorf("entries = %s", got)
+	}
+
+	if _, err := s.fetch(ctx, &Feed{Source: srv.URL + "/missing.txt", Format: FeedFormatPlain}); err == nil ||
+		!strings.Contains(err.Error(), "404") {
+		t.Errorf("missing feed: err = %v, want an HTTP status error", err)
+	}
+
+	if _, err := s.fetch(ctx, &Feed{Source: srv.URL + "/big.txt", Format: FeedFormatPlain}); err == nil ||
+		!strings.Contains(err.Error(), "limit is 2") {
+		t.Errorf("oversized feed: err = %v, want the entry limit error", err)
+	}
+
+	// An empty download must not wipe a feed that had entries
+	if _, err := s.fetch(ctx, &Feed{Source: srv.URL + "/empty.txt", Format: FeedFormatPlain, EntryCount: 5}); !errors.Is(err, ErrFeedEmpty) {
+		t.Errorf("empty feed: err = %v, want ErrFeedEmpty", err)
+	}
+	if entries, err := s.fetch(ctx, &Feed{Source: srv.URL + "/empty.txt", Format: FeedFormatPlain}); err != nil || len(entries) != 0 {
+		t.Errorf("new empty feed: entries = %v, err = %v", entries, err)
+	}
+}
+
+func TestFeedFetchMaxSize(t *testing.T) {
+	body := "192.0.2.1\n192.0.2.2\n192.0.2.3\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	// An oversized feed fails instead of being cut off, which would remove
+	// the entries past the cut
+	s := testFeedService(srv, config.FeedConfig{MaxSize: 10})
+	if _, err := s.fetch(context.Background(), &Feed{Source: srv.URL, Format: FeedFormatPlain}); err == nil ||
+		!strings.Contains(err.Error(), "size limit") {
+		t.Errorf("oversized feed: err = %v, want the size limit error", err)
+	}
+
+	s = testFeedService(srv, config.FeedConfig{MaxSize: int64(len(body))})
+	entries, err := s.fetch(context.Background(), &Feed{Source: srv.URL, Format: FeedFormatPlain})
+	if err != nil || len(entries) != 3 {
+		t.Errorf("feed at the size limit: entries = %v, err = %v", entries, err)
+	}
+}
+
+func TestFeedDefaultClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.1\n"))
+	}))
+	defer srv.Close()
+
+	s := testFeedService(nil, config.FeedConfig{})
+	_, err := s.fetch(context.Background(), &Feed{Source: srv.URL, Format: FeedFormatPlain})
+	if !errors.Is(err, ErrInvalidFeedSource) {
+		t.Errorf("err = %v, want ErrInvalidFeedSource", err)
+	}
+}
+
+func TestFeedDialControl(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"203.0.113.10:443", true},
+		{"10.0.0.5:80", true},
+		{"[2001:db8::1]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:443", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"224.0.0.1:80", false},
+	}
+	for _, tt := range tests {
+		err := feedDialControl("tcp", tt.address, nil)
+		if (err == nil) != tt.allowed {
+			t.Errorf("feedDialControl(%s) = %v, want allowed %v", tt.address, err, tt.allowed)
+		}
+	}
+}
+
+func TestFeedValidateSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "list.txt"), []byte("192.0.2.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "list.txt"), []byte("192.0.2.2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	local := NewFeedService(nil, config.FeedConfig{LocalDir: dir})
+	remoteOnly := NewFeedService(nil, config.FeedConfig{})
+
+	tests := []struct {
+		name    string
+		s       *FeedService
+		source  string
+		wantErr bool
+	}{
+		{"https url", remoteOnly, "https://www.spamhaus.org/drop/drop.txt", false},
+		{"http url", remoteOnly, "http://feeds.example.com/list.txt", false},
+		{"url without host", remoteOnly, "https:///list.txt", true},
+		{"other scheme", remoteOnly, "gopher://feeds.example.com/list", true},
+		{"local file disabled", remoteOnly, "/etc/passwd", true},
+		{"file url disabled", remoteOnly, "file:///etc/passwd", true},
+		{"relative file", local, "list.txt", false},
+		{"file url inside", local, "file://" + filepath.Join(dir, "list.txt"), false},
+		{"absolute path outside", local, "/etc/passwd", true},
+		{"dot-dot escape", local, "../list.txt", true},
+		{"symlink escape", local, "escape/list.txt", true},
+		{"symlink escape to a new file", local, "escape/new.txt", true},
+		{"new file inside", local, "new.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.s.ValidateSource(tt.source)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateSource(%q) = %v, want error %v", tt.source, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidFeedSource) {
+				t.Errorf("error %v does not wrap ErrInvalidFeedSource", err)
+			}
+		})
+	}
+
+	entries, err := local.fetch(context.Background(), &Feed{Source: "list.txt", Format: FeedFormatPlain})
+	if err != nil || len(entries) != 1 {
+		t.Errorf("local fetch: entries = %v, err = %v", entries, err)
+	}
+}
@@ -1,87 +1,367 @@
 package services
 
 import (
-	"encoding/json"
-	"fmt"
-	"net/http"
+	"container/list"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/oschwald/geoip2-golang"
+)
+
+var geoIPLog = logging.Component("geoip")
+
+const (
+	defaultGeoIPDatabasePath   = "GeoLite2-Country.mmdb"
+	defaultGeoIPCacheSize      = 10000
+	defaultGeoIPReloadInterval = time.Minute
+)
+
+var (
+	// ErrGeoIPUnavailable is returned when no GeoIP database is loaded
+	ErrGeoIPUnavailable = errors.New("geoip database not loaded")
+	// ErrGeoIPInvalidIP is returned for unparseable addresses
+	ErrGeoIPInvalidIP = errors.New("invalid IP address")
 )
 
-// GeoIPService handles geolocation lookups
+// GeoIPRecord is the result of a GeoIP lookup. Private and loopback
+// addresses resolve to country code "XX" with Private set. ASN and city
+// fields are only filled when the optional ASN and City databases are loaded.
+type GeoIPRecord struct {
+	IP              string `json:"ip"`
+	CountryCode     string `json:"country_code"`
+	Country         string `json:"country"`
+	Continent       string `json:"continent"`
+	SubdivisionCode string `json:"subdivision_code,omitempty"`
+	Subdivision     string `json:"subdivision,omitempty"`
+	City            string `json:"city,omitempty"`
+	ASN             uint   `json:"asn,omitempty"`
+	ASOrg           string `json:"as_org,omitempty"`
+	Private         bool   `json:"private"`
+}
+
+// Region returns the ISO 3166-2 code of the record's first-level
+// subdivision (e.g. "US-CA"), or "" when it is not known
+func (r *GeoIPRecord) Region() string {
+	if r.SubdivisionCode == "" || r.CountryCode == "" || r.CountryCode == "XX" {
+		return ""
+	}
+	return r.CountryCode + "-" + r.SubdivisionCode
+}
+
+// MatchesRegion reports whether the record matches a region filter entry.
+// Entries are either a country code ("US") or a country-subdivision code
+// ("US-CA"); matching is case-insensitive.
+func (r *GeoIPRecord) MatchesRegion(entry string) bool {
+	entry = strings.ToUpper(strings.TrimSpace(entry))
+	if entry == "" {
+		return false
+	}
+	if strings.Contains(entry, "-") {
+		return entry == r.Region()
+	}
+	return entry == r.CountryCode
+}
+
+// ParseASN parses an AS number written as "13335" or "AS13335"
+func ParseASN(value string) (uint, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) > 2 && strings.EqualFold(value[:2], "AS") {
+		value = value[2:]
+	}
+	asn, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || asn == 0 {
+		return 0, false
+	}
+	return uint(asn), true
+}
+
+// geoipDatabase is one mmdb file and the reader currently open on it
+type geoipDatabase struct {
+	name    string
+	path    string
+	reader  *geoip2.Reader
+	modTime time.Time
+}
+
+// GeoIPService resolves IP addresses against the local MaxMind databases.
+// The country database is required; GeoLite2-ASN and GeoLite2-City are
+// optional and add AS and city/subdivision details when configured.
+// Lookups are cached in an LRU and each database is reopened when its file
+// on disk changes, so updating an mmdb does not need a restart.
 type GeoIPService struct {
-	httpClient *http.Client
-}
-
-// GeoIPResponse represents the response from ip-api.com
-type GeoIPResponse struct {
-	Status      string  `json:"status"`
-	Country     string  `json:"country"`
-	CountryCode string  `json:"countryCode"`
-	Region      string  `json:"region"`
-	RegionName  string  `json:"regionName"`
-	City        string  `json:"city"`
-	Zip         string  `json:"zip"`
-	Lat         float64 `json:"lat"`
-	Lon         float64 `json:"lon"`
-	Timezone    string  `json:"timezone"`
-	ISP         string  `json:"isp"`
-	Org         string  `json:"org"`
-	AS          string  `json:"as"`
-	Query       string  `json:"query"`
-	Message     string  `json:"message,omitempty"`
-}
-
-// NewGeoIPService creates a new GeoIP service
-func NewGeoIPService() *GeoIPService {
-	return &GeoIPService{
-		httpClient: &http.Client{
-			Timeout: 5 * time.Second,
-		},
-	}
-}
-
-// LookupIP performs a geolocation lookup for the given IP address
-// Uses ip-api.com free API (no key required, 45 req/min limit)
-func (s *GeoIPService) LookupIP(ip string) (*GeoIPResponse, error) {
-	// Skip lookup for localhost/private IPs
-	if ip == "127.0.0.1" || ip == "::1" || ip == "localhost" {
-		return &GeoIPResponse{
-			Status:      "success",
-			Country:     "Localhost",
-			CountryCode: "XX",
-			Query:       ip,
-		}, nil
-	}
-
-	url := fmt.Sprintf("http://ip-api.com/json/%s?fields=status,message,country,countryCode,region,regionName,city,zip,lat,lon,timezone,isp,org,as,query", ip)
-
-	resp, err := s.httpClient.Get(url)
+	mu        sync.RWMutex
+	country   *geoipDatabase
+	city      *geoipDatabase
+	asn       *geoipDatabase
+	databases []*geoipDatabase
+
+	cacheMu   sync.Mutex
+	cache     map[string]*list.Element
+	cacheLRU  *list.List
+	cacheSize int
+}
+
+// NewGeoIPService opens the databases configured under waf.geoip and starts
+// watching them for changes. A missing database is not fatal; lookups fail
+// with ErrGeoIPUnavailable until the country (or city) database appears.
+func NewGeoIPService(cfg config.GeoIPConfig) *GeoIPService {
+	s := &GeoIPService{
+		cache:     make(map[string]*list.Element),
+		cacheLRU:  list.New(),
+		cacheSize: cfg.CacheSize,
+	}
+	if s.cacheSize <= 0 {
+		s.cacheSize = defaultGeoIPCacheSize
+	}
+
+	path := cfg.DatabasePath
+	if path == "" {
+		path = defaultGeoIPDatabasePath
+	}
+	s.country = &geoipDatabase{name: "country", path: path}
+	s.databases = append(s.databases, s.country)
+	if cfg.CityDatabasePath != "" {
+		s.city = &geoipDatabase{name: "city", path: cfg.CityDatabasePath}
+		s.databases = append(s.databases, s.city)
+	}
+	if cfg.ASNDatabasePath != "" {
+		s.asn = &geoipDatabase{name: "asn", path: cfg.ASNDatabasePath}
+		s.databases = append(s.databases, s.asn)
+	}
+
+	if !cfg.Enabled {
+		geoIPLog.Info("GeoIP lookups disabled by configuration")
+		return s
+	}
+
+	for _, db := range s.databases {
+		if err := s.reload(db); err != nil {
+			geoIPLog.Warn("Failed to load database", "database", db.name, "path", db.path, "error", err)
+		}
+	}
+
+	interval := cfg.ReloadInterval
+	if interval <= 0 {
+		interval = defaultGeoIPReloadInterval
+	}
+	go s.watch(interval)
+
+	return s
+}
+
+// watch reopens a database whenever its file's modification time changes
+func (s *GeoIPService) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, db := range s.databases {
+			info, err := os.Stat(db.path)
+			if err != nil {
+				continue
+			}
+
+			s.mu.RLock()
+			changed := !info.ModTime().Equal(db.modTime)
+			s.mu.RUnlock()
+
+			if changed {
+				if err := s.reload(db); err != nil {
+					geoIPLog.Warn("Failed to reload database", "database", db.name, "path", db.path, "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (s *GeoIPService) reload(db *geoipDatabase) error {
+	info, err := os.Stat(db.path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to lookup IP: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status code: %d", resp.StatusCode)
+	reader, err := geoip2.Open(db.path)
+	if err != nil {
+		return err
 	}
 
-	var geoResp GeoIPResponse
-	if err := json.NewDecoder(resp.Body).Decode(&geoResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	s.mu.Lock()
+	old := db.reader
+	db.reader = reader
+	db.modTime = info.ModTime()
+	s.mu.Unlock()
+
+	if old != nil {
+		old.Close()
 	}
+	s.purgeCache()
+
+	meta := reader.Metadata()
+	geoIPLog.Info("Database loaded", "database", db.name, "path", db.path, "type", meta.DatabaseType,
+		"built", time.Unix(int64(meta.BuildEpoch), 0).Format("2006-01-02"))
+	return nil
+}
+
+// Available reports whether country lookups are possible
+func (s *GeoIPService) Available() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.country.reader != nil || (s.city != nil && s.city.reader != nil)
+}
+
+// ASNAvailable reports whether the ASN database is loaded
+func (s *GeoIPService) ASNAvailable() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.asn != nil && s.asn.reader != nil
+}
 
-	if geoResp.Status == "fail" {
-		return nil, fmt.Errorf("geolocation lookup failed: %s", geoResp.Message)
+// LookupIP resolves the given IP address
+func (s *GeoIPService) LookupIP(ip string) (*GeoIPRecord, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, ErrGeoIPInvalidIP
+	}
+	if parsedIP.IsPrivate() || parsedIP.IsLoopback() || parsedIP.IsUnspecified() {
+		return &GeoIPRecord{IP: ip, CountryCode: "XX", Country: "Private", Private: true}, nil
+	}
+
+	if record, ok := s.cached(ip); ok {
+		return record, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record := &GeoIPRecord{IP: ip}
+	switch {
+	case s.city != nil && s.city.reader != nil:
+		// The City database is a superset of Country, so prefer it
+		city, err := s.city.reader.City(parsedIP)
+		if err != nil {
+			return nil, err
+		}
+		record.CountryCode = city.Country.IsoCode
+		record.Country = city.Country.Names["en"]
+		record.Continent = city.Continent.Code
+		record.City = city.City.Names["en"]
+		if len(city.Subdivisions) > 0 {
+			record.SubdivisionCode = city.Subdivisions[0].IsoCode
+			record.Subdivision = city.Subdivisions[0].Names["en"]
+		}
+		if record.CountryCode == "" {
+			record.CountryCode = city.RegisteredCountry.IsoCode
+			record.Country = city.RegisteredCountry.Names["en"]
+		}
+	case s.country.reader != nil:
+		country, err := s.country.reader.Country(parsedIP)
+		if err != nil {
+			return nil, err
+		}
+		record.CountryCode = country.Country.IsoCode
+		record.Country = country.Country.Names["en"]
+		record.Continent = country.Continent.Code
+		if record.CountryCode == "" {
+			// Anycast and satellite ranges only carry a registered country
+			record.CountryCode = country.RegisteredCountry.IsoCode
+			record.Country = country.RegisteredCountry.Names["en"]
+		}
+	default:
+		return nil, ErrGeoIPUnavailable
+	}
+	if record.CountryCode == "" {
+		record.CountryCode = "XX"
 	}
 
-	return &geoResp, nil
+	if s.asn != nil && s.asn.reader != nil {
+		// A failed ASN lookup still leaves a usable country record
+		if asn, err := s.asn.reader.ASN(parsedIP); err == nil {
+			record.ASN = asn.AutonomousSystemNumber
+			record.ASOrg = asn.AutonomousSystemOrganization
+		}
+	}
+
+	s.store(ip, record)
+	return record, nil
 }
 
 // GetCountryCode is a convenience method to get just the country code
 func (s *GeoIPService) GetCountryCode(ip string) (string, error) {
-	geoResp, err := s.LookupIP(ip)
+	record, err := s.LookupIP(ip)
 	if err != nil {
 		return "", err
 	}
-	return geoResp.CountryCode, nil
+	return record.CountryCode, nil
+}
+
+// CountryCodeOrUnknown returns the country code, or "XX" if it cannot be
+// determined. Used where a best-effort value is enough, e.g. traffic logs.
+func (s *GeoIPService) CountryCodeOrUnknown(ip string) string {
+	code, err := s.GetCountryCode(ip)
+	if err != nil || code == "" {
+		return "XX"
+	}
+	return code
+}
+
+// LookupOrUnknown returns the full record, or a record with country "XX"
+// and no enrichment if the address cannot be resolved
+func (s *GeoIPService) LookupOrUnknown(ip string) *GeoIPRecord {
+	record, err := s.LookupIP(ip)
+	if err != nil {
+		return &GeoIPRecord{IP: ip, CountryCode: "XX"}
+	}
+	return record
+}
+
+func (s *GeoIPService) cached(ip string) (*GeoIPRecord, bool) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	elem, ok := s.cache[ip]
+	if !ok {
+		return nil, false
+	}
+	s.cacheLRU.MoveToFront(elem)
+	return elem.Value.(*GeoIPRecord), true
+}
+
+func (s *GeoIPService) store(ip string, record *GeoIPRecord) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if elem, ok := s.cache[ip]; ok {
+		elem.Value = record
+		s.cacheLRU.MoveToFront(elem)
+		return
+	}
+
+	if s.cacheLRU.Len() >= s.cacheSize {
+		oldest := s.cacheLRU.Back()
+		s.cacheLRU.Remove(oldest)
+		delete(s.cache, oldest.Value.(*GeoIPRecord).IP)
+	}
+	s.cache[ip] = s.cacheLRU.PushFront(record)
+}
+
+// PurgeCache drops all cached lookups
+func (s *GeoIPService) PurgeCache() {
+	if s == nil {
+		return
+	}
+	s.purgeCache()
+}
+
+func (s *GeoIPService) purgeCache() {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	s.cache = make(map[string]*list.Element)
+	s.cacheLRU.Init()
 }
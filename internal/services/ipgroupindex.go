@@ -0,0 +1,267 @@
+package services
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/jmoiron/sqlx"
+)
+
+var ipIndexLog = logging.Component("ip_index")
+
+const (
+	defaultIPIndexRefresh = 5 * time.Minute
+	ipIndexLoadTimeout    = time.Minute
+)
+
+// IPGroupIndex is an in-memory copy of the whitelist and blacklist entries
+// the IP blocker checks on every request. Entries are grouped by scope
+// (global or one vhost domain) and prefix length, so a lookup costs one map
+// probe per distinct prefix length instead of a scan of every entry.
+//
+// The index is rebuilt from Postgres when Invalidate is called after a group,
+// address, import or feed change here or on another node, and periodically in
+// case an event was missed. Lookups keep using the previous copy while a
+// rebuild runs.
+type IPGroupIndex struct {
+	db      *sqlx.DB
+	current atomic.Pointer[ipGroupSnapshot]
+	reload  chan struct{}
+}
+
+// ipGroupSnapshot is one immutable build of the index
+type ipGroupSnapshot struct {
+	// sets by group type, for global groups (scope "") and each vhost domain
+	scopes     map[string]map[string]*prefixSet
+	whitelists map[string]bool
+	entries    int
+}
+
+// prefixSet holds networks and addresses, the latter as host-sized prefixes.
+// The value is the entry's expiry, zero for permanent entries.
+type prefixSet struct {
+	bits    []int
+	entries map[netip.Prefix]time.Time
+}
+
+// NewIPGroupIndex creates an empty index; call Load before serving requests
+func NewIPGroupIndex(db *sqlx.DB) *IPGroupIndex {
+	return &IPGroupIndex{db: db, reload: make(chan struct{}, 1)}
+}
+
+// Load rebuilds the index from the database
+func (x *IPGroupIndex) Load(ctx context.Context) error {
+	start := time.Now()
+	snapshot := &ipGroupSnapshot{
+		scopes:     make(map[string]map[string]*prefixSet),
+		whitelists: make(map[string]bool),
+	}
+
+	// Groups without vhost associations are global (scope ""). expires_at
+	// is in the WAF's local time, so it is compared with the WAF's clock
+	// rather than NOW() in the database session's time zone.
+	rows, err := x.db.QueryxContext(ctx, `
+		SELECT ig.type, COALESCE(v.domain, '') AS domain, ia.ip_address, ia.cidr_mask, ia.expires_at
+		FROM ip_addresses ia
+		JOIN ip_groups ig ON ia.group_id = ig.id
+		LEFT JOIN ip_group_vhosts igv ON ig.id = igv.ip_group_id
+		LEFT JOIN vhosts v ON igv.vhost_id = v.id
+		WHERE ia.expires_at IS NULL OR ia.expires_at > $1
+	`, time.Now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row struct {
+			Type      string     `db:"type"`
+			Domain    string     `db:"domain"`
+			IPAddress string     `db:"ip_address"`
+			CIDRMask  *int       `db:"cidr_mask"`
+			ExpiresAt *time.Time `db:"expires_at"`
+		}
+		if err := rows.StructScan(&row); err != nil {
+			return err
+		}
+		prefix, ok := entryPrefix(row.IPAddress, row.CIDRMask)
+		if !ok {
+			ipIndexLog.Debug("Skipping unparsable entry", "ip_address", row.IPAddress)
+			continue
+		}
+		var expiresAt time.Time
+		if row.ExpiresAt != nil {
+			expiresAt = wallClock(*row.ExpiresAt)
+		}
+		snapshot.set(row.Domain, row.Type).add(prefix, expiresAt)
+		snapshot.entries++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// A whitelist group restricts its scope even while it has no entries
+	var whitelisted []string
+	err = x.db.SelectContext(ctx, &whitelisted, `
+		SELECT DISTINCT COALESCE(v.domain, '')
+		FROM ip_groups ig
+		LEFT JOIN ip_group_vhosts igv ON ig.id = igv.ip_group_id
+		LEFT JOIN vhosts v ON igv.vhost_id = v.id
+		WHERE ig.type = 'whitelist'
+	`)
+	if err != nil {
+		return err
+	}
+	for _, domain := range whitelisted {
+		snapshot.whitelists[domain] = true
+	}
+
+	x.current.Store(snapshot)
+	ipIndexLog.Debug("Rebuilt IP group index", "entries", snapshot.entries, "duration", time.Since(start))
+	return nil
+}
+
+// Invalidate schedules a rebuild. Calls made while one is pending coalesce.
+func (x *IPGroupIndex) Invalidate() {
+	if x == nil {
+		return
+	}
+	select {
+	case x.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Run rebuilds the index when invalidated and every interval until ctx is
+// done
+func (x *IPGroupIndex) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultIPIndexRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-x.reload:
+		case <-ticker.C:
+		}
+
+		loadCtx, cancel := context.WithTimeout(ctx, ipIndexLoadTimeout)
+		if err := x.Load(loadCtx); err != nil {
+			ipIndexLog.Error("Failed to rebuild IP group index", "error", err)
+		}
+		cancel()
+	}
+}
+
+// Contains reports whether ip is in a group of groupType ("whitelist" or
+// "blacklist") that is global or assigned to domain
+func (x *IPGroupIndex) Contains(groupType, domain string, ip netip.Addr) bool {
+	snapshot := x.current.Load()
+	if snapshot == nil || !ip.IsValid() {
+		return false
+	}
+	ip = ip.Unmap()
+	now := time.Now()
+	if set := snapshot.scopes[""][groupType]; set != nil && set.contains(ip, now) {
+		return true
+	}
+	if domain == "" {
+		return false
+	}
+	set := snapshot.scopes[domain][groupType]
+	return set != nil && set.contains(ip, now)
+}
+
+// HasWhitelist reports whether a global whitelist or one assigned to domain
+// exists, in which case only whitelisted IPs may reach domain
+func (x *IPGroupIndex) HasWhitelist(domain string) bool {
+	snapshot := x.current.Load()
+	if snapshot == nil {
+		return false
+	}
+	return snapshot.whitelists[""] || snapshot.whitelists[domain]
+}
+
+// Entries returns the number of entries in the index
+func (x *IPGroupIndex) Entries() int {
+	if snapshot := x.current.Load(); snapshot != nil {
+		return snapshot.entries
+	}
+	return 0
+}
+
+func (s *ipGroupSnapshot) set(domain, groupType string) *prefixSet {
+	byType := s.scopes[domain]
+	if byType == nil {
+		byType = make(map[string]*prefixSet)
+		s.scopes[domain] = byType
+	}
+	set := byType[groupType]
+	if set == nil {
+		set = &prefixSet{entries: make(map[netip.Prefix]time.Time)}
+		byType[groupType] = set
+	}
+	return set
+}
+
+// add inserts prefix, keeping the longest-lived expiry of duplicates
+func (p *prefixSet) add(prefix netip.Prefix, expiresAt time.Time) {
+	if current, ok := p.entries[prefix]; ok {
+		if current.IsZero() || (!expiresAt.IsZero() && current.After(expiresAt)) {
+			return
+		}
+	}
+	p.entries[prefix] = expiresAt
+	if !slices.Contains(p.bits, prefix.Bits()) {
+		p.bits = append(p.bits, prefix.Bits())
+		slices.Sort(p.bits)
+	}
+}
+
+func (p *prefixSet) contains(ip netip.Addr, now time.Time) bool {
+	for _, bits := range p.bits {
+		if bits > ip.BitLen() {
+			break
+		}
+		prefix, err := ip.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if expiresAt, ok := p.entries[prefix]; ok && (expiresAt.IsZero() || expiresAt.After(now)) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryPrefix converts an ip_addresses row to a prefix; rows without a
+// positive cidr_mask match the exact address
+func entryPrefix(address string, cidrMask *int) (netip.Prefix, bool) {
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	mapped := ip.Is4In6()
+	ip = ip.Unmap()
+	bits := ip.BitLen()
+	if cidrMask != nil && *cidrMask > 0 {
+		bits = *cidrMask
+		if mapped {
+			// An IPv4-mapped IPv6 network, e.g. ::ffff:10.0.0.0/104
+			bits -= 96
+		}
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return prefix, true
+}
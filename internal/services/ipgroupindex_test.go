@@ -0,0 +1,129 @@
+package services
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// indexRow is an ip_addresses row as Load reads it
+type indexRow struct {
+	domain, groupType, ip string
+	mask                  *int
+	expiresAt             time.Time
+}
+
+// testIPGroupIndex builds an index from rows without a database
+func testIPGroupIndex(t *testing.T, rows []indexRow, whitelists ...string) *IPGroupIndex {
+	t.Helper()
+
+	snapshot := &ipGroupSnapshot{
+		scopes:     make(map[string]map[string]*prefixSet),
+		whitelists: make(map[string]bool),
+	}
+	for _, row := range rows {
+		prefix, ok := entryPrefix(row.ip, row.mask)
+		if !ok {
+			t.Fatalf("entryPrefix(%q) failed", row.ip)
+		}
+		snapshot.set(row.domain, row.groupType).add(prefix, row.expiresAt)
+		snapshot.entries++
+	}
+	for _, domain := range whitelists {
+		snapshot.whitelists[domain] = true
+	}
+
+	index := NewIPGroupIndex(nil)
+	index.current.Store(snapshot)
+	return index
+}
+
+func prefixLen(bits int) *int { return &bits }
+
+func TestIPGroupIndexContains(t *testing.T) {
+	now := time.Now()
+	index := testIPGroupIndex(t, []indexRow{
+		{"", "blacklist", "203.0.113.7", nil, time.Time{}},
+		{"", "blacklist", "198.51.100.0", prefixLen(24), time.Time{}},
+		{"shop.example.com", "blacklist", "10.0.0.0", prefixLen(8), time.Time{}},
+		{"shop.example.com", "blacklist", "2001:db8::", prefixLen(32), time.Time{}},
+		{"", "blacklist", "192.0.2.1", nil, now.Add(-time.Minute)},
+		{"", "blacklist", "192.0.2.2", nil, now.Add(time.Hour)},
+		{"", "whitelist", "172.16.5.4", prefixLen(16), time.Time{}},
+		{"", "blacklist", "::ffff:100.64.0.0", prefixLen(106), time.Time{}},
+	}, "api.example.com")
+
+	tests := []struct {
+		name      string
+		groupType string
+		domain    string
+		ip        string
+		want      bool
+	}{
+		{"global exact", "blacklist", "any.example.com", "203.0.113.7", true},
+		{"global exact other ip", "blacklist", "any.example.com", "203.0.113.8", false},
+		{"global network", "blacklist", "", "198.51.100.200", true},
+		{"vhost network", "blacklist", "shop.example.com", "10.200.1.1", true},
+		{"vhost network other vhost", "blacklist", "blog.example.com", "10.200.1.1", false},
+		{"vhost ipv6 network", "blacklist", "shop.example.com", "2001:db8:1::1", true},
+		{"ipv4-mapped client", "blacklist", "", "::ffff:203.0.113.7", true},
+		{"ipv4-mapped network", "blacklist", "", "100.64.1.1", true},
+		{"expired entry", "blacklist", "", "192.0.2.1", false},
+		{"unexpired entry", "blacklist", "", "192.0.2.2", true},
+		{"whitelist is separate", "blacklist", "", "172.16.1.1", false},
+		{"whitelist network", "whitelist", "", "172.16.1.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := index.Contains(tt.groupType, tt.domain, netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("Contains(%q, %q, %s) = %v, want %v", tt.groupType, tt.domain, tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	if index.Contains("blacklist", "", netip.Addr{}) {
+		t.Error("an unparsable client IP must not match")
+	}
+	if !index.HasWhitelist("api.example.com") || index.HasWhitelist("shop.example.com") {
+		t.Error("HasWhitelist should only report the vhost with a whitelist group")
+	}
+}
+
+func TestIPGroupIndexKeepsLongestExpiry(t *testing.T) {
+	now := time.Now()
+	index := testIPGroupIndex(t, []indexRow{
+		{"", "blacklist", "192.0.2.1", nil, time.Time{}},
+		{"", "blacklist", "192.0.2.1", nil, now.Add(-time.Minute)},
+		{"", "blacklist", "192.0.2.2", nil, now.Add(-time.Minute)},
+		{"", "blacklist", "192.0.2.2", nil, now.Add(time.Hour)},
+	})
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if !index.Contains("blacklist", "", netip.MustParseAddr(ip)) {
+			t.Errorf("%s should match through its longest-lived duplicate", ip)
+		}
+	}
+}
+
+func TestEntryPrefix(t *testing.T) {
+	tests := []struct {
+		ip   string
+		mask *int
+		want string
+		ok   bool
+	}{
+		{"203.0.113.7", nil, "203.0.113.7/32", true},
+		{"203.0.113.7", prefixLen(0), "203.0.113.7/32", true},
+		{"10.1.2.3", prefixLen(8), "10.0.0.0/8", true},
+		{"2001:db8::1", nil, "2001:db8::1/128", true},
+		{"::ffff:10.0.0.0", prefixLen(104), "10.0.0.0/8", true},
+		{"10.0.0.0", prefixLen(33), "", false},
+		{"not-an-ip", nil, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := entryPrefix(tt.ip, tt.mask)
+		if ok != tt.ok || (ok && got.String() != tt.want) {
+			t.Errorf("entryPrefix(%q) = %v, %v; want %s, %v", tt.ip, got, ok, tt.want, tt.ok)
+		}
+	}
+}
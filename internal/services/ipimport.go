@@ -0,0 +1,587 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/jmoiron/sqlx"
+)
+
+var ipExpiryLog = logging.Component("ip_expiry")
+
+// Bulk import/export formats
+const (
+	IPFormatCSV  = "csv"
+	IPFormatText = "text"
+	IPFormatJSON = "json"
+)
+
+const (
+	defaultExpiryPruneInterval = time.Minute
+	maxIPImportEntries         = 100000
+)
+
+// ErrUnsupportedIPFormat is returned for unknown import/export formats
+var ErrUnsupportedIPFormat = errors.New("unsupported format, use csv, text or json")
+
+// IPEntry is a single address or network
+type IPEntry struct {
+	IP       string
+	CIDRMask *int
+}
+
+// Key identifies the entry for dedup and diffing, in the same form
+// ip_addresses uses
+func (e IPEntry) Key() string {
+	if e.CIDRMask == nil {
+		return e.IP
+	}
+	return fmt.Sprintf("%s/%d", e.IP, *e.CIDRMask)
+}
+
+// ParseIPEntry normalises an IP or CIDR. Networks are reduced to their base
+// address and host-sized networks (/32, /128) are stored as plain addresses,
+// matching how entries are added by hand.
+func ParseIPEntry(value string) (IPEntry, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return IPEntry{}, errors.New("empty address")
+	}
+
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return IPEntry{}, fmt.Errorf("invalid CIDR %q", value)
+		}
+		ones, bits := network.Mask.Size()
+		if ones == bits {
+			return IPEntry{IP: network.IP.String()}, nil
+		}
+		if ones == 0 {
+			// Never let one entry match the whole address space
+			return IPEntry{}, fmt.Errorf("network %q is too broad", value)
+		}
+		return IPEntry{IP: network.IP.String(), CIDRMask: &ones}, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return IPEntry{}, fmt.Errorf("invalid IP address %q", value)
+	}
+	return IPEntry{IP: ip.String()}, nil
+}
+
+// IPImportRecord is one address of a bulk import or export
+type IPImportRecord struct {
+	IPAddress   string     `json:"ip_address"`
+	CIDRMask    *int       `json:"cidr_mask,omitempty"`
+	Description string     `json:"description,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Source      string     `json:"source,omitempty"`
+}
+
+// IPImportError reports an invalid line or record of a bulk import
+type IPImportError struct {
+	Line  int    `json:"line"`
+	Value string `json:"value"`
+	Error string `json:"error"`
+}
+
+// IPImportReport summarises a bulk import
+type IPImportReport struct {
+	Total      int             `json:"total"`
+	Valid      int             `json:"valid"`
+	Added      int             `json:"added"`
+	Updated    int             `json:"updated"`
+	Duplicates int             `json:"duplicates"`
+	Invalid    int             `json:"invalid"`
+	Errors     []IPImportError `json:"errors"`
+	DryRun     bool            `json:"dry_run"`
+}
+
+// IPImportOptions apply to every record that does not set its own value
+type IPImportOptions struct {
+	Description string
+	ExpiresAt   *time.Time
+	DryRun      bool
+}
+
+// maxReportedImportErrors keeps validation reports of badly broken uploads
+// to a readable size; the invalid count stays exact
+const maxReportedImportErrors = 500
+
+// ParseIPImport parses a bulk import body. Valid entries are normalised and
+// deduplicated; every rejected line is listed in the report.
+//
+//   - text: one address per line, "1.2.3.4" or "10.0.0.0/8", with an
+//     optional "# description" after it
+//   - csv: ip_address[,description[,expires_at]], or any column order when
+//     the first row is a header naming ip_address, cidr_mask, description
+//     and expires_at
+//   - json: an array of strings or of {ip_address, cidr_mask, description,
+//     expires_at} objects
+//
+// expires_at accepts RFC 3339 timestamps or a duration from now ("48h").
+func ParseIPImport(format string, r io.Reader, opts IPImportOptions) ([]IPImportRecord, *IPImportReport, error) {
+	var raw []rawImportRecord
+	var err error
+
+	switch format {
+	case IPFormatText:
+		raw, err = readTextImport(r)
+	case IPFormatCSV:
+		raw, err = readCSVImport(r)
+	case IPFormatJSON:
+		raw, err = readJSONImport(r)
+	default:
+		return nil, nil, ErrUnsupportedIPFormat
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	report := &IPImportReport{Total: len(raw), Errors: []IPImportError{}, DryRun: opts.DryRun}
+	if len(raw) > maxIPImportEntries {
+		return nil, nil, fmt.Errorf("import has %d entries, limit is %d", len(raw), maxIPImportEntries)
+	}
+
+	now := time.Now()
+	seen := make(map[string]int, len(raw))
+	records := make([]IPImportRecord, 0, len(raw))
+	for _, rec := range raw {
+		record, err := rec.normalise(now, opts)
+		if err != nil {
+			report.Invalid++
+			if len(report.Errors) < maxReportedImportErrors {
+				report.Errors = append(report.Errors, IPImportError{Line: rec.line, Value: rec.value, Error: err.Error()})
+			}
+			continue
+		}
+
+		key := IPEntry{IP: record.IPAddress, CIDRMask: record.CIDRMask}.Key()
+		if idx, dup := seen[key]; dup {
+			report.Duplicates++
+			// Keep the longest-lived copy
+			records[idx].ExpiresAt = laterExpiry(records[idx].ExpiresAt, record.ExpiresAt)
+			continue
+		}
+		seen[key] = len(records)
+		records = append(records, record)
+	}
+	report.Valid = len(records)
+
+	return records, report, nil
+}
+
+type rawImportRecord struct {
+	line        int
+	value       string
+	cidrMask    string
+	description string
+	expiresAt   string
+}
+
+func (rec rawImportRecord) normalise(now time.Time, opts IPImportOptions) (IPImportRecord, error) {
+	value := rec.value
+	if rec.cidrMask != "" && !strings.Contains(value, "/") {
+		value += "/" + rec.cidrMask
+	}
+	entry, err := ParseIPEntry(value)
+	if err != nil {
+		return IPImportRecord{}, err
+	}
+
+	record := IPImportRecord{
+		IPAddress:   entry.IP,
+		CIDRMask:    entry.CIDRMask,
+		Description: rec.description,
+		ExpiresAt:   opts.ExpiresAt,
+	}
+	if record.Description == "" {
+		record.Description = opts.Description
+	}
+	if rec.expiresAt != "" {
+		expiresAt, err := parseExpiry(rec.expiresAt, now)
+		if err != nil {
+			return IPImportRecord{}, err
+		}
+		record.ExpiresAt = &expiresAt
+	}
+	if record.ExpiresAt != nil && !record.ExpiresAt.After(now) {
+		return IPImportRecord{}, errors.New("expires_at is in the past")
+	}
+	return record, nil
+}
+
+// parseExpiry accepts an RFC 3339 timestamp or a duration from now. The
+// result is in local time, as expires_at is a TIMESTAMP column that would
+// otherwise keep the wall clock of the given offset.
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Local(), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expires_at %q, use RFC 3339 or a duration like 48h", value)
+}
+
+// ParseExpiry is parseExpiry relative to the current time
+func ParseExpiry(value string) (time.Time, error) {
+	return parseExpiry(value, time.Now())
+}
+
+// localExpiry converts an expires_at read back from Postgres to local time
+func localExpiry(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	local := wallClock(*t)
+	return &local
+}
+
+// laterExpiry returns the later of two expiries, where nil means never
+func laterExpiry(a, b *time.Time) *time.Time {
+	if a == nil || b == nil {
+		return nil
+	}
+	if b.After(*a) {
+		return b
+	}
+	return a
+}
+
+func readTextImport(r io.Reader) ([]rawImportRecord, error) {
+	var raw []rawImportRecord
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rec := rawImportRecord{line: line, value: text}
+		if idx := strings.Index(text, "#"); idx != -1 {
+			rec.value = strings.TrimSpace(text[:idx])
+			rec.description = strings.TrimSpace(text[idx+1:])
+		}
+		raw = append(raw, rec)
+	}
+	return raw, scanner.Err()
+}
+
+func readCSVImport(r io.Reader) ([]rawImportRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	// Positional layout unless the first row is a header
+	columns := map[string]int{"ip_address": 0, "description": 1, "expires_at": 2, "cidr_mask": -1}
+
+	var raw []rawImportRecord
+	first := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return raw, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if first {
+			first = false
+			if header, ok := csvImportHeader(record); ok {
+				columns = header
+				continue
+			}
+		}
+
+		field := func(name string) string {
+			idx := columns[name]
+			if idx < 0 || idx >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[idx])
+		}
+		if field("ip_address") == "" && len(strings.Join(record, "")) == 0 {
+			continue
+		}
+		raw = append(raw, rawImportRecord{
+			line:        line,
+			value:       field("ip_address"),
+			cidrMask:    field("cidr_mask"),
+			description: field("description"),
+			expiresAt:   field("expires_at"),
+		})
+	}
+}
+
+// csvImportHeader maps column names when the row is a header row
+func csvImportHeader(record []string) (map[string]int, bool) {
+	columns := map[string]int{"ip_address": -1, "cidr_mask": -1, "description": -1, "expires_at": -1}
+	for i, name := range record {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "ip", "ip_address", "address", "cidr":
+			columns["ip_address"] = i
+		case "cidr_mask", "mask", "prefix":
+			columns["cidr_mask"] = i
+		case "description", "comment", "note":
+			columns["description"] = i
+		case "expires_at", "expires", "expiry", "ttl":
+			columns["expires_at"] = i
+		}
+	}
+	return columns, columns["ip_address"] >= 0
+}
+
+func readJSONImport(r io.Reader) ([]rawImportRecord, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	raw := make([]rawImportRecord, 0, len(items))
+	for i, item := range items {
+		rec := rawImportRecord{line: i + 1}
+
+		var value string
+		if err := json.Unmarshal(item, &value); err == nil {
+			rec.value = value
+			raw = append(raw, rec)
+			continue
+		}
+
+		var obj struct {
+			IPAddress   string `json:"ip_address"`
+			CIDRMask    *int   `json:"cidr_mask"`
+			Description string `json:"description"`
+			ExpiresAt   string `json:"expires_at"`
+		}
+		if err := json.Unmarshal(item, &obj); err != nil {
+			rec.value = string(item)
+			raw = append(raw, rec)
+			continue
+		}
+		rec.value = obj.IPAddress
+		rec.description = obj.Description
+		rec.expiresAt = obj.ExpiresAt
+		if obj.CIDRMask != nil {
+			rec.cidrMask = strconv.Itoa(*obj.CIDRMask)
+		}
+		raw = append(raw, rec)
+	}
+	return raw, nil
+}
+
+// ImportIPs writes parsed records into a group. Addresses already in the
+// group are not duplicated; their expiry is extended when the import lives
+// longer, so re-running "block for 48h" refreshes the block.
+func ImportIPs(db *sqlx.DB, groupID string, records []IPImportRecord, report *IPImportReport) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existing []struct {
+		ID        string     `db:"id"`
+		IP        string     `db:"ip_address"`
+		CIDRMask  *int       `db:"cidr_mask"`
+		ExpiresAt *time.Time `db:"expires_at"`
+		FeedID    *string    `db:"feed_id"`
+	}
+	err = tx.Select(&existing, `
+		SELECT id, ip_address, cidr_mask, expires_at, feed_id::text as feed_id
+		FROM ip_addresses
+		WHERE group_id = $1 AND (expires_at IS NULL OR expires_at > $2)
+	`, groupID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	type current struct {
+		id        string
+		expiresAt *time.Time
+		feed      bool
+	}
+	byKey := make(map[string]current, len(existing))
+	for _, row := range existing {
+		entry := IPEntry{IP: row.IP, CIDRMask: row.CIDRMask}
+		if row.CIDRMask != nil && *row.CIDRMask <= 0 {
+			entry.CIDRMask = nil
+		}
+		byKey[entry.Key()] = current{id: row.ID, expiresAt: localExpiry(row.ExpiresAt), feed: row.FeedID != nil}
+	}
+
+	var added []IPImportRecord
+	for _, record := range records {
+		key := IPEntry{IP: record.IPAddress, CIDRMask: record.CIDRMask}.Key()
+		cur, ok := byKey[key]
+		if !ok {
+			added = append(added, record)
+			continue
+		}
+
+		report.Duplicates++
+		if cur.feed || cur.expiresAt == nil {
+			continue
+		}
+		if later := laterExpiry(cur.expiresAt, record.ExpiresAt); later == nil || later.After(*cur.expiresAt) {
+			if !report.DryRun {
+				if _, err := tx.Exec(`UPDATE ip_addresses SET expires_at = $1 WHERE id = $2`, later, cur.id); err != nil {
+					return err
+				}
+			}
+			report.Updated++
+		}
+	}
+
+	report.Added = len(added)
+	if report.DryRun {
+		return nil
+	}
+
+	for start := 0; start < len(added); start += feedBatchSize {
+		end := min(start+feedBatchSize, len(added))
+		if err := insertImportRecords(tx, groupID, added[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func insertImportRecords(tx *sqlx.Tx, groupID string, records []IPImportRecord) error {
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO ip_addresses (id, group_id, ip_address, cidr_mask, description, expires_at, source, created_at) VALUES `)
+	args := make([]interface{}, 0, len(records)*4+1)
+	args = append(args, groupID)
+	for i, record := range records {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&sb, "(gen_random_uuid(), $1, $%d, $%d, $%d, $%d, 'import', NOW())", n+1, n+2, n+3, n+4)
+		args = append(args, record.IPAddress, record.CIDRMask, record.Description, record.ExpiresAt)
+	}
+	_, err := tx.Exec(sb.String(), args...)
+	return err
+}
+
+// ExportIPs returns the unexpired addresses of a group
+func ExportIPs(db *sqlx.DB, groupID string) ([]IPImportRecord, error) {
+	var rows []struct {
+		IP          string     `db:"ip_address"`
+		CIDRMask    *int       `db:"cidr_mask"`
+		Description *string    `db:"description"`
+		ExpiresAt   *time.Time `db:"expires_at"`
+		Source      *string    `db:"source"`
+	}
+	err := db.Select(&rows, `
+		SELECT ip_address, cidr_mask, description, expires_at, source
+		FROM ip_addresses
+		WHERE group_id = $1 AND (expires_at IS NULL OR expires_at > $2)
+		ORDER BY created_at
+	`, groupID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]IPImportRecord, 0, len(rows))
+	for _, row := range rows {
+		record := IPImportRecord{IPAddress: row.IP, ExpiresAt: localExpiry(row.ExpiresAt)}
+		if row.CIDRMask != nil && *row.CIDRMask > 0 {
+			record.CIDRMask = row.CIDRMask
+		}
+		if row.Description != nil {
+			record.Description = *row.Description
+		}
+		if row.Source != nil {
+			record.Source = *row.Source
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// WriteIPExport writes records in one of the import formats so an export can
+// be imported again unchanged
+func WriteIPExport(w io.Writer, format string, records []IPImportRecord) error {
+	switch format {
+	case IPFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case IPFormatText:
+		bw := bufio.NewWriter(w)
+		for _, record := range records {
+			line := IPEntry{IP: record.IPAddress, CIDRMask: record.CIDRMask}.Key()
+			if record.Description != "" {
+				line += " # " + strings.ReplaceAll(record.Description, "\n", " ")
+			}
+			fmt.Fprintln(bw, line)
+		}
+		return bw.Flush()
+	case IPFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"ip_address", "cidr_mask", "description", "expires_at", "source"})
+		for _, record := range records {
+			mask, expires := "", ""
+			if record.CIDRMask != nil {
+				mask = strconv.Itoa(*record.CIDRMask)
+			}
+			if record.ExpiresAt != nil {
+				expires = record.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+			cw.Write([]string{record.IPAddress, mask, record.Description, expires, record.Source})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return ErrUnsupportedIPFormat
+	}
+}
+
+// RunIPExpiryPruner deletes expired ip_addresses rows until ctx is done. The
+// matcher already ignores expired rows; this only keeps the table small.
+func RunIPExpiryPruner(ctx context.Context, db *sqlx.DB, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultExpiryPruneInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// expires_at is in the WAF's local time, not the session time zone
+		result, err := db.ExecContext(ctx, `DELETE FROM ip_addresses WHERE expires_at IS NOT NULL AND expires_at <= $1`, time.Now())
+		if err != nil {
+			ipExpiryLog.Error("Failed to prune expired addresses", "error", err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			ipExpiryLog.Info("Pruned expired addresses", "pruned", n)
+		}
+	}
+}
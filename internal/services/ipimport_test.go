@@ -0,0 +1,164 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// importKeys returns the records as "key description" pairs
+func importKeys(records []IPImportRecord) []string {
+	keys := make([]string, len(records))
+	for i, record := range records {
+		keys[i] = IPEntry{IP: record.IPAddress, CIDRMask: record.CIDRMask}.Key() + " " + record.Description
+	}
+	return keys
+}
+
+func TestParseIPImport(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		body       string
+		want       []string
+		invalid    int
+		duplicates int
+	}{
+		{
+			name:    "text",
+			format:  IPFormatText,
+			body:    "# blocked scanners\n192.0.2.1\n198.51.100.7/24 # office\n\n2001:db8::1/128\nnot-an-ip\n",
+			want:    []string{"192.0.2.1 ", "198.51.100.0/24 office", "2001:db8::1 "},
+			invalid: 1,
+		},
+		{
+			name:    "positional csv",
+			format:  IPFormatCSV,
+			body:    "192.0.2.1,scanner\n10.0.0.0/8\n0.0.0.0/0,everything\n",
+			want:    []string{"192.0.2.1 scanner", "10.0.0.0/8 "},
+			invalid: 1,
+		},
+		{
+			name:   "csv with header",
+			format: IPFormatCSV,
+			body:   "note,mask,ip\nlab,16,172.16.9.9\n,,192.0.2.5\n",
+			want:   []string{"172.16.0.0/16 lab", "192.0.2.5 "},
+		},
+		{
+			name:       "json",
+			format:     IPFormatJSON,
+			body:       `["192.0.2.1", {"ip_address": "10.1.0.0", "cidr_mask": 16, "description": "vpn"}, {"ip_address": "192.0.2.1"}, 42]`,
+			want:       []string{"192.0.2.1 ", "10.1.0.0/16 vpn"},
+			invalid:    1,
+			duplicates: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, report, err := ParseIPImport(tt.format, strings.NewReader(tt.body), IPImportOptions{})
+			if err != nil {
+				t.Fatalf("ParseIPImport: %v", err)
+			}
+			if got := importKeys(records); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("records = %q, want %q", got, tt.want)
+			}
+			if report.Valid != len(tt.want) || report.Invalid != tt.invalid || report.Duplicates != tt.duplicates {
+				t.Errorf("report = %+v", report)
+			}
+			if len(report.Errors) != tt.invalid {
+				t.Errorf("got %d reported errors, want %d", len(report.Errors), tt.invalid)
+			}
+		})
+	}
+
+	if _, _, err := ParseIPImport("xml", strings.NewReader(""), IPImportOptions{}); !errors.Is(err, ErrUnsupportedIPFormat) {
+		t.Errorf("unknown format: err = %v", err)
+	}
+	if _, _, err := ParseIPImport(IPFormatJSON, strings.NewReader("{"), IPImportOptions{}); err == nil {
+		t.Error("malformed JSON should fail")
+	}
+}
+
+func TestParseIPImportExpiry(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	offset := future.In(time.FixedZone("UTC+5", 5*60*60)).Format(time.RFC3339)
+
+	body := "ip_address,expires_at\n" +
+		"192.0.2.1," + offset + "\n" +
+		"192.0.2.2,48h\n" +
+		"192.0.2.3," + past + "\n" +
+		"192.0.2.4,soon\n" +
+		"192.0.2.5\n"
+	defaultExpiry := time.Now().Add(time.Hour)
+	records, report, err := ParseIPImport(IPFormatCSV, strings.NewReader(body), IPImportOptions{ExpiresAt: &defaultExpiry})
+	if err != nil {
+		t.Fatalf("ParseIPImport: %v", err)
+	}
+	if report.Invalid != 2 || len(records) != 3 {
+		t.Fatalf("report = %+v, records = %d", report, len(records))
+	}
+
+	// An RFC 3339 offset is converted to local time, the same instant
+	if got := records[0].ExpiresAt; got == nil || !got.Equal(future) || got.Location() != time.Local {
+		t.Errorf("offset expiry = %v, want %v in local time", got, future)
+	}
+	if got := records[1].ExpiresAt; got == nil || time.Until(*got) < 47*time.Hour {
+		t.Errorf("duration expiry = %v", got)
+	}
+	if got := records[2].ExpiresAt; got == nil || !got.Equal(defaultExpiry) {
+		t.Errorf("default expiry = %v, want %v", got, defaultExpiry)
+	}
+}
+
+func TestParseIPImportDuplicatesKeepLongestExpiry(t *testing.T) {
+	body := `[
+		{"ip_address": "192.0.2.1", "expires_at": "1h"},
+		{"ip_address": "192.0.2.1", "expires_at": "72h"},
+		{"ip_address": "192.0.2.2", "expires_at": "1h"},
+		{"ip_address": "192.0.2.2"}
+	]`
+	records, report, err := ParseIPImport(IPFormatJSON, strings.NewReader(body), IPImportOptions{})
+	if err != nil {
+		t.Fatalf("ParseIPImport: %v", err)
+	}
+	if report.Duplicates != 2 || len(records) != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	if got := records[0].ExpiresAt; got == nil || time.Until(*got) < 71*time.Hour {
+		t.Errorf("192.0.2.1 expiry = %v, want the 72h copy", got)
+	}
+	if records[1].ExpiresAt != nil {
+		t.Errorf("192.0.2.2 expiry = %v, want permanent", records[1].ExpiresAt)
+	}
+}
+
+func TestIPExportRoundTrip(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	mask := 24
+	records := []IPImportRecord{
+		{IPAddress: "192.0.2.1", Description: "scanner"},
+		{IPAddress: "198.51.100.0", CIDRMask: &mask, ExpiresAt: &expiresAt},
+	}
+
+	for _, format := range []string{IPFormatCSV, IPFormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteIPExport(&buf, format, records); err != nil {
+				t.Fatalf("WriteIPExport: %v", err)
+			}
+			parsed, _, err := ParseIPImport(format, &buf, IPImportOptions{})
+			if err != nil {
+				t.Fatalf("ParseIPImport: %v", err)
+			}
+			if got, want := importKeys(parsed), importKeys(records); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("records = %q, want %q", got, want)
+			}
+			if len(parsed) == 2 && (parsed[1].ExpiresAt == nil || !parsed[1].ExpiresAt.Equal(expiresAt)) {
+				t.Errorf("expiry = %v, want %v", parsed[1].ExpiresAt, expiresAt)
+			}
+		})
+	}
+}
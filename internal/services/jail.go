@@ -0,0 +1,445 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+var jailLog = logging.Component("jail")
+
+// Offence reasons recorded by the WAF middleware
+const (
+	OffenceHTTPFlood   = "http_flood"
+	OffenceRateLimit   = "rate_limit"
+	OffenceAttack      = "attack"
+	OffenceNotFoundHit = "not_found_scan"
+	OffenceConnLimit   = "connection_limit"
+	OffenceSlowClient  = "slow_client"
+	OffenceManual      = "manual"
+)
+
+const (
+	jailBansKey        = "jail:bans"
+	defaultOffenceMax  = 10
+	defaultOffenceTTL  = 600
+	defaultEscalateTTL = 7 * 24 * 60 * 60
+	banHistoryTimeout  = 5 * time.Second
+)
+
+// ErrBanNotFound is returned when an IP is not currently banned
+var ErrBanNotFound = errors.New("ban not found")
+
+// Ban represents an active temporary ban
+type Ban struct {
+	IP               string    `json:"ip"`
+	Reason           string    `json:"reason"`
+	Level            int       `json:"level"`
+	Offences         int       `json:"offences"`
+	BannedAt         time.Time `json:"banned_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RemainingSeconds int       `json:"remaining_seconds"`
+}
+
+// JailService accumulates offences per IP and bans repeat offenders for
+// escalating durations. All state lives in Redis with TTLs so bans expire on
+// their own and are shared by every WAF instance. While Redis is degraded
+// the per-request ban check and offence counting are skipped (fail open).
+// Issued bans are also recorded in the ban_history table for reports.
+type JailService struct {
+	redis           *redis.Client
+	health          RedisHealth
+	db              *sqlx.DB
+	enabled         bool
+	threshold       int
+	window          time.Duration
+	durations       []time.Duration
+	escalationReset time.Duration
+}
+
+// NewJailService creates a jail from the WAF configuration. The first ban level
+// defaults to the HTTP flood block duration.
+func NewJailService(redisClient *redis.Client, health RedisHealth, db *sqlx.DB, cfg config.WAFConfig) *JailService {
+	s := &JailService{
+		redis:           redisClient,
+		health:          health,
+		db:              db,
+		enabled:         cfg.Jail.Enabled,
+		threshold:       cfg.Jail.OffenceThreshold,
+		window:          time.Duration(cfg.Jail.OffenceWindow) * time.Second,
+		escalationReset: time.Duration(cfg.Jail.EscalationReset) * time.Second,
+	}
+
+	if s.threshold <= 0 {
+		s.threshold = defaultOffenceMax
+	}
+	if s.window <= 0 {
+		s.window = defaultOffenceTTL * time.Second
+	}
+	if s.escalationReset <= 0 {
+		s.escalationReset = defaultEscalateTTL * time.Second
+	}
+
+	for _, seconds := range cfg.Jail.BanDurations {
+		if seconds > 0 {
+			s.durations = append(s.durations, time.Duration(seconds)*time.Second)
+		}
+	}
+	if len(s.durations) == 0 {
+		first := cfg.HTTPFlood.BlockDuration
+		if first <= 0 {
+			first = 300
+		}
+		s.durations = []time.Duration{time.Duration(first) * time.Second, time.Hour, 24 * time.Hour}
+	}
+
+	return s
+}
+
+// Enabled reports whether offences are being tracked
+func (s *JailService) Enabled() bool {
+	return s != nil && s.enabled
+}
+
+// OffenceWeight returns how much a single offence of the given kind counts
+// towards the threshold. A flood trips the jail immediately.
+func (s *JailService) OffenceWeight(reason string) int {
+	switch reason {
+	case OffenceHTTPFlood:
+		return s.threshold
+	case OffenceAttack, OffenceSlowClient:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// RecordOffence adds an offence for the IP and bans it once the weighted
+// offence count within the window reaches the threshold. It returns the ban
+// when one was issued.
+func (s *JailService) RecordOffence(ip, reason string) (*Ban, error) {
+	if !s.Enabled() || redisDegraded(s.health) {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RedisRequestTimeout)
+	defer cancel()
+
+	// Already banned IPs do not accumulate further offences
+	exists, err := s.redis.Exists(ctx, banKey(ip)).Result()
+	if err != nil {
+		reportRedisError(s.health, err)
+		return nil, err
+	}
+	if exists > 0 {
+		return nil, nil
+	}
+
+	key := offenceKey(ip)
+	pipe := s.redis.Pipeline()
+	countCmd := pipe.IncrBy(ctx, key, int64(s.OffenceWeight(reason)))
+	pipe.ExpireNX(ctx, key, s.window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		reportRedisError(s.health, err)
+		return nil, err
+	}
+
+	count := int(countCmd.Val())
+	if count < s.threshold {
+		return nil, nil
+	}
+
+	// Offences recorded concurrently can all cross the threshold; only the
+	// first one bans
+	ban, err := s.ban(ctx, ip, reason, count, false)
+	if err != nil {
+		reportRedisError(s.health, err)
+	}
+	return ban, err
+}
+
+// BanIP bans an IP manually at its next escalation level, replacing a ban
+// that is already in force
+func (s *JailService) BanIP(ip, reason string) (*Ban, error) {
+	if reason == "" {
+		reason = OffenceManual
+	}
+	return s.ban(context.Background(), ip, reason, 0, true)
+}
+
+// banScript escalates the level and writes the ban in one step, so offences
+// that cross the threshold at the same time raise the level only once.
+// Unless ARGV[5] is "1" it does nothing and returns 0 while a ban is in
+// force.
+//
+// KEYS: ban hash, level counter, offence counter, ban index
+// ARGV: ip, reason, offences, banned_at, replace, escalation reset seconds,
+// ban durations in seconds
+var banScript = redis.NewScript(`
+if ARGV[5] ~= "1" and redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local level = redis.call("INCR", KEYS[2])
+redis.call("EXPIRE", KEYS[2], ARGV[6])
+local levels = #ARGV - 6
+local duration = tonumber(ARGV[6 + math.min(level, levels)])
+local expires = tonumber(ARGV[4]) + duration
+redis.call("DEL", KEYS[1], KEYS[3])
+redis.call("HSET", KEYS[1], "reason", ARGV[2], "level", level, "offences", ARGV[3],
+	"banned_at", ARGV[4], "expires_at", expires)
+redis.call("EXPIRE", KEYS[1], duration)
+redis.call("ZADD", KEYS[4], expires, ARGV[1])
+return level
+`)
+
+// ban issues a ban at the IP's next escalation level. Without replace it
+// returns nil when the IP is already banned.
+func (s *JailService) ban(ctx context.Context, ip, reason string, offences int, replace bool) (*Ban, error) {
+	now := time.Now()
+	args := []interface{}{ip, reason, offences, now.Unix(), replace, int64(s.escalationReset.Seconds())}
+	for _, duration := range s.durations {
+		args = append(args, int64(duration.Seconds()))
+	}
+	level, err := banScript.Run(ctx, s.redis,
+		[]string{banKey(ip), levelKey(ip), offenceKey(ip), jailBansKey}, args...).Int()
+	if err != nil {
+		return nil, err
+	}
+	if level == 0 {
+		return nil, nil
+	}
+
+	duration := s.durations[min(level, len(s.durations))-1]
+	bannedAt := time.Unix(now.Unix(), 0)
+	ban := &Ban{
+		IP:               ip,
+		Reason:           reason,
+		Level:            level,
+		Offences:         offences,
+		BannedAt:         bannedAt,
+		ExpiresAt:        bannedAt.Add(duration),
+		RemainingSeconds: int(duration.Seconds()),
+	}
+
+	// Off the request path; the ban is in force whether or not it is recorded
+	go s.recordBan(*ban)
+
+	return ban, nil
+}
+
+// recordBan adds an issued ban to the ban history
+func (s *JailService) recordBan(ban Ban) {
+	if s.db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), banHistoryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO ban_history (ip, reason, level, offences, banned_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, ban.IP, ban.Reason, ban.Level, ban.Offences, ban.BannedAt, ban.ExpiresAt)
+	if err != nil {
+		jailLog.Error("Failed to record ban history", "ip", ban.IP, "error", err)
+	}
+}
+
+// GetBan returns the active ban for an IP, or ErrBanNotFound
+func (s *JailService) GetBan(ip string) (*Ban, error) {
+	return s.getBan(context.Background(), ip)
+}
+
+func (s *JailService) getBan(ctx context.Context, ip string) (*Ban, error) {
+	fields, err := s.redis.HGetAll(ctx, banKey(ip)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrBanNotFound
+	}
+
+	ttl, err := s.redis.TTL(ctx, banKey(ip)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return banFromFields(ip, fields, ttl), nil
+}
+
+// banFromFields builds a ban from its Redis hash and remaining TTL
+func banFromFields(ip string, fields map[string]string, ttl time.Duration) *Ban {
+	level, _ := strconv.Atoi(fields["level"])
+	offences, _ := strconv.Atoi(fields["offences"])
+	bannedAt, _ := strconv.ParseInt(fields["banned_at"], 10, 64)
+	expiresAt, _ := strconv.ParseInt(fields["expires_at"], 10, 64)
+
+	return &Ban{
+		IP:               ip,
+		Reason:           fields["reason"],
+		Level:            level,
+		Offences:         offences,
+		BannedAt:         time.Unix(bannedAt, 0),
+		ExpiresAt:        time.Unix(expiresAt, 0),
+		RemainingSeconds: int(ttl.Seconds()),
+	}
+}
+
+// IsBanned is the hot-path check used by the WAF middleware. Bans are not
+// enforced while Redis is degraded.
+func (s *JailService) IsBanned(ip string) (*Ban, bool) {
+	if s == nil || redisDegraded(s.health) {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RedisRequestTimeout)
+	defer cancel()
+
+	ban, err := s.getBan(ctx, ip)
+	if err != nil {
+		if !errors.Is(err, ErrBanNotFound) {
+			reportRedisError(s.health, err)
+		}
+		return nil, false
+	}
+	return ban, true
+}
+
+// ListBans returns all active bans, soonest expiry first
+func (s *JailService) ListBans() ([]Ban, error) {
+	ctx := context.Background()
+
+	// Drop index entries whose ban key has already expired
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := s.redis.ZRemRangeByScore(ctx, jailBansKey, "-inf", "("+now).Err(); err != nil {
+		return nil, err
+	}
+
+	ips, err := s.redis.ZRange(ctx, jailBansKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return []Ban{}, nil
+	}
+
+	// One round trip for all bans instead of two per IP
+	pipe := s.redis.Pipeline()
+	fieldCmds := make([]*redis.MapStringStringCmd, len(ips))
+	ttlCmds := make([]*redis.DurationCmd, len(ips))
+	for i, ip := range ips {
+		fieldCmds[i] = pipe.HGetAll(ctx, banKey(ip))
+		ttlCmds[i] = pipe.TTL(ctx, banKey(ip))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	bans := make([]Ban, 0, len(ips))
+	var lifted []interface{}
+	for i, ip := range ips {
+		fields := fieldCmds[i].Val()
+		if len(fields) == 0 {
+			// Lifted or expired between the range and the lookup
+			lifted = append(lifted, ip)
+			continue
+		}
+		bans = append(bans, *banFromFields(ip, fields, ttlCmds[i].Val()))
+	}
+	if len(lifted) > 0 {
+		s.redis.ZRem(ctx, jailBansKey, lifted...)
+	}
+	return bans, nil
+}
+
+// CountBans returns the number of active bans
+func (s *JailService) CountBans() (int64, error) {
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	return s.redis.ZCount(ctx, jailBansKey, now, "+inf").Result()
+}
+
+// ExtendBan pushes the expiry of an active ban out by the given duration
+func (s *JailService) ExtendBan(ip string, by time.Duration) (*Ban, error) {
+	ban, err := s.GetBan(ip)
+	if err != nil {
+		return nil, err
+	}
+	if by <= 0 {
+		return nil, fmt.Errorf("extension must be positive")
+	}
+
+	ctx := context.Background()
+	expiresAt := ban.ExpiresAt.Add(by)
+	remaining := time.Until(expiresAt)
+
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, banKey(ip), "expires_at", expiresAt.Unix())
+	pipe.Expire(ctx, banKey(ip), remaining)
+	pipe.ZAdd(ctx, jailBansKey, redis.Z{Score: float64(expiresAt.Unix()), Member: ip})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	ban.ExpiresAt = expiresAt
+	ban.RemainingSeconds = int(remaining.Seconds())
+	s.extendBanHistory(*ban)
+	return ban, nil
+}
+
+// extendBanHistory moves the expiry of the ban's history row to match an
+// extension. Rows are matched by IP and the second the ban was issued, which
+// is all the Redis hash keeps.
+func (s *JailService) extendBanHistory(ban Ban) {
+	if s.db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), banHistoryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE ban_history SET expires_at = $1
+		WHERE ip = $2 AND date_trunc('second', banned_at) = $3
+	`, ban.ExpiresAt, ban.IP, ban.BannedAt)
+	if err != nil {
+		jailLog.Error("Failed to update ban history", "ip", ban.IP, "error", err)
+	}
+}
+
+// LiftBan removes an active ban. The escalation level is reset as well so a
+// lifted IP starts again at the first ban duration.
+func (s *JailService) LiftBan(ip string) error {
+	ctx := context.Background()
+
+	exists, err := s.redis.Exists(ctx, banKey(ip)).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrBanNotFound
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.Del(ctx, banKey(ip), levelKey(ip), offenceKey(ip))
+	pipe.ZRem(ctx, jailBansKey, ip)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func banKey(ip string) string {
+	return fmt.Sprintf("jail:ban:%s", ip)
+}
+
+func levelKey(ip string) string {
+	return fmt.Sprintf("jail:level:%s", ip)
+}
+
+func offenceKey(ip string) string {
+	return fmt.Sprintf("jail:offences:%s", ip)
+}
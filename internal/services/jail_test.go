@@ -0,0 +1,111 @@
+package services
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// testJail returns a jail backed by an in-process Redis
+func testJail(t *testing.T) (*JailService, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	jail := NewJailService(client, nil, nil, config.WAFConfig{
+		Jail: config.JailConfig{
+			Enabled:          true,
+			OffenceThreshold: 5,
+			BanDurations:     []int{300, 3600, 86400},
+		},
+	})
+	return jail, mr
+}
+
+func TestJailConcurrentOffencesBanOnce(t *testing.T) {
+	jail, mr := testJail(t)
+
+	// Every one of these crosses the threshold on its own
+	const offences = 50
+	var wg sync.WaitGroup
+	bans := make(chan *Ban, offences)
+	for range offences {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ban, err := jail.RecordOffence("192.0.2.1", OffenceHTTPFlood)
+			if err != nil {
+				t.Errorf("RecordOffence: %v", err)
+			}
+			if ban != nil {
+				bans <- ban
+			}
+		}()
+	}
+	wg.Wait()
+	close(bans)
+
+	issued := 0
+	for ban := range bans {
+		issued++
+		if ban.Level != 1 || ban.RemainingSeconds != 300 {
+			t.Errorf("ban = %+v, want level 1 for 300s", ban)
+		}
+	}
+	if issued != 1 {
+		t.Errorf("%d bans issued, want 1", issued)
+	}
+	if level, _ := mr.Get(levelKey("192.0.2.1")); level != "1" {
+		t.Errorf("escalation level = %s, want 1", level)
+	}
+
+	ban, err := jail.GetBan("192.0.2.1")
+	if err != nil || ban.Level != 1 || ban.Reason != OffenceHTTPFlood {
+		t.Errorf("GetBan = %+v, %v", ban, err)
+	}
+}
+
+func TestJailEscalation(t *testing.T) {
+	jail, mr := testJail(t)
+	ip := "192.0.2.2"
+
+	for i, want := range []time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour, 24 * time.Hour} {
+		ban, err := jail.RecordOffence(ip, OffenceHTTPFlood)
+		if err != nil || ban == nil {
+			t.Fatalf("offence %d: ban = %v, err = %v", i, ban, err)
+		}
+		if ban.Level != i+1 || ban.ExpiresAt.Sub(ban.BannedAt) != want {
+			t.Errorf("offence %d: level %d for %s, want level %d for %s", i, ban.Level, ban.ExpiresAt.Sub(ban.BannedAt), i+1, want)
+		}
+		if ttl := mr.TTL(banKey(ip)); ttl != want {
+			t.Errorf("offence %d: ban TTL = %s, want %s", i, ttl, want)
+		}
+		mr.Del(banKey(ip))
+	}
+}
+
+func TestJailManualBanReplacesActiveBan(t *testing.T) {
+	jail, _ := testJail(t)
+	ip := "192.0.2.3"
+
+	if _, err := jail.RecordOffence(ip, OffenceHTTPFlood); err != nil {
+		t.Fatal(err)
+	}
+	if ban, err := jail.RecordOffence(ip, OffenceHTTPFlood); err != nil || ban != nil {
+		t.Errorf("an offence during a ban should not ban again: %+v, %v", ban, err)
+	}
+
+	ban, err := jail.BanIP(ip, "")
+	if err != nil || ban.Level != 2 || ban.Reason != OffenceManual {
+		t.Fatalf("BanIP = %+v, %v; want level 2", ban, err)
+	}
+	bans, err := jail.ListBans()
+	if err != nil || len(bans) != 1 || bans[0].Level != 2 {
+		t.Errorf("ListBans = %+v, %v", bans, err)
+	}
+}
@@ -0,0 +1,345 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/redis/go-redis/v9"
+)
+
+var limiterLog = logging.Component("limiter")
+
+const (
+	localLimiterShards       = 64
+	localLimiterShardEntries = 4096
+	limiterProbeInterval     = 5 * time.Second
+)
+
+// RedisRequestTimeout bounds every Redis call made while serving a request,
+// so a slow Redis delays requests by at most this much before the caller
+// gives up and Redis is marked unavailable
+const RedisRequestTimeout = 500 * time.Millisecond
+
+// RedisHealth is the Redis availability tracked by the FallbackLimiter.
+// Per-request Redis users skip their calls while it is degraded and report
+// failures so one timeout switches every user to its fallback.
+type RedisHealth interface {
+	Degraded() bool
+	ReportError(err error)
+}
+
+// redisDegraded reports whether per-request Redis calls should be skipped
+func redisDegraded(health RedisHealth) bool {
+	return health != nil && health.Degraded()
+}
+
+// reportRedisError passes a failed per-request Redis call on to health
+func reportRedisError(health RedisHealth, err error) {
+	if health != nil {
+		health.ReportError(err)
+	}
+}
+
+// LimiterBackend stores the windowed request counters used by the rate
+// limiter and HTTP flood protection
+type LimiterBackend interface {
+	// Count returns the current count for key and the time until it resets
+	Count(key string) (int64, time.Duration, error)
+	// Increment adds one to key and (re)starts its window
+	Increment(key string, window time.Duration) (int64, error)
+}
+
+// RedisLimiter keeps counters in Redis so limits are shared by all WAF nodes
+type RedisLimiter struct {
+	redis *redis.Client
+}
+
+// NewRedisLimiter creates a Redis-backed limiter
+func NewRedisLimiter(redisClient *redis.Client) *RedisLimiter {
+	return &RedisLimiter{redis: redisClient}
+}
+
+// Count returns the current count and TTL of key
+func (l *RedisLimiter) Count(key string) (int64, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisRequestTimeout)
+	defer cancel()
+
+	pipe := l.redis.Pipeline()
+	getCmd := pipe.Get(ctx, key)
+	ttlCmd := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+
+	count, err := getCmd.Int64()
+	if err == redis.Nil {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, ttlCmd.Val(), nil
+}
+
+// Increment adds one to key and resets its expiry to window
+func (l *RedisLimiter) Increment(key string, window time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisRequestTimeout)
+	defer cancel()
+
+	pipe := l.redis.Pipeline()
+	incrCmd := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incrCmd.Val(), nil
+}
+
+// LocalLimiter keeps counters in process memory, split over sharded LRUs so
+// a flood of distinct client IPs cannot grow it without bound
+type LocalLimiter struct {
+	shards [localLimiterShards]*limiterShard
+}
+
+type limiterShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type limiterEntry struct {
+	key       string
+	count     int64
+	expiresAt time.Time
+}
+
+// NewLocalLimiter creates an in-memory limiter
+func NewLocalLimiter() *LocalLimiter {
+	l := &LocalLimiter{}
+	for i := range l.shards {
+		l.shards[i] = &limiterShard{
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+		}
+	}
+	return l
+}
+
+func (l *LocalLimiter) shard(key string) *limiterShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return l.shards[h.Sum32()%localLimiterShards]
+}
+
+// Count returns the current count and TTL of key
+func (l *LocalLimiter) Count(key string) (int64, time.Duration, error) {
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return 0, 0, nil
+	}
+	entry := elem.Value.(*limiterEntry)
+	ttl := time.Until(entry.expiresAt)
+	if ttl <= 0 {
+		s.lru.Remove(elem)
+		delete(s.entries, key)
+		return 0, 0, nil
+	}
+	return entry.count, ttl, nil
+}
+
+// Increment adds one to key and resets its expiry to window
+func (l *LocalLimiter) Increment(key string, window time.Duration) (int64, error) {
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*limiterEntry)
+		if now.After(entry.expiresAt) {
+			entry.count = 0
+		}
+		entry.count++
+		entry.expiresAt = now.Add(window)
+		s.lru.MoveToFront(elem)
+		return entry.count, nil
+	}
+
+	if s.lru.Len() >= localLimiterShardEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*limiterEntry).key)
+	}
+
+	entry := &limiterEntry{key: key, count: 1, expiresAt: now.Add(window)}
+	s.entries[key] = s.lru.PushFront(entry)
+	return 1, nil
+}
+
+// drain removes and returns all unexpired counters
+func (l *LocalLimiter) drain() []limiterEntry {
+	now := time.Now()
+	var entries []limiterEntry
+	for _, s := range l.shards {
+		s.mu.Lock()
+		for _, elem := range s.entries {
+			entry := elem.Value.(*limiterEntry)
+			if entry.expiresAt.After(now) {
+				entries = append(entries, *entry)
+			}
+		}
+		s.entries = make(map[string]*list.Element)
+		s.lru.Init()
+		s.mu.Unlock()
+	}
+	return entries
+}
+
+// FallbackLimiter uses Redis while it is reachable and degrades to per-node
+// in-memory counters when it is not. Once Redis answers again the local
+// counters are merged back so clients do not get a fresh allowance.
+type FallbackLimiter struct {
+	redisClient *redis.Client
+	primary     *RedisLimiter
+	local       *LocalLimiter
+
+	degraded      atomic.Bool
+	degradedSince atomic.Int64
+	probing       atomic.Bool
+}
+
+// NewFallbackLimiter creates a limiter that prefers Redis. It starts in
+// degraded mode if Redis is not reachable yet.
+func NewFallbackLimiter(redisClient *redis.Client) *FallbackLimiter {
+	l := &FallbackLimiter{
+		redisClient: redisClient,
+		primary:     NewRedisLimiter(redisClient),
+		local:       NewLocalLimiter(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RedisRequestTimeout)
+	defer cancel()
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		l.markDegraded(err)
+	}
+	return l
+}
+
+// Count returns the current count and TTL of key from the active backend
+func (l *FallbackLimiter) Count(key string) (int64, time.Duration, error) {
+	if !l.degraded.Load() {
+		count, ttl, err := l.primary.Count(key)
+		if err == nil {
+			return count, ttl, nil
+		}
+		l.markDegraded(err)
+	}
+	return l.local.Count(key)
+}
+
+// Increment adds one to key on the active backend
+func (l *FallbackLimiter) Increment(key string, window time.Duration) (int64, error) {
+	if !l.degraded.Load() {
+		count, err := l.primary.Increment(key, window)
+		if err == nil {
+			return count, nil
+		}
+		l.markDegraded(err)
+	}
+	return l.local.Increment(key, window)
+}
+
+// Degraded reports whether limits are currently enforced per node only
+func (l *FallbackLimiter) Degraded() bool {
+	return l.degraded.Load()
+}
+
+// ReportError switches to degraded mode after a Redis call made outside the
+// limiter failed. Missing keys and callers that gave up are not failures.
+func (l *FallbackLimiter) ReportError(err error) {
+	if err == nil || errors.Is(err, redis.Nil) || errors.Is(err, context.Canceled) {
+		return
+	}
+	l.markDegraded(err)
+}
+
+// Status describes the limiter backend for health output
+func (l *FallbackLimiter) Status() map[string]interface{} {
+	if !l.degraded.Load() {
+		return map[string]interface{}{"backend": "redis", "degraded": false}
+	}
+	return map[string]interface{}{
+		"backend":        "local",
+		"degraded":       true,
+		"degraded_since": time.Unix(l.degradedSince.Load(), 0),
+	}
+}
+
+func (l *FallbackLimiter) markDegraded(err error) {
+	if l.degraded.CompareAndSwap(false, true) {
+		l.degradedSince.Store(time.Now().Unix())
+		limiterLog.Warn("Redis unavailable, falling back to per-node limiting", "error", err)
+	}
+	if l.probing.CompareAndSwap(false, true) {
+		go l.probe()
+	}
+}
+
+// probe waits for Redis to come back, merges the local counters into it and
+// switches back to the shared backend
+func (l *FallbackLimiter) probe() {
+	ticker := time.NewTicker(limiterProbeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), RedisRequestTimeout)
+		err := l.redisClient.Ping(ctx).Err()
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		// Switch back first so new hits go to Redis, then merge what was
+		// counted locally during the outage. A failure right after this
+		// starts a new probe.
+		l.probing.Store(false)
+		l.degraded.Store(false)
+		merged := l.reconcile()
+		limiterLog.Info("Redis available again, merged local counters", "counters", merged)
+		return
+	}
+}
+
+func (l *FallbackLimiter) reconcile() int {
+	entries := l.local.drain()
+	if len(entries) == 0 {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pipe := l.redisClient.Pipeline()
+	for _, entry := range entries {
+		ttl := time.Until(entry.expiresAt)
+		if ttl <= 0 {
+			continue
+		}
+		pipe.IncrBy(ctx, entry.key, entry.count)
+		pipe.PExpire(ctx, entry.key, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		limiterLog.Error("Failed to merge local counters into Redis", "error", err)
+	}
+	return len(entries)
+}
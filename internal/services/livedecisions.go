@@ -0,0 +1,107 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDecisionBuffer      = 256
+	defaultDecisionSubscribers = 50
+)
+
+// ErrTooManySubscribers is returned when the live decision stream is at its
+// subscriber limit
+var ErrTooManySubscribers = errors.New("too many live stream clients")
+
+// LiveDecision is one WAF decision as published to live stream clients
+type LiveDecision struct {
+	Timestamp    time.Time `json:"timestamp"`
+	RequestID    string    `json:"request_id,omitempty"`
+	ClientIP     string    `json:"client_ip"`
+	Host         string    `json:"host"`
+	Method       string    `json:"method"`
+	URL          string    `json:"url"`
+	StatusCode   int       `json:"status_code"`
+	ResponseTime int       `json:"response_time"`
+	UserAgent    string    `json:"user_agent"`
+	Decision     string    `json:"decision"`
+	BlockSource  string    `json:"block_source,omitempty"`
+	BlockReason  string    `json:"block_reason,omitempty"`
+	AttackType   string    `json:"attack_type,omitempty"`
+}
+
+// DecisionStream fans WAF decisions out to live stream clients straight from
+// the middleware. Each subscriber has a bounded buffer; when a slow client
+// lets it fill up, further decisions are dropped for that client only and
+// counted, so publishing never blocks a request.
+type DecisionStream struct {
+	mu          sync.RWMutex
+	subscribers map[*DecisionSubscription]struct{}
+	count       atomic.Int32
+	maxClients  int
+	bufferSize  int
+}
+
+// DecisionSubscription is one live stream client
+type DecisionSubscription struct {
+	C       chan *LiveDecision
+	dropped atomic.Uint64
+}
+
+// Dropped returns and resets the number of decisions dropped since the last
+// call because the client fell behind
+func (s *DecisionSubscription) Dropped() uint64 {
+	return s.dropped.Swap(0)
+}
+
+// NewDecisionStream creates an empty stream
+func NewDecisionStream() *DecisionStream {
+	return &DecisionStream{
+		subscribers: make(map[*DecisionSubscription]struct{}),
+		maxClients:  defaultDecisionSubscribers,
+		bufferSize:  defaultDecisionBuffer,
+	}
+}
+
+// Active reports whether anyone is listening, so the middleware can skip
+// building events nobody reads
+func (s *DecisionStream) Active() bool {
+	return s.count.Load() > 0
+}
+
+// Publish hands a decision to every subscriber without blocking
+func (s *DecisionStream) Publish(decision *LiveDecision) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for sub := range s.subscribers {
+		select {
+		case sub.C <- decision:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe registers a client. Call Unsubscribe when it goes away.
+func (s *DecisionStream) Subscribe() (*DecisionSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subscribers) >= s.maxClients {
+		return nil, ErrTooManySubscribers
+	}
+	sub := &DecisionSubscription{C: make(chan *LiveDecision, s.bufferSize)}
+	s.subscribers[sub] = struct{}{}
+	s.count.Store(int32(len(s.subscribers)))
+	return sub, nil
+}
+
+// Unsubscribe removes a client
+func (s *DecisionStream) Unsubscribe(sub *DecisionSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, sub)
+	s.count.Store(int32(len(s.subscribers)))
+}
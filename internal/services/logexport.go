@@ -0,0 +1,583 @@
+package services
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/jmoiron/sqlx"
+)
+
+var logExportLog = logging.Component("log_export")
+
+// Export sources and formats
+const (
+	ExportSourceTraffic = "traffic"
+	ExportSourceAttacks = "attacks"
+	ExportFormatCSV     = "csv"
+	ExportFormatNDJSON  = "ndjson"
+)
+
+// Export job states
+const (
+	ExportJobPending   = "pending"
+	ExportJobRunning   = "running"
+	ExportJobCompleted = "completed"
+	ExportJobFailed    = "failed"
+)
+
+const (
+	defaultExportDir        = "/app/data/exports"
+	defaultExportWorkers    = 1
+	defaultExportRetention  = 24 * time.Hour
+	defaultExportJobTimeout = time.Hour
+	exportFetchSize         = 1000
+	exportPollInterval      = 5 * time.Second
+	exportTimeFormat        = "2006-01-02T15:04:05.999999"
+)
+
+var (
+	ErrUnsupportedExport = errors.New("source must be traffic or attacks and format csv or ndjson")
+	ErrExportJobNotFound = errors.New("export job not found")
+)
+
+// exportTables lists the table and columns exported for each source
+var exportTables = map[string]struct {
+	table   string
+	columns string
+}{
+	ExportSourceTraffic: {"traffic_logs", "id, timestamp, client_ip, method, url, status_code, response_time, bytes_sent, " +
+		"user_agent, blocked, block_reason, country_code, is_attack, attack_type, host, asn, as_org, city, subdivision, trace_id, request_id, decision, block_source, log_source, referer"},
+	ExportSourceAttacks: {"attack_logs", "id, timestamp, client_ip, attack_type, severity, description, blocked, rule_id"},
+}
+
+// LogExport describes one extract: a source, a format, a search query in the
+// language of ParseLogQuery (or ParseAttackLogQuery for attacks) and an
+// optional [From, To) window
+type LogExport struct {
+	Source string
+	Format string
+	Query  string
+	From   time.Time
+	To     time.Time
+}
+
+// Filter validates the export and compiles its query
+func (e LogExport) Filter() (*LogFilter, error) {
+	if _, ok := exportTables[e.Source]; !ok || (e.Format != ExportFormatCSV && e.Format != ExportFormatNDJSON) {
+		return nil, ErrUnsupportedExport
+	}
+
+	var filter *LogFilter
+	var err error
+	if e.Source == ExportSourceAttacks {
+		filter, err = ParseAttackLogQuery(e.Query)
+	} else {
+		filter, err = ParseLogQuery(e.Query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return filter.Between(e.From, e.To), nil
+}
+
+// exportFlusher is implemented by writers that buffer, like http.Flusher
+type exportFlusher interface {
+	Flush()
+}
+
+// ExportLogs writes every row matching the export to w, oldest first, and
+// returns how many were written. Rows are read through a server-side cursor
+// in batches, so memory use does not grow with the size of the export; when
+// w can be flushed it is flushed after each batch.
+func ExportLogs(ctx context.Context, db *sqlx.DB, w io.Writer, export LogExport) (int64, error) {
+	filter, err := export.Filter()
+	if err != nil {
+		return 0, err
+	}
+	source := exportTables[export.Source]
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DECLARE log_export NO SCROLL CURSOR FOR SELECT "+source.columns+
+		" FROM "+source.table+filter.SQL()+" ORDER BY timestamp, id", filter.Args()...)
+	if err != nil {
+		return 0, err
+	}
+
+	var out exportWriter
+	if export.Format == ExportFormatCSV {
+		out = &csvExportWriter{w: csv.NewWriter(w)}
+	} else {
+		out = &ndjsonExportWriter{enc: json.NewEncoder(w)}
+	}
+
+	var written int64
+	for {
+		rows, err := tx.QueryxContext(ctx, fmt.Sprintf("FETCH %d FROM log_export", exportFetchSize))
+		if err != nil {
+			return written, err
+		}
+
+		fetched := 0
+		for rows.Next() {
+			if written == 0 && fetched == 0 {
+				columns, _ := rows.Columns()
+				if err := out.header(columns); err != nil {
+					rows.Close()
+					return written, err
+				}
+			}
+			values, err := rows.SliceScan()
+			if err != nil {
+				rows.Close()
+				return written, err
+			}
+			if err := out.row(values); err != nil {
+				rows.Close()
+				return written, err
+			}
+			fetched++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return written, err
+		}
+		written += int64(fetched)
+
+		if err := out.flush(); err != nil {
+			return written, err
+		}
+		if f, ok := w.(exportFlusher); ok {
+			f.Flush()
+		}
+		if fetched < exportFetchSize {
+			break
+		}
+	}
+
+	// An empty CSV export still gets its header
+	if written == 0 && export.Format == ExportFormatCSV {
+		if err := out.header(strings.Split(strings.ReplaceAll(source.columns, " ", ""), ",")); err != nil {
+			return 0, err
+		}
+		return 0, out.flush()
+	}
+	return written, nil
+}
+
+type exportWriter interface {
+	header(columns []string) error
+	row(values []interface{}) error
+	flush() error
+}
+
+type csvExportWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func (c *csvExportWriter) header(columns []string) error {
+	c.record = make([]string, len(columns))
+	return c.w.Write(columns)
+}
+
+func (c *csvExportWriter) row(values []interface{}) error {
+	for i, v := range values {
+		switch v := exportValue(v).(type) {
+		case nil:
+			c.record[i] = ""
+		case string:
+			// Keep spreadsheets from evaluating logged input as formulas
+			if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+				v = "'" + v
+			}
+			c.record[i] = v
+		default:
+			c.record[i] = fmt.Sprint(v)
+		}
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvExportWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	enc     *json.Encoder
+	columns []string
+}
+
+func (n *ndjsonExportWriter) header(columns []string) error {
+	n.columns = columns
+	return nil
+}
+
+func (n *ndjsonExportWriter) row(values []interface{}) error {
+	record := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		record[n.columns[i]] = exportValue(v)
+	}
+	return n.enc.Encode(record)
+}
+
+func (n *ndjsonExportWriter) flush() error {
+	return nil
+}
+
+// exportValue converts a scanned column to a plain value. Timestamps are
+// stored without a zone, so they are written without one.
+func exportValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(exportTimeFormat)
+	}
+	return v
+}
+
+// LogExportJob is an export written to a file in the background
+type LogExportJob struct {
+	ID          string     `db:"id" json:"id"`
+	Source      string     `db:"source" json:"source"`
+	Format      string     `db:"format" json:"format"`
+	Gzip        bool       `db:"gzip" json:"gzip"`
+	Query       string     `db:"query" json:"query"`
+	RangeStart  *time.Time `db:"range_start" json:"range_start"`
+	RangeEnd    *time.Time `db:"range_end" json:"range_end"`
+	Status      string     `db:"status" json:"status"`
+	Rows        int64      `db:"rows_exported" json:"rows_exported"`
+	Size        int64      `db:"size_bytes" json:"size_bytes"`
+	FilePath    *string    `db:"file_path" json:"-"`
+	Error       *string    `db:"error" json:"error,omitempty"`
+	NodeID      *string    `db:"node_id" json:"node_id,omitempty"`
+	CreatedBy   *string    `db:"created_by" json:"created_by,omitempty"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	StartedAt   *time.Time `db:"started_at" json:"started_at,omitempty"`
+	CompletedAt *time.Time `db:"completed_at" json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+}
+
+// Filename is the name the export is downloaded as
+func (j *LogExportJob) Filename() string {
+	name := fmt.Sprintf("%s-logs-%s.%s", j.Source, j.CreatedAt.Format("20060102-150405"), j.Format)
+	if j.Gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// Export returns the job's export description
+func (j *LogExportJob) Export() LogExport {
+	export := LogExport{Source: j.Source, Format: j.Format, Query: j.Query}
+	if j.RangeStart != nil {
+		export.From = wallClock(*j.RangeStart)
+	}
+	if j.RangeEnd != nil {
+		export.To = wallClock(*j.RangeEnd)
+	}
+	return export
+}
+
+// LogExportService runs export jobs. Jobs are queued in Postgres and claimed
+// with SKIP LOCKED, so any replica can run them; the file is written to the
+// claiming node's export directory, which should be shared between replicas
+// for downloads to work from any of them.
+type LogExportService struct {
+	db        *sqlx.DB
+	cfg       config.ExportConfig
+	nodeID    string
+	startedAt time.Time
+	wake      chan struct{}
+}
+
+// NewLogExportService creates the service and fills in config defaults
+func NewLogExportService(db *sqlx.DB, cfg config.ExportConfig, nodeID string) *LogExportService {
+	if cfg.Dir == "" {
+		cfg.Dir = defaultExportDir
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultExportWorkers
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = defaultExportRetention
+	}
+	if cfg.JobTimeout <= 0 {
+		cfg.JobTimeout = defaultExportJobTimeout
+	}
+
+	return &LogExportService{
+		db:        db,
+		cfg:       cfg,
+		nodeID:    nodeID,
+		startedAt: time.Now(),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Submit validates an export and queues it as a job
+func (s *LogExportService) Submit(export LogExport, compress bool, createdBy string) (*LogExportJob, error) {
+	if _, err := export.Filter(); err != nil {
+		return nil, err
+	}
+
+	var job LogExportJob
+	err := s.db.Get(&job, `
+		INSERT INTO log_export_jobs (source, format, gzip, query, range_start, range_end, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		RETURNING *
+	`, export.Source, export.Format, compress, export.Query, nullTime(export.From), nullTime(export.To), createdBy)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return &job, nil
+}
+
+// Get returns one job
+func (s *LogExportService) Get(id string) (*LogExportJob, error) {
+	var job LogExportJob
+	err := s.db.Get(&job, `SELECT * FROM log_export_jobs WHERE id = $1`, id)
+	if err == sql.ErrNoRows {
+		return nil, ErrExportJobNotFound
+	}
+	return &job, err
+}
+
+// List returns the most recent jobs, newest first
+func (s *LogExportService) List(limit int) ([]LogExportJob, error) {
+	jobs := []LogExportJob{}
+	err := s.db.Select(&jobs, `SELECT * FROM log_export_jobs ORDER BY created_at DESC LIMIT $1`, limit)
+	return jobs, err
+}
+
+// Delete removes a job and its file. A running job is finished by its worker
+// but its file is discarded.
+func (s *LogExportService) Delete(id string) error {
+	var path sql.NullString
+	err := s.db.Get(&path, `DELETE FROM log_export_jobs WHERE id = $1 RETURNING file_path`, id)
+	if err == sql.ErrNoRows {
+		return ErrExportJobNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if path.Valid {
+		os.Remove(path.String)
+	}
+	return nil
+}
+
+// Run processes jobs and removes expired ones until ctx is done
+func (s *LogExportService) Run(ctx context.Context) {
+	if err := os.MkdirAll(s.cfg.Dir, 0o750); err != nil {
+		logExportLog.Error("Cannot create export directory", "dir", s.cfg.Dir, "error", err)
+		return
+	}
+	s.failStale(ctx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx)
+		}()
+	}
+
+	ticker := time.NewTicker(10 * exportPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+			s.failStale(ctx)
+			s.cleanup(ctx)
+		}
+	}
+}
+
+func (s *LogExportService) worker(ctx context.Context) {
+	ticker := time.NewTicker(exportPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			job, err := s.claim(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logExportLog.Error("Failed to claim job", "error", err)
+				}
+				break
+			}
+			if job == nil {
+				break
+			}
+			s.process(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim takes the oldest pending job, or returns nil when there is none
+func (s *LogExportService) claim(ctx context.Context) (*LogExportJob, error) {
+	var job LogExportJob
+	err := s.db.GetContext(ctx, &job, `
+		UPDATE log_export_jobs SET status = $1, node_id = $2, started_at = NOW()
+		WHERE id = (
+			SELECT id FROM log_export_jobs WHERE status = $3
+			ORDER BY created_at FOR UPDATE SKIP LOCKED LIMIT 1
+		)
+		RETURNING *
+	`, ExportJobRunning, s.nodeID, ExportJobPending)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *LogExportService) process(ctx context.Context, job *LogExportJob) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.JobTimeout)
+	defer cancel()
+
+	path := filepath.Join(s.cfg.Dir, job.ID+"."+job.Format)
+	if job.Gzip {
+		path += ".gz"
+	}
+	rows, size, err := s.writeFile(ctx, job, path)
+	if err != nil {
+		os.Remove(path)
+		logExportLog.Error("Job failed", "job_id", job.ID, "error", err)
+		s.db.Exec(`UPDATE log_export_jobs SET status = $1, error = $2, completed_at = NOW(), expires_at = $3 WHERE id = $4`,
+			ExportJobFailed, err.Error(), time.Now().Add(s.cfg.Retention), job.ID)
+		return
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE log_export_jobs
+		SET status = $1, rows_exported = $2, size_bytes = $3, file_path = $4, completed_at = NOW(), expires_at = $5
+		WHERE id = $6
+	`, ExportJobCompleted, rows, size, path, time.Now().Add(s.cfg.Retention), job.ID)
+	if err != nil {
+		os.Remove(path)
+		logExportLog.Error("Failed to complete job", "job_id", job.ID, "error", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Deleted while running
+		os.Remove(path)
+		return
+	}
+	logExportLog.Info("Job finished", "job_id", job.ID, "rows", rows, "source", job.Source, "bytes", size)
+}
+
+// writeFile exports into a temporary file that is renamed into place once
+// complete, so a partial export is never downloaded
+func (s *LogExportService) writeFile(ctx context.Context, job *LogExportJob, path string) (int64, int64, error) {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	var w io.Writer = file
+	var gz *gzip.Writer
+	if job.Gzip {
+		gz = gzip.NewWriter(file)
+		w = gz
+	}
+
+	rows, err := ExportLogs(ctx, s.db, w, job.Export())
+	if err != nil {
+		return rows, 0, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return rows, 0, err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return rows, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return rows, 0, err
+	}
+	if err := file.Close(); err != nil {
+		return rows, 0, err
+	}
+	return rows, info.Size(), os.Rename(tmp, path)
+}
+
+// failStale marks jobs as failed when they have been running longer than the
+// job timeout or were started on this node before it restarted
+func (s *LogExportService) failStale(ctx context.Context) {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE log_export_jobs SET status = $1, error = 'interrupted', completed_at = NOW(), expires_at = $2
+		WHERE status = $3 AND (started_at < $4 OR (node_id = $5 AND started_at < $6))
+	`, ExportJobFailed, time.Now().Add(s.cfg.Retention), ExportJobRunning,
+		time.Now().Add(-s.cfg.JobTimeout-time.Minute), s.nodeID, s.startedAt)
+	if err != nil && ctx.Err() == nil {
+		logExportLog.Error("Failed to expire stale jobs", "error", err)
+	}
+}
+
+// cleanup removes expired jobs and their files
+func (s *LogExportService) cleanup(ctx context.Context) {
+	var paths []sql.NullString
+	err := s.db.SelectContext(ctx, &paths, `DELETE FROM log_export_jobs WHERE expires_at < NOW() RETURNING file_path`)
+	if err != nil {
+		if ctx.Err() == nil {
+			logExportLog.Error("Failed to remove expired jobs", "error", err)
+		}
+		return
+	}
+	for _, path := range paths {
+		if path.Valid {
+			os.Remove(path.String)
+		}
+	}
+}
+
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
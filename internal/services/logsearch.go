@@ -0,0 +1,514 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultLogSearchLimit = 100
+	maxLogSearchLimit     = 1000
+	logCursorTimeFormat   = "2006-01-02 15:04:05.999999"
+)
+
+// Kinds of searchable traffic log fields
+const (
+	logFieldText = iota
+	logFieldUpper
+	logFieldInt
+	logFieldIP
+	logFieldFlag
+)
+
+type logField struct {
+	column string
+	kind   int
+}
+
+// logSchema is what queries can match in one log table: fields, the values
+// of is: and the column bare words are a substring of
+type logSchema struct {
+	fields map[string]logField
+	flags  map[string]string
+	text   string
+}
+
+var trafficLogSchema = logSchema{fields: trafficLogFields, flags: trafficLogFlags, text: "url"}
+
+var attackLogSchema = logSchema{
+	fields: map[string]logField{
+		"ip":       {"client_ip", logFieldIP},
+		"attack":   {"attack_type", logFieldText},
+		"severity": {"severity", logFieldText},
+		"desc":     {"description", logFieldText},
+		"is":       {"", logFieldFlag},
+	},
+	flags: map[string]string{
+		"blocked": "blocked = true",
+		"allowed": "blocked IS NOT TRUE",
+	},
+	text: "description",
+}
+
+// trafficLogFields are the field names accepted in traffic log queries
+var trafficLogFields = map[string]logField{
+	"host":    {"host", logFieldText},
+	"ip":      {"client_ip", logFieldIP},
+	"status":  {"status_code", logFieldInt},
+	"method":  {"method", logFieldUpper},
+	"url":     {"url", logFieldText},
+	"ua":      {"user_agent", logFieldText},
+	"ref":     {"referer", logFieldText},
+	"country": {"country_code", logFieldUpper},
+	"region":  {"subdivision", logFieldUpper},
+	"city":    {"city", logFieldText},
+	"asn":     {"asn", logFieldInt},
+	"org":     {"as_org", logFieldText},
+	"attack":  {"attack_type", logFieldText},
+	"reason":  {"block_reason", logFieldText},
+	"rt":      {"response_time", logFieldInt},
+	"bytes":   {"bytes_sent", logFieldInt},
+	"trace":   {"trace_id", logFieldText},
+	"request": {"request_id", logFieldText},
+	"source":  {"block_source", logFieldText},
+	"via":     {"log_source", logFieldText},
+	"is":      {"", logFieldFlag},
+}
+
+// trafficLogFlags are the values of is: in traffic log queries
+var trafficLogFlags = map[string]string{
+	"attack":  "is_attack = true",
+	"blocked": "blocked = true",
+	"allowed": "blocked IS NOT TRUE",
+}
+
+// logSortColumns maps sort names to the expression rows are ordered by
+var logSortColumns = map[string]string{
+	"timestamp":     "timestamp",
+	"status":        "COALESCE(status_code, 0)",
+	"response_time": "COALESCE(response_time, 0)",
+	"bytes_sent":    "COALESCE(bytes_sent, 0)",
+}
+
+var (
+	intComparisonRe = regexp.MustCompile(`^(>=|<=|!=|>|<|=)?(-?\d+)$`)
+	statusClassRe   = regexp.MustCompile(`^([1-5])xx$`)
+	uuidRe          = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// LogQueryError is returned for queries that do not parse
+type LogQueryError struct {
+	Term   string
+	Reason string
+}
+
+func (e *LogQueryError) Error() string {
+	return fmt.Sprintf("invalid search term %q: %s", e.Term, e.Reason)
+}
+
+// LogFilter is a parameterised WHERE clause over traffic_logs. Conditions are
+// ANDed; every value is passed as an argument, never spliced into the SQL.
+type LogFilter struct {
+	conds []string
+	args  []interface{}
+}
+
+// ParseLogQuery compiles a search query into a filter. A query is a list of
+// space-separated terms that must all match:
+//
+//	host:shop.example.com status:>=500 ip:10.0.0.0/8 country:RU,CN
+//	attack:"SQL Injection" ua:~curl url:/admin* -method:GET is:blocked
+//
+// Text fields match exactly, ~value matches a substring and * is a wildcard.
+// Numeric fields take =, !=, >, >=, < and <=, and status also takes 5xx. ip
+// takes an address or a CIDR range. Comma-separated values match any of them,
+// a leading - negates a term and a bare word is a substring of the URL.
+func ParseLogQuery(query string) (*LogFilter, error) {
+	return parseLogQuery(query, trafficLogSchema)
+}
+
+// ParseAttackLogQuery compiles a query over attack_logs, which has the fields
+// ip, attack, severity and desc and the flags is:blocked and is:allowed. Bare
+// words match the description.
+func ParseAttackLogQuery(query string) (*LogFilter, error) {
+	return parseLogQuery(query, attackLogSchema)
+}
+
+func parseLogQuery(query string, schema logSchema) (*LogFilter, error) {
+	filter := &LogFilter{}
+	terms, err := splitLogQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, term := range terms {
+		negate := false
+		raw := term
+		if strings.HasPrefix(term, "-") && len(term) > 1 {
+			negate = true
+			term = term[1:]
+		}
+
+		name, value, hasField := strings.Cut(term, ":")
+		var cond string
+		if !hasField {
+			cond = fmt.Sprintf("%s ILIKE %s", schema.text, filter.arg("%"+escapeLike(unquote(term))+"%"))
+		} else {
+			field, ok := schema.fields[strings.ToLower(name)]
+			if !ok {
+				return nil, &LogQueryError{Term: raw, Reason: "unknown field " + name}
+			}
+			if value == "" {
+				return nil, &LogQueryError{Term: raw, Reason: "missing value"}
+			}
+			cond, err = filter.compileTerm(field, schema.flags, value)
+			if err != nil {
+				return nil, &LogQueryError{Term: raw, Reason: err.Error()}
+			}
+		}
+
+		if negate {
+			// NULL columns count as not matching, so they pass a negated term
+			cond = "(" + cond + ") IS NOT TRUE"
+		}
+		filter.conds = append(filter.conds, cond)
+	}
+	return filter, nil
+}
+
+// Where adds a condition with its own placeholders written as ?, which are
+// renumbered to follow the filter's arguments
+func (f *LogFilter) Where(cond string, args ...interface{}) *LogFilter {
+	for _, arg := range args {
+		cond = strings.Replace(cond, "?", f.arg(arg), 1)
+	}
+	f.conds = append(f.conds, cond)
+	return f
+}
+
+// Between limits the filter to [from, to); zero times leave that side open
+func (f *LogFilter) Between(from, to time.Time) *LogFilter {
+	if !from.IsZero() {
+		f.Where("timestamp >= ?", from)
+	}
+	if !to.IsZero() {
+		f.Where("timestamp < ?", to)
+	}
+	return f
+}
+
+// SQL returns the WHERE clause, empty when there are no conditions
+func (f *LogFilter) SQL() string {
+	if len(f.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.conds, " AND ")
+}
+
+// Args returns the placeholder values in order
+func (f *LogFilter) Args() []interface{} {
+	return f.args
+}
+
+func (f *LogFilter) arg(value interface{}) string {
+	f.args = append(f.args, value)
+	return "$" + strconv.Itoa(len(f.args))
+}
+
+func (f *LogFilter) compileTerm(field logField, flags map[string]string, value string) (string, error) {
+	if field.kind == logFieldFlag {
+		cond, ok := flags[strings.ToLower(value)]
+		if !ok {
+			names := make([]string, 0, len(flags))
+			for name := range flags {
+				names = append(names, "is:"+name)
+			}
+			sort.Strings(names)
+			return "", fmt.Errorf("expected one of %s", strings.Join(names, ", "))
+		}
+		return cond, nil
+	}
+
+	// A quoted value is taken whole, commas and spaces included
+	values := strings.Split(value, ",")
+	if quoted := strings.TrimPrefix(value, "~"); strings.HasPrefix(quoted, `"`) {
+		values = []string{strings.TrimSuffix(value, quoted) + unquote(quoted)}
+	}
+
+	conds := make([]string, 0, len(values))
+	for _, v := range values {
+		if v == "" {
+			return "", fmt.Errorf("empty value")
+		}
+		cond, err := f.compileValue(field, v)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, cond)
+	}
+	if len(conds) == 1 {
+		return conds[0], nil
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", nil
+}
+
+func (f *LogFilter) compileValue(field logField, value string) (string, error) {
+	switch field.kind {
+	case logFieldInt:
+		if m := statusClassRe.FindStringSubmatch(value); m != nil && field.column == "status_code" {
+			class, _ := strconv.Atoi(m[1])
+			return fmt.Sprintf("%s BETWEEN %s AND %s", field.column, f.arg(class*100), f.arg(class*100+99)), nil
+		}
+		m := intComparisonRe.FindStringSubmatch(value)
+		if m == nil {
+			return "", fmt.Errorf("expected a number, optionally prefixed with =, !=, >, >=, < or <=")
+		}
+		op := m[1]
+		if op == "" {
+			op = "="
+		}
+		n, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s", field.column, op, f.arg(n)), nil
+
+	case logFieldIP:
+		if strings.Contains(value, "/") {
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return "", fmt.Errorf("invalid CIDR range")
+			}
+			return fmt.Sprintf("%s::inet <<= %s::inet", field.column, f.arg(network.String())), nil
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", fmt.Errorf("invalid IP address")
+		}
+		return fmt.Sprintf("%s = %s", field.column, f.arg(ip.String())), nil
+	}
+
+	if field.kind == logFieldUpper {
+		value = strings.ToUpper(value)
+	}
+	if contains, ok := strings.CutPrefix(value, "~"); ok {
+		return fmt.Sprintf("%s ILIKE %s", field.column, f.arg("%"+escapeLike(contains)+"%")), nil
+	}
+	if strings.Contains(value, "*") {
+		pattern := strings.ReplaceAll(escapeLike(value), "*", "%")
+		return fmt.Sprintf("%s ILIKE %s", field.column, f.arg(pattern)), nil
+	}
+	return fmt.Sprintf("%s = %s", field.column, f.arg(value)), nil
+}
+
+// splitLogQuery splits on whitespace outside double quotes
+func splitLogQuery(query string) ([]string, error) {
+	var terms []string
+	var current strings.Builder
+	quoted := false
+
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if current.Len() > 0 {
+				terms = append(terms, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, &LogQueryError{Term: current.String(), Reason: "unterminated quote"}
+	}
+	if current.Len() > 0 {
+		terms = append(terms, current.String())
+	}
+	return terms, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// TrafficLogRow is one traffic log as returned by searches
+type TrafficLogRow struct {
+	ID           string    `db:"id" json:"id"`
+	Timestamp    time.Time `db:"timestamp" json:"timestamp"`
+	ClientIP     string    `db:"client_ip" json:"client_ip"`
+	Method       string    `db:"method" json:"method"`
+	URL          string    `db:"url" json:"url"`
+	StatusCode   int       `db:"status_code" json:"status_code"`
+	ResponseTime int       `db:"response_time" json:"response_time"`
+	BytesSent    int64     `db:"bytes_sent" json:"bytes_sent"`
+	UserAgent    string    `db:"user_agent" json:"user_agent"`
+	Blocked      bool      `db:"blocked" json:"blocked"`
+	BlockReason  *string   `db:"block_reason" json:"block_reason"`
+	CountryCode  *string   `db:"country_code" json:"country_code"`
+	IsAttack     bool      `db:"is_attack" json:"is_attack"`
+	AttackType   *string   `db:"attack_type" json:"attack_type"`
+	Host         string    `db:"host" json:"host"`
+	ASN          *int64    `db:"asn" json:"asn"`
+	ASOrg        *string   `db:"as_org" json:"as_org"`
+	City         *string   `db:"city" json:"city"`
+	Subdivision  *string   `db:"subdivision" json:"subdivision"`
+	TraceID      *string   `db:"trace_id" json:"trace_id"`
+	RequestID    *string   `db:"request_id" json:"request_id"`
+	Decision     *string   `db:"decision" json:"decision"`
+	BlockSource  *string   `db:"block_source" json:"block_source"`
+	LogSource    string    `db:"log_source" json:"log_source"`
+	Referer      *string   `db:"referer" json:"referer"`
+}
+
+// trafficLogRowColumns selects a TrafficLogRow
+const trafficLogRowColumns = `id, timestamp, client_ip, COALESCE(method, '') AS method, COALESCE(url, '') AS url,
+		       COALESCE(status_code, 0) AS status_code, COALESCE(response_time, 0) AS response_time,
+		       COALESCE(bytes_sent, 0) AS bytes_sent, COALESCE(user_agent, '') AS user_agent,
+		       COALESCE(blocked, false) AS blocked, block_reason, country_code,
+		       COALESCE(is_attack, false) AS is_attack, attack_type, COALESCE(host, '') AS host,
+		       asn, as_org, city, subdivision, trace_id, request_id, decision, block_source, log_source, referer`
+
+// LogSearch is a page request against traffic_logs. Sort is one of
+// timestamp (default), status, response_time or bytes_sent; Cursor is the
+// NextCursor of the previous page.
+type LogSearch struct {
+	Filter    *LogFilter
+	Sort      string
+	Ascending bool
+	Cursor    string
+	Limit     int
+}
+
+// LogSearchResult is one page of search results
+type LogSearchResult struct {
+	Logs       []TrafficLogRow `json:"logs"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// logCursor is the position after the last row of a page: its sort value
+// and id, which breaks ties
+type logCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// SearchTrafficLogs returns one page of logs matching the search. Pages are
+// keyset-paginated on (sort value, id), so they stay stable while new logs
+// arrive and cost the same however deep the caller pages.
+func SearchTrafficLogs(ctx context.Context, db *sqlx.DB, search LogSearch) (*LogSearchResult, error) {
+	if search.Sort == "" {
+		search.Sort = "timestamp"
+	}
+	sortExpr, ok := logSortColumns[search.Sort]
+	if !ok {
+		return nil, &LogQueryError{Term: search.Sort, Reason: "unknown sort field"}
+	}
+	if search.Limit <= 0 {
+		search.Limit = defaultLogSearchLimit
+	}
+	search.Limit = min(search.Limit, maxLogSearchLimit)
+
+	// Copy the filter so the caller's can be reused
+	filter := &LogFilter{}
+	if search.Filter != nil {
+		filter.conds = append(filter.conds, search.Filter.conds...)
+		filter.args = append(filter.args, search.Filter.args...)
+	}
+
+	direction, comparison, cast := "DESC", "<", "::bigint"
+	if search.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+	if search.Sort == "timestamp" {
+		cast = "::timestamp"
+	}
+
+	if search.Cursor != "" {
+		cursor, err := decodeLogCursor(search.Cursor)
+		if err != nil || !cursor.valid(search.Sort) {
+			return nil, &LogQueryError{Term: search.Cursor, Reason: "invalid cursor"}
+		}
+		filter.Where(fmt.Sprintf("(%s, id) %s (?%s, ?::uuid)", sortExpr, comparison, cast), cursor.Value, cursor.ID)
+	}
+
+	query := `
+		SELECT ` + trafficLogRowColumns + `
+		FROM traffic_logs` + filter.SQL() + `
+		ORDER BY ` + sortExpr + ` ` + direction + `, id ` + direction + `
+		LIMIT ` + strconv.Itoa(search.Limit+1)
+
+	logs := []TrafficLogRow{}
+	if err := db.SelectContext(ctx, &logs, query, filter.Args()...); err != nil {
+		return nil, err
+	}
+
+	result := &LogSearchResult{Logs: logs}
+	if len(logs) > search.Limit {
+		result.Logs = logs[:search.Limit]
+		last := result.Logs[search.Limit-1]
+		result.NextCursor = encodeLogCursor(logCursor{Sort: search.Sort, Value: logSortValue(last, search.Sort), ID: last.ID})
+	}
+	return result, nil
+}
+
+func logSortValue(row TrafficLogRow, sortBy string) string {
+	switch sortBy {
+	case "status":
+		return strconv.Itoa(row.StatusCode)
+	case "response_time":
+		return strconv.Itoa(row.ResponseTime)
+	case "bytes_sent":
+		return strconv.FormatInt(row.BytesSent, 10)
+	default:
+		return row.Timestamp.Format(logCursorTimeFormat)
+	}
+}
+
+// valid checks a decoded cursor before its values reach SQL casts
+func (c logCursor) valid(sortBy string) bool {
+	if c.Sort != sortBy || !uuidRe.MatchString(c.ID) {
+		return false
+	}
+	if sortBy == "timestamp" {
+		_, err := time.Parse(logCursorTimeFormat, c.Value)
+		return err == nil
+	}
+	_, err := strconv.ParseInt(c.Value, 10, 64)
+	return err == nil
+}
+
+func encodeLogCursor(cursor logCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeLogCursor(s string) (logCursor, error) {
+	var cursor logCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
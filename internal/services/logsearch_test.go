@@ -0,0 +1,139 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseLogQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		sql   string
+		args  []interface{}
+	}{
+		{"", "", nil},
+		{"host:shop.example.com", " WHERE host = $1", []interface{}{"shop.example.com"}},
+		{"status:>=500 method:post", " WHERE status_code >= $1 AND method = $2", []interface{}{int64(500), "POST"}},
+		{"status:4xx", " WHERE status_code BETWEEN $1 AND $2", []interface{}{400, 499}},
+		{"ip:10.0.0.0/8", " WHERE client_ip::inet <<= $1::inet", []interface{}{"10.0.0.0/8"}},
+		{"ip:192.0.2.1", " WHERE client_ip = $1", []interface{}{"192.0.2.1"}},
+		{"country:ru,cn", " WHERE (country_code = $1 OR country_code = $2)", []interface{}{"RU", "CN"}},
+		{`attack:"SQL Injection"`, " WHERE attack_type = $1", []interface{}{"SQL Injection"}},
+		{"ua:~curl", " WHERE user_agent ILIKE $1", []interface{}{"%curl%"}},
+		{"url:/admin*", " WHERE url ILIKE $1", []interface{}{"/admin%"}},
+		{"-method:GET", " WHERE (method = $1) IS NOT TRUE", []interface{}{"GET"}},
+		{"is:blocked", " WHERE blocked = true", nil},
+		{"100%_off", " WHERE url ILIKE $1", []interface{}{`%100\%\_off%`}},
+		{"via:nginx asn:13335", " WHERE log_source = $1 AND asn = $2", []interface{}{"nginx", int64(13335)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			filter, err := ParseLogQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseLogQuery: %v", err)
+			}
+			if got := filter.SQL(); got != tt.sql {
+				t.Errorf("SQL = %q, want %q", got, tt.sql)
+			}
+			if got, want := fmt.Sprint(filter.Args()), fmt.Sprint(tt.args); got != want {
+				t.Errorf("args = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseLogQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		"color:red",
+		"host:",
+		"status:abc",
+		"ip:10.0.0.0/99",
+		"ip:not-an-ip",
+		"is:fast",
+		"country:US,,CN",
+		`attack:"SQL`,
+	} {
+		_, err := ParseLogQuery(query)
+		var queryErr *LogQueryError
+		if !errors.As(err, &queryErr) {
+			t.Errorf("ParseLogQuery(%q) error = %v, want a LogQueryError", query, err)
+		}
+	}
+}
+
+func TestLogFilterWhere(t *testing.T) {
+	filter, err := ParseLogQuery("status:404")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	filter.Where("host = ?", "a.example.com").Between(from, time.Time{})
+
+	want := " WHERE status_code = $1 AND host = $2 AND timestamp >= $3"
+	if got := filter.SQL(); got != want {
+		t.Errorf("SQL = %q, want %q", got, want)
+	}
+	if n := len(filter.Args()); n != 3 {
+		t.Errorf("got %d args, want 3", n)
+	}
+}
+
+func TestLogCursorRoundTrip(t *testing.T) {
+	row := TrafficLogRow{
+		ID:         "6f1c2f7e-3b7a-4d53-9a55-0c7b6f1e2d3c",
+		Timestamp:  time.Date(2024, 5, 1, 12, 30, 15, 123456000, time.UTC),
+		StatusCode: 502,
+		BytesSent:  1 << 40,
+	}
+
+	for _, sortBy := range []string{"timestamp", "status", "response_time", "bytes_sent"} {
+		t.Run(sortBy, func(t *testing.T) {
+			encoded := encodeLogCursor(logCursor{Sort: sortBy, Value: logSortValue(row, sortBy), ID: row.ID})
+			cursor, err := decodeLogCursor(encoded)
+			if err != nil {
+				t.Fatalf("decodeLogCursor: %v", err)
+			}
+			if cursor.ID != row.ID || cursor.Value != logSortValue(row, sortBy) {
+				t.Errorf("cursor = %+v", cursor)
+			}
+			if !cursor.valid(sortBy) {
+				t.Error("a cursor from the same sort should be valid")
+			}
+			other := "status"
+			if sortBy == "status" {
+				other = "timestamp"
+			}
+			if cursor.valid(other) {
+				t.Errorf("a %s cursor should not be valid for sort %s", sortBy, other)
+			}
+		})
+	}
+
+	if got := logSortValue(row, "timestamp"); got != "2024-05-01 12:30:15.123456" {
+		t.Errorf("timestamp cursor value = %q", got)
+	}
+}
+
+func TestLogCursorRejectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("nope"))},
+		{"sql in id", encodeLogCursor(logCursor{Sort: "status", Value: "500", ID: "1'; DROP TABLE traffic_logs; --"})},
+		{"sql in value", encodeLogCursor(logCursor{Sort: "status", Value: "500 OR 1=1", ID: "6f1c2f7e-3b7a-4d53-9a55-0c7b6f1e2d3c"})},
+		{"bad timestamp", encodeLogCursor(logCursor{Sort: "timestamp", Value: "yesterday", ID: "6f1c2f7e-3b7a-4d53-9a55-0c7b6f1e2d3c"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := decodeLogCursor(tt.cursor)
+			if err == nil && cursor.valid(cursor.Sort) {
+				t.Errorf("cursor %+v was accepted", cursor)
+			}
+		})
+	}
+}
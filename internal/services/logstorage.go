@@ -0,0 +1,499 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var logStorageLog = logging.Component("log_storage")
+
+const (
+	defaultLogPartitionsAhead           = 3
+	defaultLogRetention                 = 30 * 24 * time.Hour
+	defaultMinuteRollupRetention        = 7 * 24 * time.Hour
+	defaultHourRollupRetention          = 400 * 24 * time.Hour
+	defaultLogMaintenanceInterval       = time.Hour
+	defaultLogRollupInterval            = time.Minute
+	defaultLogRollupLateness            = 2 * time.Minute
+	logRollupChunk                      = 6 * time.Hour
+	logPartitionTimeFormat              = "2006-01-02 15:04:05"
+	logMaintenanceLockID          int64 = 0x77616601
+	logRollupLockID               int64 = 0x77616602
+)
+
+// partitionBoundRe extracts the upper bound from pg_get_expr(relpartbound)
+var partitionBoundRe = regexp.MustCompile(`TO \('([^']+)'\)`)
+
+// logPartition is one partition of traffic_logs. End is zero for MAXVALUE.
+type logPartition struct {
+	Name string
+	End  time.Time
+}
+
+// LogStorageService keeps traffic_logs partitioned by time, enforces retention
+// and maintains the per-minute and per-hour rollups the dashboard reads. Each
+// job runs under a Postgres advisory lock so only one replica does the work.
+//
+// Timestamps are stored without a time zone in the WAF's local time, so
+// partition bounds and cutoffs are computed on the WAF side as well.
+type LogStorageService struct {
+	db     *sqlx.DB
+	cfg    config.LogStorageConfig
+	hourly bool
+}
+
+// NewLogStorageService creates the service and fills in config defaults
+func NewLogStorageService(db *sqlx.DB, cfg config.LogStorageConfig) *LogStorageService {
+	if cfg.PartitionsAhead <= 0 {
+		cfg.PartitionsAhead = defaultLogPartitionsAhead
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = defaultLogRetention
+	}
+	if cfg.MinuteRollupRetention <= 0 {
+		cfg.MinuteRollupRetention = defaultMinuteRollupRetention
+	}
+	if cfg.HourRollupRetention <= 0 {
+		cfg.HourRollupRetention = defaultHourRollupRetention
+	}
+	if cfg.MaintenanceInterval <= 0 {
+		cfg.MaintenanceInterval = defaultLogMaintenanceInterval
+	}
+	if cfg.RollupInterval <= 0 {
+		cfg.RollupInterval = defaultLogRollupInterval
+	}
+	if cfg.RollupLateness <= 0 {
+		cfg.RollupLateness = defaultLogRollupLateness
+	}
+
+	hourly := cfg.PartitionInterval == "hourly"
+	if !hourly && cfg.PartitionInterval != "" && cfg.PartitionInterval != "daily" {
+		logStorageLog.Warn("Unknown partition interval, using daily", "interval", cfg.PartitionInterval)
+	}
+
+	return &LogStorageService{db: db, cfg: cfg, hourly: hourly}
+}
+
+// Run creates partitions and computes rollups on startup, then on their
+// intervals until ctx is done
+func (s *LogStorageService) Run(ctx context.Context) {
+	s.Maintain(ctx)
+	s.Rollup(ctx)
+
+	maintenance := time.NewTicker(s.cfg.MaintenanceInterval)
+	defer maintenance.Stop()
+	rollup := time.NewTicker(s.cfg.RollupInterval)
+	defer rollup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-maintenance.C:
+			s.Maintain(ctx)
+		case <-rollup.C:
+			s.Rollup(ctx)
+		}
+	}
+}
+
+// Maintain creates upcoming partitions, drops or deletes logs past retention
+// and prunes old rollups
+func (s *LogStorageService) Maintain(ctx context.Context) {
+	s.withLock(ctx, logMaintenanceLockID, func(conn *sqlx.Conn) {
+		partitioned, err := s.isPartitioned(ctx, conn)
+		if err != nil {
+			logStorageLog.Error("Failed to inspect traffic_logs", "error", err)
+			return
+		}
+		if partitioned {
+			if err := s.ensurePartitions(ctx, conn); err != nil {
+				logStorageLog.Error("Failed to create partitions", "error", err)
+			}
+		}
+		if err := s.applyRetention(ctx, conn, partitioned); err != nil {
+			logStorageLog.Error("Failed to apply retention", "error", err)
+		}
+		if err := s.pruneRollups(ctx, conn); err != nil {
+			logStorageLog.Error("Failed to prune rollups", "error", err)
+		}
+	})
+}
+
+// Rollup aggregates new traffic into the rollup tables. A backlog, such as
+// the history present when rollups are first enabled, is worked through in
+// chunks.
+func (s *LogStorageService) Rollup(ctx context.Context) {
+	s.withLock(ctx, logRollupLockID, func(conn *sqlx.Conn) {
+		for ctx.Err() == nil {
+			caughtUp, err := s.rollupChunk(ctx, conn)
+			if err != nil {
+				logStorageLog.Error("Rollup failed", "error", err)
+				return
+			}
+			if caughtUp {
+				return
+			}
+		}
+	})
+}
+
+// withLock runs fn under a session advisory lock; see withAdvisoryLock
+func (s *LogStorageService) withLock(ctx context.Context, lockID int64, fn func(conn *sqlx.Conn)) {
+	if err := withAdvisoryLock(ctx, s.db, lockID, fn); err != nil {
+		logStorageLog.Error("Maintenance skipped", "error", err)
+	}
+}
+
+// withAdvisoryLock runs fn on a dedicated connection holding a session
+// advisory lock. When another replica holds the lock fn is skipped.
+func withAdvisoryLock(ctx context.Context, db *sqlx.DB, lockID int64, fn func(conn *sqlx.Conn)) error {
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.GetContext(ctx, &locked, "SELECT pg_try_advisory_lock($1)", lockID); err != nil {
+		return fmt.Errorf("failed to take lock: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID)
+
+	fn(conn)
+	return nil
+}
+
+func (s *LogStorageService) isPartitioned(ctx context.Context, conn *sqlx.Conn) (bool, error) {
+	var kind string
+	err := conn.GetContext(ctx, &kind, "SELECT relkind::text FROM pg_class WHERE oid = 'traffic_logs'::regclass")
+	return kind == "p", err
+}
+
+func (s *LogStorageService) partitions(ctx context.Context, conn *sqlx.Conn) ([]logPartition, error) {
+	var rows []struct {
+		Name  string `db:"name"`
+		Bound string `db:"bound"`
+	}
+	err := conn.SelectContext(ctx, &rows, `
+		SELECT c.relname AS name, pg_get_expr(c.relpartbound, c.oid) AS bound
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'traffic_logs'::regclass
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make([]logPartition, 0, len(rows))
+	for _, row := range rows {
+		partition := logPartition{Name: row.Name}
+		if m := partitionBoundRe.FindStringSubmatch(row.Bound); m != nil {
+			end, err := time.ParseInLocation(logPartitionTimeFormat, m[1], time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("partition %s: %w", row.Name, err)
+			}
+			partition.End = end
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions, nil
+}
+
+// ensurePartitions creates partitions from the end of the newest one (or the
+// current interval) until PartitionsAhead intervals past now
+func (s *LogStorageService) ensurePartitions(ctx context.Context, conn *sqlx.Conn) error {
+	partitions, err := s.partitions(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	start := s.truncate(now)
+	for _, partition := range partitions {
+		if partition.End.After(start) {
+			start = partition.End
+		}
+	}
+	horizon := s.next(s.truncate(now))
+	for i := 0; i < s.cfg.PartitionsAhead; i++ {
+		horizon = s.next(horizon)
+	}
+
+	for start.Before(horizon) {
+		// The first partition may be partial after the interval was changed
+		end := s.next(s.truncate(start))
+		name := "traffic_logs_p" + start.Format(s.nameFormat())
+		_, err := conn.ExecContext(ctx, fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s PARTITION OF traffic_logs FOR VALUES FROM ('%s') TO ('%s')",
+			pq.QuoteIdentifier(name), start.Format(logPartitionTimeFormat), end.Format(logPartitionTimeFormat)))
+		if err != nil {
+			return fmt.Errorf("partition %s: %w", name, err)
+		}
+		logStorageLog.Info("Created partition", "partition", name)
+		start = end
+	}
+	return nil
+}
+
+// applyRetention removes logs past retention. Partitions are dropped once all
+// of their rows are older than the longest retention; vhosts keeping their
+// logs for less than that have their rows deleted from the live partitions.
+func (s *LogStorageService) applyRetention(ctx context.Context, conn *sqlx.Conn, partitioned bool) error {
+	var vhosts []struct {
+		Domain string `db:"domain"`
+		Days   int    `db:"log_retention_days"`
+	}
+	if err := conn.SelectContext(ctx, &vhosts, `SELECT domain, log_retention_days FROM vhosts WHERE log_retention_days > 0`); err != nil {
+		return err
+	}
+
+	longest := s.cfg.Retention
+	custom := make([]string, 0, len(vhosts))
+	for _, vhost := range vhosts {
+		custom = append(custom, vhost.Domain)
+		longest = max(longest, time.Duration(vhost.Days)*24*time.Hour)
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-longest)
+	if partitioned {
+		partitions, err := s.partitions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, partition := range partitions {
+			if partition.End.IsZero() || partition.End.After(cutoff) {
+				continue
+			}
+			if _, err := conn.ExecContext(ctx, "DROP TABLE IF EXISTS "+pq.QuoteIdentifier(partition.Name)); err != nil {
+				return fmt.Errorf("drop partition %s: %w", partition.Name, err)
+			}
+			logStorageLog.Info("Dropped partition", "partition", partition.Name)
+		}
+	} else if err := s.deleteLogs(ctx, conn, "timestamp < $1", cutoff); err != nil {
+		return err
+	}
+
+	for _, vhost := range vhosts {
+		retention := time.Duration(vhost.Days) * 24 * time.Hour
+		if retention < longest {
+			if err := s.deleteLogs(ctx, conn, "host = $1 AND timestamp < $2", vhost.Domain, now.Add(-retention)); err != nil {
+				return err
+			}
+		}
+	}
+	if s.cfg.Retention < longest {
+		err := s.deleteLogs(ctx, conn, "(host IS NULL OR NOT host = ANY($1)) AND timestamp < $2",
+			pq.Array(custom), now.Add(-s.cfg.Retention))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LogStorageService) deleteLogs(ctx context.Context, conn *sqlx.Conn, where string, args ...interface{}) error {
+	result, err := conn.ExecContext(ctx, "DELETE FROM traffic_logs WHERE "+where, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		logStorageLog.Info("Deleted traffic logs past retention", "deleted", n)
+	}
+	return nil
+}
+
+// pruneRollups drops rollup rows past their retention. Distinct IPs and the
+// ban history are kept as long as the raw logs.
+func (s *LogStorageService) pruneRollups(ctx context.Context, conn *sqlx.Conn) error {
+	now := time.Now()
+	prunes := []struct {
+		table  string
+		column string
+		cutoff time.Time
+	}{
+		{"traffic_rollups_minute", "bucket", now.Add(-s.cfg.MinuteRollupRetention)},
+		{"traffic_rollups_hour", "bucket", now.Add(-s.cfg.HourRollupRetention)},
+		{"traffic_rollups_hour_ips", "bucket", now.Add(-s.cfg.Retention)},
+		{"ban_history", "banned_at", now.Add(-s.cfg.Retention)},
+	}
+	for _, prune := range prunes {
+		if _, err := conn.ExecContext(ctx, "DELETE FROM "+prune.table+" WHERE "+prune.column+" < $1", prune.cutoff); err != nil {
+			return fmt.Errorf("%s: %w", prune.table, err)
+		}
+	}
+	return nil
+}
+
+// rollupChunk aggregates the logs after the watermark, at most logRollupChunk
+// at a time. Minutes within RollupLateness of now are recomputed on every run
+// so rows written late by the traffic log pipeline are still counted; older
+// rows, such as ingested nginx logs, move the watermark back when they are
+// written. Each bucket is rebuilt from the raw logs, so recomputing it is
+// idempotent.
+func (s *LogStorageService) rollupChunk(ctx context.Context, conn *sqlx.Conn) (bool, error) {
+	end := truncateMinute(time.Now())
+
+	var watermark time.Time
+	err := conn.GetContext(ctx, &watermark, `SELECT watermark FROM traffic_rollup_state WHERE name = 'minute'`)
+	if err == sql.ErrNoRows {
+		// Start from the oldest log still worth an hourly rollup
+		var oldest sql.NullTime
+		err = conn.GetContext(ctx, &oldest, `SELECT MIN(timestamp) FROM traffic_logs WHERE timestamp >= $1`,
+			end.Add(-s.cfg.HourRollupRetention))
+		watermark = end
+		if oldest.Valid {
+			watermark = truncateHour(wallClock(oldest.Time))
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	watermark = wallClock(watermark)
+
+	from := watermark
+	if lateFrom := end.Add(-s.cfg.RollupLateness); lateFrom.Before(from) {
+		from = truncateMinute(lateFrom)
+	}
+	to := end
+	caughtUp := true
+	if to.Sub(from) > logRollupChunk {
+		to = from.Add(logRollupChunk)
+		caughtUp = false
+	}
+	if !to.After(from) {
+		return true, nil
+	}
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO traffic_rollups_minute
+			(bucket, host, country_code, status_code, attack_type, requests, blocked, attacks, bytes_sent, response_time_ms)
+		SELECT
+			date_trunc('minute', timestamp),
+			COALESCE(host, ''),
+			COALESCE(country_code, ''),
+			COALESCE(status_code, 0),
+			CASE WHEN is_attack THEN COALESCE(attack_type, '') ELSE '' END,
+			COUNT(*),
+			COUNT(*) FILTER (WHERE blocked),
+			COUNT(*) FILTER (WHERE is_attack),
+			COALESCE(SUM(bytes_sent), 0),
+			COALESCE(SUM(response_time), 0)
+		FROM traffic_logs
+		WHERE timestamp >= $1 AND timestamp < $2
+		GROUP BY 1, 2, 3, 4, 5
+		ON CONFLICT (bucket, host, country_code, status_code, attack_type) DO UPDATE SET
+			requests = EXCLUDED.requests,
+			blocked = EXCLUDED.blocked,
+			attacks = EXCLUDED.attacks,
+			bytes_sent = EXCLUDED.bytes_sent,
+			response_time_ms = EXCLUDED.response_time_ms
+	`, from, to)
+	if err != nil {
+		return false, fmt.Errorf("minute rollup: %w", err)
+	}
+
+	// Hours are rebuilt from their minutes
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO traffic_rollups_hour
+			(bucket, host, country_code, status_code, attack_type, requests, blocked, attacks, bytes_sent, response_time_ms)
+		SELECT
+			date_trunc('hour', bucket), host, country_code, status_code, attack_type,
+			SUM(requests), SUM(blocked), SUM(attacks), SUM(bytes_sent), SUM(response_time_ms)
+		FROM traffic_rollups_minute
+		WHERE bucket >= $1 AND bucket < $2
+		GROUP BY 1, 2, 3, 4, 5
+		ON CONFLICT (bucket, host, country_code, status_code, attack_type) DO UPDATE SET
+			requests = EXCLUDED.requests,
+			blocked = EXCLUDED.blocked,
+			attacks = EXCLUDED.attacks,
+			bytes_sent = EXCLUDED.bytes_sent,
+			response_time_ms = EXCLUDED.response_time_ms
+	`, truncateHour(from), truncateHour(to.Add(-time.Minute)).Add(time.Hour))
+	if err != nil {
+		return false, fmt.Errorf("hour rollup: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO traffic_rollups_hour_ips (bucket, host, client_ip)
+		SELECT DISTINCT date_trunc('hour', timestamp), COALESCE(host, ''), client_ip
+		FROM traffic_logs
+		WHERE timestamp >= $1 AND timestamp < $2
+		ON CONFLICT DO NOTHING
+	`, from, to)
+	if err != nil {
+		return false, fmt.Errorf("ip rollup: %w", err)
+	}
+
+	// A batch written behind the watermark since it was read has moved it
+	// back; keep that so the batch is rolled up on the next run
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO traffic_rollup_state (name, watermark, updated_at) VALUES ('minute', $1, NOW())
+		ON CONFLICT (name) DO UPDATE SET watermark = EXCLUDED.watermark, updated_at = EXCLUDED.updated_at
+		WHERE traffic_rollup_state.watermark = $2
+	`, to, watermark)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	if !caughtUp {
+		logStorageLog.Debug("Rolled up traffic", "until", to.Format(logPartitionTimeFormat))
+	}
+	return caughtUp, nil
+}
+
+func (s *LogStorageService) truncate(t time.Time) time.Time {
+	if s.hourly {
+		return truncateHour(t)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func (s *LogStorageService) next(t time.Time) time.Time {
+	if s.hourly {
+		return t.Add(time.Hour)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+func (s *LogStorageService) nameFormat() string {
+	if s.hourly {
+		return "2006010215"
+	}
+	return "20060102"
+}
+
+// wallClock reinterprets a TIMESTAMP read back from Postgres, which lib/pq
+// returns in UTC, as local time
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
+
+func truncateHour(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+func truncateMinute(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+}
@@ -0,0 +1,333 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TailPollInterval is how often a followed file should be polled
+	TailPollInterval = 500 * time.Millisecond
+	tailReadChunk    = 64 * 1024
+	// tailBacklogWindow is how far back from the end the initial lines are
+	// looked for
+	tailBacklogWindow = 1 << 20
+	// tailMaxLine bounds a line without a newline yet; longer ones are cut
+	tailMaxLine = 64 * 1024
+	// tailFingerprintBytes is how much of the first line identifies a file
+	tailFingerprintBytes = 512
+
+	// TailNoticeRotated and TailNoticeTruncated are reported when the followed
+	// file is replaced or shrinks
+	TailNoticeRotated   = "rotated"
+	TailNoticeTruncated = "truncated"
+)
+
+// TailEvent is one line appended to a followed file, or a notice that the
+// file was rotated or truncated
+type TailEvent struct {
+	Line   string
+	Notice string
+}
+
+// FileTail follows a log file by offset, like tail -F. Every byte appended
+// is reported exactly once as part of a line; a rotated file is read to its
+// end before the new one is opened, and a truncated file is read again from
+// the start.
+type FileTail struct {
+	path        string
+	file        *os.File
+	info        os.FileInfo
+	offset      int64
+	pending     []byte
+	fingerprint string
+}
+
+// TailPosition is where a FileTail stopped reading. The fingerprint
+// identifies the file by its first line, so a saved position is only resumed
+// in the file it was taken from.
+type TailPosition struct {
+	Offset      int64
+	Fingerprint string
+}
+
+// OpenFileTail opens path and returns its last backlog lines. Following
+// starts after the last complete line.
+func OpenFileTail(path string, backlog int) (*FileTail, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	t := &FileTail{path: path, file: file, info: info}
+	lines, err := t.lastLines(backlog)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return t, lines, nil
+}
+
+// ResumeFileTail opens path at a position returned by Position. If the file
+// was rotated or truncated since, it is followed from its beginning; a zero
+// position starts at its end.
+func ResumeFileTail(path string, pos TailPosition) (*FileTail, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	t := &FileTail{path: path, file: file, info: info}
+	if pos == (TailPosition{}) {
+		if _, err := t.lastLines(0); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return t, nil
+	}
+	if pos.Offset <= info.Size() && t.Position().Fingerprint == pos.Fingerprint {
+		t.offset = pos.Offset
+	}
+	return t, nil
+}
+
+// Position returns the offset of the first line not reported yet
+func (t *FileTail) Position() TailPosition {
+	if t.fingerprint == "" {
+		buf := make([]byte, tailFingerprintBytes)
+		n, _ := t.file.ReadAt(buf, 0)
+		// Until the first line is complete the file has nothing to resume
+		if idx := bytes.IndexByte(buf[:n], '\n'); idx >= 0 || n == len(buf) {
+			if idx >= 0 {
+				n = idx
+			}
+			sum := sha256.Sum256(buf[:n])
+			t.fingerprint = hex.EncodeToString(sum[:8])
+		}
+	}
+	return TailPosition{Offset: t.offset - int64(len(t.pending)), Fingerprint: t.fingerprint}
+}
+
+// lastLines reads up to n complete lines before the end of the file and
+// sets the offset just past the last of them
+func (t *FileTail) lastLines(n int) ([]string, error) {
+	size := t.info.Size()
+	start := size - tailBacklogWindow
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, size-start)
+	if _, err := t.file.ReadAt(buf, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// A trailing partial line is picked up once it is completed
+	end := bytes.LastIndexByte(buf, '\n')
+	t.offset = start + int64(end+1)
+	if end < 0 || n <= 0 {
+		return nil, nil
+	}
+
+	lines := strings.Split(string(buf[:end]), "\n")
+	if start > 0 {
+		// The window began mid-line
+		lines = lines[1:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// Close closes the followed file
+func (t *FileTail) Close() error {
+	return t.file.Close()
+}
+
+// Poll emits what was appended since the last call and switches files on
+// rotation or truncation. While the path is missing, e.g. between a rotation
+// and the new file being created, the old file keeps being followed. It
+// returns false as soon as emit does; the next call continues after the last
+// line emit accepted.
+func (t *FileTail) Poll(emit func(TailEvent) bool) bool {
+	if current, err := t.file.Stat(); err == nil && current.Size() < t.offset {
+		t.offset = 0
+		t.pending = nil
+		t.fingerprint = ""
+		if !emit(TailEvent{Notice: TailNoticeTruncated}) {
+			return false
+		}
+	}
+	if !t.readAppended(emit) {
+		return false
+	}
+
+	info, err := os.Stat(t.path)
+	if err != nil || os.SameFile(info, t.info) {
+		return true
+	}
+
+	file, err := os.Open(t.path)
+	if err != nil {
+		return true
+	}
+	// Whatever the old file got before it was rotated away
+	if !t.readAppended(emit) {
+		file.Close()
+		return false
+	}
+	if len(t.pending) > 0 {
+		if !emit(TailEvent{Line: string(t.pending)}) {
+			file.Close()
+			return false
+		}
+		t.pending = nil
+	}
+	t.file.Close()
+	t.file, t.info, t.offset, t.fingerprint = file, info, 0, ""
+	if !emit(TailEvent{Notice: TailNoticeRotated}) {
+		return false
+	}
+	return t.readAppended(emit)
+}
+
+// readAppended emits the complete lines between the offset and the end of
+// the current file
+func (t *FileTail) readAppended(emit func(TailEvent) bool) bool {
+	buf := make([]byte, tailReadChunk)
+	for {
+		n, err := t.file.ReadAt(buf, t.offset)
+		if n > 0 {
+			t.offset += int64(n)
+			data := append(t.pending, buf[:n]...)
+			for {
+				idx := bytes.IndexByte(data, '\n')
+				if idx < 0 {
+					break
+				}
+				if !emit(TailEvent{Line: string(bytes.TrimSuffix(data[:idx], []byte("\r")))}) {
+					// The line is read again on the next call
+					t.offset -= int64(len(data))
+					t.pending = nil
+					return false
+				}
+				data = data[idx+1:]
+			}
+			if len(data) > tailMaxLine {
+				if !emit(TailEvent{Line: string(data)}) {
+					t.offset -= int64(len(data))
+					t.pending = nil
+					return false
+				}
+				data = nil
+			}
+			t.pending = append([]byte(nil), data...)
+		}
+		if err != nil || n < len(buf) {
+			return true
+		}
+	}
+}
+
+// accessLinePattern matches the start of nginx's combined log format up to
+// the status code
+var accessLinePattern = regexp.MustCompile(`^(\S+) \S+ \S+ \[[^\]]*\] "(?:[^"\\]|\\.)*" (\d{3}) `)
+
+// errorLineClient finds the client address in an nginx error log line
+var errorLineClient = regexp.MustCompile(`client: ([0-9a-fA-F.:]+)`)
+
+// LineFilter selects live log lines and WAF decisions. Pattern is a regular
+// expression, Status an exact code such as 404 or a class such as 5xx, and
+// IP a client address.
+type LineFilter struct {
+	Pattern *regexp.Regexp
+	Status  string
+	IP      string
+}
+
+// ParseLineFilter validates the filter parameters of a live stream
+func ParseLineFilter(pattern, status, ip string) (*LineFilter, error) {
+	filter := &LineFilter{Status: strings.ToLower(strings.TrimSpace(status)), IP: strings.TrimSpace(ip)}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		filter.Pattern = re
+	}
+	if filter.Status != "" {
+		valid := len(filter.Status) == 3 && filter.Status[0] >= '1' && filter.Status[0] <= '5'
+		if valid && filter.Status[1:] != "xx" {
+			_, err := strconv.Atoi(filter.Status)
+			valid = err == nil
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid status %q: use a code such as 404 or a class such as 5xx", status)
+		}
+	}
+	return filter, nil
+}
+
+// MatchLine reports whether an nginx log line passes the filter. Status only
+// matches access log lines; the IP is the client of access and error lines.
+func (f *LineFilter) MatchLine(line string) bool {
+	if f.Pattern != nil && !f.Pattern.MatchString(line) {
+		return false
+	}
+	if f.Status == "" && f.IP == "" {
+		return true
+	}
+
+	clientIP, status := "", 0
+	if m := accessLinePattern.FindStringSubmatch(line); m != nil {
+		clientIP = m[1]
+		status, _ = strconv.Atoi(m[2])
+	} else if m := errorLineClient.FindStringSubmatch(line); m != nil {
+		clientIP = m[1]
+	}
+	if f.IP != "" && clientIP != f.IP {
+		return false
+	}
+	return f.Status == "" || f.matchStatus(status)
+}
+
+// MatchDecision reports whether a live WAF decision passes the filter. The
+// pattern is matched against the URL and user agent.
+func (f *LineFilter) MatchDecision(d *LiveDecision) bool {
+	if f.Pattern != nil && !f.Pattern.MatchString(d.URL) && !f.Pattern.MatchString(d.UserAgent) {
+		return false
+	}
+	if f.IP != "" && d.ClientIP != f.IP {
+		return false
+	}
+	return f.Status == "" || f.matchStatus(d.StatusCode)
+}
+
+func (f *LineFilter) matchStatus(status int) bool {
+	if status == 0 {
+		return false
+	}
+	code := strconv.Itoa(status)
+	if strings.HasSuffix(f.Status, "xx") {
+		return code[0] == f.Status[0]
+	}
+	return code == f.Status
+}
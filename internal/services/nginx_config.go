@@ -69,6 +69,11 @@ type CustomLocation struct {
 // VHostTemplate is the nginx configuration template for a virtual host
 const VHostTemplate = `# Virtual Host: {{.Name}}
 # Generated automatically - Optimized for Performance & Security
+
+# JSON access log, read by the WAF into traffic analytics. $waf_proxied is 0
+# by default and set to 1 in locations that pass requests to the WAF, which
+# logs those itself.
+log_format waf_json_{{.UpstreamName}} escape=json '{"msec":$msec,"remote_addr":"$remote_addr","host":"$host","method":"$request_method","uri":"$request_uri","protocol":"$server_protocol","status":$status,"body_bytes_sent":$body_bytes_sent,"request_time":$request_time,"referer":"$http_referer","user_agent":"$http_user_agent","upstream_addr":"$upstream_addr","cache_status":"$upstream_cache_status","waf":"$waf_proxied"}';
 {{if .HasUpstream}}
 # Upstream for load balancing: {{.Domain}}
 upstream {{.UpstreamName}}_backend {
@@ -144,8 +149,9 @@ server {
     {{end}}
 
     # Access and Error Logs
-    access_log /var/log/nginx/{{.Domain}}_access.log;
+    access_log /var/log/nginx/{{.Domain}}_access.log waf_json_{{.UpstreamName}};
     error_log /var/log/nginx/{{.Domain}}_error.log warn;
+    set $waf_proxied 0;
     
     # Per-VHost Upload Size Limit
     client_max_body_size 100m;
@@ -155,12 +161,13 @@ server {
         expires 30d;
         add_header Cache-Control "public, no-transform, immutable";
         add_header Vary "Accept-Encoding";
-        access_log off;
         log_not_found off;
         
+        set $waf_proxied 1;
         proxy_pass http://waf:8080;
         proxy_set_header Host $host;
         proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Client-Protocol $server_protocol;
         proxy_cache backend_cache;
         proxy_cache_valid 200 30d;
         proxy_cache_valid 404 1m;
@@ -170,11 +177,12 @@ server {
         expires 7d;
         add_header Cache-Control "public, no-transform";
         add_header Vary "Accept-Encoding";
-        access_log off;
         
+        set $waf_proxied 1;
         proxy_pass http://waf:8080;
         proxy_set_header Host $host;
         proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Client-Protocol $server_protocol;
         proxy_cache backend_cache;
         proxy_cache_valid 200 7d;
     }
@@ -198,9 +206,11 @@ server {
         limit_req zone=api burst=200 nodelay;
         limit_req_status 429;
         
+        set $waf_proxied 1;
         proxy_pass http://waf:8080;
         proxy_set_header Host $host;
         proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Client-Protocol $server_protocol;
         proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
         proxy_set_header X-Forwarded-Proto $scheme;
         
@@ -234,10 +244,12 @@ server {
         limit_req zone=general burst=100 nodelay;
         
         {{if .HasUpstream}}proxy_pass http://{{.UpstreamName}}_backend;
-        {{else}}proxy_pass http://waf:8080;
+        {{else}}set $waf_proxied 1;
+        proxy_pass http://waf:8080;
         {{end}}proxy_set_header Host $host;
         proxy_set_header X-Real-IP $remote_addr;
-        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        {{if not .HasUpstream}}proxy_set_header X-Client-Protocol $server_protocol;
+        {{end}}proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
         proxy_set_header X-Forwarded-Proto $scheme;
         proxy_set_header X-Forwarded-Host $host;
         proxy_set_header X-Forwarded-Port $server_port;
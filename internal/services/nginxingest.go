@@ -0,0 +1,389 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var nginxIngestLog = logging.Component("nginx_ingest")
+
+const (
+	// nginxIngestLockID is the advisory lock of the replica reading the logs
+	nginxIngestLockID              = 0x77616605
+	defaultNginxLogDir             = "/data/nginx/logs"
+	defaultNginxIngestPollInterval = 2 * time.Second
+	nginxIngestDomainRefresh       = 30 * time.Second
+	// nginxIngestMaxLines bounds the lines read from one file per poll, so a
+	// backlog is worked off without flooding the traffic log queue
+	nginxIngestMaxLines = 5000
+
+	// LogSourceWAF and LogSourceNginx tell where a traffic_logs row came from
+	LogSourceWAF   = "waf"
+	LogSourceNginx = "nginx"
+)
+
+// NginxAccessRecord is one line of the JSON access log format emitted by
+// VHostTemplate
+type NginxAccessRecord struct {
+	Msec          float64 `json:"msec"`
+	RemoteAddr    string  `json:"remote_addr"`
+	Host          string  `json:"host"`
+	Method        string  `json:"method"`
+	URI           string  `json:"uri"`
+	Protocol      string  `json:"protocol"`
+	Status        int     `json:"status"`
+	BodyBytesSent int     `json:"body_bytes_sent"`
+	RequestTime   float64 `json:"request_time"`
+	Referer       string  `json:"referer"`
+	UserAgent     string  `json:"user_agent"`
+	UpstreamAddr  string  `json:"upstream_addr"`
+	CacheStatus   string  `json:"cache_status"`
+	WAF           string  `json:"waf"`
+}
+
+// ParseNginxAccessLine parses a JSON access log line
+func ParseNginxAccessLine(line string) (*NginxAccessRecord, error) {
+	if !strings.HasPrefix(line, "{") {
+		return nil, fmt.Errorf("not a JSON access log line")
+	}
+	var record NginxAccessRecord
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return nil, err
+	}
+	if record.Msec <= 0 || record.Status == 0 {
+		return nil, fmt.Errorf("access log line without time or status")
+	}
+	return &record, nil
+}
+
+// Time returns when nginx finished the request
+func (r *NginxAccessRecord) Time() time.Time {
+	return time.UnixMilli(int64(math.Round(r.Msec * 1000)))
+}
+
+// ReachedWAF reports whether nginx passed the request on to the WAF, which
+// logged it already. Cache hits and requests nginx rejected itself never got
+// there even in locations that proxy to the WAF.
+func (r *NginxAccessRecord) ReachedWAF() bool {
+	return r.WAF == "1" && r.UpstreamAddr != "" && r.UpstreamAddr != "-"
+}
+
+// combinedEscaper escapes quoted fields the way nginx does in text logs
+var combinedEscaper = strings.NewReplacer(`"`, `\x22`, `\`, `\x5C`)
+
+// Combined renders the record in nginx's combined log format, as the access
+// logs looked before they were switched to JSON
+func (r *NginxAccessRecord) Combined() string {
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %d "%s" "%s"`,
+		r.RemoteAddr, r.Time().Format("02/Jan/2006:15:04:05 -0700"), r.Method, combinedEscaper.Replace(r.URI), r.Protocol,
+		r.Status, r.BodyBytesSent, combinedField(r.Referer), combinedField(r.UserAgent))
+}
+
+func combinedField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return combinedEscaper.Replace(s)
+}
+
+// FormatNginxAccessLine shows a JSON access log line in the combined format
+// and returns other lines unchanged
+func FormatNginxAccessLine(line string) string {
+	record, err := ParseNginxAccessLine(line)
+	if err != nil {
+		return line
+	}
+	return record.Combined()
+}
+
+// trafficLogEntry converts a request nginx served for domain. Requests nginx
+// rejected before any upstream was asked, with its request limits (429) or a
+// deny rule (403), are logged as blocked by nginx.
+func (r *NginxAccessRecord) trafficLogEntry(domain string) TrafficLogEntry {
+	entry := TrafficLogEntry{
+		Timestamp:    r.Time(),
+		ClientIP:     r.RemoteAddr,
+		Method:       r.Method,
+		URL:          r.URI,
+		StatusCode:   r.Status,
+		ResponseTime: int(math.Round(r.RequestTime * 1000)),
+		BytesSent:    r.BodyBytesSent,
+		UserAgent:    r.UserAgent,
+		Referer:      r.Referer,
+		Host:         domain,
+		Decision:     "allowed",
+		LogSource:    LogSourceNginx,
+	}
+	if r.UpstreamAddr == "" || r.UpstreamAddr == "-" {
+		switch r.Status {
+		case http.StatusTooManyRequests:
+			entry.BlockReason = "Rate limited by nginx"
+		case http.StatusForbidden:
+			entry.BlockReason = "Denied by nginx"
+		}
+		if entry.BlockReason != "" {
+			entry.Blocked = true
+			entry.Decision = "blocked"
+			entry.BlockSource = LogSourceNginx
+		}
+	}
+	return entry
+}
+
+// NginxIngestStats reports what the ingest has read
+type NginxIngestStats struct {
+	Enabled  bool   `json:"enabled"`
+	Files    int32  `json:"files"`
+	Ingested uint64 `json:"ingested"`
+	Skipped  uint64 `json:"skipped"`
+	Invalid  uint64 `json:"invalid"`
+	Deferred uint64 `json:"deferred"`
+}
+
+// NginxIngestService reads the JSON access logs of the vhosts into the
+// traffic log pipeline, so requests nginx served without the WAF, like cached
+// static assets, show up in traffic analytics. Requests nginx passed to the
+// WAF are skipped because the WAF logged them already. One replica at a time
+// reads the logs; how far each file was read is kept in nginx_log_positions,
+// so a restart or another replica continues without gaps or duplicates.
+type NginxIngestService struct {
+	db         *sqlx.DB
+	trafficLog *TrafficLogger
+	cfg        config.NginxIngestConfig
+
+	// Only used by Run
+	files     map[string]*nginxLogFile
+	domains   []string
+	domainsAt time.Time
+
+	openFiles atomic.Int32
+	ingested  atomic.Uint64
+	skipped   atomic.Uint64
+	invalid   atomic.Uint64
+	deferred  atomic.Uint64
+}
+
+// nginxLogFile is an access log being followed and the position last saved
+// for it
+type nginxLogFile struct {
+	domain string
+	tail   *FileTail
+	saved  TailPosition
+}
+
+// NewNginxIngestService creates the service and fills in config defaults
+func NewNginxIngestService(db *sqlx.DB, trafficLog *TrafficLogger, cfg config.NginxIngestConfig) *NginxIngestService {
+	if cfg.LogDir == "" {
+		cfg.LogDir = defaultNginxLogDir
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultNginxIngestPollInterval
+	}
+	return &NginxIngestService{
+		db:         db,
+		trafficLog: trafficLog,
+		cfg:        cfg,
+		files:      make(map[string]*nginxLogFile),
+	}
+}
+
+// Stats returns the ingest counters
+func (s *NginxIngestService) Stats() NginxIngestStats {
+	return NginxIngestStats{
+		Enabled:  s.cfg.Enabled,
+		Files:    s.openFiles.Load(),
+		Ingested: s.ingested.Load(),
+		Skipped:  s.skipped.Load(),
+		Invalid:  s.invalid.Load(),
+		Deferred: s.deferred.Load(),
+	}
+}
+
+// Run reads new access log lines every PollInterval until ctx is done
+func (s *NginxIngestService) Run(ctx context.Context) {
+	if !s.cfg.Enabled {
+		nginxIngestLog.Info("nginx access log ingest disabled")
+		return
+	}
+	nginxIngestLog.Info("Ingesting nginx access logs", "dir", s.cfg.LogDir, "poll_interval", s.cfg.PollInterval.String())
+	defer s.closeFiles()
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			held := false
+			err := withAdvisoryLock(ctx, s.db, nginxIngestLockID, func(conn *sqlx.Conn) {
+				held = true
+				s.poll(ctx, conn)
+			})
+			if err != nil {
+				nginxIngestLog.Error("Ingest skipped", "error", err)
+			}
+			if !held {
+				// Another replica reads the logs now; reopen at the positions
+				// it saved if this one takes over again
+				s.closeFiles()
+			}
+		}
+	}
+}
+
+func (s *NginxIngestService) poll(ctx context.Context, conn *sqlx.Conn) {
+	if time.Since(s.domainsAt) > nginxIngestDomainRefresh {
+		var domains []string
+		if err := conn.SelectContext(ctx, &domains, "SELECT domain FROM vhosts WHERE enabled = true"); err != nil {
+			nginxIngestLog.Error("Failed to load vhost domains", "error", err)
+		} else {
+			s.domains = domains
+		}
+		// Retry on the next interval either way rather than on every poll
+		s.domainsAt = time.Now()
+	}
+
+	paths := make(map[string]string, len(s.domains))
+	for _, domain := range s.domains {
+		paths[filepath.Join(s.cfg.LogDir, domain+"_access.log")] = domain
+	}
+	for path, file := range s.files {
+		if _, ok := paths[path]; !ok {
+			file.tail.Close()
+			delete(s.files, path)
+		}
+	}
+
+	saved, err := s.loadPositions(ctx, conn, paths)
+	if err != nil {
+		nginxIngestLog.Error("Failed to load log positions", "error", err)
+		return
+	}
+
+	queueFull := false
+	for path, domain := range paths {
+		if queueFull {
+			// The rest is read once the traffic log has caught up
+			break
+		}
+		file := s.files[path]
+		if file != nil && file.saved != saved[path] {
+			// Another replica read the file since this one last did
+			file.tail.Close()
+			delete(s.files, path)
+			file = nil
+		}
+		if file == nil {
+			tail, err := ResumeFileTail(path, saved[path])
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					nginxIngestLog.Warn("Failed to open access log", "path", path, "error", err)
+				}
+				continue
+			}
+			file = &nginxLogFile{domain: domain, tail: tail, saved: saved[path]}
+			s.files[path] = file
+		}
+
+		queueFull = !s.ingest(file)
+
+		position := file.tail.Position()
+		if position == file.saved {
+			continue
+		}
+		_, err := conn.ExecContext(ctx, `
+			INSERT INTO nginx_log_positions (path, log_offset, fingerprint, updated_at) VALUES ($1, $2, $3, NOW())
+			ON CONFLICT (path) DO UPDATE SET
+				log_offset = EXCLUDED.log_offset, fingerprint = EXCLUDED.fingerprint, updated_at = EXCLUDED.updated_at
+		`, path, position.Offset, position.Fingerprint)
+		if err != nil {
+			nginxIngestLog.Error("Failed to save log position", "path", path, "error", err)
+			continue
+		}
+		file.saved = position
+	}
+	s.openFiles.Store(int32(len(s.files)))
+}
+
+func (s *NginxIngestService) loadPositions(ctx context.Context, conn *sqlx.Conn, paths map[string]string) (map[string]TailPosition, error) {
+	list := make([]string, 0, len(paths))
+	for path := range paths {
+		list = append(list, path)
+	}
+	var rows []struct {
+		Path        string `db:"path"`
+		Offset      int64  `db:"log_offset"`
+		Fingerprint string `db:"fingerprint"`
+	}
+	err := conn.SelectContext(ctx, &rows, `
+		SELECT path, log_offset, fingerprint FROM nginx_log_positions WHERE path = ANY($1)`, pq.Array(list))
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make(map[string]TailPosition, len(rows))
+	for _, row := range rows {
+		positions[row.Path] = TailPosition{Offset: row.Offset, Fingerprint: row.Fingerprint}
+	}
+	return positions, nil
+}
+
+// ingest queues the requests appended to one access log. It returns false
+// when the traffic log queue is full; the file is then read again from the
+// refused line on the next poll.
+func (s *NginxIngestService) ingest(file *nginxLogFile) bool {
+	lines := 0
+	queued := true
+	file.tail.Poll(func(event TailEvent) bool {
+		if event.Notice != "" {
+			return true
+		}
+		if lines >= nginxIngestMaxLines {
+			return false
+		}
+		lines++
+
+		record, err := ParseNginxAccessLine(event.Line)
+		if err != nil {
+			// e.g. lines written before the vhost config switched to JSON
+			s.invalid.Add(1)
+			return true
+		}
+		if record.ReachedWAF() {
+			s.skipped.Add(1)
+			return true
+		}
+		if !s.trafficLog.TryEnqueue(record.trafficLogEntry(file.domain)) {
+			s.deferred.Add(1)
+			queued = false
+			return false
+		}
+		s.ingested.Add(1)
+		return true
+	})
+	return queued
+}
+
+func (s *NginxIngestService) closeFiles() {
+	for path, file := range s.files {
+		file.tail.Close()
+		delete(s.files, path)
+	}
+	s.openFiles.Store(0)
+}
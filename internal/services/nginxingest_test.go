@@ -0,0 +1,80 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseNginxAccessLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+		reached bool
+	}{
+		{
+			name:    "proxied to the WAF",
+			line:    `{"msec":1714566615.123,"remote_addr":"192.0.2.1","host":"shop.example.com","method":"GET","uri":"/","protocol":"HTTP/1.1","status":200,"body_bytes_sent":512,"request_time":0.004,"referer":"","user_agent":"curl/8.0","upstream_addr":"127.0.0.1:8080","cache_status":"MISS","waf":"1"}`,
+			reached: true,
+		},
+		{
+			name: "cache hit",
+			line: `{"msec":1714566615.123,"remote_addr":"192.0.2.1","host":"shop.example.com","method":"GET","uri":"/logo.png","protocol":"HTTP/2.0","status":200,"body_bytes_sent":2048,"request_time":0.000,"upstream_addr":"","cache_status":"HIT","waf":"1"}`,
+		},
+		{
+			name: "static location",
+			line: `{"msec":1714566615.123,"remote_addr":"192.0.2.1","host":"shop.example.com","method":"GET","uri":"/static/app.js","protocol":"HTTP/1.1","status":200,"body_bytes_sent":100,"request_time":0.001,"upstream_addr":"10.0.0.5:80","waf":"0"}`,
+		},
+		{
+			name: "rejected by nginx",
+			line: `{"msec":1714566615.123,"remote_addr":"192.0.2.1","host":"shop.example.com","method":"GET","uri":"/","protocol":"HTTP/1.1","status":429,"body_bytes_sent":0,"request_time":0.000,"upstream_addr":"-","waf":"1"}`,
+		},
+		{name: "combined format", line: `192.0.2.1 - - [01/May/2024:12:30:15 +0000] "GET / HTTP/1.1" 200 512 "-" "curl/8.0"`, wantErr: true},
+		{name: "truncated", line: `{"msec":1714566615.123,"status":`, wantErr: true},
+		{name: "no status", line: `{"msec":1714566615.123,"remote_addr":"192.0.2.1"}`, wantErr: true},
+		{name: "no time", line: `{"status":200}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, err := ParseNginxAccessLine(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNginxAccessLine err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := record.ReachedWAF(); got != tt.reached {
+				t.Errorf("ReachedWAF = %v, want %v", got, tt.reached)
+			}
+			if want := time.UnixMilli(1714566615123); !record.Time().Equal(want) {
+				t.Errorf("Time = %v, want %v", record.Time(), want)
+			}
+		})
+	}
+}
+
+func TestNginxAccessRecordTrafficLogEntry(t *testing.T) {
+	record, err := ParseNginxAccessLine(`{"msec":1714566615.5,"remote_addr":"192.0.2.1","host":"shop.example.com","method":"POST","uri":"/login","protocol":"HTTP/1.1","status":403,"body_bytes_sent":150,"request_time":0.0126,"upstream_addr":"","waf":"0"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := record.trafficLogEntry("shop.example.com")
+	if !entry.Blocked || entry.BlockReason != "Denied by nginx" || entry.BlockSource != LogSourceNginx {
+		t.Errorf("entry = %+v, want blocked by nginx", entry)
+	}
+	if entry.ResponseTime != 13 || entry.LogSource != LogSourceNginx {
+		t.Errorf("response time = %d, source = %q", entry.ResponseTime, entry.LogSource)
+	}
+}
+
+func TestFormatNginxAccessLine(t *testing.T) {
+	line := `{"msec":1714566615.123,"remote_addr":"192.0.2.1","method":"GET","uri":"/a\"b","protocol":"HTTP/1.1","status":200,"body_bytes_sent":5,"referer":"","user_agent":"curl/8.0"}`
+	want := `192.0.2.1 - - [` + time.UnixMilli(1714566615123).Format("02/Jan/2006:15:04:05 -0700") +
+		`] "GET /a\x22b HTTP/1.1" 200 5 "-" "curl/8.0"`
+	if got := FormatNginxAccessLine(line); got != want {
+		t.Errorf("FormatNginxAccessLine = %s, want %s", got, want)
+	}
+	if got := FormatNginxAccessLine("2024/05/01 12:00:00 [error] upstream timed out"); got != "2024/05/01 12:00:00 [error] upstream timed out" {
+		t.Errorf("non-JSON lines should be returned unchanged, got %s", got)
+	}
+}
@@ -0,0 +1,743 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var reportsLog = logging.Component("reports")
+
+// Report frequencies
+const (
+	ReportDaily  = "daily"
+	ReportWeekly = "weekly"
+)
+
+const (
+	defaultReportCheckInterval         = 5 * time.Minute
+	defaultReportCertificateDays       = 30
+	reportLockID                 int64 = 0x77616606
+	reportBuildTimeout                 = 2 * time.Minute
+	reportTopLimit                     = 10
+	reportMaxIncidents                 = 50
+	reportDateLayout                   = "2006-01-02"
+	reportTimeLayout                   = "2006-01-02 15:04"
+)
+
+var ErrReportScheduleNotFound = errors.New("report schedule not found")
+
+// ReportValidationError reports an invalid schedule or report request
+type ReportValidationError struct {
+	Reason string
+}
+
+func (e *ReportValidationError) Error() string {
+	return e.Reason
+}
+
+func invalidReport(format string, args ...interface{}) error {
+	return &ReportValidationError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// ReportSchedule emails a report of one vhost, or all vhosts when VHost is
+// empty, every day or every week on Weekday. Periods end at local midnight
+// and are sent at SendHour. Recipients are the listed addresses and the
+// email addresses of AdminIDs.
+type ReportSchedule struct {
+	ID            string         `db:"id" json:"id"`
+	Name          string         `db:"name" json:"name"`
+	VHost         string         `db:"vhost" json:"vhost"`
+	Frequency     string         `db:"frequency" json:"frequency"`
+	Weekday       int            `db:"weekday" json:"weekday"`
+	SendHour      int            `db:"send_hour" json:"send_hour"`
+	Recipients    string         `db:"recipients" json:"recipients"`
+	AdminIDs      pq.StringArray `db:"admin_ids" json:"admin_ids"`
+	Enabled       bool           `db:"enabled" json:"enabled"`
+	LastPeriodEnd *time.Time     `db:"last_period_end" json:"last_period_end,omitempty"`
+	LastSentAt    *time.Time     `db:"last_sent_at" json:"last_sent_at,omitempty"`
+	LastError     *string        `db:"last_error" json:"last_error,omitempty"`
+	CreatedBy     *string        `db:"created_by" json:"created_by,omitempty"`
+	CreatedAt     time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// Validate checks a schedule and normalises its fields
+func (r *ReportSchedule) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return invalidReport("name is required")
+	}
+	if r.Frequency == "" {
+		r.Frequency = ReportWeekly
+	}
+	if r.Frequency != ReportDaily && r.Frequency != ReportWeekly {
+		return invalidReport("frequency must be daily or weekly")
+	}
+	if r.Weekday < 0 || r.Weekday > 6 {
+		return invalidReport("weekday must be 0 (Sunday) to 6 (Saturday)")
+	}
+	if r.SendHour < 0 || r.SendHour > 23 {
+		return invalidReport("send_hour must be 0 to 23")
+	}
+	addrs := splitRecipients(r.Recipients)
+	for _, addr := range addrs {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return invalidReport("invalid email address %q", addr)
+		}
+	}
+	r.Recipients = strings.Join(addrs, ", ")
+	if r.AdminIDs == nil {
+		r.AdminIDs = pq.StringArray{}
+	}
+	for _, id := range r.AdminIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			return invalidReport("invalid admin ID %q", id)
+		}
+	}
+	if len(addrs) == 0 && len(r.AdminIDs) == 0 {
+		return invalidReport("recipients or admin_ids must name at least one recipient")
+	}
+	r.VHost = strings.ToLower(strings.TrimSpace(r.VHost))
+	return nil
+}
+
+func splitRecipients(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// periodDays is the length of the schedule's period
+func (r *ReportSchedule) periodDays() int {
+	if r.Frequency == ReportDaily {
+		return 1
+	}
+	return 7
+}
+
+// latestPeriodEnd returns the end of the newest period that is complete at
+// now, a local midnight
+func (r *ReportSchedule) latestPeriodEnd(now time.Time) time.Time {
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if r.Frequency == ReportWeekly {
+		end = end.AddDate(0, 0, -((int(end.Weekday()) - r.Weekday + 7) % 7))
+	}
+	return end
+}
+
+// dueAt returns the end of the newest period whose send time has passed
+func (r *ReportSchedule) dueAt(now time.Time) time.Time {
+	end := r.latestPeriodEnd(now)
+	if now.Before(end.Add(time.Duration(r.SendHour) * time.Hour)) {
+		end = end.AddDate(0, 0, -r.periodDays())
+	}
+	return end
+}
+
+// ReportPeriod returns the latest complete day, or the seven days before
+// today for weekly, as reports sent on a schedule cover them
+func ReportPeriod(frequency string, now time.Time) (time.Time, time.Time, error) {
+	if frequency == "" {
+		frequency = ReportWeekly
+	}
+	if frequency != ReportDaily && frequency != ReportWeekly {
+		return time.Time{}, time.Time{}, invalidReport("frequency must be daily or weekly")
+	}
+	schedule := &ReportSchedule{Frequency: frequency}
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	return to.AddDate(0, 0, -schedule.periodDays()), to, nil
+}
+
+// ReportCounts is the traffic of a report period
+type ReportCounts struct {
+	Requests  int64 `db:"requests" json:"requests"`
+	Blocked   int64 `db:"blocked" json:"blocked"`
+	Attacks   int64 `db:"attacks" json:"attacks"`
+	Bytes     int64 `db:"bytes" json:"bytes"`
+	UniqueIPs int64 `db:"-" json:"unique_ips"`
+}
+
+// ReportAttackType is one attack type and how often it was seen
+type ReportAttackType struct {
+	Name    string `db:"name" json:"name"`
+	Attacks int64  `db:"attacks" json:"attacks"`
+	Blocked int64  `db:"blocked" json:"blocked"`
+}
+
+// ReportCertificate is a certificate that expires soon or has expired
+type ReportCertificate struct {
+	Name     string    `db:"name" json:"name"`
+	ValidTo  time.Time `db:"valid_to" json:"valid_to"`
+	DaysLeft int       `db:"-" json:"days_left"`
+}
+
+// ReportIncident is a backend health alert open during the period
+type ReportIncident struct {
+	Subject    string     `db:"subject" json:"subject"`
+	Severity   string     `db:"severity" json:"severity"`
+	Message    string     `db:"message" json:"message"`
+	StartedAt  time.Time  `db:"started_at" json:"started_at"`
+	ResolvedAt *time.Time `db:"resolved_at" json:"resolved_at,omitempty"`
+}
+
+// Report is a security summary of one vhost, or all vhosts, over [From, To),
+// compared with the period of the same length before it
+type Report struct {
+	VHost            string              `json:"vhost"`
+	From             time.Time           `json:"from"`
+	To               time.Time           `json:"to"`
+	Current          ReportCounts        `json:"current"`
+	Previous         ReportCounts        `json:"previous"`
+	TopAttackers     []TrafficTopEntry   `json:"top_attackers"`
+	TopAttackTypes   []ReportAttackType  `json:"top_attack_types"`
+	NewBans          []Ban               `json:"new_bans"`
+	BannedIPsBlocked int64               `json:"banned_ips_blocked"`
+	Certificates     []ReportCertificate `json:"certificates"`
+	BackendIncidents []ReportIncident    `json:"backend_incidents"`
+	GeneratedAt      time.Time           `json:"generated_at"`
+}
+
+// ReportService builds security summary reports and emails them on the
+// schedules stored in report_schedules. Sending runs under an advisory lock,
+// so only one replica sends each report.
+type ReportService struct {
+	db    *sqlx.DB
+	email *EmailService
+	cfg   config.ReportsConfig
+}
+
+// NewReportService creates the service and fills in config defaults
+func NewReportService(db *sqlx.DB, email *EmailService, cfg config.ReportsConfig) *ReportService {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = defaultReportCheckInterval
+	}
+	if cfg.CertificateDays <= 0 {
+		cfg.CertificateDays = defaultReportCertificateDays
+	}
+	return &ReportService{db: db, email: email, cfg: cfg}
+}
+
+// Run sends the reports that are due every CheckInterval until ctx is done
+func (s *ReportService) Run(ctx context.Context) {
+	if !s.cfg.Enabled {
+		reportsLog.Info("Scheduled reports disabled")
+		return
+	}
+	reportsLog.Info("Checking report schedules", "interval", s.cfg.CheckInterval.String())
+
+	ticker := time.NewTicker(s.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := withAdvisoryLock(ctx, s.db, reportLockID, func(*sqlx.Conn) {
+				s.SendDue(ctx)
+			})
+			if err != nil {
+				reportsLog.Error("Report check skipped", "error", err)
+			}
+		}
+	}
+}
+
+// SendDue sends every enabled schedule whose latest period has not been
+// reported yet. A period missed while no replica ran is sent late; older
+// missed periods are skipped.
+func (s *ReportService) SendDue(ctx context.Context) {
+	schedules := []ReportSchedule{}
+	if err := s.db.SelectContext(ctx, &schedules, `SELECT * FROM report_schedules WHERE enabled ORDER BY created_at`); err != nil {
+		reportsLog.Error("Failed to load schedules", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range schedules {
+		schedule := &schedules[i]
+		end := schedule.dueAt(now)
+		if schedule.LastPeriodEnd != nil && !wallClock(*schedule.LastPeriodEnd).Before(end) {
+			continue
+		}
+		s.send(ctx, schedule, end, true)
+	}
+}
+
+// SendSchedule sends a schedule's latest complete period right away,
+// without changing when it is sent next
+func (s *ReportService) SendSchedule(ctx context.Context, id string) error {
+	schedule, err := s.GetSchedule(id)
+	if err != nil {
+		return err
+	}
+	return s.send(ctx, schedule, schedule.latestPeriodEnd(time.Now()), false)
+}
+
+// send builds and emails the period of a schedule ending at end and records
+// the outcome. Scheduled sends mark the period as reported even when
+// delivery failed, so a broken mail server is not retried every check.
+func (s *ReportService) send(ctx context.Context, schedule *ReportSchedule, end time.Time, scheduled bool) error {
+	err := s.deliver(ctx, schedule, end)
+	if err != nil {
+		reportsLog.Error("Failed to send report", "schedule", schedule.Name, "error", err)
+	} else {
+		reportsLog.Info("Report sent", "schedule", schedule.Name, "period_end", end.Format(reportDateLayout))
+	}
+
+	var lastError interface{}
+	if err != nil {
+		lastError = err.Error()
+	}
+	var periodEnd interface{}
+	if scheduled {
+		periodEnd = end
+	}
+	s.db.ExecContext(ctx, `
+		UPDATE report_schedules SET last_period_end = COALESCE($2, last_period_end), last_sent_at = $3, last_error = $4
+		WHERE id = $1
+	`, schedule.ID, periodEnd, time.Now(), lastError)
+	return err
+}
+
+func (s *ReportService) deliver(ctx context.Context, schedule *ReportSchedule, end time.Time) error {
+	recipients, err := s.recipients(ctx, schedule)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return errors.New("no active recipients")
+	}
+
+	buildCtx, cancel := context.WithTimeout(ctx, reportBuildTimeout)
+	defer cancel()
+	report, err := s.BuildReport(buildCtx, schedule.VHost, end.AddDate(0, 0, -schedule.periodDays()), end)
+	if err != nil {
+		return fmt.Errorf("build report: %w", err)
+	}
+	body, err := RenderReport(report)
+	if err != nil {
+		return err
+	}
+
+	subject := ReportTitle(report)
+	var errs []string
+	for _, to := range recipients {
+		if err := s.email.SendEmail(to, subject, body); err != nil {
+			errs = append(errs, to+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// recipients returns the schedule's addresses and those of its active
+// admins, without duplicates
+func (s *ReportService) recipients(ctx context.Context, schedule *ReportSchedule) ([]string, error) {
+	addrs := splitRecipients(schedule.Recipients)
+	if len(schedule.AdminIDs) > 0 {
+		var emails []string
+		if err := s.db.SelectContext(ctx, &emails, `
+			SELECT email FROM admins WHERE id = ANY($1::uuid[]) AND COALESCE(is_active, true)
+		`, schedule.AdminIDs); err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, emails...)
+	}
+
+	seen := map[string]bool{}
+	unique := addrs[:0]
+	for _, addr := range addrs {
+		if key := strings.ToLower(addr); !seen[key] {
+			seen[key] = true
+			unique = append(unique, addr)
+		}
+	}
+	return unique, nil
+}
+
+// BuildReport gathers the report of vhost (empty for all vhosts) over
+// [from, to). Traffic counts come from the hourly rollups, top attackers from
+// the raw logs; bans are all the ones issued in the period from the ban
+// history, including those that have expired or were lifted since.
+func (s *ReportService) BuildReport(ctx context.Context, vhost string, from, to time.Time) (*Report, error) {
+	if !to.After(from) {
+		return nil, invalidReport("the report period must not be empty")
+	}
+	report := &Report{
+		VHost:            vhost,
+		From:             from,
+		To:               to,
+		TopAttackTypes:   []ReportAttackType{},
+		NewBans:          []Ban{},
+		Certificates:     []ReportCertificate{},
+		BackendIncidents: []ReportIncident{},
+		GeneratedAt:      time.Now(),
+	}
+
+	var err error
+	if report.Current, err = s.counts(ctx, vhost, from, to); err != nil {
+		return nil, err
+	}
+	if report.Previous, err = s.counts(ctx, vhost, from.Add(-to.Sub(from)), from); err != nil {
+		return nil, err
+	}
+
+	attacks := (&LogFilter{}).Where("is_attack = true").Between(from, to)
+	if vhost != "" {
+		attacks.Where("host = ?", vhost)
+	}
+	if report.TopAttackers, err = TopTraffic(ctx, s.db, attacks, "ip", reportTopLimit); err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{from, to}
+	hostFilter := ""
+	if vhost != "" {
+		args = append(args, vhost)
+		hostFilter = " AND host = $3"
+	}
+	if err := s.db.SelectContext(ctx, &report.TopAttackTypes, `
+		SELECT attack_type AS name, SUM(attacks)::bigint AS attacks, SUM(blocked)::bigint AS blocked
+		FROM traffic_rollups_hour
+		WHERE attack_type <> '' AND bucket >= $1 AND bucket < $2`+hostFilter+`
+		GROUP BY attack_type
+		ORDER BY attacks DESC
+		LIMIT `+fmt.Sprint(reportTopLimit), args...); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.GetContext(ctx, &report.BannedIPsBlocked, `
+		SELECT COUNT(DISTINCT client_ip) FROM traffic_logs
+		WHERE block_source = 'jail' AND timestamp >= $1 AND timestamp < $2`+hostFilter, args...); err != nil {
+		return nil, err
+	}
+	if report.NewBans, err = s.newBans(ctx, vhost, from, to); err != nil {
+		return nil, err
+	}
+	if report.Certificates, err = s.expiringCertificates(ctx, vhost, to); err != nil {
+		return nil, err
+	}
+	if report.BackendIncidents, err = s.backendIncidents(ctx, vhost, from, to); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (s *ReportService) counts(ctx context.Context, vhost string, from, to time.Time) (ReportCounts, error) {
+	args := []interface{}{from, to}
+	hostFilter := ""
+	if vhost != "" {
+		args = append(args, vhost)
+		hostFilter = " AND host = $3"
+	}
+
+	var counts ReportCounts
+	err := s.db.GetContext(ctx, &counts, `
+		SELECT COALESCE(SUM(requests), 0)::bigint AS requests,
+		       COALESCE(SUM(blocked), 0)::bigint AS blocked,
+		       COALESCE(SUM(attacks), 0)::bigint AS attacks,
+		       COALESCE(SUM(bytes_sent), 0)::bigint AS bytes
+		FROM traffic_rollups_hour
+		WHERE bucket >= $1 AND bucket < $2`+hostFilter, args...)
+	if err != nil {
+		return counts, err
+	}
+	err = s.db.GetContext(ctx, &counts.UniqueIPs, `
+		SELECT COUNT(DISTINCT client_ip) FROM traffic_rollups_hour_ips
+		WHERE bucket >= $1 AND bucket < $2`+hostFilter, args...)
+	return counts, err
+}
+
+// newBans returns the bans issued in the period, including those already
+// lifted; for a vhost, only those of IPs that sent it requests in the period
+func (s *ReportService) newBans(ctx context.Context, vhost string, from, to time.Time) ([]Ban, error) {
+	args := []interface{}{from, to}
+	hostFilter := ""
+	if vhost != "" {
+		args = append(args, vhost)
+		hostFilter = ` AND ip IN (
+			SELECT DISTINCT client_ip FROM traffic_logs
+			WHERE host = $3 AND timestamp >= $1 AND timestamp < $2)`
+	}
+
+	var rows []struct {
+		IP        string    `db:"ip"`
+		Reason    string    `db:"reason"`
+		Level     int       `db:"level"`
+		Offences  int       `db:"offences"`
+		BannedAt  time.Time `db:"banned_at"`
+		ExpiresAt time.Time `db:"expires_at"`
+	}
+	if err := s.db.SelectContext(ctx, &rows, `
+		SELECT ip, reason, level, offences, banned_at, expires_at FROM ban_history
+		WHERE banned_at >= $1 AND banned_at < $2`+hostFilter+`
+		ORDER BY banned_at`, args...); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(rows))
+	for _, row := range rows {
+		ban := Ban{
+			IP:        row.IP,
+			Reason:    row.Reason,
+			Level:     row.Level,
+			Offences:  row.Offences,
+			BannedAt:  wallClock(row.BannedAt),
+			ExpiresAt: wallClock(row.ExpiresAt),
+		}
+		if remaining := ban.ExpiresAt.Sub(now); remaining > 0 {
+			ban.RemainingSeconds = int(remaining.Seconds())
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+// expiringCertificates returns certificates that expire within
+// CertificateDays of the report's end or have expired, soonest first. For a
+// vhost these are the certificate it uses and those named after it.
+func (s *ReportService) expiringCertificates(ctx context.Context, vhost string, to time.Time) ([]ReportCertificate, error) {
+	horizon := to.UTC().AddDate(0, 0, s.cfg.CertificateDays)
+	query := `SELECT COALESCE(NULLIF(common_name, ''), name) AS name, valid_to FROM certificates WHERE valid_to < $1`
+	args := []interface{}{horizon}
+	if vhost != "" {
+		query += ` AND (LOWER(common_name) = $2 OR LOWER(name) = $2
+			OR id IN (SELECT ssl_certificate_id FROM vhosts WHERE LOWER(domain) = $2))`
+		args = append(args, vhost)
+	}
+	query += ` ORDER BY valid_to`
+
+	certs := []ReportCertificate{}
+	if err := s.db.SelectContext(ctx, &certs, query, args...); err != nil {
+		return nil, err
+	}
+	for i := range certs {
+		certs[i].DaysLeft = int(time.Until(certs[i].ValidTo).Hours() / 24)
+	}
+	return certs, nil
+}
+
+// backendIncidents returns the backend_unhealthy alerts that were open at
+// any time during the period
+func (s *ReportService) backendIncidents(ctx context.Context, vhost string, from, to time.Time) ([]ReportIncident, error) {
+	args := []interface{}{from, to}
+	subjectFilter := ""
+	if vhost != "" {
+		args = append(args, vhost)
+		subjectFilter = " AND LOWER(a.subject) = $3"
+	}
+
+	incidents := []ReportIncident{}
+	err := s.db.SelectContext(ctx, &incidents, `
+		SELECT a.subject, a.severity, a.message, a.started_at, a.resolved_at
+		FROM alerts a JOIN alert_rules r ON r.id = a.rule_id
+		WHERE r.type = '`+AlertRuleBackendUnhealthy+`' AND a.started_at < $2
+		  AND (a.resolved_at IS NULL OR a.resolved_at >= $1)`+subjectFilter+`
+		ORDER BY a.started_at
+		LIMIT `+fmt.Sprint(reportMaxIncidents), args...)
+	for i := range incidents {
+		incidents[i].StartedAt = wallClock(incidents[i].StartedAt)
+		if resolved := incidents[i].ResolvedAt; resolved != nil {
+			local := wallClock(*resolved)
+			incidents[i].ResolvedAt = &local
+		}
+	}
+	return incidents, err
+}
+
+// ReportTitle is the heading and email subject of a report. Periods from
+// midnight to midnight are named by their days.
+func ReportTitle(r *Report) string {
+	scope := "all sites"
+	if r.VHost != "" {
+		scope = r.VHost
+	}
+	period := r.From.Format(reportTimeLayout) + " to " + r.To.Format(reportTimeLayout)
+	if isMidnight(r.From) && isMidnight(r.To) {
+		period = r.From.Format(reportDateLayout)
+		if last := r.To.AddDate(0, 0, -1); last.After(r.From) {
+			period += " to " + last.Format(reportDateLayout)
+		}
+	}
+	return fmt.Sprintf("WAF security report for %s: %s", scope, period)
+}
+
+func isMidnight(t time.Time) bool {
+	return t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0
+}
+
+// RenderReport renders a report as a self-contained HTML page, used for
+// emails and downloads alike
+func RenderReport(r *Report) (string, error) {
+	var b bytes.Buffer
+	if err := reportTemplate.Execute(&b, struct {
+		Title string
+		*Report
+	}{ReportTitle(r), r}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// reportChange formats the change from prev to cur as a percentage
+func reportChange(cur, prev int64) string {
+	switch {
+	case prev == 0 && cur == 0:
+		return "no change"
+	case prev == 0:
+		return "new"
+	}
+	pct := float64(cur-prev) * 100 / float64(prev)
+	if pct >= 0 {
+		return fmt.Sprintf("+%.1f%%", pct)
+	}
+	return fmt.Sprintf("%.1f%%", pct)
+}
+
+// reportBytes formats a byte count with a binary unit
+func reportBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Email clients drop <style> blocks, so everything is styled inline
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"change": reportChange,
+	"bytes":  reportBytes,
+	"day":    func(t time.Time) string { return t.Format(reportDateLayout) },
+	"date":   func(t time.Time) string { return t.Format(reportTimeLayout) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>{{.Title}}</title></head>
+<body style="font-family: Arial, sans-serif; line-height: 1.5; color: #333; max-width: 720px; margin: 0 auto; padding: 20px;">
+    <h2 style="color: #1e40af;">{{.Title}}</h2>
+    <p style="color: #6b7280;">{{date .From}} to {{date .To}}, compared with the period of the same length before it</p>
+
+    <h3>Traffic</h3>
+    <table style="border-collapse: collapse; width: 100%;">
+        <tr style="background: #f3f4f6;"><th align="left" style="padding: 6px;"></th><th align="right" style="padding: 6px;">This period</th><th align="right" style="padding: 6px;">Previous</th><th align="right" style="padding: 6px;">Change</th></tr>
+        <tr><td style="padding: 6px;">Requests</td><td align="right">{{.Current.Requests}}</td><td align="right">{{.Previous.Requests}}</td><td align="right">{{change .Current.Requests .Previous.Requests}}</td></tr>
+        <tr><td style="padding: 6px;">Blocked</td><td align="right">{{.Current.Blocked}}</td><td align="right">{{.Previous.Blocked}}</td><td align="right">{{change .Current.Blocked .Previous.Blocked}}</td></tr>
+        <tr><td style="padding: 6px;">Attacks</td><td align="right">{{.Current.Attacks}}</td><td align="right">{{.Previous.Attacks}}</td><td align="right">{{change .Current.Attacks .Previous.Attacks}}</td></tr>
+        <tr><td style="padding: 6px;">Unique IPs</td><td align="right">{{.Current.UniqueIPs}}</td><td align="right">{{.Previous.UniqueIPs}}</td><td align="right">{{change .Current.UniqueIPs .Previous.UniqueIPs}}</td></tr>
+        <tr><td style="padding: 6px;">Bandwidth</td><td align="right">{{bytes .Current.Bytes}}</td><td align="right">{{bytes .Previous.Bytes}}</td><td align="right">{{change .Current.Bytes .Previous.Bytes}}</td></tr>
+    </table>
+
+    <h3>Top attackers</h3>
+    {{if .TopAttackers}}<table style="border-collapse: collapse; width: 100%;">
+        <tr style="background: #f3f4f6;"><th align="left" style="padding: 6px;">IP</th><th align="right" style="padding: 6px;">Attacks</th><th align="right" style="padding: 6px;">Blocked</th></tr>
+        {{range .TopAttackers}}<tr><td style="padding: 6px; font-family: monospace;">{{.Value}}</td><td align="right">{{.Requests}}</td><td align="right">{{.Blocked}}</td></tr>
+        {{end}}</table>{{else}}<p>No attacks were detected.</p>{{end}}
+
+    <h3>Top attack types</h3>
+    {{if .TopAttackTypes}}<table style="border-collapse: collapse; width: 100%;">
+        <tr style="background: #f3f4f6;"><th align="left" style="padding: 6px;">Type</th><th align="right" style="padding: 6px;">Attacks</th><th align="right" style="padding: 6px;">Blocked</th></tr>
+        {{range .TopAttackTypes}}<tr><td style="padding: 6px;">{{.Name}}</td><td align="right">{{.Attacks}}</td><td align="right">{{.Blocked}}</td></tr>
+        {{end}}</table>{{else}}<p>No attacks were detected.</p>{{end}}
+
+    <h3>Banned IPs</h3>
+    <p>{{.BannedIPsBlocked}} banned IPs were turned away during the period.</p>
+    {{if .NewBans}}<table style="border-collapse: collapse; width: 100%;">
+        <tr style="background: #f3f4f6;"><th align="left" style="padding: 6px;">IP</th><th align="left" style="padding: 6px;">Reason</th><th align="left" style="padding: 6px;">Banned</th><th align="left" style="padding: 6px;">Until</th></tr>
+        {{range .NewBans}}<tr><td style="padding: 6px; font-family: monospace;">{{.IP}}</td><td>{{.Reason}}</td><td>{{date .BannedAt}}</td><td>{{date .ExpiresAt}}</td></tr>
+        {{end}}</table>{{else}}<p>No bans issued in the period are still active.</p>{{end}}
+
+    <h3>Certificates</h3>
+    {{if .Certificates}}<ul>
+        {{range .Certificates}}<li>{{if lt .DaysLeft 0}}<strong style="color: #dc2626;">{{.Name}} expired on {{day .ValidTo}}</strong>{{else}}{{.Name}} expires in {{.DaysLeft}} days ({{day .ValidTo}}){{end}}</li>
+        {{end}}</ul>{{else}}<p>No certificates expire soon.</p>{{end}}
+
+    <h3>Backend health</h3>
+    {{if .BackendIncidents}}<ul>
+        {{range .BackendIncidents}}<li>{{date .StartedAt}}{{if .ResolvedAt}} to {{date .ResolvedAt}}{{else}}, still open{{end}}: {{.Message}}</li>
+        {{end}}</ul>{{else}}<p>No backend health incidents.</p>{{end}}
+
+    <p style="margin-top: 30px; font-size: 12px; color: #6b7280;">Generated by Docode WAF on {{date .GeneratedAt}}.</p>
+</body>
+</html>
+`))
+
+// ListSchedules returns all report schedules
+func (s *ReportService) ListSchedules() ([]ReportSchedule, error) {
+	schedules := []ReportSchedule{}
+	err := s.db.Select(&schedules, `SELECT * FROM report_schedules ORDER BY created_at DESC`)
+	return schedules, err
+}
+
+// GetSchedule returns one schedule
+func (s *ReportService) GetSchedule(id string) (*ReportSchedule, error) {
+	var schedule ReportSchedule
+	err := s.db.Get(&schedule, `SELECT * FROM report_schedules WHERE id = $1`, id)
+	if err == sql.ErrNoRows {
+		return nil, ErrReportScheduleNotFound
+	}
+	return &schedule, err
+}
+
+// CreateSchedule validates and stores a schedule. Its first report is the
+// next period to end, not the one that ended last.
+func (s *ReportService) CreateSchedule(schedule *ReportSchedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+	return s.db.Get(schedule, `
+		INSERT INTO report_schedules (name, vhost, frequency, weekday, send_hour, recipients, admin_ids, enabled,
+		                              last_period_end, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING *
+	`, schedule.Name, schedule.VHost, schedule.Frequency, schedule.Weekday, schedule.SendHour, schedule.Recipients,
+		schedule.AdminIDs, schedule.Enabled, schedule.dueAt(time.Now()), schedule.CreatedBy)
+}
+
+// UpdateSchedule validates and replaces a schedule. Like a new one, it is
+// next sent for the next period to end.
+func (s *ReportService) UpdateSchedule(id string, schedule *ReportSchedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+	err := s.db.Get(schedule, `
+		UPDATE report_schedules SET name = $2, vhost = $3, frequency = $4, weekday = $5, send_hour = $6,
+		       recipients = $7, admin_ids = $8, enabled = $9,
+		       last_period_end = GREATEST(COALESCE(last_period_end, $10), $10), updated_at = NOW()
+		WHERE id = $1
+		RETURNING *
+	`, id, schedule.Name, schedule.VHost, schedule.Frequency, schedule.Weekday, schedule.SendHour,
+		schedule.Recipients, schedule.AdminIDs, schedule.Enabled, schedule.dueAt(time.Now()))
+	if err == sql.ErrNoRows {
+		return ErrReportScheduleNotFound
+	}
+	return err
+}
+
+// DeleteSchedule removes a schedule
+func (s *ReportService) DeleteSchedule(id string) error {
+	return deleteByID(s.db, "report_schedules", id, ErrReportScheduleNotFound)
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrRequestNotFound is returned when no traffic log row has the request ID
+var ErrRequestNotFound = errors.New("request not found")
+
+// blockSources describes each middleware that can block a request
+var blockSources = map[string]string{
+	"jail":             "the client IP is serving a temporary ban",
+	"connection_limit": "the client had too many requests in flight at once",
+	"attack_mode":      "the site is in under attack mode, which only serves GET and HEAD requests",
+	"rate_limit":       "the client exceeded the site's rate limit",
+	"http_flood":       "the client exceeded the HTTP flood threshold",
+	"ip_blocker":       "the client IP matched an IP group or blocking rule",
+	"region_filter":    "the client's region is not allowed on this site",
+	"bot_detector":     "the bot detector scored the request above the block threshold",
+	"nginx":            "nginx rejected the request before it reached the WAF",
+}
+
+// RequestExplanation is the support view of one request: its log row and a
+// plain-language account of the decision
+type RequestExplanation struct {
+	RequestID string        `json:"request_id"`
+	Decision  string        `json:"decision"`
+	Summary   string        `json:"summary"`
+	Log       TrafficLogRow `json:"log"`
+}
+
+// ExplainRequest looks up a request by the ID printed on block pages. IDs are
+// unique per request, so the newest row wins if a trusted proxy reused one.
+func ExplainRequest(ctx context.Context, db *sqlx.DB, requestID string) (*RequestExplanation, error) {
+	var row TrafficLogRow
+	err := db.GetContext(ctx, &row, `
+		SELECT `+trafficLogRowColumns+`
+		FROM traffic_logs
+		WHERE request_id = $1
+		ORDER BY timestamp DESC
+		LIMIT 1`, requestID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decision := deref(row.Decision)
+	if decision == "" {
+		// Rows logged before decisions were recorded
+		switch {
+		case row.Blocked:
+			decision = "blocked"
+		case row.IsAttack:
+			decision = "attack"
+		default:
+			decision = "allowed"
+		}
+	}
+
+	return &RequestExplanation{
+		RequestID: requestID,
+		Decision:  decision,
+		Summary:   explainDecision(decision, row),
+		Log:       row,
+	}, nil
+}
+
+func explainDecision(decision string, row TrafficLogRow) string {
+	switch decision {
+	case "blocked":
+		source := deref(row.BlockSource)
+		summary := fmt.Sprintf("Blocked with HTTP %d", row.StatusCode)
+		if description, ok := blockSources[source]; ok {
+			summary = fmt.Sprintf("Blocked by %s with HTTP %d: %s", strings.ReplaceAll(source, "_", " "), row.StatusCode, description)
+		}
+		if reason := deref(row.BlockReason); reason != "" {
+			summary += " (" + reason + ")"
+		}
+		return summary + "."
+	case "challenged":
+		return "Challenged by the bot detector: the visitor was shown a verification page and had not passed it yet."
+	case "attack":
+		return fmt.Sprintf("Allowed with HTTP %d, but matched the %s attack pattern.", row.StatusCode, deref(row.AttackType))
+	default:
+		return fmt.Sprintf("Allowed and proxied to the backend, which answered HTTP %d.", row.StatusCode)
+	}
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,723 @@
+package services
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+)
+
+var siemLog = logging.Component("siem")
+
+// Security event severities, lowest first
+const (
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+// Security event actions
+const (
+	EventActionBlocked  = "blocked"
+	EventActionDetected = "detected"
+)
+
+// SIEM sink formats and transports
+const (
+	SIEMFormatSyslog = "syslog"
+	SIEMFormatCEF    = "cef"
+	SIEMFormatJSON   = "json"
+
+	SIEMTransportUDP  = "udp"
+	SIEMTransportTCP  = "tcp"
+	SIEMTransportTLS  = "tls"
+	SIEMTransportFile = "file"
+)
+
+const (
+	defaultSIEMBufferSize       = 10000
+	defaultSIEMDialTimeout      = 5 * time.Second
+	defaultSIEMRetryInterval    = time.Second
+	defaultSIEMMaxRetryInterval = time.Minute
+	defaultSIEMFacility         = 13 // log audit
+	defaultSIEMAppName          = "docode-waf"
+	siemWriteTimeout            = 5 * time.Second
+	siemCloseTimeout            = 5 * time.Second
+	siemMaxURLLength            = 2048
+
+	// siemSDID is the RFC 5424 structured data ID. 32473 is the enterprise
+	// number reserved for documentation, as no private number is registered.
+	siemSDID = "waf@32473"
+)
+
+var severityRank = map[string]int{
+	SeverityLow:      1,
+	SeverityMedium:   2,
+	SeverityHigh:     3,
+	SeverityCritical: 4,
+}
+
+// attackSeverity rates the attack types reported by the logging middleware
+var attackSeverity = map[string]string{
+	"SQL Injection":     SeverityCritical,
+	"Command Injection": SeverityCritical,
+	"XSS":               SeverityHigh,
+	"Path Traversal":    SeverityHigh,
+	"Admin Scan":        SeverityMedium,
+	"Bot Traffic":       SeverityLow,
+}
+
+// SecurityEvent is one block or attack decision
+type SecurityEvent struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Action      string    `json:"action"`
+	Severity    string    `json:"severity"`
+	ClientIP    string    `json:"client_ip"`
+	Host        string    `json:"host"`
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	StatusCode  int       `json:"status_code"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	AttackType  string    `json:"attack_type,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	CountryCode string    `json:"country_code,omitempty"`
+	ASN         uint      `json:"asn,omitempty"`
+	ASOrg       string    `json:"as_org,omitempty"`
+	NodeID      string    `json:"node_id,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+}
+
+// EventSeverity rates a decision: attacks by their type, other blocks medium
+func EventSeverity(attackType string, blocked bool) string {
+	if severity, ok := attackSeverity[attackType]; ok {
+		return severity
+	}
+	if attackType != "" || blocked {
+		return SeverityMedium
+	}
+	return SeverityLow
+}
+
+// SIEMSinkStats reports the state of one sink
+type SIEMSinkStats struct {
+	Name      string `json:"name"`
+	Format    string `json:"format"`
+	Transport string `json:"transport"`
+	Target    string `json:"target"`
+	Queued    int    `json:"queued"`
+	Capacity  int    `json:"capacity"`
+	Sent      uint64 `json:"sent"`
+	Dropped   uint64 `json:"dropped"`
+	Retries   uint64 `json:"retries"`
+	Connected bool   `json:"connected"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// EventForwarder fans security events out to the configured SIEM sinks.
+// Publish never blocks: each sink buffers events in its own bounded queue and
+// drops new ones while its collector is unreachable and the queue is full.
+type EventForwarder struct {
+	geoIP  *GeoIPService
+	nodeID string
+	sinks  []*eventSink
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+	stop   chan struct{}
+}
+
+// NewEventForwarder creates the forwarder. Sinks with an invalid
+// configuration are logged and skipped. Call Start to launch the writers.
+func NewEventForwarder(cfg config.SIEMConfig, geoIP *GeoIPService, nodeID string) *EventForwarder {
+	f := &EventForwarder{geoIP: geoIP, nodeID: nodeID, stop: make(chan struct{})}
+	if !cfg.Enabled {
+		return f
+	}
+
+	hostname, _ := os.Hostname()
+	for i, sinkCfg := range cfg.Sinks {
+		sink, err := newEventSink(sinkCfg, hostname)
+		if err != nil {
+			siemLog.Warn("Skipping sink", "index", i+1, "sink", sinkCfg.Name, "error", err)
+			continue
+		}
+		f.sinks = append(f.sinks, sink)
+	}
+	return f
+}
+
+// Start launches one writer per sink
+func (f *EventForwarder) Start() {
+	for _, sink := range f.sinks {
+		f.wg.Add(1)
+		go func(sink *eventSink) {
+			defer f.wg.Done()
+			sink.run(f.stop)
+		}(sink)
+		siemLog.Info("Forwarding events", "sink", sink.cfg.Name, "format", sink.cfg.Format, "target", sink.target())
+	}
+}
+
+// Enabled reports whether any sink is configured
+func (f *EventForwarder) Enabled() bool {
+	return f != nil && len(f.sinks) > 0
+}
+
+// Publish queues an event for every sink whose filters it passes
+func (f *EventForwarder) Publish(event SecurityEvent) {
+	if !f.Enabled() {
+		return
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return
+	}
+
+	if len(event.URL) > siemMaxURLLength {
+		event.URL = event.URL[:siemMaxURLLength]
+	}
+	event.NodeID = f.nodeID
+	enriched := false
+	for _, sink := range f.sinks {
+		if !sink.accepts(event) {
+			continue
+		}
+		if !enriched && f.geoIP != nil {
+			geo := f.geoIP.LookupOrUnknown(event.ClientIP)
+			event.CountryCode, event.ASN, event.ASOrg = geo.CountryCode, geo.ASN, geo.ASOrg
+			enriched = true
+		}
+		sink.enqueue(event)
+	}
+}
+
+// Close stops accepting events and gives the writers a short time to send
+// what is still queued. Events are not retried once closing has started.
+func (f *EventForwarder) Close() {
+	if !f.Enabled() {
+		return
+	}
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	for _, sink := range f.sinks {
+		close(sink.queue)
+	}
+	f.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(siemCloseTimeout):
+		close(f.stop)
+		siemLog.Warn("Gave up waiting for sinks to drain")
+	}
+}
+
+// Stats returns per-sink counters
+func (f *EventForwarder) Stats() []SIEMSinkStats {
+	stats := []SIEMSinkStats{}
+	if f == nil {
+		return stats
+	}
+	for _, sink := range f.sinks {
+		stats = append(stats, sink.stats())
+	}
+	return stats
+}
+
+// eventSink is one destination with its own queue and connection
+type eventSink struct {
+	cfg         config.SIEMSinkConfig
+	hostname    string
+	minSeverity int
+	vhosts      map[string]struct{}
+	attackTypes map[string]struct{}
+	tlsConfig   *tls.Config
+	queue       chan SecurityEvent
+
+	// w is only used by the sink's writer goroutine
+	w         io.WriteCloser
+	connected atomic.Bool
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+	retries   atomic.Uint64
+	lastError atomic.Value
+}
+
+func newEventSink(cfg config.SIEMSinkConfig, hostname string) (*eventSink, error) {
+	cfg.Format = strings.ToLower(cfg.Format)
+	cfg.Transport = strings.ToLower(cfg.Transport)
+	switch cfg.Format {
+	case SIEMFormatSyslog, SIEMFormatCEF, SIEMFormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported format %q", cfg.Format)
+	}
+	switch cfg.Transport {
+	case SIEMTransportUDP, SIEMTransportTCP, SIEMTransportTLS:
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("%s transport needs an address", cfg.Transport)
+		}
+	case SIEMTransportFile:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("file transport needs a path")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported transport %q", cfg.Transport)
+	}
+
+	if cfg.Name == "" {
+		cfg.Name = cfg.Format + "-" + cfg.Transport
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultSIEMBufferSize
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultSIEMDialTimeout
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultSIEMRetryInterval
+	}
+	if cfg.MaxRetryInterval < cfg.RetryInterval {
+		cfg.MaxRetryInterval = defaultSIEMMaxRetryInterval
+	}
+	if cfg.Facility <= 0 || cfg.Facility > 23 {
+		cfg.Facility = defaultSIEMFacility
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = defaultSIEMAppName
+	}
+
+	minSeverity := 0
+	if cfg.MinSeverity != "" {
+		rank, ok := severityRank[strings.ToLower(cfg.MinSeverity)]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_severity %q", cfg.MinSeverity)
+		}
+		minSeverity = rank
+	}
+
+	sink := &eventSink{
+		cfg:         cfg,
+		hostname:    syslogHeaderField(hostname, 255),
+		minSeverity: minSeverity,
+		vhosts:      lowerSet(cfg.VHosts),
+		attackTypes: lowerSet(cfg.AttackTypes),
+		queue:       make(chan SecurityEvent, cfg.BufferSize),
+	}
+
+	if cfg.Transport == SIEMTransportTLS {
+		serverName, _, err := net.SplitHostPort(cfg.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %w", err)
+		}
+		sink.tlsConfig = &tls.Config{
+			ServerName:         serverName,
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: cfg.TLSSkipVerify,
+		}
+		if cfg.TLSCAFile != "" {
+			pem, err := os.ReadFile(cfg.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", cfg.TLSCAFile)
+			}
+			sink.tlsConfig.RootCAs = pool
+		}
+	}
+
+	return sink, nil
+}
+
+func lowerSet(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[strings.ToLower(strings.TrimSpace(v))] = struct{}{}
+	}
+	return set
+}
+
+func (s *eventSink) target() string {
+	if s.cfg.Transport == SIEMTransportFile {
+		return s.cfg.Path
+	}
+	return s.cfg.Transport + "://" + s.cfg.Address
+}
+
+// accepts applies the sink's severity, vhost and attack type filters
+func (s *eventSink) accepts(event SecurityEvent) bool {
+	if severityRank[event.Severity] < s.minSeverity {
+		return false
+	}
+	if s.vhosts != nil {
+		if _, ok := s.vhosts[strings.ToLower(event.Host)]; !ok {
+			return false
+		}
+	}
+	if s.attackTypes != nil {
+		if _, ok := s.attackTypes[strings.ToLower(event.AttackType)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *eventSink) enqueue(event SecurityEvent) {
+	select {
+	case s.queue <- event:
+	default:
+		if s.dropped.Add(1)%1000 == 1 {
+			siemLog.Warn("Sink buffer full, dropping events", "sink", s.cfg.Name, "dropped", s.dropped.Load())
+		}
+	}
+}
+
+func (s *eventSink) stats() SIEMSinkStats {
+	stats := SIEMSinkStats{
+		Name:      s.cfg.Name,
+		Format:    s.cfg.Format,
+		Transport: s.cfg.Transport,
+		Target:    s.target(),
+		Queued:    len(s.queue),
+		Capacity:  cap(s.queue),
+		Sent:      s.sent.Load(),
+		Dropped:   s.dropped.Load(),
+		Retries:   s.retries.Load(),
+		Connected: s.connected.Load(),
+	}
+	if err, ok := s.lastError.Load().(string); ok {
+		stats.LastError = err
+	}
+	return stats
+}
+
+// run sends queued events until the queue is closed. A failed write is
+// retried with exponential backoff, holding up the events behind it so they
+// are delivered in order once the collector is back.
+func (s *eventSink) run(stop <-chan struct{}) {
+	defer s.disconnect()
+
+	closing := false
+	for event := range s.queue {
+		msg := s.format(event)
+		backoff := s.cfg.RetryInterval
+		for {
+			err := s.write(msg)
+			if err == nil {
+				s.sent.Add(1)
+				break
+			}
+
+			s.disconnect()
+			s.lastError.Store(err.Error())
+			if s.retries.Add(1)%100 == 1 {
+				siemLog.Warn("Sink write failed, retrying", "sink", s.cfg.Name, "backoff", backoff.String(), "error", err)
+			}
+			if closing {
+				s.dropped.Add(1)
+				break
+			}
+			select {
+			case <-stop:
+				closing = true
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > s.cfg.MaxRetryInterval {
+				backoff = s.cfg.MaxRetryInterval
+			}
+		}
+	}
+}
+
+func (s *eventSink) write(msg []byte) error {
+	if s.w == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	if conn, ok := s.w.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(siemWriteTimeout))
+	}
+	_, err := s.w.Write(msg)
+	return err
+}
+
+func (s *eventSink) connect() error {
+	var (
+		w   io.WriteCloser
+		err error
+	)
+	switch s.cfg.Transport {
+	case SIEMTransportFile:
+		if err = os.MkdirAll(filepath.Dir(s.cfg.Path), 0o750); err != nil {
+			return err
+		}
+		w, err = os.OpenFile(s.cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	case SIEMTransportTLS:
+		dialer := &net.Dialer{Timeout: s.cfg.DialTimeout}
+		w, err = tls.DialWithDialer(dialer, "tcp", s.cfg.Address, s.tlsConfig)
+	default:
+		w, err = net.DialTimeout(s.cfg.Transport, s.cfg.Address, s.cfg.DialTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	s.w = w
+	s.connected.Store(true)
+	return nil
+}
+
+func (s *eventSink) disconnect() {
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	s.connected.Store(false)
+}
+
+// format renders an event and frames it for the transport. Syslog and CEF
+// over TCP/TLS use RFC 6587 octet counting; everything else is one event per
+// line (or per datagram).
+func (s *eventSink) format(event SecurityEvent) []byte {
+	var msg []byte
+	switch s.cfg.Format {
+	case SIEMFormatJSON:
+		msg, _ = json.Marshal(event)
+	case SIEMFormatCEF:
+		msg = []byte(formatCEF(event))
+		if s.cfg.Transport != SIEMTransportFile {
+			msg = s.syslogMessage(event, nil, string(msg))
+		}
+	default:
+		msg = s.syslogMessage(event, syslogStructuredData(event), eventSummary(event))
+	}
+
+	if s.cfg.Format != SIEMFormatJSON && (s.cfg.Transport == SIEMTransportTCP || s.cfg.Transport == SIEMTransportTLS) {
+		return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	if s.cfg.Transport == SIEMTransportUDP {
+		return msg
+	}
+	return append(msg, '\n')
+}
+
+// syslogMessage builds an RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func (s *eventSink) syslogMessage(event SecurityEvent, sd []byte, msg string) []byte {
+	pri := s.cfg.Facility*8 + syslogSeverity(event.Severity)
+	msgID := "ATTACK"
+	if event.Action == EventActionBlocked {
+		msgID = "BLOCK"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d %s ",
+		pri,
+		event.Timestamp.Format("2006-01-02T15:04:05.000000Z07:00"),
+		nilIfEmpty(s.hostname),
+		nilIfEmpty(syslogHeaderField(s.cfg.AppName, 48)),
+		os.Getpid(),
+		msgID,
+	)
+	if len(sd) == 0 {
+		buf.WriteString("-")
+	} else {
+		buf.Write(sd)
+	}
+	buf.WriteString(" ")
+	buf.WriteString(msg)
+	return buf.Bytes()
+}
+
+// syslogSeverity maps event severities to syslog severities
+func syslogSeverity(severity string) int {
+	switch severity {
+	case SeverityCritical:
+		return 2 // critical
+	case SeverityHigh:
+		return 3 // error
+	case SeverityMedium:
+		return 4 // warning
+	default:
+		return 5 // notice
+	}
+}
+
+func syslogStructuredData(event SecurityEvent) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[" + siemSDID)
+	param := func(name, value string) {
+		if value == "" {
+			return
+		}
+		buf.WriteString(" " + name + "=\"")
+		for _, r := range value {
+			if r == '"' || r == '\\' || r == ']' {
+				buf.WriteByte('\\')
+			}
+			buf.WriteRune(r)
+		}
+		buf.WriteString("\"")
+	}
+	param("action", event.Action)
+	param("severity", event.Severity)
+	param("src", event.ClientIP)
+	param("host", event.Host)
+	param("method", event.Method)
+	param("url", event.URL)
+	param("status", strconv.Itoa(event.StatusCode))
+	param("attackType", event.AttackType)
+	param("reason", event.Reason)
+	param("country", event.CountryCode)
+	if event.ASN != 0 {
+		param("asn", strconv.FormatUint(uint64(event.ASN), 10))
+	}
+	param("userAgent", event.UserAgent)
+	param("node", event.NodeID)
+	param("requestId", event.RequestID)
+	buf.WriteString("]")
+	return buf.Bytes()
+}
+
+// syslogHeaderField makes a value safe for a header field: printable ASCII
+// without spaces, truncated to max
+func syslogHeaderField(value string, max int) string {
+	var b strings.Builder
+	for i := 0; i < len(value) && b.Len() < max; i++ {
+		if c := value[i]; c > 32 && c < 127 {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func nilIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func eventSummary(event SecurityEvent) string {
+	var b strings.Builder
+	if event.Action == EventActionBlocked {
+		b.WriteString("Blocked ")
+	} else {
+		b.WriteString("Detected ")
+	}
+	if event.AttackType != "" {
+		b.WriteString(event.AttackType + " ")
+	}
+	fmt.Fprintf(&b, "%s %s%s from %s", event.Method, event.Host, event.URL, event.ClientIP)
+	if event.Reason != "" {
+		b.WriteString(": " + event.Reason)
+	}
+	return b.String()
+}
+
+// cefSeverity maps event severities to the CEF 0-10 scale
+func cefSeverity(severity string) int {
+	switch severity {
+	case SeverityCritical:
+		return 10
+	case SeverityHigh:
+		return 8
+	case SeverityMedium:
+		return 5
+	default:
+		return 3
+	}
+}
+
+// formatCEF renders an ArcSight CEF:0 record
+func formatCEF(event SecurityEvent) string {
+	header := func(value string) string {
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		return strings.ReplaceAll(value, "|", `\|`)
+	}
+	ext := func(value string) string {
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		value = strings.ReplaceAll(value, "=", `\=`)
+		value = strings.ReplaceAll(value, "\r", `\r`)
+		return strings.ReplaceAll(value, "\n", `\n`)
+	}
+
+	signature, name := "block", "Request blocked"
+	if event.AttackType != "" {
+		signature = strings.ToLower(strings.ReplaceAll(event.AttackType, " ", "-"))
+		name = event.AttackType
+		if event.Action == EventActionBlocked {
+			name += " blocked"
+		} else {
+			name += " detected"
+		}
+	}
+
+	countryLabel := ""
+	if event.CountryCode != "" {
+		countryLabel = "country"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|Docode|WAF|1.0|%s|%s|%d|", header(signature), header(name), cefSeverity(event.Severity))
+	fields := []struct{ key, value string }{
+		{"rt", strconv.FormatInt(event.Timestamp.UnixMilli(), 10)},
+		{"act", event.Action},
+		{"src", event.ClientIP},
+		{"dhost", event.Host},
+		{"requestMethod", event.Method},
+		{"request", event.URL},
+		{"requestClientApplication", event.UserAgent},
+		{"cat", event.AttackType},
+		{"reason", event.Reason},
+		{"cn1Label", "statusCode"},
+		{"cn1", strconv.Itoa(event.StatusCode)},
+		{"cs1Label", countryLabel},
+		{"cs1", event.CountryCode},
+		{"dvchost", event.NodeID},
+		{"externalId", event.RequestID},
+	}
+	first := true
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(field.key + "=" + ext(field.value))
+	}
+	return b.String()
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aleh/docode-waf/internal/config"
+)
+
+func testSecurityEvent() SecurityEvent {
+	return SecurityEvent{
+		Timestamp:   time.Date(2024, 5, 1, 12, 30, 15, 123456000, time.UTC),
+		Action:      EventActionBlocked,
+		Severity:    SeverityCritical,
+		ClientIP:    "192.0.2.1",
+		Host:        "shop.example.com",
+		Method:      "GET",
+		URL:         "/search?q=1' OR '1'='1",
+		StatusCode:  403,
+		AttackType:  "SQL Injection",
+		Reason:      `matched "union|select"`,
+		CountryCode: "NL",
+		NodeID:      "waf-1",
+	}
+}
+
+func testEventSink(t *testing.T, format, transport string) *eventSink {
+	t.Helper()
+	sink, err := newEventSink(config.SIEMSinkConfig{
+		Format:    format,
+		Transport: transport,
+		Address:   "siem.example.com:6514",
+		Path:      "/var/log/waf/events.log",
+	}, "waf node 1")
+	if err != nil {
+		t.Fatalf("newEventSink: %v", err)
+	}
+	return sink
+}
+
+func TestEventSinkFraming(t *testing.T) {
+	event := testSecurityEvent()
+	// facility 13 (log audit) * 8 + severity 2 (critical)
+	syslogHeader := fmt.Sprintf("<106>1 2024-05-01T12:30:15.123456Z wafnode1 docode-waf %d BLOCK ", os.Getpid())
+
+	tests := []struct {
+		format, transport string
+		prefix            string
+		octetCounted      bool
+		newline           bool
+	}{
+		{SIEMFormatSyslog, SIEMTransportUDP, syslogHeader + "[waf@32473 ", false, false},
+		{SIEMFormatSyslog, SIEMTransportTCP, syslogHeader + "[waf@32473 ", true, false},
+		{SIEMFormatSyslog, SIEMTransportTLS, syslogHeader + "[waf@32473 ", true, false},
+		{SIEMFormatSyslog, SIEMTransportFile, syslogHeader + "[waf@32473 ", false, true},
+		{SIEMFormatCEF, SIEMTransportUDP, syslogHeader + "- CEF:0|Docode|WAF|1.0|sql-injection|", false, false},
+		{SIEMFormatCEF, SIEMTransportTCP, syslogHeader + "- CEF:0|Docode|WAF|1.0|sql-injection|", true, false},
+		{SIEMFormatCEF, SIEMTransportFile, "CEF:0|Docode|WAF|1.0|sql-injection|", false, true},
+		{SIEMFormatJSON, SIEMTransportTCP, `{"timestamp":"2024-05-01T12:30:15.123456Z"`, false, true},
+		{SIEMFormatJSON, SIEMTransportUDP, `{"timestamp":"2024-05-01T12:30:15.123456Z"`, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.transport, func(t *testing.T) {
+			msg := string(testEventSink(t, tt.format, tt.transport).format(event))
+
+			if tt.octetCounted {
+				length, rest, ok := strings.Cut(msg, " ")
+				n, err := strconv.Atoi(length)
+				if !ok || err != nil || n != len(rest) {
+					t.Fatalf("message is not octet counted: %q", msg)
+				}
+				msg = rest
+			}
+			if strings.HasSuffix(msg, "\n") != tt.newline {
+				t.Errorf("trailing newline = %v, want %v: %q", !tt.newline, tt.newline, msg)
+			}
+			if strings.Count(strings.TrimSuffix(msg, "\n"), "\n") != 0 {
+				t.Errorf("message spans lines: %q", msg)
+			}
+			if !strings.HasPrefix(msg, tt.prefix) {
+				t.Errorf("message = %q, want prefix %q", msg, tt.prefix)
+			}
+		})
+	}
+}
+
+func TestSyslogStructuredDataEscaping(t *testing.T) {
+	event := testSecurityEvent()
+	event.Reason = `a "quoted" \ value]`
+	sd := string(syslogStructuredData(event))
+
+	want := `reason="a \"quoted\" \\ value\]"`
+	if !strings.Contains(sd, want) {
+		t.Errorf("structured data = %s, want it to contain %s", sd, want)
+	}
+	if !strings.HasPrefix(sd, "[waf@32473 action=\"blocked\" severity=\"critical\" src=\"192.0.2.1\"") || !strings.HasSuffix(sd, `"]`) {
+		t.Errorf("structured data = %s", sd)
+	}
+}
+
+func TestFormatCEF(t *testing.T) {
+	event := testSecurityEvent()
+	event.AttackType = "Path|Traversal"
+	event.URL = "/a=b\nc"
+	event.Reason = `C:\windows`
+	event.Action = EventActionDetected
+	event.Severity = SeverityHigh
+
+	got := formatCEF(event)
+	wantPrefix := `CEF:0|Docode|WAF|1.0|path\|traversal|Path\|Traversal detected|8|rt=1714566615123 act=detected src=192.0.2.1 `
+	if !strings.HasPrefix(got, wantPrefix) {
+		t.Errorf("CEF = %s, want prefix %s", got, wantPrefix)
+	}
+	for _, want := range []string{`request=/a\=b\nc`, `reason=C:\\windows`, "cn1Label=statusCode cn1=403", "cs1Label=country cs1=NL", "dvchost=waf-1"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("CEF = %s, want it to contain %s", got, want)
+		}
+	}
+
+	event.CountryCode = ""
+	if got := formatCEF(event); strings.Contains(got, "cs1Label") {
+		t.Errorf("CEF without a country should omit cs1Label: %s", got)
+	}
+}
+
+func TestEventSinkTCPDelivery(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	sink, err := newEventSink(config.SIEMSinkConfig{
+		Format:    SIEMFormatSyslog,
+		Transport: SIEMTransportTCP,
+		Address:   ln.Addr().String(),
+	}, "waf-1")
+	if err != nil {
+		t.Fatalf("newEventSink: %v", err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		sink.run(stop)
+		close(done)
+	}()
+
+	event := testSecurityEvent()
+	sink.enqueue(event)
+	event.URL = "/second"
+	sink.enqueue(event)
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// RFC 6587 octet counting: "<length> <message>" back to back
+	for i, wantURL := range []string{`url="/search?q=1' OR '1'='1"`, `url="/second"`} {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatalf("message %d: read length: %v", i, err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("message %d: bad length %q", i, length)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(reader, msg); err != nil {
+			t.Fatalf("message %d: read: %v", i, err)
+		}
+		if !strings.Contains(string(msg), wantURL) {
+			t.Errorf("message %d = %s, want %s", i, msg, wantURL)
+		}
+	}
+
+	close(sink.queue)
+	close(stop)
+	<-done
+	if stats := sink.stats(); stats.Sent != 2 || stats.Dropped != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestNewEventSinkValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.SIEMSinkConfig
+	}{
+		{"unknown format", config.SIEMSinkConfig{Format: "leef", Transport: SIEMTransportUDP, Address: "siem:514"}},
+		{"unknown transport", config.SIEMSinkConfig{Format: SIEMFormatCEF, Transport: "http", Address: "siem:514"}},
+		{"network without address", config.SIEMSinkConfig{Format: SIEMFormatCEF, Transport: SIEMTransportTCP}},
+		{"file without path", config.SIEMSinkConfig{Format: SIEMFormatJSON, Transport: SIEMTransportFile}},
+		{"unknown severity", config.SIEMSinkConfig{Format: SIEMFormatJSON, Transport: SIEMTransportUDP, Address: "siem:514", MinSeverity: "urgent"}},
+	}
+	for _, tt := range tests {
+		if _, err := newEventSink(tt.cfg, "waf-1"); err == nil {
+			t.Errorf("%s: newEventSink should fail", tt.name)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/aleh/docode-waf/internal/logging"
+	"github.com/aleh/docode-waf/internal/metrics"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var trafficLogLog = logging.Component("traffic_log")
+
+const (
+	defaultTrafficLogQueueSize     = 10000
+	defaultTrafficLogBatchSize     = 500
+	defaultTrafficLogWorkers       = 2
+	defaultTrafficLogFlushInterval = time.Second
+	defaultTrafficLogFlushTimeout  = 10 * time.Second
+	trafficLogDomainRefresh        = 30 * time.Second
+	trafficLogCloseTimeout         = 10 * time.Second
+	// maxTrafficHostLength is the size of the traffic_logs host column
+	maxTrafficHostLength = 255
+)
+
+// unknownTrafficHost is logged as the host of requests without a usable Host
+const unknownTrafficHost = "_unknown"
+
+// trafficLogColumns are written with COPY; id and anything else not listed
+// take their column defaults
+var trafficLogColumns = []string{
+	"timestamp", "client_ip", "method", "url", "status_code",
+	"response_time", "bytes_sent", "user_agent", "blocked", "block_reason",
+	"is_attack", "attack_type", "country_code", "host",
+	"asn", "as_org", "city", "subdivision", "trace_id",
+	"request_id", "decision", "block_source", "log_source", "referer",
+}
+
+// TrafficLogEntry is one request, copied out of the gin context before it is
+// recycled. Enrichment (GeoIP, vhost domain) happens on the writer side.
+type TrafficLogEntry struct {
+	Timestamp    time.Time
+	ClientIP     string
+	Method       string
+	URL          string
+	StatusCode   int
+	ResponseTime int // milliseconds
+	BytesSent    int
+	UserAgent    string
+	Blocked      bool
+	BlockReason  string
+	IsAttack     bool
+	AttackType   string
+	Host         string // raw Host header
+	TraceID      string // hex OpenTelemetry trace ID, empty when not traced
+	RequestID    string
+	Decision     string // allowed, blocked, challenged or attack
+	BlockSource  string // middleware that blocked the request
+	LogSource    string // LogSourceWAF (default) or LogSourceNginx
+	Referer      string
+}
+
+// TrafficLogStats reports the state of the traffic log pipeline
+type TrafficLogStats struct {
+	Queued        int    `json:"queued"`
+	Capacity      int    `json:"capacity"`
+	Enqueued      uint64 `json:"enqueued"`
+	Written       uint64 `json:"written"`
+	Dropped       uint64 `json:"dropped"`
+	Failed        uint64 `json:"failed"`
+	Batches       uint64 `json:"batches"`
+	FailedBatches uint64 `json:"failed_batches"`
+	LastFlushMs   int64  `json:"last_flush_ms"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+// TrafficLogger writes traffic_logs rows in batches. Requests are queued in a
+// bounded channel; when Postgres falls behind the queue fills up and new
+// entries are dropped and counted instead of piling up goroutines.
+type TrafficLogger struct {
+	db    *sqlx.DB
+	geoIP *GeoIPService
+	cfg   config.TrafficLogConfig
+
+	// mu guards queue against sends after Close
+	mu     sync.RWMutex
+	closed bool
+	queue  chan TrafficLogEntry
+	wg     sync.WaitGroup
+
+	domainsMu sync.RWMutex
+	domains   map[string]struct{}
+	domainsAt time.Time
+
+	enqueued      atomic.Uint64
+	written       atomic.Uint64
+	dropped       atomic.Uint64
+	failed        atomic.Uint64
+	batches       atomic.Uint64
+	failedBatches atomic.Uint64
+	lastFlushMs   atomic.Int64
+	lastError     atomic.Value
+}
+
+// NewTrafficLogger creates the logger and fills in config defaults. Call
+// Start to launch the writers.
+func NewTrafficLogger(db *sqlx.DB, geoIP *GeoIPService, cfg config.TrafficLogConfig) *TrafficLogger {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultTrafficLogQueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultTrafficLogBatchSize
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultTrafficLogWorkers
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultTrafficLogFlushInterval
+	}
+	if cfg.FlushTimeout <= 0 {
+		cfg.FlushTimeout = defaultTrafficLogFlushTimeout
+	}
+
+	return &TrafficLogger{
+		db:    db,
+		geoIP: geoIP,
+		cfg:   cfg,
+		queue: make(chan TrafficLogEntry, cfg.QueueSize),
+	}
+}
+
+// Start launches the writer workers
+func (l *TrafficLogger) Start() {
+	for i := 0; i < l.cfg.Workers; i++ {
+		l.wg.Add(1)
+		go l.worker()
+	}
+	trafficLogLog.Info("Started writers", "workers", l.cfg.Workers, "queue", l.cfg.QueueSize,
+		"batch", l.cfg.BatchSize, "flush_interval", l.cfg.FlushInterval.String())
+}
+
+// Enqueue queues an entry for writing. When the queue is full it waits up to
+// EnqueueTimeout for room and then drops the entry; it never blocks longer.
+func (l *TrafficLogger) Enqueue(entry TrafficLogEntry) bool {
+	if l.TryEnqueue(entry) {
+		return true
+	}
+	if l.dropped.Add(1)%1000 == 1 {
+		trafficLogLog.Warn("Queue full, dropping entries", "dropped", l.dropped.Load())
+	}
+	return false
+}
+
+// TryEnqueue is Enqueue for callers that keep the entry and retry it later
+// when the queue is full, so a refused entry is not counted as dropped
+func (l *TrafficLogger) TryEnqueue(entry TrafficLogEntry) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return false
+	}
+
+	select {
+	case l.queue <- entry:
+		l.enqueued.Add(1)
+		return true
+	default:
+	}
+
+	if l.cfg.EnqueueTimeout > 0 {
+		timer := time.NewTimer(l.cfg.EnqueueTimeout)
+		defer timer.Stop()
+		select {
+		case l.queue <- entry:
+			l.enqueued.Add(1)
+			return true
+		case <-timer.C:
+		}
+	}
+	return false
+}
+
+// Close stops accepting entries and waits for queued ones to be written
+func (l *TrafficLogger) Close() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.queue)
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		trafficLogLog.Info("Flushed and stopped", "written", l.written.Load(), "dropped", l.dropped.Load())
+	case <-time.After(trafficLogCloseTimeout):
+		trafficLogLog.Warn("Gave up waiting for writers", "queued", len(l.queue))
+	}
+}
+
+// Stats returns the pipeline counters
+func (l *TrafficLogger) Stats() TrafficLogStats {
+	stats := TrafficLogStats{
+		Queued:        len(l.queue),
+		Capacity:      cap(l.queue),
+		Enqueued:      l.enqueued.Load(),
+		Written:       l.written.Load(),
+		Dropped:       l.dropped.Load(),
+		Failed:        l.failed.Load(),
+		Batches:       l.batches.Load(),
+		FailedBatches: l.failedBatches.Load(),
+		LastFlushMs:   l.lastFlushMs.Load(),
+	}
+	if err, ok := l.lastError.Load().(string); ok {
+		stats.LastError = err
+	}
+	return stats
+}
+
+func (l *TrafficLogger) worker() {
+	defer l.wg.Done()
+
+	batch := make([]TrafficLogEntry, 0, l.cfg.BatchSize)
+	ticker := time.NewTicker(l.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry, ok := <-l.queue:
+			if !ok {
+				l.flush(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= l.cfg.BatchSize {
+				l.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				l.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush writes a batch with COPY in a single transaction
+func (l *TrafficLogger) flush(batch []TrafficLogEntry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	start := time.Now()
+	err := l.copyBatch(batch)
+	l.lastFlushMs.Store(time.Since(start).Milliseconds())
+	metrics.ObservePostgres("traffic_log_copy", start, err)
+	l.batches.Add(1)
+
+	if err != nil {
+		l.failed.Add(uint64(len(batch)))
+		l.lastError.Store(err.Error())
+		if l.failedBatches.Add(1)%100 == 1 {
+			trafficLogLog.Error("Failed to write entries", "entries", len(batch), "failed_batches", l.failedBatches.Load(), "error", err)
+		}
+		return
+	}
+	l.written.Add(uint64(len(batch)))
+}
+
+func (l *TrafficLogger) copyBatch(batch []TrafficLogEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.cfg.FlushTimeout)
+	defer cancel()
+
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("traffic_logs", trafficLogColumns...))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range batch {
+		geo := l.geoIP.LookupOrUnknown(entry.ClientIP)
+		_, err := stmt.ExecContext(ctx,
+			entry.Timestamp,
+			entry.ClientIP,
+			entry.Method,
+			entry.URL,
+			entry.StatusCode,
+			entry.ResponseTime,
+			entry.BytesSent,
+			entry.UserAgent,
+			entry.Blocked,
+			entry.BlockReason,
+			entry.IsAttack,
+			entry.AttackType,
+			geo.CountryCode,
+			l.resolveDomain(entry.Host),
+			nullIfZero(int64(geo.ASN)),
+			nullIfEmpty(geo.ASOrg),
+			nullIfEmpty(geo.City),
+			nullIfEmpty(geo.Region()),
+			nullIfEmpty(entry.TraceID),
+			nullIfEmpty(entry.RequestID),
+			nullIfEmpty(entry.Decision),
+			nullIfEmpty(entry.BlockSource),
+			logSource(entry.LogSource),
+			nullIfEmpty(entry.Referer),
+		)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	// Entries behind the rollup watermark, e.g. ingested nginx logs or a
+	// backlog, move it back so their minutes are rolled up again
+	oldest := batch[0].Timestamp
+	for _, entry := range batch[1:] {
+		if entry.Timestamp.Before(oldest) {
+			oldest = entry.Timestamp
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE traffic_rollup_state SET watermark = $1 WHERE name = 'minute' AND watermark > $1
+	`, truncateMinute(oldest.Local()))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// resolveDomain maps a Host header to the vhost it was served for. Requests
+// by IP or for unknown hosts keep the host they named, without the port, and
+// requests without a usable host are logged as unknownTrafficHost. The vhost
+// list is cached so logging costs no queries per request.
+func (l *TrafficLogger) resolveDomain(httpHost string) string {
+	hostOnly := hostDomain(httpHost)
+
+	l.domainsMu.RLock()
+	stale := time.Since(l.domainsAt) > trafficLogDomainRefresh
+	l.domainsMu.RUnlock()
+	if stale {
+		l.refreshDomains()
+	}
+
+	l.domainsMu.RLock()
+	defer l.domainsMu.RUnlock()
+	if _, ok := l.domains[hostOnly]; ok {
+		return hostOnly
+	}
+	if hostOnly == "" || len(hostOnly) > maxTrafficHostLength || !utf8.ValidString(hostOnly) {
+		return unknownTrafficHost
+	}
+	return hostOnly
+}
+
+func (l *TrafficLogger) refreshDomains() {
+	var domains []string
+	err := l.db.Select(&domains, "SELECT domain FROM vhosts WHERE enabled = true")
+
+	l.domainsMu.Lock()
+	defer l.domainsMu.Unlock()
+	// Retry on the next interval either way rather than on every entry
+	l.domainsAt = time.Now()
+	if err != nil {
+		trafficLogLog.Error("Failed to load vhost domains", "error", err)
+		return
+	}
+
+	l.domains = make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		l.domains[domain] = struct{}{}
+	}
+}
+
+func logSource(source string) string {
+	if source == "" {
+		return LogSourceWAF
+	}
+	return source
+}
+
+func nullIfZero(v int64) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
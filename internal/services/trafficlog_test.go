@@ -0,0 +1,36 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrafficLoggerResolveDomain(t *testing.T) {
+	l := &TrafficLogger{
+		domains:   map[string]struct{}{"shop.example.com": {}, "2001:db8::1": {}},
+		domainsAt: time.Now(),
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"shop.example.com", "shop.example.com"},
+		{"shop.example.com:8443", "shop.example.com"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"203.0.113.7", "203.0.113.7"},
+		{"203.0.113.7:80", "203.0.113.7"},
+		{"[2001:db8::2]", "[2001:db8::2]"},
+		{"2001:db8::2", "2001:db8::2"},
+		{"other.example.com:8080", "other.example.com"},
+		{"", unknownTrafficHost},
+		{strings.Repeat("a", 256), unknownTrafficHost},
+		{"bad\xffhost", unknownTrafficHost},
+	}
+	for _, tt := range tests {
+		if got := l.resolveDomain(tt.host); got != tt.want {
+			t.Errorf("resolveDomain(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/aleh/docode-waf/internal/models"
 	"github.com/jmoiron/sqlx"
@@ -114,3 +115,11 @@ func (s *VHostService) GetVHostByID(id string) (*models.VHost, error) {
 
 	return &vhost, nil
 }
+
+// hostDomain returns a Host header value without its port
+func hostDomain(host string) string {
+	if domain, _, err := net.SplitHostPort(host); err == nil {
+		return domain
+	}
+	return host
+}
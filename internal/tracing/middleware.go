@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const stepKey = "tracing_step"
+
+// ServerMiddleware starts the root span of each WAF request. Every later span,
+// including the upstream call, is a child of it.
+func ServerMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		opts := []trace.SpanStartOption{
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ServerAddress(c.Request.Host),
+				semconv.ClientAddress(c.ClientIP()),
+				semconv.UserAgentOriginal(c.GetHeader("User-Agent")),
+				attribute.String("waf.request_id", c.GetString("request_id")),
+			),
+		}
+		if trustIncoming {
+			ctx = propagator.Extract(ctx, propagation.HeaderCarrier(c.Request.Header))
+		} else {
+			opts = append(opts, trace.WithNewRoot())
+		}
+
+		ctx, span := tracer.Start(ctx, c.Request.Method, opts...)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(
+			semconv.HTTPResponseStatusCode(status),
+			attribute.Bool("waf.blocked", c.GetBool("blocked")),
+		)
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// step is the span of one middleware, open until it passes the request on
+type step struct {
+	span   trace.Span
+	parent context.Context
+	ended  bool
+}
+
+func (s *step) end(c *gin.Context) {
+	s.ended = true
+	s.span.End()
+	c.Request = c.Request.WithContext(s.parent)
+}
+
+// Step wraps a middleware in a span named name. The span covers the
+// middleware's work before it hands the request on, so the next middleware's
+// span is a sibling rather than a child; a request it aborts ends the span
+// when the middleware returns. Use the result with Use(Step(...)...).
+func Step(name string, handler gin.HandlerFunc) []gin.HandlerFunc {
+	if !enabled {
+		return []gin.HandlerFunc{handler}
+	}
+
+	start := func(c *gin.Context) {
+		parent := c.Request.Context()
+		ctx, span := tracer.Start(parent, name)
+		s := &step{span: span, parent: parent}
+		c.Set(stepKey, s)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if !s.ended {
+			span.SetAttributes(attribute.Bool("waf.aborted", true))
+			s.end(c)
+		}
+	}
+	finish := func(c *gin.Context) {
+		if value, ok := c.Get(stepKey); ok {
+			if s := value.(*step); !s.ended {
+				s.end(c)
+			}
+		}
+	}
+	return []gin.HandlerFunc{start, handler, finish}
+}
+
+// Annotate adds attributes to the current span of the request
+func Annotate(c *gin.Context, attrs ...attribute.KeyValue) {
+	if enabled {
+		trace.SpanFromContext(c.Request.Context()).SetAttributes(attrs...)
+	}
+}
@@ -0,0 +1,225 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aleh/docode-waf/internal/config"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// testCollector is an OTLP/HTTP endpoint that keeps the spans it receives
+type testCollector struct {
+	mu       sync.Mutex
+	spans    []*tracepb.Span
+	services []string
+}
+
+func (tc *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected export", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tc.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		tc.services = append(tc.services, stringAttr(rs.GetResource().GetAttributes(), "service.name"))
+		for _, ss := range rs.ScopeSpans {
+			tc.spans = append(tc.spans, ss.Spans...)
+		}
+	}
+	tc.mu.Unlock()
+
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+// span returns the received span whose name and path attribute match
+func (tc *testCollector) span(t *testing.T, name, path string) *tracepb.Span {
+	t.Helper()
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for _, span := range tc.spans {
+		if span.Name == name && (path == "" || stringAttr(span.Attributes, "url.path") == path) {
+			return span
+		}
+	}
+	t.Fatalf("no %q span for %q among %d spans", name, path, len(tc.spans))
+	return nil
+}
+
+// child returns the received span named name whose parent is parent
+func (tc *testCollector) child(name string, parent *tracepb.Span) *tracepb.Span {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for _, span := range tc.spans {
+		if span.Name == name && string(span.ParentSpanId) == string(parent.SpanId) {
+			return span
+		}
+	}
+	return nil
+}
+
+func stringAttr(attrs []*commonpb.KeyValue, key string) string {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.GetValue().GetStringValue()
+		}
+	}
+	return ""
+}
+
+func attr(attrs []*commonpb.KeyValue, key string) *commonpb.AnyValue {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.GetValue()
+		}
+	}
+	return nil
+}
+
+// resetTracing restores the package state Setup changes
+func resetTracing() {
+	enabled = false
+	trustIncoming = false
+	tracer = otel.Tracer(instrumentationName)
+}
+
+func TestTracingExportsToCollector(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	collector := &testCollector{}
+	collectorSrv := httptest.NewServer(collector)
+	defer collectorSrv.Close()
+
+	var backendTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendTraceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	shutdown, err := Setup(config.TracingConfig{
+		Enabled:     true,
+		Endpoint:    collectorSrv.URL + "/v1/traces",
+		ServiceName: "waf-test",
+	})
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	t.Cleanup(resetTracing)
+	if !Enabled() {
+		t.Fatal("Setup should enable tracing")
+	}
+
+	client := &http.Client{Transport: InstrumentTransport(http.DefaultTransport)}
+	router := gin.New()
+	router.Use(ServerMiddleware())
+	router.Use(Step("ip_blocker", func(c *gin.Context) {
+		if c.Request.URL.Path == "/blocked" {
+			c.AbortWithStatus(http.StatusForbidden)
+		}
+	})...)
+	router.GET("/*path", func(c *gin.Context) {
+		req, _ := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, backend.URL+c.Request.URL.Path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+		c.Status(resp.StatusCode)
+	})
+
+	incomingTraceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, path := range []string{"/orders", "/blocked"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("traceparent", "00-"+incomingTraceID+"-00f067aa0ba902b7-01")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	root := collector.span(t, "GET", "/orders")
+	upstream := collector.span(t, "proxy upstream", "/orders")
+
+	// An untrusted incoming traceparent starts a new trace
+	traceID := hex.EncodeToString(root.TraceId)
+	if traceID == incomingTraceID || len(root.ParentSpanId) != 0 {
+		t.Errorf("root span continued the incoming trace %s", incomingTraceID)
+	}
+	if root.Kind != tracepb.Span_SPAN_KIND_SERVER || upstream.Kind != tracepb.Span_SPAN_KIND_CLIENT {
+		t.Errorf("span kinds = %v, %v", root.Kind, upstream.Kind)
+	}
+	if code := attr(root.Attributes, "http.response.status_code"); code.GetIntValue() != http.StatusBadGateway {
+		t.Errorf("root status code = %v", code)
+	}
+	if root.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("root status = %v, want an error for a 502", root.Status)
+	}
+
+	// The step and the upstream call are both children of the request span
+	if collector.child("ip_blocker", root) == nil {
+		t.Error("the ip_blocker span is not a child of the request span")
+	}
+	if hex.EncodeToString(upstream.TraceId) != traceID || string(upstream.ParentSpanId) != string(root.SpanId) {
+		t.Error("the upstream span is not a child of the request span")
+	}
+
+	// The backend sees the upstream span as its parent
+	wantTraceparent := "00-" + traceID + "-" + hex.EncodeToString(upstream.SpanId) + "-01"
+	if backendTraceparent != wantTraceparent {
+		t.Errorf("backend traceparent = %q, want %q", backendTraceparent, wantTraceparent)
+	}
+
+	blockedStep := collector.child("ip_blocker", collector.span(t, "GET", "/blocked"))
+	if blockedStep == nil || !attr(blockedStep.Attributes, "waf.aborted").GetBoolValue() {
+		t.Error("the step that aborted /blocked should be marked waf.aborted")
+	}
+
+	for _, service := range collector.services {
+		if service != "waf-test" {
+			t.Errorf("service.name = %q, want waf-test", service)
+		}
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	shutdown, err := Setup(config.TracingConfig{})
+	if err != nil || shutdown(context.Background()) != nil {
+		t.Fatalf("Setup with tracing disabled: %v", err)
+	}
+	if Enabled() {
+		t.Fatal("tracing should stay disabled")
+	}
+
+	handler := func(*gin.Context) {}
+	if got := Step("ip_blocker", handler); len(got) != 1 {
+		t.Errorf("Step should return the handler alone, got %d handlers", len(got))
+	}
+	if TraceID(context.Background()) != "" {
+		t.Error("TraceID without a span should be empty")
+	}
+}
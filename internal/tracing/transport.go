@@ -0,0 +1,56 @@
+package tracing
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentTransport wraps the reverse proxy transport in a client span per
+// upstream request and propagates it to the backend as a W3C traceparent
+// header. The span ends when the response headers arrive.
+func InstrumentTransport(next http.RoundTripper) http.RoundTripper {
+	return upstreamTransport{next: next}
+}
+
+type upstreamTransport struct {
+	next http.RoundTripper
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !enabled {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, span := tracer.Start(req.Context(), "proxy upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.ServerAddress(req.URL.Host),
+			semconv.URLPath(req.URL.Path),
+		),
+	)
+	defer span.End()
+
+	// The proxy already cloned the request, so its headers can be modified
+	req = req.WithContext(ctx)
+	if !trustIncoming {
+		req.Header.Del("tracestate")
+	}
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,22 @@
+-- Migration: Add behavioural bot scoring settings to vhosts
+-- Replaces the binary "challenge everyone" bot detection with score bands
+
+-- Detection mode: challenge_all (challenge every visitor) or score (action by score band)
+ALTER TABLE vhosts
+ADD COLUMN IF NOT EXISTS bot_detection_mode VARCHAR(20) DEFAULT 'score';
+
+-- Score bands: score < challenge threshold is allowed,
+-- challenge threshold <= score < block threshold is challenged, anything above is blocked
+ALTER TABLE vhosts
+ADD COLUMN IF NOT EXISTS bot_score_challenge_threshold INT DEFAULT 30;
+
+ALTER TABLE vhosts
+ADD COLUMN IF NOT EXISTS bot_score_block_threshold INT DEFAULT 70;
+
+ALTER TABLE vhosts
+ADD CONSTRAINT check_bot_detection_mode
+CHECK (bot_detection_mode IN ('challenge_all', 'score'));
+
+COMMENT ON COLUMN vhosts.bot_detection_mode IS 'Bot detection mode: challenge_all or score';
+COMMENT ON COLUMN vhosts.bot_score_challenge_threshold IS 'Bot score (0-100) from which visitors are challenged';
+COMMENT ON COLUMN vhosts.bot_score_block_threshold IS 'Bot score (0-100) from which visitors are blocked';
@@ -0,0 +1,21 @@
+-- Migration: Record adaptive "under attack" mode transitions per vhost
+
+CREATE TABLE IF NOT EXISTS attack_mode_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    domain VARCHAR(255) NOT NULL,
+    active BOOLEAN NOT NULL,
+    source VARCHAR(20) NOT NULL,
+    reason TEXT,
+    rps DOUBLE PRECISION DEFAULT 0,
+    baseline_rps DOUBLE PRECISION DEFAULT 0,
+    error_rate DOUBLE PRECISION DEFAULT 0,
+    baseline_error_rate DOUBLE PRECISION DEFAULT 0,
+    changed_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT check_attack_mode_source CHECK (source IN ('auto', 'manual'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_attack_mode_events_domain ON attack_mode_events(domain, created_at DESC);
+
+COMMENT ON TABLE attack_mode_events IS 'Transitions of vhosts into and out of under attack mode';
+COMMENT ON COLUMN attack_mode_events.source IS 'auto (baseline detector) or manual (forced from the API)';
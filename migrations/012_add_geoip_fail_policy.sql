@@ -0,0 +1,19 @@
+-- Migration: Per-vhost GeoIP fail policy
+-- Decides what region filtering does when an IP cannot be resolved
+
+ALTER TABLE vhosts
+ADD COLUMN IF NOT EXISTS geoip_fail_policy VARCHAR(10) DEFAULT 'open';
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint
+        WHERE conname = 'check_geoip_fail_policy' AND conrelid = 'vhosts'::regclass
+    ) THEN
+        ALTER TABLE vhosts
+        ADD CONSTRAINT check_geoip_fail_policy
+        CHECK (geoip_fail_policy IN ('open', 'closed'));
+    END IF;
+END $$;
+
+COMMENT ON COLUMN vhosts.geoip_fail_policy IS 'Region filtering on GeoIP lookup failure: open (allow) or closed (block)';
@@ -0,0 +1,25 @@
+-- Migration: ASN and city enrichment
+-- Stores AS and city details from the optional GeoLite2-ASN/City databases,
+-- and adds a per-vhost request limit shared by all IPs of one ASN
+
+ALTER TABLE traffic_logs
+ADD COLUMN IF NOT EXISTS asn BIGINT,
+ADD COLUMN IF NOT EXISTS as_org VARCHAR(255),
+ADD COLUMN IF NOT EXISTS city VARCHAR(255),
+ADD COLUMN IF NOT EXISTS subdivision VARCHAR(10);
+
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_asn ON traffic_logs(asn) WHERE asn IS NOT NULL;
+
+COMMENT ON COLUMN traffic_logs.asn IS 'Autonomous system number of the client IP (GeoLite2-ASN)';
+COMMENT ON COLUMN traffic_logs.as_org IS 'Autonomous system organization of the client IP';
+COMMENT ON COLUMN traffic_logs.city IS 'City of the client IP (GeoLite2-City)';
+COMMENT ON COLUMN traffic_logs.subdivision IS 'ISO 3166-2 subdivision code of the client IP, e.g. US-CA';
+
+ALTER TABLE vhosts
+ADD COLUMN IF NOT EXISTS asn_rate_limit_requests INT DEFAULT 0;
+
+COMMENT ON COLUMN vhosts.asn_rate_limit_requests IS 'Requests per rate limit window allowed from one ASN across all its IPs (0 = disabled)';
+
+COMMENT ON COLUMN blocking_rules.type IS 'Rule type: ip, region, asn, url or user_agent';
+COMMENT ON COLUMN vhosts.region_whitelist IS 'Country codes (e.g. US) or ISO 3166-2 subdivision codes (e.g. US-CA) to whitelist. If not empty, only these regions are allowed.';
+COMMENT ON COLUMN vhosts.region_blacklist IS 'Country codes (e.g. CN) or ISO 3166-2 subdivision codes (e.g. US-TX) to blacklist.';
@@ -0,0 +1,46 @@
+-- Migration: IP reputation feeds
+-- Subscribes IP groups to external blocklists that are refreshed on a schedule
+
+CREATE TABLE IF NOT EXISTS ip_group_feeds (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    group_id UUID NOT NULL REFERENCES ip_groups(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    source TEXT NOT NULL,
+    format VARCHAR(20) NOT NULL DEFAULT 'plain',
+    csv_column INT DEFAULT 1,
+    refresh_interval INT NOT NULL DEFAULT 3600,
+    enabled BOOLEAN DEFAULT true,
+    last_sync_at TIMESTAMP,
+    last_success_at TIMESTAMP,
+    last_status VARCHAR(20) DEFAULT 'pending',
+    last_error TEXT,
+    entry_count INT DEFAULT 0,
+    last_added INT DEFAULT 0,
+    last_removed INT DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT check_feed_format CHECK (format IN ('plain', 'spamhaus_drop', 'csv', 'tor')),
+    CONSTRAINT check_feed_status CHECK (last_status IN ('pending', 'ok', 'error')),
+    CONSTRAINT check_feed_refresh_interval CHECK (refresh_interval >= 60)
+);
+
+CREATE INDEX IF NOT EXISTS idx_ip_group_feeds_group_id ON ip_group_feeds(group_id);
+
+DROP TRIGGER IF EXISTS update_ip_group_feeds_updated_at ON ip_group_feeds;
+CREATE TRIGGER update_ip_group_feeds_updated_at BEFORE UPDATE ON ip_group_feeds
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Entries imported from a feed are owned by it; manual entries have no feed
+ALTER TABLE ip_addresses
+ADD COLUMN IF NOT EXISTS feed_id UUID REFERENCES ip_group_feeds(id) ON DELETE CASCADE,
+ADD COLUMN IF NOT EXISTS source VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS idx_ip_addresses_feed_id ON ip_addresses(feed_id) WHERE feed_id IS NOT NULL;
+
+COMMENT ON TABLE ip_group_feeds IS 'External IP reputation feeds synchronised into ip_addresses';
+COMMENT ON COLUMN ip_group_feeds.source IS 'http(s) URL or local file path of the feed';
+COMMENT ON COLUMN ip_group_feeds.format IS 'plain (one IP/CIDR per line), spamhaus_drop, csv or tor (exit list)';
+COMMENT ON COLUMN ip_group_feeds.csv_column IS '1-based column holding the IP/CIDR for csv feeds';
+COMMENT ON COLUMN ip_group_feeds.refresh_interval IS 'Seconds between refreshes';
+COMMENT ON COLUMN ip_addresses.feed_id IS 'Feed that imported this entry (NULL for manual entries)';
+COMMENT ON COLUMN ip_addresses.source IS 'Attribution for the entry, e.g. the feed name';
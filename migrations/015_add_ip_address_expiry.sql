@@ -0,0 +1,9 @@
+-- Migration: Time-limited IP group entries
+-- Entries with an expiry stop matching once it passes and are pruned by a background job
+
+ALTER TABLE ip_addresses
+ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_ip_addresses_expires_at ON ip_addresses(expires_at) WHERE expires_at IS NOT NULL;
+
+COMMENT ON COLUMN ip_addresses.expires_at IS 'When the entry stops applying (NULL = permanent)';
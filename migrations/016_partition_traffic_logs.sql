@@ -0,0 +1,88 @@
+-- Migration: Time-partitioned traffic logs with rollups
+-- traffic_logs becomes a table partitioned by timestamp. The WAF creates the
+-- upcoming daily/hourly partitions itself and drops the ones past retention;
+-- existing rows are kept in a single legacy partition that is dropped once
+-- all of it has aged out. Dashboard statistics read the rollup tables.
+
+DO $$
+DECLARE
+    idx RECORD;
+    legacy_end TIMESTAMP;
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_class WHERE relname = 'traffic_logs' AND relkind = 'r') THEN
+        ALTER TABLE traffic_logs RENAME TO traffic_logs_legacy;
+
+        -- The partitioned table recreates these under their original names
+        FOR idx IN SELECT indexname FROM pg_indexes
+                   WHERE tablename = 'traffic_logs_legacy' AND indexname LIKE 'idx_traffic_logs_%' LOOP
+            EXECUTE format('ALTER INDEX %I RENAME TO %I', idx.indexname,
+                           replace(idx.indexname, 'idx_traffic_logs_', 'idx_traffic_logs_legacy_'));
+        END LOOP;
+
+        -- The partition key must be part of the primary key and cannot be NULL
+        ALTER TABLE traffic_logs_legacy DROP CONSTRAINT IF EXISTS traffic_logs_pkey;
+        UPDATE traffic_logs_legacy SET timestamp = CURRENT_TIMESTAMP WHERE timestamp IS NULL;
+        ALTER TABLE traffic_logs_legacy ALTER COLUMN timestamp SET NOT NULL;
+
+        CREATE TABLE traffic_logs (LIKE traffic_logs_legacy INCLUDING DEFAULTS INCLUDING COMMENTS)
+        PARTITION BY RANGE (timestamp);
+        ALTER TABLE traffic_logs ADD PRIMARY KEY (id, timestamp);
+
+        -- New partitions start at the next midnight after the newest row
+        SELECT date_trunc('day', GREATEST(MAX(timestamp), CURRENT_TIMESTAMP)) + INTERVAL '1 day'
+        INTO legacy_end FROM traffic_logs_legacy;
+        EXECUTE format('ALTER TABLE traffic_logs ATTACH PARTITION traffic_logs_legacy FOR VALUES FROM (MINVALUE) TO (%L)', legacy_end);
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_timestamp ON traffic_logs(timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_client_ip ON traffic_logs(client_ip);
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_is_attack ON traffic_logs(is_attack);
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_attack_type ON traffic_logs(attack_type);
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_host ON traffic_logs(host);
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_country_code ON traffic_logs(country_code);
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_timestamp_attack ON traffic_logs(timestamp DESC, is_attack);
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_asn ON traffic_logs(asn) WHERE asn IS NOT NULL;
+
+ALTER TABLE vhosts
+ADD COLUMN IF NOT EXISTS log_retention_days INT DEFAULT 0 CHECK (log_retention_days >= 0);
+
+COMMENT ON COLUMN vhosts.log_retention_days IS 'Days traffic logs of this vhost are kept (0 = global retention)';
+
+-- Per-minute and per-hour counters. Dimensions use '' and 0 instead of NULL
+-- so they can be part of the primary key; attack_type is '' for non-attacks.
+CREATE TABLE IF NOT EXISTS traffic_rollups_minute (
+    bucket TIMESTAMP NOT NULL,
+    host VARCHAR(255) NOT NULL DEFAULT '',
+    country_code VARCHAR(2) NOT NULL DEFAULT '',
+    status_code INT NOT NULL DEFAULT 0,
+    attack_type VARCHAR(100) NOT NULL DEFAULT '',
+    requests BIGINT NOT NULL DEFAULT 0,
+    blocked BIGINT NOT NULL DEFAULT 0,
+    attacks BIGINT NOT NULL DEFAULT 0,
+    bytes_sent BIGINT NOT NULL DEFAULT 0,
+    response_time_ms BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (bucket, host, country_code, status_code, attack_type)
+);
+
+CREATE TABLE IF NOT EXISTS traffic_rollups_hour (LIKE traffic_rollups_minute INCLUDING ALL);
+
+-- Distinct client IPs per hour and vhost, for unique visitor counts
+CREATE TABLE IF NOT EXISTS traffic_rollups_hour_ips (
+    bucket TIMESTAMP NOT NULL,
+    host VARCHAR(255) NOT NULL DEFAULT '',
+    client_ip VARCHAR(45) NOT NULL,
+    PRIMARY KEY (bucket, host, client_ip)
+);
+
+-- How far each rollup has been computed
+CREATE TABLE IF NOT EXISTS traffic_rollup_state (
+    name VARCHAR(50) PRIMARY KEY,
+    watermark TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE traffic_rollups_minute IS 'Traffic counters per minute, host, country, status and attack type';
+COMMENT ON TABLE traffic_rollups_hour IS 'Traffic counters per hour, host, country, status and attack type';
+COMMENT ON TABLE traffic_rollups_hour_ips IS 'Distinct client IPs per hour and host';
+COMMENT ON COLUMN traffic_rollups_minute.response_time_ms IS 'Sum of response times; divide by requests for the mean';
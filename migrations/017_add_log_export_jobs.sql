@@ -0,0 +1,31 @@
+-- Migration: Asynchronous log export jobs
+-- Large traffic/attack log extracts are written to a file by a background
+-- worker and downloaded once complete
+
+CREATE TABLE IF NOT EXISTS log_export_jobs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    source VARCHAR(20) NOT NULL CHECK (source IN ('traffic', 'attacks')),
+    format VARCHAR(10) NOT NULL CHECK (format IN ('csv', 'ndjson')),
+    gzip BOOLEAN NOT NULL DEFAULT false,
+    query TEXT NOT NULL DEFAULT '',
+    range_start TIMESTAMP,
+    range_end TIMESTAMP,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'completed', 'failed')),
+    rows_exported BIGINT NOT NULL DEFAULT 0,
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    file_path VARCHAR(512),
+    error TEXT,
+    node_id VARCHAR(255),
+    created_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_log_export_jobs_status ON log_export_jobs(status, created_at);
+CREATE INDEX IF NOT EXISTS idx_log_export_jobs_expires_at ON log_export_jobs(expires_at) WHERE expires_at IS NOT NULL;
+
+COMMENT ON COLUMN log_export_jobs.query IS 'Search query in the log search language';
+COMMENT ON COLUMN log_export_jobs.node_id IS 'WAF node that ran the export and holds the file';
+COMMENT ON COLUMN log_export_jobs.expires_at IS 'When the job and its file are deleted';
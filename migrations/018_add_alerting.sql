@@ -0,0 +1,79 @@
+-- Migration: Alerting rules, notification channels, silences and history
+-- Rules are evaluated by a background job against traffic logs, rollups,
+-- backend probes and certificates; firing alerts are deduplicated per rule
+-- and subject and notified through the rule's channels
+
+CREATE TABLE IF NOT EXISTS alert_channels (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(20) NOT NULL CHECK (type IN ('webhook', 'slack', 'email')),
+    target TEXT NOT NULL,
+    secret VARCHAR(255) NOT NULL DEFAULT '',
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS alert_rules (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(30) NOT NULL CHECK (type IN ('attack_count', 'blocked_ratio', 'error_rate', 'backend_unhealthy', 'certificate_expiry')),
+    vhost VARCHAR(255) NOT NULL DEFAULT '',
+    attack_type VARCHAR(100) NOT NULL DEFAULT '',
+    threshold DOUBLE PRECISION NOT NULL DEFAULT 0,
+    window_seconds INTEGER NOT NULL DEFAULT 300 CHECK (window_seconds > 0),
+    min_requests INTEGER NOT NULL DEFAULT 0,
+    severity VARCHAR(20) NOT NULL DEFAULT 'warning' CHECK (severity IN ('info', 'warning', 'critical')),
+    channel_ids UUID[] NOT NULL DEFAULT '{}',
+    repeat_interval_seconds INTEGER NOT NULL DEFAULT 3600,
+    notify_resolved BOOLEAN NOT NULL DEFAULT true,
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS alert_silences (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    rule_id UUID REFERENCES alert_rules(id) ON DELETE CASCADE,
+    subject VARCHAR(255) NOT NULL DEFAULT '',
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    comment TEXT NOT NULL DEFAULT '',
+    created_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS idx_alert_silences_ends_at ON alert_silences(ends_at);
+
+CREATE TABLE IF NOT EXISTS alerts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    rule_id UUID NOT NULL REFERENCES alert_rules(id) ON DELETE CASCADE,
+    rule_name VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL CHECK (status IN ('firing', 'resolved')),
+    severity VARCHAR(20) NOT NULL,
+    message TEXT NOT NULL,
+    value DOUBLE PRECISION NOT NULL DEFAULT 0,
+    threshold DOUBLE PRECISION NOT NULL DEFAULT 0,
+    silenced BOOLEAN NOT NULL DEFAULT false,
+    notifications INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_evaluated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_notified_at TIMESTAMP,
+    resolved_at TIMESTAMP
+);
+
+-- At most one open alert per rule and subject
+CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_firing ON alerts(rule_id, subject) WHERE status = 'firing';
+CREATE INDEX IF NOT EXISTS idx_alerts_started_at ON alerts(started_at DESC);
+
+COMMENT ON COLUMN alert_channels.target IS 'Webhook URL, or comma-separated addresses for email';
+COMMENT ON COLUMN alert_channels.secret IS 'HMAC-SHA256 key for signing generic webhook bodies';
+COMMENT ON COLUMN alert_rules.vhost IS 'Domain the rule applies to (empty = all vhosts)';
+COMMENT ON COLUMN alert_rules.threshold IS 'Count, percentage, or days before certificate expiry depending on type';
+COMMENT ON COLUMN alert_rules.repeat_interval_seconds IS 'Re-notify while firing this often (0 = once)';
+COMMENT ON COLUMN alert_silences.rule_id IS 'Rule to silence (NULL = all rules)';
+COMMENT ON COLUMN alert_silences.subject IS 'Vhost or certificate domain to silence (empty = all subjects)';
+COMMENT ON COLUMN alerts.subject IS 'Vhost, backend or certificate domain the alert is about';
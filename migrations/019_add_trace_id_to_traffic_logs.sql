@@ -0,0 +1,10 @@
+-- Migration: OpenTelemetry trace IDs on traffic logs
+-- Links each logged request to its trace in the tracing backend. NULL when
+-- tracing is disabled.
+
+ALTER TABLE traffic_logs
+ADD COLUMN IF NOT EXISTS trace_id VARCHAR(32);
+
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_trace_id ON traffic_logs(trace_id) WHERE trace_id IS NOT NULL;
+
+COMMENT ON COLUMN traffic_logs.trace_id IS 'Hex W3C trace ID of the request (OpenTelemetry)';
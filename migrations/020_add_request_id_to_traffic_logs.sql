@@ -0,0 +1,15 @@
+-- Migration: Request IDs and decisions on traffic logs
+-- Every request gets an ID that is forwarded to the backend and printed on
+-- block pages, so a support reference can be matched to its log row. The
+-- decision and the middleware that blocked the request explain the outcome.
+
+ALTER TABLE traffic_logs
+ADD COLUMN IF NOT EXISTS request_id VARCHAR(128),
+ADD COLUMN IF NOT EXISTS decision VARCHAR(20),
+ADD COLUMN IF NOT EXISTS block_source VARCHAR(50);
+
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_request_id ON traffic_logs(request_id) WHERE request_id IS NOT NULL;
+
+COMMENT ON COLUMN traffic_logs.request_id IS 'X-Request-ID of the request, shown as the reference on block pages';
+COMMENT ON COLUMN traffic_logs.decision IS 'allowed, blocked, challenged or attack (detected but allowed)';
+COMMENT ON COLUMN traffic_logs.block_source IS 'Middleware that blocked the request, e.g. rate_limit or ip_blocker';
@@ -0,0 +1,40 @@
+-- Migration: Forensic request captures
+-- Requests flagged as attacks, and a sample of other requests on chosen
+-- vhosts, are stored with their full headers, a truncated and redacted body
+-- and the rule that matched, so flagged requests can be reviewed and
+-- replayed against a backend to rule out false positives.
+
+CREATE TABLE IF NOT EXISTS request_captures (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    request_id VARCHAR(128),
+    captured_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    host VARCHAR(255) NOT NULL DEFAULT '',
+    client_ip VARCHAR(45) NOT NULL DEFAULT '',
+    method VARCHAR(10) NOT NULL,
+    url TEXT NOT NULL,
+    proto VARCHAR(20) NOT NULL DEFAULT '',
+    headers JSONB NOT NULL DEFAULT '{}',
+    body BYTEA,
+    body_size BIGINT NOT NULL DEFAULT 0,
+    body_truncated BOOLEAN NOT NULL DEFAULT false,
+    capture_reason VARCHAR(20) NOT NULL CHECK (capture_reason IN ('attack', 'sample')),
+    attack_type VARCHAR(100),
+    matched_rule JSONB,
+    decision VARCHAR(20),
+    block_source VARCHAR(50),
+    block_reason TEXT,
+    status_code INT
+);
+
+CREATE INDEX IF NOT EXISTS idx_request_captures_captured_at ON request_captures(captured_at DESC);
+CREATE INDEX IF NOT EXISTS idx_request_captures_request_id ON request_captures(request_id) WHERE request_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_request_captures_host ON request_captures(host, captured_at DESC);
+
+ALTER TABLE vhosts
+ADD COLUMN IF NOT EXISTS capture_sample_percent REAL DEFAULT 0 CHECK (capture_sample_percent >= 0 AND capture_sample_percent <= 100);
+
+COMMENT ON COLUMN request_captures.headers IS 'Request headers by name, with configured headers redacted';
+COMMENT ON COLUMN request_captures.body IS 'First max_body_bytes of the body, with configured JSON and form fields redacted';
+COMMENT ON COLUMN request_captures.body_size IS 'Content-Length of the request, or the bytes read when unknown';
+COMMENT ON COLUMN request_captures.matched_rule IS 'Attack rule that matched: type, pattern and field';
+COMMENT ON COLUMN vhosts.capture_sample_percent IS 'Percent of non-attack requests captured for review (0 = attacks only)';
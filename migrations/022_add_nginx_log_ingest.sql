@@ -0,0 +1,18 @@
+-- Migration: nginx access log ingest
+-- Requests nginx answers itself (cached static assets, custom locations with
+-- their own proxy_pass) never reach the WAF. They are read from nginx's JSON
+-- access logs into traffic_logs and tagged with where they were logged.
+
+ALTER TABLE traffic_logs
+ADD COLUMN IF NOT EXISTS log_source VARCHAR(10) NOT NULL DEFAULT 'waf';
+
+COMMENT ON COLUMN traffic_logs.log_source IS 'waf for requests logged by the WAF middleware, nginx for requests read from nginx access logs';
+
+-- How far each access log has been read, so a restart or another replica
+-- taking over continues where the last one stopped
+CREATE TABLE IF NOT EXISTS nginx_log_positions (
+    path VARCHAR(512) PRIMARY KEY,
+    log_offset BIGINT NOT NULL DEFAULT 0,
+    fingerprint VARCHAR(64) NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
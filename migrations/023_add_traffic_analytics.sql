@@ -0,0 +1,11 @@
+-- Migration: per-vhost traffic analytics
+-- Top referrers need the Referer header, which was not logged so far. The
+-- analytics endpoints always read one vhost over a time window, so they get
+-- an index of their own.
+
+ALTER TABLE traffic_logs
+ADD COLUMN IF NOT EXISTS referer TEXT;
+
+COMMENT ON COLUMN traffic_logs.referer IS 'Referer request header, NULL when the request had none';
+
+CREATE INDEX IF NOT EXISTS idx_traffic_logs_host_timestamp ON traffic_logs(host, timestamp DESC);
@@ -0,0 +1,29 @@
+-- Migration: Scheduled security summary reports
+-- Each schedule emails an HTML summary of one vhost (or all vhosts) daily or
+-- weekly to a list of addresses and/or admins. The last period sent is kept
+-- so every period is reported once, whichever replica sends it.
+
+CREATE TABLE IF NOT EXISTS report_schedules (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(255) NOT NULL,
+    vhost VARCHAR(255) NOT NULL DEFAULT '',
+    frequency VARCHAR(10) NOT NULL CHECK (frequency IN ('daily', 'weekly')),
+    weekday INTEGER NOT NULL DEFAULT 1 CHECK (weekday BETWEEN 0 AND 6),
+    send_hour INTEGER NOT NULL DEFAULT 8 CHECK (send_hour BETWEEN 0 AND 23),
+    recipients TEXT NOT NULL DEFAULT '',
+    admin_ids UUID[] NOT NULL DEFAULT '{}',
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    last_period_end TIMESTAMP,
+    last_sent_at TIMESTAMP,
+    last_error TEXT,
+    created_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON COLUMN report_schedules.vhost IS 'Domain the report covers (empty = all vhosts)';
+COMMENT ON COLUMN report_schedules.weekday IS 'Day weekly reports are sent, 0 = Sunday';
+COMMENT ON COLUMN report_schedules.send_hour IS 'Local hour reports are sent at; periods end at midnight';
+COMMENT ON COLUMN report_schedules.recipients IS 'Comma-separated email addresses';
+COMMENT ON COLUMN report_schedules.admin_ids IS 'Admins whose email address also receives the report';
+COMMENT ON COLUMN report_schedules.last_period_end IS 'End of the last period reported';
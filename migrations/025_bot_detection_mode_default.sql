@@ -0,0 +1,12 @@
+-- Migration: Challenge every visitor by default
+-- Vhosts keep the original challenge-everyone behaviour; score bands are
+-- opt-in. Migration 010 defaulted the column to 'score', so vhosts that got
+-- score mode that way are switched back. An explicit choice of score mode
+-- cannot be told apart from the old default and has to be made again.
+
+ALTER TABLE vhosts
+ALTER COLUMN bot_detection_mode SET DEFAULT 'challenge_all';
+
+UPDATE vhosts
+SET bot_detection_mode = 'challenge_all'
+WHERE bot_detection_mode = 'score' OR bot_detection_mode IS NULL;
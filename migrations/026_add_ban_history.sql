@@ -0,0 +1,16 @@
+-- Migration: Ban history
+-- Active bans live in Redis only until they expire. Every ban issued by the
+-- jail is also recorded here so reports can list the bans of a period after
+-- they have been lifted. Rows are kept as long as the traffic logs.
+
+CREATE TABLE IF NOT EXISTS ban_history (
+    id BIGSERIAL PRIMARY KEY,
+    ip VARCHAR(45) NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    level INTEGER NOT NULL,
+    offences INTEGER NOT NULL DEFAULT 0,
+    banned_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_ban_history_banned_at ON ban_history(banned_at);
@@ -37,6 +37,7 @@ echo -e "${BLUE}Truncating logs...${NC}"
 docker compose exec -T postgres psql -U waf_user -d docode_waf << 'EOF'
 -- Truncate traffic logs (includes attack logs)
 TRUNCATE TABLE traffic_logs;
+TRUNCATE TABLE traffic_rollups_minute, traffic_rollups_hour, traffic_rollups_hour_ips, traffic_rollup_state;
 
 -- Vacuum to reclaim space
 VACUUM FULL traffic_logs;